@@ -8,8 +8,10 @@ require (
 	github.com/gorilla/websocket v1.5.3
 	github.com/joho/godotenv v1.5.1
 	github.com/kardianos/service v1.2.4
+	github.com/klauspost/compress v1.18.0
 	github.com/pion/stun/v2 v2.0.0
 	github.com/shirou/gopsutil/v3 v3.24.5
+	golang.org/x/crypto v0.12.0
 	gopkg.in/natefinch/lumberjack.v2 v2.2.1
 )
 
@@ -27,6 +29,5 @@ require (
 	github.com/tklauser/go-sysconf v0.3.12 // indirect
 	github.com/tklauser/numcpus v0.6.1 // indirect
 	github.com/yusufpapurcu/wmi v1.2.4 // indirect
-	golang.org/x/crypto v0.12.0 // indirect
 	golang.org/x/sys v0.34.0 // indirect
 )
@@ -1,6 +1,8 @@
 package agentworker
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"time"
 
 	"github.com/The-Promised-Neverland/agent/internal/config"
@@ -55,10 +57,21 @@ func (w *AgentWorker) SendConnSeverNotice() error {
 	return w.Agent.Send(ws.Outbound{Msg: &msg})
 }
 
-func (w *AgentWorker) SendDirectorySnapshot(snapshot models.DirectorySnapshot) error {
+// RequestPush asks the master to send path, relative to the shared folder, to each destination
+// agent. The master answers with master_transfer_push_result.
+func (w *AgentWorker) RequestPush(path string, destinations []string, delta bool) error {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
 	msg := models.Message{
-		Type:    models.AgentMsgDirectorySnapshot,
-		Payload: snapshot,
+		Type: models.AgentMsgTransferPush,
+		Payload: models.TransferPush{
+			RequestID:    hex.EncodeToString(id),
+			Path:         path,
+			Destinations: destinations,
+			Delta:        delta,
+		},
 	}
 	return w.Agent.Send(ws.Outbound{Msg: &msg})
 }
@@ -6,6 +6,7 @@ import (
 	"path/filepath"
 	"runtime"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/The-Promised-Neverland/agent/pkg/idcommands"
@@ -23,6 +24,10 @@ type Config struct {
 	binaryPath         string
 	agentName          string
 	stunserverAddr     string
+	enrollmentToken    string
+	credentialPath     string
+	pushFolder         string
+	pushDestinations   []string
 }
 
 func defaultPaths() string {
@@ -43,6 +48,18 @@ func defaultPaths() string {
 	}
 }
 
+// defaultCredentialPath returns where the agent keeps the credential issued at enrollment.
+func defaultCredentialPath() string {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return filepath.Join(filepath.Dir(defaultPaths()), "nebulalink-credential.json")
+	}
+	return filepath.Join(configDir, "NebulaLink", "credential.json")
+}
+
+// defaultHeartbeatSec is the heartbeat interval when HEARTBEAT_TIMER is unset
+const defaultHeartbeatSec = 3
+
 func New(agentName string) *Config {
 	err := godotenv.Load() // ignore error if .env not found
 	if err != nil {
@@ -52,8 +69,22 @@ func New(agentName string) *Config {
 	serviceName := os.Getenv("SERVICE_NAME")
 	serviceDisplayName := os.Getenv("SERVICE_DISPLAY_NAME")
 	serviceDescription := os.Getenv("SERVICE_DESCRIPTION")
-	heartbeatSec, _ := strconv.Atoi(os.Getenv("HEARTBEAT_TIMER"))
+	heartbeatSec, err := strconv.Atoi(os.Getenv("HEARTBEAT_TIMER"))
+	if err != nil || heartbeatSec <= 0 {
+		heartbeatSec = defaultHeartbeatSec
+	}
 	stunserverAddr := os.Getenv("STUN_SERVER_ADDR")
+	enrollmentToken := os.Getenv("ENROLLMENT_TOKEN")
+	credentialPath := os.Getenv("CREDENTIAL_PATH")
+	if credentialPath == "" {
+		credentialPath = defaultCredentialPath()
+	}
+	var pushDestinations []string
+	for _, id := range strings.Split(os.Getenv("PUSH_DESTINATIONS"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			pushDestinations = append(pushDestinations, id)
+		}
+	}
 	cfg := &Config{
 		agentID:            idcommands.GenerateAgentID(),
 		masterServerConn:   masterURL,
@@ -63,6 +94,10 @@ func New(agentName string) *Config {
 		heartbeatTimer:     time.Duration(heartbeatSec) * time.Second,
 		agentName:          agentName,
 		stunserverAddr:     stunserverAddr,
+		enrollmentToken:    enrollmentToken,
+		credentialPath:     credentialPath,
+		pushFolder:         os.Getenv("PUSH_FOLDER"),
+		pushDestinations:   pushDestinations,
 	}
 	cfg.binaryPath = defaultPaths()
 	return cfg
@@ -104,6 +139,32 @@ func (c *Config) AgentName() string {
 	return c.agentName
 }
 
+func (c *Config) EnrollmentToken() string {
+	return c.enrollmentToken
+}
+
+func (c *Config) CredentialPath() string {
+	return c.credentialPath
+}
+
+// PushFolder returns the folder of the shared folder this agent pushes to PushDestinations
+// whenever it changes, or "" if it pushes nothing by itself
+func (c *Config) PushFolder() string {
+	if len(c.pushDestinations) == 0 {
+		return ""
+	}
+	return c.pushFolder
+}
+
+func (c *Config) PushDestinations() []string {
+	return c.pushDestinations
+}
+
+// StateDir returns where the agent keeps its own state, next to its credential
+func (c *Config) StateDir() string {
+	return filepath.Dir(c.credentialPath)
+}
+
 // SharedFolderPath returns the OS-specific path for the shared folder on Desktop.
 // Windows: C:\Users\<Username>\Desktop\NebulaLink-shared
 // Linux: /home/<username>/Desktop/NebulaLink-shared
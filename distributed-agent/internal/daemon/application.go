@@ -2,15 +2,19 @@ package daemon
 
 import (
 	"context"
-	"os"
+	"errors"
 	"path/filepath"
+	"sync"
 	"time"
 
 	agentworker "github.com/The-Promised-Neverland/agent/internal/agent_worker"
 	"github.com/The-Promised-Neverland/agent/internal/config"
 	"github.com/The-Promised-Neverland/agent/internal/handlers"
-	"github.com/The-Promised-Neverland/agent/internal/models"
 	"github.com/The-Promised-Neverland/agent/internal/service"
+	"github.com/The-Promised-Neverland/agent/internal/snapshot"
+	"github.com/The-Promised-Neverland/agent/internal/syncpair"
+	"github.com/The-Promised-Neverland/agent/internal/task"
+	"github.com/The-Promised-Neverland/agent/internal/transfer"
 	"github.com/The-Promised-Neverland/agent/internal/watcher"
 	"github.com/The-Promised-Neverland/agent/internal/ws"
 	"github.com/The-Promised-Neverland/agent/pkg/logger"
@@ -18,19 +22,47 @@ import (
 
 type Application struct {
 	config  *config.Config
-	agent   *ws.Agent
-	worker  *agentworker.AgentWorker
 	service *service.Service
 	watcher *watcher.Watcher
+	// agent and worker belong to the connected session, nil between sessions; sessionMu
+	// guards them for goroutines other than superviseConnection
+	agent     *ws.Agent
+	worker    *agentworker.AgentWorker
+	sessionMu sync.RWMutex
+	// tasks runs the current session's tasks; they are cancelled when the session ends
+	tasks *task.Runner
+	// transfers outlives the WebSocket session so interrupted receives can resume
+	transfers *transfer.TransferManager
+	// syncs keeps the folders of this agent's sync pairs mirrored across sessions
+	syncs *syncpair.Manager
+	// snapshots indexes the shared folder and reports its changes to the master
+	snapshots *snapshot.Manager
+	// pushTimer pushes the push folder once it has been quiet for pushDelay
+	pushTimer *time.Timer
+	// pushPending is set when a push could not be requested, so it is sent on reconnect
+	pushPending bool
+	pushMu      sync.Mutex
 }
 
+const (
+	// pushDelay gathers the watcher events of a burst of changes to the push folder into one push
+	pushDelay = 5 * time.Second
+	// reconnectDelay is the wait between connection attempts
+	reconnectDelay = 5 * time.Second
+	// maxAuthRetryDelay caps the backoff while the master keeps rejecting the credential
+	maxAuthRetryDelay = 5 * time.Minute
+)
+
 func newApplication(
 	cfg *config.Config,
 	svc *service.Service,
 ) *Application {
 	return &Application{
-		config:  cfg,
-		service: svc,
+		config:    cfg,
+		service:   svc,
+		transfers: transfer.NewTransferManager(cfg, svc),
+		syncs:     syncpair.NewManager(cfg),
+		snapshots: snapshot.NewManager(cfg),
 	}
 }
 
@@ -61,7 +93,9 @@ func NewApplicationWithManager(cfg *config.Config, svc *service.Service) *Daemon
 func (app *Application) Run(appCtx context.Context, daemonManager *DaemonManager) {
 	if app.watcher != nil {
 		app.startWatcher(appCtx)
+		go app.snapshots.Run(appCtx)
 	}
+	go app.syncs.Run(appCtx)
 	app.superviseConnection(appCtx, daemonManager)
 	app.Shutdown()
 }
@@ -71,29 +105,37 @@ func (app *Application) Shutdown() {
 		app.watcher.Stop()
 		app.watcher = nil
 	}
-	if app.agent == nil {
-		return
+	app.cleanupAgent()
+}
+
+// cleanupAgent ends the current session, if any, and cancels its tasks
+func (app *Application) cleanupAgent() {
+	if app.tasks != nil {
+		app.tasks.CancelAll()
+		app.tasks = nil
 	}
-	if app.worker != nil {
-		app.worker.SendConnSeverNotice()
+	app.sessionMu.Lock()
+	agent, worker := app.agent, app.worker
+	app.agent, app.worker = nil, nil
+	app.sessionMu.Unlock()
+	if agent == nil {
+		return
 	}
-	if err := app.agent.Close(); err != nil {
-		logger.Log.Error("Error closing agent connection:", "err", err)
+	worker.SendConnSeverNotice()
+	if err := agent.Close(); err != nil {
+		logger.Log.Debug("Error closing agent connection", "err", err)
 	}
-	app.agent = nil
-	app.worker = nil
 }
 
-func (app *Application) cleanupAgent() {
-	if app.agent != nil {
-		app.worker.SendConnSeverNotice()
-		_ = app.agent.Close()
-		app.agent = nil
-		app.worker = nil
-	}
+// currentWorker returns the worker of the connected session, nil while disconnected
+func (app *Application) currentWorker() *agentworker.AgentWorker {
+	app.sessionMu.RLock()
+	defer app.sessionMu.RUnlock()
+	return app.worker
 }
 
 func (app *Application) superviseConnection(appCtx context.Context, daemonManager *DaemonManager) {
+	authRetryDelay := time.Duration(0)
 	for {
 		select {
 		case <-appCtx.Done():
@@ -101,26 +143,40 @@ func (app *Application) superviseConnection(appCtx context.Context, daemonManage
 		default:
 		}
 		app.cleanupAgent()
-		app.agent = ws.NewAgent(app.config, appCtx)
-		app.worker = agentworker.NewAgentWorker(app.agent, app.service, app.config)
-		handlerMgr := handlers.NewHandler(app.agent, app.service, app.config, daemonManager)
+		agent := ws.NewAgent(app.config, appCtx)
+		worker := agentworker.NewAgentWorker(agent, app.service, app.config)
+		handlerMgr := handlers.NewHandler(appCtx, agent, app.service, app.config, daemonManager, app.transfers, app.syncs, app.snapshots)
 		handlerMgr.RegisterHandlers()
-		if err := app.agent.Connect(); err != nil {
+		app.tasks = handlerMgr.TaskRunner
+		if err := agent.Connect(); err != nil {
+			_ = agent.Close()
 			logger.Log.Error("Failed to connect to master:", "err", err)
+			delay := reconnectDelay
+			if errors.Is(err, ws.ErrUnauthorized) {
+				authRetryDelay = min(max(2*authRetryDelay, reconnectDelay), maxAuthRetryDelay)
+				delay = authRetryDelay
+				logger.Log.Info("Retrying connection", "in", delay)
+			}
 			select {
 			case <-appCtx.Done():
 				return
-			case <-time.After(5 * time.Second):
+			case <-time.After(delay):
 			}
 			continue
 		}
-		disconnectCh := app.agent.AgentDisconnected()
-		app.agent.RunPumps()
+		authRetryDelay = 0
+		disconnectCh := agent.AgentDisconnected()
+		agent.RunPumps()
+		app.sessionMu.Lock()
+		app.agent, app.worker = agent, worker
+		app.sessionMu.Unlock()
 		go app.service.GetSTUNClient().StartPeriodicQuery(appCtx, 60 * time.Second)
-		go app.heartbeatLoop(appCtx, disconnectCh)
+		go app.heartbeatLoop(appCtx, worker, disconnectCh)
+		go app.transfers.ResumeInterrupted()
 		if app.watcher != nil {
 			go app.sendInitialDirectorySnapshot()
 		}
+		app.sendPendingPush()
 		select {
 		case <-disconnectCh:
 		case <-appCtx.Done():
@@ -129,7 +185,7 @@ func (app *Application) superviseConnection(appCtx context.Context, daemonManage
 	}
 }
 
-func (app *Application) heartbeatLoop(appCtx context.Context, disconnectCh <-chan struct{}) {
+func (app *Application) heartbeatLoop(appCtx context.Context, worker *agentworker.AgentWorker, disconnectCh <-chan struct{}) {
 	ticker := time.NewTicker(app.config.HeartbeatTimer())
 	defer ticker.Stop()
 	for {
@@ -141,7 +197,7 @@ func (app *Application) heartbeatLoop(appCtx context.Context, disconnectCh <-cha
 			logger.Log.Info("Stopping heartbeat goroutine due to agent disconnect...")
 			return
 		case <-ticker.C:
-			if err := app.worker.SendHeartbeat(); err != nil {
+			if err := worker.SendHeartbeat(); err != nil {
 				logger.Log.Error("Failed to send heartbeat:", "err", err)
 			}
 		}
@@ -193,92 +249,75 @@ func (app *Application) processFileEvent(event watcher.FileEvent) {
 		"path", event.Path,
 		"timestamp", event.Timestamp,
 	)
-	if app.agent != nil && app.worker != nil {
-		snapshot, err := app.scanDirectory()
-		if err != nil {
-			logger.Log.Error("Failed to scan directory", "err", err)
-			return
-		}
-		if err := app.worker.SendDirectorySnapshot(snapshot); err != nil {
-			logger.Log.Error("Failed to send directory snapshot", "err", err)
-		} else {
-			logger.Log.Info("Directory snapshot sent", "files", snapshot.Directory.TotalFiles)
-		}
-	}
+	app.syncs.FileChanged(event.Path)
+	app.schedulePush(event.Path)
+	app.snapshots.FileChanged(event.Path)
 }
 
-// scanDirectory recursively scans the shared folder and returns a directory snapshot
-func (app *Application) scanDirectory() (models.DirectorySnapshot, error) {
+// schedulePush pushes the configured push folder to its destinations once changes to it settle.
+// The push is a delta transfer, so destinations that have an earlier version get only what changed.
+func (app *Application) schedulePush(path string) {
+	folder := app.config.PushFolder()
+	if folder == "" {
+		return
+	}
 	sharedPath, err := app.config.SharedFolderPath()
 	if err != nil {
-		return models.DirectorySnapshot{}, err
+		return
 	}
-	var files []models.FileInfo
-	var totalSize int64
-	err = filepath.Walk(sharedPath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			logger.Log.Warn("Error accessing path", "path", path, "err", err)
-			return nil
-		}
-		if info.IsDir() && filepath.Base(path) == "transfers" {
-			return filepath.SkipDir
-		}
-		relPath, err := filepath.Rel(sharedPath, path)
-		if err != nil {
-			relPath = path
-		}
-		if relPath == "." || relPath == "" {
-			return nil
-		}
-		fileInfo := models.FileInfo{
-			Name:     info.Name(),
-			Path:     relPath,
-			Size:     info.Size(),
-			Modified: info.ModTime().Format(time.RFC3339),
-		}
-		if info.IsDir() {
-			fileInfo.Type = "directory"
-		} else {
-			fileInfo.Type = "file"
-			totalSize += info.Size()
-		}
-		files = append(files, fileInfo)
-		return nil
+	if rel, err := filepath.Rel(filepath.Join(sharedPath, folder), path); err != nil || !(rel == "." || filepath.IsLocal(rel)) {
+		return
+	}
+	app.pushMu.Lock()
+	defer app.pushMu.Unlock()
+	if app.pushTimer != nil {
+		app.pushTimer.Stop()
+	}
+	app.pushTimer = time.AfterFunc(pushDelay, func() {
+		app.push(folder)
 	})
-	if err != nil {
-		return models.DirectorySnapshot{}, err
+}
+
+// push asks the master to push folder, or leaves it pending until the agent reconnects
+func (app *Application) push(folder string) {
+	worker := app.currentWorker()
+	if worker == nil {
+		app.setPushPending()
+		logger.Log.Warn("[TRANSFER] Not connected to master, push folder is pushed once reconnected", "folder", folder)
+		return
 	}
-	fileCount := 0
-	for _, f := range files {
-		if f.Type == "file" {
-			fileCount++
-		}
+	if err := worker.RequestPush(folder, app.config.PushDestinations(), true); err != nil {
+		app.setPushPending()
+		logger.Log.Error("[TRANSFER] Failed to request push, retrying once reconnected", "folder", folder, "err", err)
+		return
+	}
+	logger.Log.Info("[TRANSFER] Push requested", "folder", folder, "destinations", len(app.config.PushDestinations()))
+}
+
+func (app *Application) setPushPending() {
+	app.pushMu.Lock()
+	defer app.pushMu.Unlock()
+	app.pushPending = true
+}
+
+// sendPendingPush requests the push that could not be sent while disconnected
+func (app *Application) sendPendingPush() {
+	app.pushMu.Lock()
+	pending := app.pushPending
+	app.pushPending = false
+	app.pushMu.Unlock()
+	if pending {
+		go app.push(app.config.PushFolder())
 	}
-	return models.DirectorySnapshot{
-		AgentID:   app.config.AgentID(),
-		Timestamp: time.Now().Format(time.RFC3339),
-		Directory: models.DirectoryInfo{
-			Files:      files,
-			TotalFiles: fileCount,
-			TotalSize:  totalSize,
-		},
-	}, nil
 }
 
 // sendInitialDirectorySnapshot sends the directory snapshot when agent connects
 func (app *Application) sendInitialDirectorySnapshot() {
 	time.Sleep(1 * time.Second)
-	if app.agent == nil || app.worker == nil {
+	if app.currentWorker() == nil {
 		return
 	}
-	snapshot, err := app.scanDirectory()
-	if err != nil {
-		logger.Log.Error("Failed to scan directory for initial snapshot", "err", err)
-		return
-	}
-	if err := app.worker.SendDirectorySnapshot(snapshot); err != nil {
+	if err := app.snapshots.SendFull(); err != nil {
 		logger.Log.Error("Failed to send initial directory snapshot", "err", err)
-	} else {
-		logger.Log.Info("Initial directory snapshot sent", "files", snapshot.Directory.TotalFiles)
 	}
 }
@@ -0,0 +1,138 @@
+package enrollment
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/The-Promised-Neverland/agent/internal/config"
+	"github.com/The-Promised-Neverland/agent/pkg/logger"
+)
+
+const (
+	// CredentialStatusHeader is set by the master on a rejected /ws upgrade to say why
+	CredentialStatusHeader = "X-Credential-Status"
+	// CredentialRevoked means the credential was revoked or replaced and will never be accepted again
+	CredentialRevoked = "revoked"
+)
+
+// Credential is the long-lived per-agent secret issued by the master at enrollment
+type Credential struct {
+	AgentID      string    `json:"agent_id"`
+	CredentialID string    `json:"credential_id"`
+	Credential   string    `json:"credential"`
+	MasterURL    string    `json:"master_url"`
+	EnrolledAt   time.Time `json:"enrolled_at"`
+}
+
+type enrollRequest struct {
+	Token     string `json:"token"`
+	AgentID   string `json:"agent_id"`
+	AgentName string `json:"agent_name,omitempty"`
+}
+
+type enrollResponse struct {
+	Type    string `json:"type"`
+	Payload struct {
+		AgentID      string `json:"agent_id"`
+		CredentialID string `json:"credential_id"`
+		Credential   string `json:"credential"`
+	} `json:"payload"`
+	Message string `json:"message,omitempty"`
+}
+
+// EnsureCredential returns the stored credential, enrolling with ENROLLMENT_TOKEN if there is none
+func EnsureCredential(cfg *config.Config) (*Credential, error) {
+	cred, err := Load(cfg.CredentialPath())
+	if err == nil && cred.AgentID == cfg.AgentID() {
+		return cred, nil
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		logger.Log.Warn("Stored credential is unreadable, enrolling again", "path", cfg.CredentialPath(), "err", err)
+	}
+	if cfg.EnrollmentToken() == "" {
+		return nil, fmt.Errorf("agent is not enrolled: set ENROLLMENT_TOKEN to a token minted by the master admin")
+	}
+	cred, err = Enroll(cfg.MasterServerConn(), cfg.EnrollmentToken(), cfg.AgentID(), cfg.AgentName())
+	if err != nil {
+		return nil, err
+	}
+	if err := Save(cfg.CredentialPath(), cred); err != nil {
+		return nil, fmt.Errorf("failed to store credential: %w", err)
+	}
+	logger.Log.Info("Agent enrolled with master", "credential_id", cred.CredentialID, "path", cfg.CredentialPath())
+	return cred, nil
+}
+
+// Enroll trades a one-time enrollment token for a credential
+func Enroll(masterURL, token, agentID, agentName string) (*Credential, error) {
+	body, err := json.Marshal(enrollRequest{
+		Token:     token,
+		AgentID:   agentID,
+		AgentName: agentName,
+	})
+	if err != nil {
+		return nil, err
+	}
+	enrollURL := strings.TrimRight(masterURL, "/") + "/api/v1/enroll"
+	client := &http.Client{Timeout: 15 * time.Second}
+	resp, err := client.Post(enrollURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("enrollment request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	var result enrollResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode enrollment response (status %d): %w", resp.StatusCode, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("enrollment rejected by master (status %d): %s", resp.StatusCode, result.Message)
+	}
+	return &Credential{
+		AgentID:      result.Payload.AgentID,
+		CredentialID: result.Payload.CredentialID,
+		Credential:   result.Payload.Credential,
+		MasterURL:    masterURL,
+		EnrolledAt:   time.Now(),
+	}, nil
+}
+
+func Load(path string) (*Credential, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cred Credential
+	if err := json.Unmarshal(data, &cred); err != nil {
+		return nil, err
+	}
+	if cred.Credential == "" {
+		return nil, errors.New("credential file has no credential")
+	}
+	return &cred, nil
+}
+
+func Save(path string, cred *Credential) error {
+	data, err := json.MarshalIndent(cred, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// Discard removes a credential the master no longer accepts so the next connect re-enrolls
+func Discard(path string) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
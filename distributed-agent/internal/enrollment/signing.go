@@ -0,0 +1,53 @@
+package enrollment
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SigningKeyHeader carries the agent's public signing key on the /ws upgrade
+const SigningKeyHeader = "X-Signing-Key"
+
+// SigningKeyPath is where the agent keeps the ed25519 key it signs transfer manifests with,
+// next to its credential
+func SigningKeyPath(credentialPath string) string {
+	return strings.TrimSuffix(credentialPath, filepath.Ext(credentialPath)) + "-signing.key"
+}
+
+// EnsureSigningKey loads the agent's manifest signing key, creating it on first use
+func EnsureSigningKey(credentialPath string) (ed25519.PrivateKey, error) {
+	path := SigningKeyPath(credentialPath)
+	data, err := os.ReadFile(path)
+	if err == nil {
+		seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("signing key %s is malformed", path)
+		}
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(key.Seed())), 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// PublicSigningKey encodes the public half of key the way the agent announces it to the master
+func PublicSigningKey(key ed25519.PrivateKey) string {
+	return base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+}
@@ -1,25 +1,62 @@
 package handlers
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"path/filepath"
+	"time"
 
 	"github.com/The-Promised-Neverland/agent/internal/models"
+	"github.com/The-Promised-Neverland/agent/internal/transfer"
 	"github.com/The-Promised-Neverland/agent/internal/ws"
 	"github.com/The-Promised-Neverland/agent/pkg/logger"
 )
 
-func (h *Handlers) RequestMetrics() error {
+func (h *Handlers) RequestMetrics(msg *any) error {
+	requestID := ""
+	if payloadRaw, ok := (*msg).(map[string]interface{}); ok {
+		requestID, _ = payloadRaw["request_id"].(string)
+	}
 	metrics := h.BusinessService.GetHostMetrics()
 	response := models.Message{
-		Type:    models.MasterMsgMetricsRequest,
-		Payload: metrics,
+		Type: models.AgentMsgMetricsResponse,
+		Payload: models.MetricsResponse{
+			RequestID:  requestID,
+			AgentID:    h.Config.AgentID(),
+			SysMetrics: *metrics,
+			Timestamp:  time.Now().Unix(),
+		},
 	}
 	return h.Agent.Send(ws.Outbound{Msg: &response})
 }
 
 func (h *Handlers) AssignTask(msg *any) error {
+	payloadRaw, ok := (*msg).(map[string]interface{})
+	if !ok {
+		return errors.New("payload is not a valid map[string]interface{}")
+	}
+	jobID, ok := payloadRaw["job_id"].(string)
+	if !ok || jobID == "" {
+		return fmt.Errorf("job_id is missing or not a string")
+	}
+	command, ok := payloadRaw["command"].(string)
+	if !ok || command == "" {
+		return fmt.Errorf("command is missing or not a string")
+	}
+	jobType, _ := payloadRaw["job_type"].(string)
+	timeout := 0
+	if t, ok := payloadRaw["timeout"].(float64); ok {
+		timeout = int(t)
+	}
+	logger.Log.Info("[TASK] Task assigned by master", "job_id", jobID, "job_type", jobType, "timeout", timeout)
+	go h.TaskRunner.Run(h.AppCtx, models.TaskAssignmentPayload{
+		JobID:   jobID,
+		JobType: jobType,
+		Command: command,
+		Timeout: timeout,
+	})
 	return nil
 }
 
@@ -45,31 +82,47 @@ func (h *Handlers) ReceiveTransfer(msg *any) error {
 		sourceAgentID, _ = payloadRaw["agent_id"].(string)
 	}
 	trxfMode, _ := payloadRaw["transfer_mode"].(string)
-	logger.Log.Info("Received transfer status", "status", status, "source_agent", sourceAgentID, "mode", trxfMode)
+	connectionID, _ := payloadRaw["connection_id"].(string)
+	resumeOffset, _ := payloadRaw["resume_offset"].(float64)
+	stream := streamSettings(payloadRaw)
+	logger.Log.Info("Received transfer status", "status", status, "source_agent", sourceAgentID, "mode", trxfMode, "connection_id", connectionID)
 	switch status {
 	case "initiated":
 		if sourceAgentID == "" {
 			return fmt.Errorf("source_agent_id is required to start transfer")
 		}
-		logger.Log.Info("Transfer initiated - preparing to receive data", "sourceAgent", sourceAgentID, "mode", trxfMode)
-		if err := h.TransferManager.Receive(sourceAgentID, trxfMode); err != nil {
+		logger.Log.Info("Transfer initiated - preparing to receive data", "sourceAgent", sourceAgentID, "mode", trxfMode, "codec", stream.Codec, "encryption", stream.Encryption, "resume_offset", int64(resumeOffset))
+		if err := h.TransferManager.Receive(connectionID, sourceAgentID, trxfMode, stream, int64(resumeOffset)); err != nil {
 			return fmt.Errorf("failed to start receive: %w", err)
 		}
-		if trxfMode == "relay" {
-			h.Agent.BinaryChunkHandler = func(chunk []byte) error {
-				return h.TransferManager.WriteChunk(chunk)
-			}
-		}
 		logger.Log.Info("Transfer setup complete, waiting for data")
 	case "completed":
 		logger.Log.Info("Received 'completed' status - finalizing transfer")
-		h.Agent.BinaryChunkHandler = nil
-		if err := h.TransferManager.Complete(); err != nil {
+		var manifest *models.TransferManifest
+		if raw, ok := payloadRaw["manifest"]; ok && raw != nil {
+			data, err := json.Marshal(raw)
+			if err == nil {
+				err = json.Unmarshal(data, &manifest)
+			}
+			if err != nil {
+				logger.Log.Warn("Ignoring malformed transfer manifest", "connection_id", connectionID, "err", err)
+				manifest = nil
+			}
+		}
+		signingKey, _ := payloadRaw["source_signing_key"].(string)
+		if err := h.TransferManager.Complete(connectionID, manifest, signingKey); err != nil {
+			h.reportReceiveFailure(connectionID, err)
+			h.Syncs.PullFailed(connectionID)
 			return fmt.Errorf("failed to complete transfer: %w", err)
 		}
+		h.Syncs.Received(connectionID, manifest)
 		logger.Log.Info("Transfer completed and file extracted successfully")
 	case "running":
 		logger.Log.Info("Transfer in progress", "sourceAgent", sourceAgentID)
+	case "transfer_failed":
+		reason, _ := payloadRaw["reason"].(string)
+		logger.Log.Warn("Transfer failed on the source side, keeping what arrived for a resume", "sourceAgent", sourceAgentID, "connection_id", connectionID, "reason", reason)
+		h.TransferManager.Interrupt(connectionID)
 	default:
 		logger.Log.Info("Transfer status update", "status", status, "sourceAgent", sourceAgentID)
 	}
@@ -77,6 +130,29 @@ func (h *Handlers) ReceiveTransfer(msg *any) error {
 	return nil
 }
 
+// reportReceiveFailure tells the master a received transfer could not be completed, with the
+// paths that failed verification if that was the reason
+func (h *Handlers) reportReceiveFailure(connectionID string, err error) {
+	payload := map[string]interface{}{
+		"status":        "transfer_failed",
+		"connection_id": connectionID,
+		"reason":        err.Error(),
+		"agent_id":      h.Config.AgentID(),
+		"role":          models.TransferRoleDestination,
+	}
+	var integrityErr *transfer.IntegrityError
+	if errors.As(err, &integrityErr) {
+		payload["corrupt_paths"] = integrityErr.Paths
+	}
+	failureMsg := models.Message{
+		Type:    models.MasterMsgTransferStatus,
+		Payload: payload,
+	}
+	if sendErr := h.Agent.Send(ws.Outbound{Msg: &failureMsg}); sendErr != nil {
+		logger.Log.Error("Failed to report transfer failure to master", "error", sendErr)
+	}
+}
+
 func (h *Handlers) SendFileSystem(msg *any) error {
 	payloadRaw, ok := (*msg).(map[string]interface{})
 	if !ok {
@@ -93,7 +169,13 @@ func (h *Handlers) SendFileSystem(msg *any) error {
 	trxfMode, _ := payloadRaw["transfer_mode"].(string)
 	path = filepath.Clean(path)
 	connectionID, _ := payloadRaw["connection_id"].(string)
-	logger.Log.Info("[TRANSFER] File transfer request received from master", "filePath", path, "requestInitiator", requestInitiator, "transfer_mode", trxfMode, "connection_id", connectionID)
+	resume := transfer.ResumePoint{}
+	if offset, ok := payloadRaw["resume_offset"].(float64); ok {
+		resume.Offset = int64(offset)
+	}
+	resume.Entry, _ = payloadRaw["resume_entry"].(string)
+	stream := streamSettings(payloadRaw)
+	logger.Log.Info("[TRANSFER] File transfer request received from master", "filePath", path, "requestInitiator", requestInitiator, "transfer_mode", trxfMode, "codec", stream.Codec, "encryption", stream.Encryption, "connection_id", connectionID, "resume_offset", resume.Offset)
 	if trxfMode == "" {
 		logger.Log.Error("[TRANSFER] Transfer mode not specified by master - rejecting transfer request", "connection_id", connectionID)
 		return fmt.Errorf("transfer mode not specified - master must coordinate first")
@@ -107,23 +189,76 @@ func (h *Handlers) SendFileSystem(msg *any) error {
 		logger.Log.Error("[TRANSFER] Unknown transfer mode specified", "transfer_mode", trxfMode, "connection_id", connectionID)
 		return fmt.Errorf("unknown transfer mode: %s", trxfMode)
 	}
-	if err := h.TransferManager.Send(path, requestInitiator, trxfMode); err != nil {
-		logger.Log.Error("[TRANSFER] Transfer failed, reporting to master", "error", err, "mode", trxfMode, "connection_id", connectionID)
-		connectionID, _ := payloadRaw["connection_id"].(string)
-		failureMsg := models.Message{
-			Type: models.MasterMsgTransferStatus,
-			Payload: map[string]interface{}{
-				"status":        "transfer_failed",
-				"connection_id": connectionID,
-				"reason":        err.Error(),
-				"agent_id":      h.Config.AgentID(),
-			},
-		}
-		if sendErr := h.Agent.Send(ws.Outbound{Msg: &failureMsg}); sendErr != nil {
-			logger.Log.Error("Failed to report transfer failure to master", "error", sendErr)
+	// Sending runs outside the dispatch loop so a cancel from the master can reach it
+	go func() {
+		err := h.TransferManager.Send(connectionID, path, requestInitiator, trxfMode, stream, resume)
+		switch {
+		case err == nil:
+		case errors.Is(err, context.Canceled):
+			logger.Log.Info("[TRANSFER] Transfer cancelled by master", "mode", trxfMode, "connection_id", connectionID)
+		default:
+			logger.Log.Error("[TRANSFER] Transfer failed, reporting to master", "error", err, "mode", trxfMode, "connection_id", connectionID)
+			failureMsg := models.Message{
+				Type: models.MasterMsgTransferStatus,
+				Payload: map[string]interface{}{
+					"status":        "transfer_failed",
+					"connection_id": connectionID,
+					"reason":        err.Error(),
+					"agent_id":      h.Config.AgentID(),
+				},
+			}
+			if sendErr := h.Agent.Send(ws.Outbound{Msg: &failureMsg}); sendErr != nil {
+				logger.Log.Error("Failed to report transfer failure to master", "error", sendErr)
+			}
 		}
-		return fmt.Errorf("transfer failed: %w", err)
+	}()
+	return nil
+}
+
+func (h *Handlers) CancelTransfer(msg *any) error {
+	payloadRaw, ok := (*msg).(map[string]interface{})
+	if !ok {
+		return errors.New("payload is not a valid map[string]interface{}")
+	}
+	connectionID, ok := payloadRaw["connection_id"].(string)
+	if !ok || connectionID == "" {
+		return fmt.Errorf("connection_id is missing or not a string")
+	}
+	reason, _ := payloadRaw["reason"].(string)
+	logger.Log.Info("[TRANSFER] Cancel received from master", "connection_id", connectionID, "reason", reason)
+	if h.TransferManager.Cancel(connectionID) {
+		logger.Log.Info("[TRANSFER] Discarded partially received transfer", "connection_id", connectionID)
+	}
+	return nil
+}
+
+func (h *Handlers) RequestTransferResume(msg *any) error {
+	payloadRaw, ok := (*msg).(map[string]interface{})
+	if !ok {
+		return errors.New("payload is not a valid map[string]interface{}")
+	}
+	connectionID, ok := payloadRaw["connection_id"].(string)
+	if !ok || connectionID == "" {
+		return fmt.Errorf("connection_id is missing or not a string")
+	}
+	logger.Log.Info("[TRANSFER] Master asked to resume transfer", "connection_id", connectionID)
+	return h.TransferManager.RequestResume(connectionID)
+}
+
+func (h *Handlers) GrantTransferCredit(msg *any) error {
+	payloadRaw, ok := (*msg).(map[string]interface{})
+	if !ok {
+		return errors.New("payload is not a valid map[string]interface{}")
+	}
+	connectionID, ok := payloadRaw["connection_id"].(string)
+	if !ok || connectionID == "" {
+		return fmt.Errorf("connection_id is missing or not a string")
 	}
+	granted, ok := payloadRaw["granted"].(float64)
+	if !ok {
+		return fmt.Errorf("granted is missing or not a number")
+	}
+	h.TransferManager.Grant(connectionID, uint64(granted))
 	return nil
 }
 
@@ -169,17 +304,95 @@ func (h *Handlers) HandleP2PInitiation(msg *any) error {
 	return nil
 }
 
-func (h *Handlers) LogTransferIntent(msg *any) error {
-	if payloadMap, ok := (*msg).(map[string]interface{}); ok {
-		requestingAgentID, _ := payloadMap["requesting_agent_id"].(string)
-		sourceAgentID, _ := payloadMap["source_agent_id"].(string)
-		path, _ := payloadMap["path"].(string)
-		connectionID, _ := payloadMap["connection_id"].(string)
-		logger.Log.Info("[AUDIT] Transfer intent received from master", "requesting_agent", requestingAgentID, "source_agent", sourceAgentID, "path", path, "connection_id", connectionID)
+// HandleTransferIntent logs a transfer the master is setting up. If it is encrypted, it sends
+// the key for this agent's role in it; the destination of a delta transfer also sends the block
+// signatures of the files it has.
+func (h *Handlers) HandleTransferIntent(msg *any) error {
+	payloadMap, ok := (*msg).(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	requestingAgentID, _ := payloadMap["requesting_agent_id"].(string)
+	sourceAgentID, _ := payloadMap["source_agent_id"].(string)
+	path, _ := payloadMap["path"].(string)
+	connectionID, _ := payloadMap["connection_id"].(string)
+	role, _ := payloadMap["role"].(string)
+	stream := streamSettings(payloadMap)
+	logger.Log.Info("[AUDIT] Transfer intent received from master", "requesting_agent", requestingAgentID, "source_agent", sourceAgentID, "path", path, "connection_id", connectionID, "role", role, "codec", stream.Codec, "encryption", stream.Encryption, "delta", stream.Delta)
+	if stream.Delta && role == models.TransferRoleDestination {
+		// Signing reads every file already received from the source, so it runs on its own
+		go func() {
+			if err := h.TransferManager.SendSignatures(connectionID, sourceAgentID, stream); err != nil {
+				logger.Log.Error("[TRANSFER] Failed to send block signatures", "connection_id", connectionID, "error", err)
+			}
+		}()
+	}
+	if stream.Encryption != models.TransferEncryptionX25519 || role == "" {
+		return nil
+	}
+	if err := h.TransferManager.PrepareKey(connectionID, role); err != nil {
+		return fmt.Errorf("failed to prepare transfer key: %w", err)
+	}
+	return nil
+}
+
+// SetTransferSignatures takes the destination's block signatures for a delta transfer this
+// agent sends
+func (h *Handlers) SetTransferSignatures(msg *any) error {
+	data, err := json.Marshal(*msg)
+	if err != nil {
+		return err
+	}
+	var signatures models.TransferSignatures
+	if err := json.Unmarshal(data, &signatures); err != nil {
+		return fmt.Errorf("malformed transfer signatures: %w", err)
+	}
+	if signatures.ConnectionID == "" {
+		return fmt.Errorf("transfer signatures without connection_id")
+	}
+	h.TransferManager.SetSignatures(signatures)
+	logger.Log.Info("[TRANSFER] Block signatures received for delta transfer", "connection_id", signatures.ConnectionID, "files", len(signatures.Files))
+	return nil
+}
+
+// SetTransferKey takes the other agent's ephemeral key for an encrypted transfer
+func (h *Handlers) SetTransferKey(msg *any) error {
+	data, err := json.Marshal(*msg)
+	if err != nil {
+		return err
+	}
+	var key models.TransferKey
+	if err := json.Unmarshal(data, &key); err != nil {
+		return fmt.Errorf("malformed transfer key: %w", err)
 	}
+	if key.ConnectionID == "" || key.Role == "" {
+		return fmt.Errorf("transfer key without connection_id or role")
+	}
+	if err := h.TransferManager.SetPeerKey(key); err != nil {
+		return fmt.Errorf("rejected %s key for transfer %s: %w", key.Role, key.ConnectionID, err)
+	}
+	logger.Log.Info("[TRANSFER] Peer transfer key accepted", "connection_id", key.ConnectionID, "peer_role", key.Role)
 	return nil
 }
 
+// streamSettings reads how a transfer's stream is encoded from a master payload
+func streamSettings(payload map[string]interface{}) transfer.StreamSettings {
+	codec, _ := payload["codec"].(string)
+	encryption, _ := payload["encryption"].(string)
+	delta, _ := payload["delta"].(bool)
+	target, _ := payload["target"].(string)
+	var files []string
+	if raw, ok := payload["files"].([]interface{}); ok {
+		files = make([]string, 0, len(raw))
+		for _, f := range raw {
+			if name, ok := f.(string); ok {
+				files = append(files, name)
+			}
+		}
+	}
+	return transfer.StreamSettings{Codec: codec, Encryption: encryption, Delta: delta, Files: files, Target: target}
+}
+
 func (h *Handlers) HandleRelayFallback(msg *any) error {
 	payloadRaw, ok := (*msg).(map[string]interface{})
 	if !ok {
@@ -206,13 +419,12 @@ func (h *Handlers) HandleRelayFallback(msg *any) error {
 		return h.SendFileSystem(msg)
 	case "receive":
 		sourceAgentID, _ := payloadRaw["source_agent_id"].(string)
-		logger.Log.Info("[TRANSFER] Master command: RECEIVE file via relay mode (fallback from P2P)", "action", action, "source_agent", sourceAgentID, "connection_id", connectionID)
-		if err := h.TransferManager.Receive(sourceAgentID, "relay"); err != nil {
+		resumeOffset, _ := payloadRaw["resume_offset"].(float64)
+		stream := streamSettings(payloadRaw)
+		logger.Log.Info("[TRANSFER] Master command: RECEIVE file via relay mode (fallback from P2P)", "action", action, "source_agent", sourceAgentID, "connection_id", connectionID, "codec", stream.Codec, "encryption", stream.Encryption)
+		if err := h.TransferManager.Receive(connectionID, sourceAgentID, "relay", stream, int64(resumeOffset)); err != nil {
 			return fmt.Errorf("failed to prepare receive: %w", err)
 		}
-		h.Agent.BinaryChunkHandler = func(chunk []byte) error {
-			return h.TransferManager.WriteChunk(chunk)
-		}
 		logger.Log.Info("[TRANSFER] Ready to receive binary chunks via relay", "source_agent", sourceAgentID)
 	default:
 		return fmt.Errorf("unknown action command: %s", action)
@@ -220,3 +432,83 @@ func (h *Handlers) HandleRelayFallback(msg *any) error {
 
 	return nil
 }
+
+// SetSyncPairs takes the sync pairs this agent is part of
+func (h *Handlers) SetSyncPairs(msg *any) error {
+	data, err := json.Marshal(*msg)
+	if err != nil {
+		return err
+	}
+	var payload struct {
+		Pairs []models.SyncPairConfig `json:"pairs"`
+	}
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return fmt.Errorf("malformed sync pairs: %w", err)
+	}
+	logger.Log.Info("[SYNC] Sync pairs received from master", "pairs", len(payload.Pairs))
+	return h.Syncs.SetPairs(payload.Pairs)
+}
+
+// ApplySyncChanges takes the other agent's changes to a synced folder
+func (h *Handlers) ApplySyncChanges(msg *any) error {
+	changes, err := syncChanges(msg)
+	if err != nil {
+		return err
+	}
+	return h.Syncs.Changes(changes)
+}
+
+// AckSyncChanges takes the changes the other agent of a pair applied
+func (h *Handlers) AckSyncChanges(msg *any) error {
+	ack, err := syncChanges(msg)
+	if err != nil {
+		return err
+	}
+	return h.Syncs.Acked(ack)
+}
+
+func syncChanges(msg *any) (models.SyncChanges, error) {
+	var changes models.SyncChanges
+	data, err := json.Marshal(*msg)
+	if err != nil {
+		return changes, err
+	}
+	if err := json.Unmarshal(data, &changes); err != nil {
+		return changes, fmt.Errorf("malformed sync changes: %w", err)
+	}
+	if changes.PairID == "" {
+		return changes, fmt.Errorf("sync changes without pair_id")
+	}
+	return changes, nil
+}
+
+// LogPushResult logs the transfers the master started for a push this agent asked for
+func (h *Handlers) LogPushResult(msg *any) error {
+	data, err := json.Marshal(*msg)
+	if err != nil {
+		return err
+	}
+	var result models.TransferPushResult
+	if err := json.Unmarshal(data, &result); err != nil {
+		return fmt.Errorf("malformed push result: %w", err)
+	}
+	for _, r := range result.Results {
+		if r.Error != "" {
+			logger.Log.Warn("[TRANSFER] Push to destination did not start", "request_id", result.RequestID, "path", result.Path, "destination", r.DestinationAgentID, "connection_id", r.TransferID, "reason", r.Error)
+			continue
+		}
+		logger.Log.Info("[TRANSFER] Push to destination started", "request_id", result.RequestID, "path", result.Path, "destination", r.DestinationAgentID, "connection_id", r.TransferID)
+	}
+	return nil
+}
+
+// SendDirectorySnapshot answers the master, which asks for a full snapshot when it missed a delta
+func (h *Handlers) SendDirectorySnapshot() error {
+	logger.Log.Info("[SNAPSHOT] Master asked for a full directory snapshot")
+	go func() {
+		if err := h.Snapshots.SendFull(); err != nil {
+			logger.Log.Warn("[SNAPSHOT] Requested directory snapshot not sent", "err", err)
+		}
+	}()
+	return nil
+}
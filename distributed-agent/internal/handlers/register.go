@@ -1,9 +1,14 @@
 package handlers
 
 import (
+	"context"
+
 	"github.com/The-Promised-Neverland/agent/internal/config"
 	"github.com/The-Promised-Neverland/agent/internal/models"
 	"github.com/The-Promised-Neverland/agent/internal/service"
+	"github.com/The-Promised-Neverland/agent/internal/snapshot"
+	"github.com/The-Promised-Neverland/agent/internal/syncpair"
+	"github.com/The-Promised-Neverland/agent/internal/task"
 	"github.com/The-Promised-Neverland/agent/internal/transfer"
 	"github.com/The-Promised-Neverland/agent/internal/ws"
 )
@@ -20,45 +25,73 @@ type Handlers struct {
 	Config               *config.Config
 	DaemonManagerService DaemonManagerService
 	TransferManager      *transfer.TransferManager
+	Syncs                *syncpair.Manager
+	Snapshots            *snapshot.Manager
+	TaskRunner           *task.Runner
+	// AppCtx is the daemon's context; tasks started from this session stop when it is done
+	AppCtx context.Context
 }
 
-func NewHandler(agent *ws.Agent, businessService *service.Service, cfg *config.Config, daemonManagerService DaemonManagerService) *Handlers {
-	transferManager := transfer.NewTransferManager(cfg, businessService, agent)
+// NewHandler wires handlers for one WebSocket session. The transfer, sync and snapshot managers
+// are shared across sessions so interrupted transfers can resume after a reconnect, synced
+// folders keep their state and the shared folder stays indexed.
+func NewHandler(appCtx context.Context, agent *ws.Agent, businessService *service.Service, cfg *config.Config, daemonManagerService DaemonManagerService, transferManager *transfer.TransferManager, syncs *syncpair.Manager, snapshots *snapshot.Manager) *Handlers {
+	transferManager.SetAgent(agent)
+	syncs.SetAgent(agent)
+	snapshots.SetAgent(agent)
+	taskRunner := task.NewRunner(cfg, func(msg *models.Message) error {
+		return agent.Send(ws.Outbound{Msg: msg})
+	})
 	return &Handlers{
 		Agent:                agent,
 		BusinessService:      businessService,
 		Config:               cfg,
 		DaemonManagerService: daemonManagerService,
 		TransferManager:      transferManager,
+		Syncs:                syncs,
+		Snapshots:            snapshots,
+		TaskRunner:           taskRunner,
+		AppCtx:               appCtx,
 	}
 }
 
 func (h *Handlers) RegisterHandlers() {
+	// Relay frames carry their stream ID, so one handler serves every incoming transfer
+	h.Agent.BinaryChunkHandler = h.TransferManager.WriteChunk
+
 	h.Agent.RegisterHandler(models.MasterMsgMetricsRequest, func(msg *any) error {
-		return h.RequestMetrics()
+		return h.RequestMetrics(msg)
 	})
 
 	h.Agent.RegisterHandler(models.MasterMsgTaskAssignment, func(msg *any) error {
 		return h.AssignTask(msg)
 	})
 
-	h.Agent.RegisterHandler(models.MasterMsgRestartAgent, func(msg *any) error {
+	h.Agent.RegisterAckFirstHandler(models.MasterMsgRestartAgent, func(msg *any) error {
 		return h.RestartAgent()
 	})
 
-	h.Agent.RegisterHandler(models.MasterMsgAgentUninstall, func(msg *any) error {
+	h.Agent.RegisterAckFirstHandler(models.MasterMsgAgentUninstall, func(msg *any) error {
 		return h.UninstallAgent()
 	})
 
 	h.Agent.RegisterHandler(models.MasterMsgTransferIntent, func(msg *any) error {
-		return h.LogTransferIntent(msg)
+		return h.HandleTransferIntent(msg)
+	})
+
+	h.Agent.RegisterHandler(models.MasterMsgTransferKey, func(msg *any) error {
+		return h.SetTransferKey(msg)
+	})
+
+	h.Agent.RegisterHandler(models.MasterMsgTransferSignatures, func(msg *any) error {
+		return h.SetTransferSignatures(msg)
 	})
 
-	h.Agent.RegisterHandler(models.MasterMsgP2PTransferStart, func(msg *any) error {
+	h.Agent.RegisterAckFirstHandler(models.MasterMsgP2PTransferStart, func(msg *any) error {
 		return h.SendFileSystem(msg)
 	})
 
-	h.Agent.RegisterHandler(models.MasterMsgRelayTransferStart, func(msg *any) error {
+	h.Agent.RegisterAckFirstHandler(models.MasterMsgRelayTransferStart, func(msg *any) error {
 		return h.SendFileSystem(msg)
 	})
 
@@ -66,11 +99,43 @@ func (h *Handlers) RegisterHandlers() {
 		return h.ReceiveTransfer(msg)
 	})
 
+	h.Agent.RegisterHandler(models.MasterMsgTransferCancel, func(msg *any) error {
+		return h.CancelTransfer(msg)
+	})
+
+	h.Agent.RegisterHandler(models.MasterMsgTransferCredit, func(msg *any) error {
+		return h.GrantTransferCredit(msg)
+	})
+
+	h.Agent.RegisterHandler(models.MasterMsgTransferResume, func(msg *any) error {
+		return h.RequestTransferResume(msg)
+	})
+
+	h.Agent.RegisterHandler(models.MasterMsgTransferPushResult, func(msg *any) error {
+		return h.LogPushResult(msg)
+	})
+
 	h.Agent.RegisterHandler(models.MasterMsgP2PInitiate, func(msg *any) error {
 		return h.HandleP2PInitiation(msg)
 	})
 
-	h.Agent.RegisterHandler(models.MasterMsgRelayFallback, func(msg *any) error {
+	h.Agent.RegisterAckFirstHandler(models.MasterMsgRelayFallback, func(msg *any) error {
 		return h.HandleRelayFallback(msg)
 	})
+
+	h.Agent.RegisterHandler(models.MasterMsgSyncPairs, func(msg *any) error {
+		return h.SetSyncPairs(msg)
+	})
+
+	h.Agent.RegisterHandler(models.MasterMsgSyncChanges, func(msg *any) error {
+		return h.ApplySyncChanges(msg)
+	})
+
+	h.Agent.RegisterHandler(models.MasterMsgSyncAck, func(msg *any) error {
+		return h.AckSyncChanges(msg)
+	})
+
+	h.Agent.RegisterHandler(models.MasterMsgSnapshotRequest, func(msg *any) error {
+		return h.SendDirectorySnapshot()
+	})
 }
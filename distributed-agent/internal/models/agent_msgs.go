@@ -1,17 +1,68 @@
 package models
 
 const (
-	AgentMsgHeartbeat         = "agent_metrics"
-	AgentMsgJobStatus         = "agent_job_status"
-	AgentConnBreakNotice      = "agent_conn_break"
-	AgentMsgDirectorySnapshot = "agent_directory_snapshot"
+	AgentMsgHeartbeat          = "agent_metrics"
+	AgentMsgMetricsResponse    = "agent_metrics_response"
+	AgentMsgJobStatus          = "agent_job_status"
+	AgentConnBreakNotice       = "agent_conn_break"
+	AgentMsgDirectorySnapshot  = "agent_directory_snapshot"
+	AgentMsgDirectoryDelta     = "agent_directory_delta"
+	AgentMsgTransferProgress   = "agent_transfer_progress"
+	AgentMsgTransferCredit     = "agent_transfer_credit"
+	AgentMsgTransferResume     = "agent_transfer_resume"
+	AgentMsgTransferKey        = "agent_transfer_key"
+	AgentMsgTransferSignatures = "agent_transfer_signatures"
+	AgentMsgTransferPush       = "agent_transfer_push"
+	AgentMsgSyncChanges        = "agent_sync_changes"
+	AgentMsgSyncAck            = "agent_sync_ack"
+	AgentMsgSyncPull           = "agent_sync_pull"
+	AgentMsgSyncReport         = "agent_sync_report"
+)
+
+const (
+	TransferRoleSource      = "source"
+	TransferRoleDestination = "destination"
+)
+
+const (
+	TransferCodecNone = "none"
+	TransferCodecGzip = "gzip"
+	TransferCodecZstd = "zstd"
+)
+
+// TransferCodecsHeader lists, when connecting, the codecs this agent can send and receive a
+// transfer stream with, in order of preference
+const TransferCodecsHeader = "X-Transfer-Codecs"
+
+// HeartbeatIntervalHeader announces, when connecting, the seconds between this agent's
+// heartbeats so the master knows how long a silence means the connection is gone
+const HeartbeatIntervalHeader = "X-Heartbeat-Interval"
+
+var TransferCodecs = []string{TransferCodecZstd, TransferCodecGzip, TransferCodecNone}
+
+const (
+	TransferEncryptionNone = "none"
+	// TransferEncryptionX25519 agrees a key per transfer over X25519 and seals the stream with AES-256-GCM
+	TransferEncryptionX25519 = "x25519-aes-256-gcm"
+)
+
+// TransferEncryptionHeader lists, when connecting, the transfer encryption this agent supports
+const TransferEncryptionHeader = "X-Transfer-Encryption"
+
+const (
+	JobStatusRunning   = "running"
+	JobStatusCompleted = "completed"
+	JobStatusFailed    = "failed"
 )
 
 type JobStatus struct {
-	AgentID string `json:"agent_id"`
-	JobID   string `json:"job_id"`
-	Status  string `json:"status"`
-	Output  string `json:"output,omitempty"`
+	AgentID   string `json:"agent_id"`
+	JobID     string `json:"job_id"`
+	Status    string `json:"status"`
+	Output    string `json:"output,omitempty"`
+	Error     string `json:"error,omitempty"`
+	ExitCode  *int   `json:"exit_code,omitempty"`
+	Timestamp int64  `json:"timestamp,omitempty"`
 }
 
 type FileSystemTransfer struct {
@@ -22,6 +73,89 @@ type FileSystemTransfer struct {
 	RequestingAgent string `json:"requesting_agent_id"`
 }
 
+// TransferProgress is one side's view of a running transfer, reported every second
+type TransferProgress struct {
+	ConnectionID string  `json:"connection_id"`
+	Role         string  `json:"role"` // "source" or "destination"
+	BytesDone    int64   `json:"bytes_done"`
+	TotalBytes   int64   `json:"total_bytes,omitempty"` // known to the source only
+	Chunks       int64   `json:"chunks"`
+	Rate         float64 `json:"rate_bytes_per_sec"`
+	ETASeconds   float64 `json:"eta_seconds,omitempty"`
+}
+
+// TransferCredit lets a relay source send chunks until it has sent Granted in total
+type TransferCredit struct {
+	ConnectionID string `json:"connection_id"`
+	Granted      uint64 `json:"granted"`
+}
+
+// TransferCheckpoint is how far a destination got with a transfer; it asks the source to resume there
+type TransferCheckpoint struct {
+	ConnectionID     string `json:"connection_id"`
+	Offset           int64  `json:"offset"` // tar bytes written to the temp file
+	EntriesCompleted int    `json:"entries_completed"`
+	Entry            string `json:"entry,omitempty"` // tar entry in progress at Offset, if its header arrived
+}
+
+// TransferManifest lists every file of a transfer with its SHA-256. The source sends it, signed,
+// with its completed status and the destination checks the extracted files against it.
+type TransferManifest struct {
+	ConnectionID string         `json:"connection_id"`
+	Files        []ManifestFile `json:"files"`
+	Signature    string         `json:"signature,omitempty"` // base64 ed25519 signature of the manifest without it
+}
+
+type ManifestFile struct {
+	Path   string `json:"path"` // tar entry name
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"` // hex
+}
+
+// TransferKey is an agent's ephemeral X25519 public key for one role in an encrypted transfer,
+// signed with its manifest signing key. The master forwards it to the other agent.
+type TransferKey struct {
+	ConnectionID string `json:"connection_id"`
+	Role         string `json:"role"`
+	PublicKey    string `json:"public_key"`            // base64
+	Signature    string `json:"signature"`             // base64 ed25519 signature, see transfer.keySigningBytes
+	SigningKey   string `json:"signing_key,omitempty"` // the sender's public signing key, filled in by the master
+}
+
+// TransferSignatures are the block signatures of the files a delta transfer's destination
+// already has, sent to the source through the master
+type TransferSignatures struct {
+	ConnectionID string          `json:"connection_id"`
+	Files        []FileSignature `json:"files"`
+}
+
+// FileSignature describes a file in blocks of BlockSize bytes, the last one possibly shorter
+type FileSignature struct {
+	Path      string `json:"path"` // tar entry name
+	Size      int64  `json:"size"`
+	BlockSize int64  `json:"block_size"`
+	Blocks    string `json:"blocks"` // base64 of a rolling checksum (4, big endian) and a strong checksum (16) per block
+}
+
+// TransferPush asks the master to send a path of this agent to each of Destinations
+type TransferPush struct {
+	RequestID    string   `json:"request_id"` // echoed in the master's answer
+	Path         string   `json:"path"`
+	Destinations []string `json:"destinations"`
+	Delta        bool     `json:"delta"`
+}
+
+// TransferPushResult is the master's answer to a TransferPush
+type TransferPushResult struct {
+	RequestID string `json:"request_id"`
+	Path      string `json:"path"`
+	Results   []struct {
+		DestinationAgentID string `json:"destination_agent_id"`
+		TransferID         string `json:"transfer_id,omitempty"`
+		Error              string `json:"error,omitempty"`
+	} `json:"results"`
+}
+
 type Metrics struct {
 	AgentID        string      `json:"agent_id"`
 	AgentName      string      `json:"agent_name,omitempty"`
@@ -30,14 +164,27 @@ type Metrics struct {
 	PublicEndpoint string      `json:"public_endpoint,omitempty"`
 }
 
+// MetricsResponse answers a master_metrics_request, echoing its request_id
+type MetricsResponse struct {
+	RequestID  string      `json:"request_id"`
+	AgentID    string      `json:"agent_id"`
+	SysMetrics HostMetrics `json:"host_metrics"`
+	Timestamp  int64       `json:"timestamp"`
+}
+
 type ConnBreak struct {
 	AgentID   string `json:"agent_id"`
 	Timestamp int64  `json:"timestamp,omitempty"`
 }
 
+// DirectorySnapshot is the whole shared folder at Version. A large folder is sent in Parts
+// messages of the same version, each with a page of Files and the totals of the whole folder.
 type DirectorySnapshot struct {
 	AgentID   string        `json:"agent_id"`
 	Timestamp string        `json:"timestamp"`
+	Version   uint64        `json:"version"`
+	Part      int           `json:"part"`  // 0-based
+	Parts     int           `json:"parts"` // at least 1
 	Directory DirectoryInfo `json:"directory"`
 }
 
@@ -47,6 +194,20 @@ type DirectoryInfo struct {
 	TotalSize  int64      `json:"total_size"`
 }
 
+// DirectoryDelta turns the shared folder at BaseVersion into the folder at Version. The master
+// applies it only to its copy at BaseVersion and otherwise asks for a full snapshot.
+type DirectoryDelta struct {
+	AgentID     string     `json:"agent_id"`
+	Timestamp   string     `json:"timestamp"`
+	Version     uint64     `json:"version"`
+	BaseVersion uint64     `json:"base_version"`
+	Added       []FileInfo `json:"added,omitempty"`
+	Modified    []FileInfo `json:"modified,omitempty"`
+	Removed     []string   `json:"removed,omitempty"` // paths
+	TotalFiles  int        `json:"total_files"`
+	TotalSize   int64      `json:"total_size"`
+}
+
 type FileInfo struct {
 	Name     string `json:"name"`
 	Path     string `json:"path"`
@@ -0,0 +1,20 @@
+package models
+
+const (
+	AgentMsgCommandResult = "agent_command_result"
+
+	// CommandStatusAccepted: the command was received and is acted on after this reply (restart, uninstall)
+	CommandStatusAccepted = "accepted"
+	// CommandStatusOK: the handler finished without error
+	CommandStatusOK = "ok"
+	// CommandStatusError: the handler failed or there is no handler for the command
+	CommandStatusError = "error"
+)
+
+// CommandResult answers a master message that carried an ID; the envelope's reply_to holds that ID
+type CommandResult struct {
+	Command   string `json:"command"`
+	Status    string `json:"status"`
+	Error     string `json:"error,omitempty"`
+	HandledAt int64  `json:"handled_at"`
+}
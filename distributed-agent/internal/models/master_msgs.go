@@ -11,11 +11,25 @@ const (
 	MasterMsgP2PTransferStart   = "master_p2p_transfer_start"
 	MasterMsgRelayTransferStart = "master_relay_transfer_start"
 	MasterMsgRelayFallback      = "master_relay_fallback"
+	MasterMsgTransferCancel     = "master_transfer_cancel"
+	MasterMsgTransferCredit     = "master_transfer_credit"
+	MasterMsgTransferResume     = "master_transfer_resume"
+	MasterMsgTransferKey        = "master_transfer_key"
+	MasterMsgTransferSignatures = "master_transfer_signatures"
+	MasterMsgTransferPushResult = "master_transfer_push_result"
+	MasterMsgSyncPairs          = "master_sync_pairs"
+	MasterMsgSyncChanges        = "master_sync_changes"
+	MasterMsgSyncAck            = "master_sync_ack"
+	MasterMsgSnapshotRequest    = "master_directory_snapshot_request"
+)
+
+const (
+	JobTypeShellCommand = "shell_command"
 )
 
-// TODO: Based on furthur development, shape it up
 type TaskAssignmentPayload struct {
-	JobID      string `json:"job_id"`
-	JobType    string `json:"job_type"`
-	Parameters string `json:"parameters"`
+	JobID   string `json:"job_id"`
+	JobType string `json:"job_type"`
+	Command string `json:"command"`
+	Timeout int    `json:"timeout"` // seconds
 }
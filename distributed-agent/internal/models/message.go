@@ -3,4 +3,7 @@ package models
 type Message struct {
 	Type    string      `json:"type"`
 	Payload interface{} `json:"payload,omitempty"`
+	ID      string      `json:"id,omitempty"`
+	ReplyTo string      `json:"reply_to,omitempty"`
+	SentAt  int64       `json:"sent_at,omitempty"` // unix milliseconds, set when written to the socket
 }
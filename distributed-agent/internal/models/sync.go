@@ -0,0 +1,66 @@
+package models
+
+import "time"
+
+const (
+	SyncSideA = "a"
+	SyncSideB = "b"
+	// SyncWinnerNewest keeps the most recently modified version of a file both agents changed.
+	// An edit always wins over a deletion.
+	SyncWinnerNewest = "newest"
+)
+
+// SyncPairConfig is this agent's side of a sync pair, as the master sends it
+type SyncPairConfig struct {
+	ID             string `json:"id"`
+	Side           string `json:"side"`   // "a" or "b"
+	Folder         string `json:"folder"` // relative to the shared folder
+	PeerAgentID    string `json:"peer_agent_id"`
+	PeerFolder     string `json:"peer_folder"`
+	ConflictWinner string `json:"conflict_winner"` // "newest", "a" or "b"
+}
+
+// SyncChange is the state of a file in a sync pair's folder, or its deletion
+type SyncChange struct {
+	Path    string    `json:"path"` // slash-separated, relative to the pair's folder
+	Size    int64     `json:"size,omitempty"`
+	ModTime time.Time `json:"mod_time,omitempty"`
+	SHA256  string    `json:"sha256,omitempty"`
+	Deleted bool      `json:"deleted,omitempty"`
+}
+
+// SyncChanges carries an agent's changes to the other agent of a pair. An acknowledgement
+// has the same shape: the changes an agent now holds as the other sent them.
+type SyncChanges struct {
+	PairID  string       `json:"pair_id"`
+	Changes []SyncChange `json:"changes"`
+}
+
+// SyncPull asks the master to transfer files of a pair from the other agent into this one's
+// folder
+type SyncPull struct {
+	PairID       string   `json:"pair_id"`
+	ConnectionID string   `json:"connection_id"`
+	Files        []string `json:"files"`
+}
+
+// SyncConflict is a file both agents changed since they last agreed on it. Hashes are empty
+// for a deleted file.
+type SyncConflict struct {
+	Path         string    `json:"path"`
+	LocalSHA256  string    `json:"local_sha256,omitempty"`
+	RemoteSHA256 string    `json:"remote_sha256,omitempty"`
+	Winner       string    `json:"winner"` // side whose version was kept
+	At           time.Time `json:"at"`
+}
+
+// SyncReport is this agent's state of its folder of a pair
+type SyncReport struct {
+	PairID    string         `json:"pair_id"`
+	Files     int            `json:"files"`
+	Bytes     int64          `json:"bytes"`
+	Pending   int            `json:"pending"` // local changes the other agent has not applied yet
+	ScannedAt time.Time      `json:"scanned_at"`
+	Error     string         `json:"error,omitempty"`
+	Conflicts []SyncConflict `json:"conflicts,omitempty"` // found since the last report
+}
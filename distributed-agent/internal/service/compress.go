@@ -0,0 +1,26 @@
+package service
+
+import (
+	"path"
+	"strings"
+)
+
+// incompressibleTypes are extensions of files that are already compressed. Compressing them
+// again costs CPU and saves next to nothing.
+var incompressibleTypes = map[string]bool{
+	// archives
+	".gz": true, ".tgz": true, ".bz2": true, ".xz": true, ".zst": true, ".lz4": true, ".br": true,
+	".zip": true, ".7z": true, ".rar": true, ".jar": true, ".apk": true, ".whl": true,
+	// images
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true, ".heic": true, ".avif": true,
+	// audio and video
+	".mp3": true, ".aac": true, ".m4a": true, ".ogg": true, ".opus": true, ".flac": true,
+	".mp4": true, ".m4v": true, ".mkv": true, ".mov": true, ".webm": true, ".avi": true,
+	// documents and fonts stored as compressed containers
+	".pdf": true, ".docx": true, ".xlsx": true, ".pptx": true, ".odt": true, ".epub": true, ".woff2": true,
+}
+
+// compressibleType reports whether the content of the named file is worth compressing
+func compressibleType(name string) bool {
+	return !incompressibleTypes[strings.ToLower(path.Ext(name))]
+}
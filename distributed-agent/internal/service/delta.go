@@ -0,0 +1,383 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+
+	"github.com/The-Promised-Neverland/agent/internal/models"
+)
+
+// In a delta transfer, a file the destination already has can be sent as instructions to
+// rebuild it from that copy instead of its content:
+//
+//	copy:    'C' | first block (uvarint) | block count (uvarint)
+//	literal: 'L' | length (uvarint) | bytes
+//
+// The tar header of such an entry carries the block size as DeltaBlockSizeRecord and the size
+// of the instructions. The manifest still lists the rebuilt file's size and SHA-256.
+const (
+	DeltaBlockSizeRecord = "NEBULA.delta.block_size"
+	// DeltaMinSize is the smallest file worth signing; smaller ones are sent whole
+	DeltaMinSize = 16 * 1024
+
+	deltaOpCopy        = 'C'
+	deltaOpLiteral     = 'L'
+	deltaStrongSize    = 16
+	deltaSignatureSize = 4 + deltaStrongSize
+	deltaMinBlockSize  = 2 * 1024
+	deltaMaxBlockSize  = 1024 * 1024
+	deltaTargetBlocks  = 1024
+	// deltaWindowBuffer bounds what the source keeps of a file while it looks for matching blocks
+	deltaWindowBuffer = 1024 * 1024
+)
+
+// ErrBadDelta means a delta entry or signature does not describe a valid file
+var ErrBadDelta = errors.New("malformed delta")
+
+// DeltaBasis holds the destination's block signatures by tar entry name
+type DeltaBasis map[string]*models.FileSignature
+
+// deltaBlockSize keeps a file's signature at about deltaTargetBlocks blocks
+func deltaBlockSize(size int64) int64 {
+	block := (size/deltaTargetBlocks + 1023) &^ 1023
+	return min(max(block, deltaMinBlockSize), deltaMaxBlockSize)
+}
+
+// SignFile computes the block signatures of a file the destination already has, listed
+// under the tar entry name
+func SignFile(filePath, name string) (*models.FileSignature, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	blockSize := deltaBlockSize(info.Size())
+	blocks := make([]byte, 0, (info.Size()+blockSize-1)/blockSize*deltaSignatureSize)
+	buf := make([]byte, blockSize)
+	var size int64
+	for {
+		n, err := io.ReadFull(f, buf)
+		if n > 0 {
+			blocks = binary.BigEndian.AppendUint32(blocks, newRollingSum(buf[:n]).sum())
+			blocks = append(blocks, strongSum(buf[:n])...)
+			size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &models.FileSignature{
+		Path:      name,
+		Size:      size,
+		BlockSize: blockSize,
+		Blocks:    base64.StdEncoding.EncodeToString(blocks),
+	}, nil
+}
+
+func strongSum(block []byte) []byte {
+	sum := sha256.Sum256(block)
+	return sum[:deltaStrongSize]
+}
+
+// rollingSum is rsync's weak checksum of a window, which slides by a byte in constant time
+type rollingSum struct {
+	a, b uint32
+	n    uint32
+}
+
+func newRollingSum(window []byte) rollingSum {
+	r := rollingSum{n: uint32(len(window))}
+	for i, c := range window {
+		r.a += uint32(c)
+		r.b += (r.n - uint32(i)) * uint32(c)
+	}
+	return r
+}
+
+// roll drops out from the front of the window and adds in at its end
+func (r *rollingSum) roll(out, in byte) {
+	r.a += uint32(in) - uint32(out)
+	r.b += r.a - r.n*uint32(out)
+}
+
+func (r rollingSum) sum() uint32 {
+	return r.a&0xffff | r.b<<16
+}
+
+// deltaOp copies count blocks from start, or, for a literal, count bytes of the file at start
+type deltaOp struct {
+	copy         bool
+	start, count int64
+}
+
+// deltaPlan is how a file is rebuilt from the destination's copy
+type deltaPlan struct {
+	ops       []deltaOp
+	blockSize int64
+	size      int64  // of the file
+	sum       []byte // SHA-256 of the file
+	copied    int64  // bytes of the file the destination's copy provides
+}
+
+func (p *deltaPlan) literal(start, n int64) {
+	if n == 0 {
+		return
+	}
+	if last := len(p.ops) - 1; last >= 0 && !p.ops[last].copy && p.ops[last].start+p.ops[last].count == start {
+		p.ops[last].count += n
+		return
+	}
+	p.ops = append(p.ops, deltaOp{start: start, count: n})
+}
+
+func (p *deltaPlan) copyBlock(block int64, n int64) {
+	p.copied += n
+	if last := len(p.ops) - 1; last >= 0 && p.ops[last].copy && p.ops[last].start+p.ops[last].count == block {
+		p.ops[last].count++
+		return
+	}
+	p.ops = append(p.ops, deltaOp{copy: true, start: block, count: 1})
+}
+
+// encodedSize is the size of the instructions, which is the tar entry's size
+func (p *deltaPlan) encodedSize() int64 {
+	var size int64
+	var buf [binary.MaxVarintLen64]byte
+	for _, op := range p.ops {
+		size += 1 + int64(binary.PutUvarint(buf[:], uint64(op.count)))
+		if op.copy {
+			size += int64(binary.PutUvarint(buf[:], uint64(op.start)))
+		} else {
+			size += op.count
+		}
+	}
+	return size
+}
+
+// planDelta reads a file once, looking for the blocks of the destination's copy at every
+// offset. It returns nil if no block matched, so the file is better sent whole.
+func planDelta(filePath string, sig *models.FileSignature) (*deltaPlan, error) {
+	blocks, err := base64.StdEncoding.DecodeString(sig.Blocks)
+	count := int64(len(blocks) / deltaSignatureSize)
+	blockSize := sig.BlockSize
+	if err != nil || len(blocks)%deltaSignatureSize != 0 || blockSize <= 0 || blockSize > deltaMaxBlockSize || count != (sig.Size+blockSize-1)/blockSize {
+		return nil, fmt.Errorf("%w: bad signature for %s", ErrBadDelta, sig.Path)
+	}
+	if count == 0 {
+		return nil, nil
+	}
+	weak := func(j int64) uint32 {
+		return binary.BigEndian.Uint32(blocks[j*deltaSignatureSize:])
+	}
+	strong := func(j int64) []byte {
+		return blocks[j*deltaSignatureSize+4 : (j+1)*deltaSignatureSize]
+	}
+	lastSize := sig.Size - (count-1)*blockSize
+	full := count
+	if lastSize < blockSize {
+		full--
+	}
+	index := make(map[uint32][]int64, full)
+	for j := int64(0); j < full; j++ {
+		index[weak(j)] = append(index[weak(j)], j)
+	}
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sum := sha256.New()
+	scan := &deltaScanner{r: io.TeeReader(f, sum)}
+	plan := &deltaPlan{blockSize: blockSize}
+	var pos, literalStart int64
+	var rolling rollingSum
+	rollingValid := false
+	for {
+		window, err := scan.window(pos, int(blockSize)+1)
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(window)) < blockSize {
+			// The end of the file can only match the destination's short last block
+			if len(window) > 0 && int64(len(window)) == lastSize && lastSize < blockSize &&
+				weak(count-1) == newRollingSum(window).sum() && bytes.Equal(strong(count-1), strongSum(window)) {
+				plan.literal(literalStart, pos-literalStart)
+				plan.copyBlock(count-1, lastSize)
+				pos += lastSize
+				literalStart = pos
+			}
+			break
+		}
+		block := window[:blockSize]
+		if !rollingValid {
+			rolling = newRollingSum(block)
+			rollingValid = true
+		}
+		if candidates := index[rolling.sum()]; len(candidates) > 0 {
+			blockSum := strongSum(block)
+			if j := slices.IndexFunc(candidates, func(j int64) bool { return bytes.Equal(strong(j), blockSum) }); j >= 0 {
+				plan.literal(literalStart, pos-literalStart)
+				plan.copyBlock(candidates[j], blockSize)
+				pos += blockSize
+				literalStart = pos
+				rollingValid = false
+				continue
+			}
+		}
+		if int64(len(window)) == blockSize {
+			break
+		}
+		rolling.roll(window[0], window[blockSize])
+		pos++
+	}
+	plan.size = scan.end()
+	plan.literal(literalStart, plan.size-literalStart)
+	plan.sum = sum.Sum(nil)
+	if plan.copied == 0 {
+		return nil, nil
+	}
+	return plan, nil
+}
+
+// deltaScanner reads a file forward, keeping the bytes from the current window on
+type deltaScanner struct {
+	r    io.Reader
+	data []byte
+	base int64 // file offset of data[0]
+	eof  bool
+}
+
+// window returns up to n bytes of the file from pos on, fewer only at its end
+func (s *deltaScanner) window(pos int64, n int) ([]byte, error) {
+	start := int(pos - s.base)
+	if start > deltaWindowBuffer {
+		s.data = append(s.data[:0], s.data[start:]...)
+		s.base = pos
+		start = 0
+	}
+	for len(s.data)-start < n && !s.eof {
+		s.data = slices.Grow(s.data, max(n, 64*1024))
+		read, err := s.r.Read(s.data[len(s.data):cap(s.data)])
+		s.data = s.data[:len(s.data)+read]
+		if err == io.EOF {
+			s.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return s.data[start:min(start+n, len(s.data))], nil
+}
+
+// end is the size of the file once the scanner reached its end
+func (s *deltaScanner) end() int64 {
+	return s.base + int64(len(s.data))
+}
+
+// writeDelta writes the instructions of a plan to w and reports the rebuilt file to onFile, if set
+func writeDelta(filePath, name string, plan *deltaPlan, w io.Writer, onFile FileHashFunc) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var head []byte
+	for _, op := range plan.ops {
+		head = head[:0]
+		if op.copy {
+			head = append(head, deltaOpCopy)
+			head = binary.AppendUvarint(head, uint64(op.start))
+			head = binary.AppendUvarint(head, uint64(op.count))
+			if _, err := w.Write(head); err != nil {
+				return err
+			}
+			continue
+		}
+		head = append(head, deltaOpLiteral)
+		head = binary.AppendUvarint(head, uint64(op.count))
+		if _, err := w.Write(head); err != nil {
+			return err
+		}
+		n, err := io.Copy(w, io.NewSectionReader(f, op.start, op.count))
+		if err != nil {
+			return err
+		}
+		if n != op.count {
+			return fmt.Errorf("%s shrank while it was sent", name)
+		}
+	}
+	if onFile != nil {
+		onFile(name, plan.size, plan.sum)
+	}
+	return nil
+}
+
+// ApplyDelta rebuilds a file into w from the instructions of a delta entry and basis, the
+// destination's copy of basisSize bytes that the source signed in blocks of blockSize
+func ApplyDelta(w io.Writer, delta io.Reader, basis io.ReaderAt, basisSize, blockSize int64) (int64, error) {
+	if blockSize <= 0 || blockSize > deltaMaxBlockSize {
+		return 0, fmt.Errorf("%w: block size %d", ErrBadDelta, blockSize)
+	}
+	blocks := uint64((basisSize + blockSize - 1) / blockSize)
+	r := bufio.NewReader(delta)
+	var written int64
+	for {
+		op, err := r.ReadByte()
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+		switch op {
+		case deltaOpCopy:
+			first, err := binary.ReadUvarint(r)
+			if err != nil {
+				return written, fmt.Errorf("%w: truncated copy", ErrBadDelta)
+			}
+			count, err := binary.ReadUvarint(r)
+			if err != nil || first >= blocks || count > blocks-first {
+				return written, fmt.Errorf("%w: copy of blocks past the end of the file", ErrBadDelta)
+			}
+			start := int64(first) * blockSize
+			end := min(start+int64(count)*blockSize, basisSize)
+			n, err := io.Copy(w, io.NewSectionReader(basis, start, end-start))
+			written += n
+			if err != nil {
+				return written, err
+			}
+			if n != end-start {
+				return written, fmt.Errorf("%w: the file to patch is shorter than signed", ErrBadDelta)
+			}
+		case deltaOpLiteral:
+			size, err := binary.ReadUvarint(r)
+			if err != nil || size > 1<<40 {
+				return written, fmt.Errorf("%w: bad literal", ErrBadDelta)
+			}
+			n, err := io.CopyN(w, r, int64(size))
+			written += n
+			if err == io.EOF {
+				return written, fmt.Errorf("%w: truncated literal", ErrBadDelta)
+			}
+			if err != nil {
+				return written, err
+			}
+		default:
+			return written, fmt.Errorf("%w: unknown instruction %q", ErrBadDelta, op)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package service
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/The-Promised-Neverland/agent/internal/models"
+)
+
+const testBlockSize = deltaMinBlockSize // of files up to 2 MiB
+
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func writeFile(t *testing.T, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestDeltaRoundTrip(t *testing.T) {
+	tests := []struct {
+		name       string
+		basisSize  int
+		target     func(t *testing.T, basis []byte) []byte
+		wantCopied int64 // 0 when no block matches and the file is sent whole
+	}{
+		{"unchanged with a short last block", 10*testBlockSize + 100, func(t *testing.T, basis []byte) []byte {
+			return basis
+		}, 10*testBlockSize + 100},
+		{"unchanged exact block multiple", 8 * testBlockSize, func(t *testing.T, basis []byte) []byte {
+			return basis
+		}, 8 * testBlockSize},
+		{"first byte changed", 10*testBlockSize + 100, func(t *testing.T, basis []byte) []byte {
+			target := bytes.Clone(basis)
+			target[0] ^= 1
+			return target
+		}, 9*testBlockSize + 100},
+		{"bytes inserted inside a block", 10*testBlockSize + 100, func(t *testing.T, basis []byte) []byte {
+			return concat(basis[:5000], randomBytes(t, 100), basis[5000:])
+		}, 9*testBlockSize + 100},
+		{"appended after the short last block", 10*testBlockSize + 100, func(t *testing.T, basis []byte) []byte {
+			return concat(basis, randomBytes(t, 5000))
+		}, 10 * testBlockSize},
+		{"truncated inside a block", 10*testBlockSize + 100, func(t *testing.T, basis []byte) []byte {
+			return basis[:4*testBlockSize+10]
+		}, 4 * testBlockSize},
+		{"blocks moved", 10*testBlockSize + 100, func(t *testing.T, basis []byte) []byte {
+			return concat(basis[2*testBlockSize:], basis[:2*testBlockSize])
+		}, 10 * testBlockSize},
+		{"new data longer than the window buffer", 3 * 1024 * 1024, func(t *testing.T, basis []byte) []byte {
+			return concat(randomBytes(t, deltaWindowBuffer+deltaWindowBuffer/2), basis)
+		}, 3 * 1024 * 1024},
+		{"no block in common", 10 * testBlockSize, func(t *testing.T, basis []byte) []byte {
+			return randomBytes(t, 10*testBlockSize)
+		}, 0},
+		{"shorter than a block", 10 * testBlockSize, func(t *testing.T, basis []byte) []byte {
+			return basis[:testBlockSize-1]
+		}, 0},
+		{"empty destination copy", 0, func(t *testing.T, basis []byte) []byte {
+			return randomBytes(t, 10*testBlockSize)
+		}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			basis := randomBytes(t, tt.basisSize)
+			target := tt.target(t, basis)
+			sig, err := SignFile(writeFile(t, "basis", basis), "f")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sig.Size != int64(len(basis)) || sig.BlockSize != deltaBlockSize(int64(len(basis))) {
+				t.Fatalf("signature of %d bytes = %+v", len(basis), sig)
+			}
+			targetPath := writeFile(t, "target", target)
+			plan, err := planDelta(targetPath, sig)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantCopied == 0 {
+				if plan != nil {
+					t.Fatalf("planned a delta copying %d bytes, want the file sent whole", plan.copied)
+				}
+				return
+			}
+			if plan == nil {
+				t.Fatal("no delta planned")
+			}
+			if plan.copied != tt.wantCopied {
+				t.Errorf("delta copies %d bytes, want %d", plan.copied, tt.wantCopied)
+			}
+
+			var delta bytes.Buffer
+			var reportedSize int64
+			var reportedSum []byte
+			err = writeDelta(targetPath, "f", plan, &delta, func(name string, size int64, sum []byte) {
+				reportedSize, reportedSum = size, sum
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if int64(delta.Len()) != plan.encodedSize() {
+				t.Errorf("wrote %d bytes of instructions, planned %d", delta.Len(), plan.encodedSize())
+			}
+			if wantSum := sha256.Sum256(target); reportedSize != int64(len(target)) || !bytes.Equal(reportedSum, wantSum[:]) {
+				t.Errorf("reported %d bytes with SHA-256 %x, want %d with %x", reportedSize, reportedSum, len(target), wantSum)
+			}
+
+			var rebuilt bytes.Buffer
+			written, err := ApplyDelta(&rebuilt, &delta, bytes.NewReader(basis), sig.Size, sig.BlockSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if written != int64(len(target)) || !bytes.Equal(rebuilt.Bytes(), target) {
+				t.Fatalf("rebuilt %d bytes that differ from the %d sent", written, len(target))
+			}
+		})
+	}
+}
+
+func TestApplyDeltaRejected(t *testing.T) {
+	const basisSize = 3*testBlockSize + 100 // 4 blocks
+	op := func(code byte, args ...uint64) []byte {
+		b := []byte{code}
+		for _, arg := range args {
+			b = binary.AppendUvarint(b, arg)
+		}
+		return b
+	}
+	tests := []struct {
+		name      string
+		delta     []byte
+		basisLen  int // bytes actually on disk
+		blockSize int64
+	}{
+		{"copy starting past the end", op(deltaOpCopy, 4, 1), basisSize, testBlockSize},
+		{"copy running past the end", op(deltaOpCopy, 2, 3), basisSize, testBlockSize},
+		{"copy without a start", op(deltaOpCopy), basisSize, testBlockSize},
+		{"copy without a count", op(deltaOpCopy, 0), basisSize, testBlockSize},
+		{"copy of a basis shorter than signed", op(deltaOpCopy, 0, 4), 5000, testBlockSize},
+		{"literal longer than its data", concat(op(deltaOpLiteral, 10), []byte("abc")), basisSize, testBlockSize},
+		{"oversized literal", op(deltaOpLiteral, 1<<41), basisSize, testBlockSize},
+		{"truncated literal length", []byte{deltaOpLiteral, 0x80}, basisSize, testBlockSize},
+		{"unknown instruction", concat(op(deltaOpCopy, 0, 1), []byte{'X'}), basisSize, testBlockSize},
+		{"zero block size", op(deltaOpCopy, 0, 1), basisSize, 0},
+		{"block size over the maximum", op(deltaOpCopy, 0, 1), basisSize, deltaMaxBlockSize + 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			basis := bytes.NewReader(randomBytes(t, tt.basisLen))
+			var out bytes.Buffer
+			if _, err := ApplyDelta(&out, bytes.NewReader(tt.delta), basis, basisSize, tt.blockSize); !errors.Is(err, ErrBadDelta) {
+				t.Fatalf("ApplyDelta error = %v, want %v", err, ErrBadDelta)
+			}
+		})
+	}
+}
+
+func TestPlanDeltaBadSignature(t *testing.T) {
+	target := writeFile(t, "target", randomBytes(t, 4*testBlockSize))
+	sig, err := SignFile(target, "f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		alter func(sig *models.FileSignature)
+	}{
+		{"not base64", func(sig *models.FileSignature) { sig.Blocks = "not base64!" }},
+		{"partial block signature", func(sig *models.FileSignature) { sig.Blocks = "AAAA" }},
+		{"block count not matching the size", func(sig *models.FileSignature) { sig.Size += testBlockSize }},
+		{"zero block size", func(sig *models.FileSignature) { sig.BlockSize = 0 }},
+		{"block size over the maximum", func(sig *models.FileSignature) { sig.BlockSize = deltaMaxBlockSize + 1 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bad := *sig
+			tt.alter(&bad)
+			if _, err := planDelta(target, &bad); !errors.Is(err, ErrBadDelta) {
+				t.Fatalf("planDelta error = %v, want %v", err, ErrBadDelta)
+			}
+		})
+	}
+}
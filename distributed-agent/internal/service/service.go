@@ -2,10 +2,14 @@ package service
 
 import (
 	"archive/tar"
+	"context"
+	"crypto/sha256"
 	"errors"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strconv"
 
 	stun "github.com/The-Promised-Neverland/agent/internal/STUN"
 	"github.com/The-Promised-Neverland/agent/internal/config"
@@ -53,8 +57,63 @@ func (s *Service) GetSTUNClient() *stun.STUNClient {
 	return s.stunClient
 }
 
-func (s *Service) StreamRequestedFileSystem(path string) (<-chan []byte, <-chan error) {
-	dataCh := make(chan []byte, 8)
+// TransferSize estimates the size of the tar stream StreamRequestedFileSystem produces for
+// path and files: a 512-byte header per entry plus regular file contents padded to 512 bytes.
+func (s *Service) TransferSize(path string, files []string) (int64, error) {
+	sharedPath, err := s.cfg.SharedFolderPath()
+	if err != nil {
+		return 0, errors.New("Shared path not provided")
+	}
+	targetPath := filepath.Clean(filepath.Join(sharedPath, path))
+	selection := newFileSelection(files)
+	var total int64
+	err = filepath.Walk(targetPath, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if filePath == targetPath && info.IsDir() {
+			return nil
+		}
+		if rel, err := filepath.Rel(targetPath, filePath); err == nil {
+			if skip, err := selection.skip(filepath.ToSlash(rel), info.IsDir()); skip {
+				return err
+			}
+		}
+		total += 512
+		if info.Mode().IsRegular() {
+			total += (info.Size() + 511) &^ 511
+		}
+		return nil
+	})
+	return total, err
+}
+
+// ErrResumeMismatch means the tree changed since an interrupted transfer, so it cannot resume
+var ErrResumeMismatch = errors.New("source changed since the transfer was interrupted")
+
+// FileHashFunc receives the SHA-256 of each regular file as it is tarred
+type FileHashFunc func(name string, size int64, sum []byte)
+
+// Chunk is a piece of the tar stream. Compressible is false for content of file types that
+// are already compressed, so a codec can send it as is.
+type Chunk struct {
+	Data         []byte
+	Compressible bool
+}
+
+// streamChunkSize is the most tar bytes a Chunk holds
+const streamChunkSize = 64 * 1024
+
+// StreamRequestedFileSystem tars path from the shared folder into chunks, or only files under it
+// when files is not nil, starting offset bytes into the tar stream so an interrupted transfer can resume. Entries that end before offset are
+// skipped without being sent. A non-empty entry must name the tar entry offset falls in.
+// onFile, if set, is called for every regular file, skipped ones included, so it sees the whole tree.
+// A chunk never mixes compressible and incompressible bytes. Files with a signature in basis
+// are sent as delta entries when some of their blocks match, see delta.go.
+// Cancelling ctx stops the walk and closes the data channel; ctx's error is then sent on the
+// error channel.
+func (s *Service) StreamRequestedFileSystem(ctx context.Context, path string, files []string, offset int64, entry string, onFile FileHashFunc, basis DeltaBasis) (<-chan Chunk, <-chan error) {
+	dataCh := make(chan Chunk, 8)
 	errCh := make(chan error, 1)
 	sharedPath, err := s.cfg.SharedFolderPath()
 	if err != nil {
@@ -67,67 +126,242 @@ func (s *Service) StreamRequestedFileSystem(path string) (<-chan []byte, <-chan
 	go func() {
 		defer close(dataCh)
 		defer close(errCh)
-		pr, pw := io.Pipe()
-		tw := tar.NewWriter(pw)
-		defer tw.Close()
-		go func() {
-			defer pw.Close()
-			basePath := targetPath
-			if info, err := os.Stat(targetPath); err == nil && !info.IsDir() {
-				basePath = filepath.Dir(targetPath)
+		chunks := &chunkWriter{ctx: ctx, out: dataCh, compressible: true}
+		out := &skipWriter{w: chunks}
+		// The stream ends after the last entry's content, without padding or the tar trailer;
+		// readers stop at EOF
+		tw := tar.NewWriter(out)
+		basePath := targetPath
+		if info, err := os.Stat(targetPath); err == nil && !info.IsDir() {
+			basePath = filepath.Dir(targetPath)
+		}
+		selection := newFileSelection(files)
+		pos := int64(0) // tar offset of the next entry, while skipping to offset
+		started := offset <= 0
+		walkErr := filepath.Walk(targetPath, func(filePath string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
 			}
-			if walkErr := filepath.Walk(targetPath, func(filePath string, info os.FileInfo, err error) error {
-				if err != nil {
-					return err
-				}
-				rel, err := filepath.Rel(basePath, filePath)
-				if err != nil {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(basePath, filePath)
+			if err != nil {
+				return err
+			}
+			if rel == "." || rel == "" {
+				return nil
+			}
+			if skip, err := selection.skip(filepath.ToSlash(rel), info.IsDir()); skip {
+				return err
+			}
+			header, err := tar.FileInfoHeader(info, "")
+			if err != nil {
+				return err
+			}
+			header.Name = filepath.ToSlash(rel)
+			var plan *deltaPlan
+			if sig := basis[header.Name]; sig != nil && info.Mode().IsRegular() {
+				if plan, err = planDelta(filePath, sig); err != nil {
 					return err
 				}
-				if rel == "." || rel == "" {
-					return nil
+				if plan != nil {
+					header.Size = plan.encodedSize()
+					header.PAXRecords = map[string]string{DeltaBlockSizeRecord: strconv.FormatInt(plan.blockSize, 10)}
 				}
-				header, err := tar.FileInfoHeader(info, "")
+			}
+			if !started {
+				span, err := tarEntrySpan(header)
 				if err != nil {
 					return err
 				}
-				header.Name = filepath.ToSlash(rel)
-				if err := tw.WriteHeader(header); err != nil {
-					return err
-				}
-				if !info.IsDir() {
-					f, err := os.Open(filePath)
-					if err != nil {
-						return err
+				if pos+span <= offset {
+					pos += span
+					if plan != nil && onFile != nil {
+						onFile(header.Name, plan.size, plan.sum)
+						return nil
 					}
-					defer f.Close()
-					if _, err := io.Copy(tw, f); err != nil {
-						return err
+					if onFile != nil && !info.IsDir() {
+						return hashFile(filePath, header, io.Discard, onFile)
 					}
+					return nil
 				}
-				return nil
-			}); walkErr != nil {
-				_ = pw.CloseWithError(walkErr)
+				if entry != "" && header.Name != entry {
+					return fmt.Errorf("%w: expected %q at offset %d, found %q", ErrResumeMismatch, entry, offset, header.Name)
+				}
+				out.skip = offset - pos
+				started = true
 			}
-		}()
-
-		buf := make([]byte, 64*1024)
-		for {
-			n, err := pr.Read(buf)
-			if n > 0 {
-				chunk := make([]byte, n)
-				copy(chunk, buf[:n])
-				dataCh <- chunk
+			if err := chunks.setCompressible(true); err != nil {
+				return err
 			}
-			if err == io.EOF {
-				break
+			if err := tw.WriteHeader(header); err != nil {
+				return err
 			}
-			if err != nil {
-				errCh <- err
-				break
+			if !info.IsDir() {
+				if err := chunks.setCompressible(compressibleType(header.Name)); err != nil {
+					return err
+				}
+				if plan != nil {
+					return writeDelta(filePath, header.Name, plan, tw, onFile)
+				}
+				return hashFile(filePath, header, tw, onFile)
 			}
+			return nil
+		})
+		if walkErr == nil && !started && offset > pos {
+			walkErr = fmt.Errorf("%w: offset %d is past the end of %s", ErrResumeMismatch, offset, path)
+		}
+		if walkErr == nil {
+			walkErr = chunks.flush()
+		}
+		if walkErr != nil {
+			errCh <- walkErr
 		}
 	}()
 
 	return dataCh, errCh
 }
+
+// fileSelection limits a walk to some files under its root. A nil selection takes everything.
+type fileSelection struct {
+	files map[string]bool
+	dirs  map[string]bool // folders holding a selected file
+}
+
+func newFileSelection(files []string) *fileSelection {
+	if files == nil {
+		return nil
+	}
+	s := &fileSelection{files: make(map[string]bool), dirs: make(map[string]bool)}
+	for _, f := range files {
+		name := filepath.Clean(filepath.FromSlash(f))
+		s.files[filepath.ToSlash(name)] = true
+		for dir := filepath.Dir(name); dir != "."; dir = filepath.Dir(dir) {
+			s.dirs[filepath.ToSlash(dir)] = true
+		}
+	}
+	return s
+}
+
+// skip reports whether a walk leaves out name, slash-separated and relative to its root. The
+// error is filepath.SkipDir for a folder holding no selected file; other folders are walked
+// into without an entry of their own.
+func (s *fileSelection) skip(name string, isDir bool) (bool, error) {
+	switch {
+	case s == nil:
+		return false, nil
+	case isDir && s.dirs[name]:
+		return true, nil
+	case isDir:
+		return true, filepath.SkipDir
+	default:
+		return !s.files[name], nil
+	}
+}
+
+// hashFile copies a file's content to w and reports the SHA-256 of a regular file to onFile, if set
+func hashFile(filePath string, header *tar.Header, w io.Writer, onFile FileHashFunc) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if onFile == nil || header.Typeflag != tar.TypeReg {
+		_, err := io.Copy(w, f)
+		return err
+	}
+	sum := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(w, sum), f); err != nil {
+		return err
+	}
+	onFile(header.Name, header.Size, sum.Sum(nil))
+	return nil
+}
+
+// tarEntrySpan is how many bytes an entry takes up in a tar stream: its header (with any
+// PAX records) plus its content padded to 512 bytes
+func tarEntrySpan(header *tar.Header) (int64, error) {
+	var headerBytes countingWriter
+	if err := tar.NewWriter(&headerBytes).WriteHeader(header); err != nil {
+		return 0, err
+	}
+	return int64(headerBytes) + (header.Size+511)&^511, nil
+}
+
+type countingWriter int64
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	*c += countingWriter(len(p))
+	return len(p), nil
+}
+
+// chunkWriter cuts what is written to it into Chunks of up to streamChunkSize bytes
+type chunkWriter struct {
+	ctx          context.Context
+	out          chan<- Chunk
+	buf          []byte
+	compressible bool
+}
+
+func (c *chunkWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if c.buf == nil {
+			c.buf = make([]byte, 0, streamChunkSize)
+		}
+		taken := min(len(p), streamChunkSize-len(c.buf))
+		c.buf = append(c.buf, p[:taken]...)
+		p = p[taken:]
+		if len(c.buf) == streamChunkSize {
+			if err := c.flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// setCompressible starts a new chunk if the bytes written next are of the other kind
+func (c *chunkWriter) setCompressible(compressible bool) error {
+	if compressible == c.compressible {
+		return nil
+	}
+	err := c.flush()
+	c.compressible = compressible
+	return err
+}
+
+// flush sends what is buffered as a chunk
+func (c *chunkWriter) flush() error {
+	if len(c.buf) == 0 {
+		return nil
+	}
+	select {
+	case c.out <- Chunk{Data: c.buf, Compressible: c.compressible}:
+		c.buf = nil
+		return nil
+	case <-c.ctx.Done():
+		return c.ctx.Err()
+	}
+}
+
+// skipWriter drops the first skip bytes written to it
+type skipWriter struct {
+	w    io.Writer
+	skip int64
+}
+
+func (s *skipWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if s.skip >= int64(n) {
+		s.skip -= int64(n)
+		return n, nil
+	}
+	p = p[s.skip:]
+	s.skip = 0
+	if _, err := s.w.Write(p); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
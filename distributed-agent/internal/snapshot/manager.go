@@ -0,0 +1,274 @@
+package snapshot
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/The-Promised-Neverland/agent/internal/config"
+	"github.com/The-Promised-Neverland/agent/internal/models"
+	"github.com/The-Promised-Neverland/agent/internal/ws"
+	"github.com/The-Promised-Neverland/agent/pkg/logger"
+)
+
+const (
+	// fullInterval reconciles the master's copy with a full snapshot, catching changes the
+	// watcher missed or dropped
+	fullInterval = 10 * time.Minute
+	// pageSize bounds the entries of one message so a large folder stays well under the
+	// master's message size limit. A delta larger than this is sent as a full snapshot.
+	pageSize = 2000
+	// sendTimeout bounds how long a snapshot message waits for room in the send buffer
+	sendTimeout = 10 * time.Second
+)
+
+// Manager keeps an index of the shared folder and reports it to the master: a full snapshot
+// when connecting, periodically and when the master asks for one, and between them a versioned
+// delta for each watcher event. Each message moves the version by one so the master can tell
+// when it missed one. The manager outlives WebSocket sessions; see SetAgent.
+type Manager struct {
+	config *config.Config
+	agent  *ws.Agent
+	mu     sync.Mutex // guards agent
+
+	// indexMu serializes updates of the index with the messages that report them, so the
+	// master receives the versions in order
+	indexMu    sync.Mutex
+	entries    map[string]models.FileInfo // by path relative to the shared folder
+	totalFiles int
+	totalSize  int64
+	version    uint64 // 0 until the first full snapshot built the index
+}
+
+func NewManager(cfg *config.Config) *Manager {
+	return &Manager{
+		config:  cfg,
+		entries: make(map[string]models.FileInfo),
+	}
+}
+
+// SetAgent switches the manager to a new WebSocket session
+func (m *Manager) SetAgent(agent *ws.Agent) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.agent = agent
+}
+
+// Run sends a full snapshot periodically until ctx is done
+func (m *Manager) Run(ctx context.Context) {
+	ticker := time.NewTicker(fullInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := m.SendFull(); err != nil {
+				logger.Log.Warn("[SNAPSHOT] Periodic directory snapshot not sent", "err", err)
+			}
+		}
+	}
+}
+
+// SendFull rescans the shared folder, replaces the index with it and sends it whole
+func (m *Manager) SendFull() error {
+	if !m.connected() {
+		return errors.New("not connected to master")
+	}
+	sharedPath, err := m.config.SharedFolderPath()
+	if err != nil {
+		return err
+	}
+	m.indexMu.Lock()
+	defer m.indexMu.Unlock()
+	return m.sendFullLocked(sharedPath)
+}
+
+func (m *Manager) sendFullLocked(sharedPath string) error {
+	m.entries = scan(sharedPath, ".")
+	m.totalFiles, m.totalSize = 0, 0
+	for _, f := range m.entries {
+		m.count(f, 1)
+	}
+	m.version++
+	paths := make([]string, 0, len(m.entries))
+	for p := range m.entries {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths) // directories before their content
+	parts := max(1, (len(paths)+pageSize-1)/pageSize)
+	timestamp := time.Now().Format(time.RFC3339)
+	for part := range parts {
+		page := paths[part*pageSize : min(len(paths), (part+1)*pageSize)]
+		files := make([]models.FileInfo, 0, len(page))
+		for _, p := range page {
+			files = append(files, m.entries[p])
+		}
+		err := m.send(&models.Message{
+			Type: models.AgentMsgDirectorySnapshot,
+			Payload: models.DirectorySnapshot{
+				AgentID:   m.config.AgentID(),
+				Timestamp: timestamp,
+				Version:   m.version,
+				Part:      part,
+				Parts:     parts,
+				Directory: models.DirectoryInfo{
+					Files:      files,
+					TotalFiles: m.totalFiles,
+					TotalSize:  m.totalSize,
+				},
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	logger.Log.Info("[SNAPSHOT] Directory snapshot sent", "version", m.version, "files", m.totalFiles, "parts", parts)
+	return nil
+}
+
+// FileChanged updates the index with the state of path, and of everything under it if it is a
+// directory, and sends what changed as a delta. Nothing is indexed before the first full
+// snapshot, which is sent once connected.
+func (m *Manager) FileChanged(path string) {
+	sharedPath, err := m.config.SharedFolderPath()
+	if err != nil {
+		return
+	}
+	rel, err := filepath.Rel(sharedPath, path)
+	if err != nil || !filepath.IsLocal(rel) || slices.Contains(strings.Split(rel, string(filepath.Separator)), "transfers") {
+		return
+	}
+	m.indexMu.Lock()
+	defer m.indexMu.Unlock()
+	if m.version == 0 {
+		return
+	}
+
+	found := scan(sharedPath, rel)
+	// The parent's modification time moves when an entry is added to or removed from it
+	if parent := filepath.Dir(rel); parent != "." {
+		if info, err := os.Stat(filepath.Join(sharedPath, parent)); err == nil {
+			found[parent] = fileInfo(parent, info)
+		}
+	}
+	delta := models.DirectoryDelta{
+		AgentID:   m.config.AgentID(),
+		Timestamp: time.Now().Format(time.RFC3339),
+	}
+	prefix := rel + string(filepath.Separator)
+	for p, f := range m.entries {
+		if _, ok := found[p]; !ok && (p == rel || strings.HasPrefix(p, prefix)) {
+			delta.Removed = append(delta.Removed, p)
+			m.count(f, -1)
+			delete(m.entries, p)
+		}
+	}
+	for p, f := range found {
+		old, ok := m.entries[p]
+		switch {
+		case !ok:
+			delta.Added = append(delta.Added, f)
+		case old != f:
+			delta.Modified = append(delta.Modified, f)
+			m.count(old, -1)
+		default:
+			continue
+		}
+		m.count(f, 1)
+		m.entries[p] = f
+	}
+	changes := len(delta.Added) + len(delta.Modified) + len(delta.Removed)
+	if changes == 0 {
+		return
+	}
+	if changes > pageSize {
+		if err := m.sendFullLocked(sharedPath); err != nil {
+			logger.Log.Warn("[SNAPSHOT] Directory snapshot not sent", "err", err)
+		}
+		return
+	}
+	sort.Strings(delta.Removed)
+	sort.Slice(delta.Added, func(i, j int) bool { return delta.Added[i].Path < delta.Added[j].Path })
+	delta.BaseVersion = m.version
+	m.version++
+	delta.Version = m.version
+	delta.TotalFiles, delta.TotalSize = m.totalFiles, m.totalSize
+	if err := m.send(&models.Message{Type: models.AgentMsgDirectoryDelta, Payload: delta}); err != nil {
+		// The master sees the gap in versions with the next delta and asks for a full snapshot
+		logger.Log.Warn("[SNAPSHOT] Directory delta not sent", "version", delta.Version, "err", err)
+		return
+	}
+	logger.Log.Debug("[SNAPSHOT] Directory delta sent", "version", delta.Version,
+		"added", len(delta.Added), "modified", len(delta.Modified), "removed", len(delta.Removed))
+}
+
+// count adds (sign 1) or removes (sign -1) an entry from the totals
+func (m *Manager) count(f models.FileInfo, sign int) {
+	if f.Type == "file" {
+		m.totalFiles += sign
+		m.totalSize += int64(sign) * f.Size
+	}
+}
+
+func (m *Manager) connected() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.agent != nil
+}
+
+func (m *Manager) send(msg *models.Message) error {
+	m.mu.Lock()
+	agent := m.agent
+	m.mu.Unlock()
+	if agent == nil {
+		return errors.New("not connected to master")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+	defer cancel()
+	return agent.SendWait(ctx, ws.Outbound{Msg: msg})
+}
+
+// scan returns the entries at and under rel, a path relative to sharedPath, skipping transfer
+// directories. It returns none if rel no longer exists.
+func scan(sharedPath, rel string) map[string]models.FileInfo {
+	entries := make(map[string]models.FileInfo)
+	filepath.Walk(filepath.Join(sharedPath, rel), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				logger.Log.Warn("Error accessing path", "path", path, "err", err)
+			}
+			return nil
+		}
+		if info.IsDir() && filepath.Base(path) == "transfers" {
+			return filepath.SkipDir
+		}
+		relPath, err := filepath.Rel(sharedPath, path)
+		if err != nil || relPath == "." {
+			return nil
+		}
+		entries[relPath] = fileInfo(relPath, info)
+		return nil
+	})
+	return entries
+}
+
+func fileInfo(relPath string, info os.FileInfo) models.FileInfo {
+	f := models.FileInfo{
+		Name:     info.Name(),
+		Path:     relPath,
+		Size:     info.Size(),
+		Modified: info.ModTime().Format(time.RFC3339),
+		Type:     "file",
+	}
+	if info.IsDir() {
+		f.Type = "directory"
+	}
+	return f
+}
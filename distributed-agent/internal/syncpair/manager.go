@@ -0,0 +1,372 @@
+package syncpair
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/The-Promised-Neverland/agent/internal/config"
+	"github.com/The-Promised-Neverland/agent/internal/models"
+	"github.com/The-Promised-Neverland/agent/internal/ws"
+	"github.com/The-Promised-Neverland/agent/pkg/logger"
+)
+
+const (
+	// scanDelay gathers the watcher events of a burst of changes into one scan
+	scanDelay = 2 * time.Second
+	// rescanInterval catches changes the watcher missed
+	rescanInterval = 5 * time.Minute
+	// resendAfter is how long a change waits for the other agent to apply it before it is sent again
+	resendAfter = 10 * time.Minute
+	// pullRetention is how long a pull waits for its transfer to complete
+	pullRetention = time.Hour
+	// maxBatch bounds the changes of one message and the files of one pull
+	maxBatch = 500
+	// sendTimeout bounds how long a sync message waits for room in the send buffer
+	sendTimeout = 10 * time.Second
+)
+
+// Manager keeps this agent's folders of its sync pairs mirrored with the other agent of each.
+// A scan of a folder compares it with what both agents last agreed on and pushes what changed
+// through the master; the other agent applies deletions itself and pulls new content with a
+// sync transfer. Each pair's work runs in order on a goroutine of its own. The manager outlives
+// WebSocket sessions; see SetAgent.
+type Manager struct {
+	config *config.Config
+	agent  *ws.Agent
+	pairs  map[string]*pair
+	pulls  map[string]*pull // sync transfers this agent asked for, by connection ID
+	mu     sync.Mutex
+}
+
+// pull is a sync transfer this agent receives
+type pull struct {
+	pairID string
+	files  map[string]bool
+	at     time.Time
+}
+
+func NewManager(cfg *config.Config) *Manager {
+	return &Manager{
+		config: cfg,
+		pairs:  make(map[string]*pair),
+		pulls:  make(map[string]*pull),
+	}
+}
+
+// SetAgent switches the manager to a new WebSocket session
+func (m *Manager) SetAgent(agent *ws.Agent) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.agent = agent
+}
+
+// Run rescans every folder periodically until ctx is done
+func (m *Manager) Run(ctx context.Context) {
+	ticker := time.NewTicker(rescanInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.mu.Lock()
+			for id, pl := range m.pulls {
+				if time.Since(pl.at) > pullRetention {
+					delete(m.pulls, id)
+				}
+			}
+			pairs := make([]*pair, 0, len(m.pairs))
+			for _, p := range m.pairs {
+				pairs = append(pairs, p)
+			}
+			m.mu.Unlock()
+			for _, p := range pairs {
+				m.scheduleScan(p)
+			}
+		}
+	}
+}
+
+// SetPairs replaces the pairs this agent is part of, as the master sends them on connect and
+// whenever they change. Every pair is scanned again and its unacknowledged changes resent; a
+// pair no longer listed stops syncing and forgets its state, leaving the folder as it is.
+func (m *Manager) SetPairs(configs []models.SyncPairConfig) error {
+	sharedPath, err := m.config.SharedFolderPath()
+	if err != nil {
+		return fmt.Errorf("failed to get shared folder path: %w", err)
+	}
+	listed := make(map[string]bool, len(configs))
+	var current []*pair
+	m.mu.Lock()
+	for _, c := range configs {
+		folder := filepath.FromSlash(c.Folder)
+		if c.ID == "" || filepath.Base(c.ID) != c.ID || !filepath.IsLocal(folder) {
+			logger.Log.Warn("[SYNC] Ignoring invalid sync pair", "pair_id", c.ID, "folder", c.Folder)
+			continue
+		}
+		listed[c.ID] = true
+		p := m.pairs[c.ID]
+		if p == nil {
+			p = newPair(c, filepath.Join(sharedPath, folder), filepath.Join(m.config.StateDir(), "sync", c.ID+".json"))
+			m.pairs[c.ID] = p
+			go p.run()
+			logger.Log.Info("[SYNC] Syncing folder with peer", "pair_id", c.ID, "folder", c.Folder, "peer_agent", c.PeerAgentID, "peer_folder", c.PeerFolder, "conflict_winner", c.ConflictWinner)
+		}
+		current = append(current, p)
+	}
+	for id, p := range m.pairs {
+		if !listed[id] {
+			logger.Log.Info("[SYNC] Sync pair removed, folder is no longer synced", "pair_id", id, "folder", p.config.Folder)
+			close(p.stop)
+			delete(m.pairs, id)
+		}
+	}
+	m.mu.Unlock()
+	for _, p := range current {
+		p.do(func() {
+			p.sent = make(map[string]sentChange)
+			m.scan(p)
+		})
+	}
+	return nil
+}
+
+// FileChanged schedules a scan of every folder holding path, a watcher event's path
+func (m *Manager) FileChanged(path string) {
+	m.mu.Lock()
+	var touched []*pair
+	for _, p := range m.pairs {
+		if rel, err := filepath.Rel(p.root, path); err == nil && (rel == "." || filepath.IsLocal(rel)) {
+			touched = append(touched, p)
+		}
+	}
+	m.mu.Unlock()
+	for _, p := range touched {
+		m.scheduleScan(p)
+	}
+}
+
+// Changes applies the other agent's changes to a pair's folder
+func (m *Manager) Changes(changes models.SyncChanges) error {
+	p := m.pair(changes.PairID)
+	if p == nil {
+		return fmt.Errorf("unknown sync pair %s", changes.PairID)
+	}
+	p.do(func() {
+		m.applyChanges(p, changes.Changes)
+	})
+	return nil
+}
+
+// Acked records the changes the other agent applied as agreed on by both
+func (m *Manager) Acked(ack models.SyncChanges) error {
+	p := m.pair(ack.PairID)
+	if p == nil {
+		return fmt.Errorf("unknown sync pair %s", ack.PairID)
+	}
+	p.do(func() {
+		p.acked(ack.Changes)
+	})
+	// What changed while the changes were on their way goes out with the next scan
+	m.scheduleScan(p)
+	return nil
+}
+
+// Received takes the files of a completed sync transfer as agreed on by both agents. Transfers
+// this agent did not ask for as a sync pull are ignored.
+func (m *Manager) Received(connectionID string, manifest *models.TransferManifest) {
+	m.mu.Lock()
+	pl := m.pulls[connectionID]
+	delete(m.pulls, connectionID)
+	var p *pair
+	if pl != nil {
+		p = m.pairs[pl.pairID]
+	}
+	m.mu.Unlock()
+	if p == nil || manifest == nil {
+		return
+	}
+	p.do(func() {
+		var acks []models.SyncChange
+		for _, f := range manifest.Files {
+			if !pl.files[f.Path] {
+				continue
+			}
+			if st, ok := p.pulled(f); ok {
+				acks = append(acks, st.change(f.Path))
+			}
+		}
+		logger.Log.Info("[SYNC] Pulled files from peer", "pair_id", p.config.ID, "files", len(acks))
+		p.save()
+		m.ack(p, acks)
+		m.report(p)
+	})
+}
+
+// PullFailed forgets a sync transfer that will not complete. The other agent sends its
+// changes again once they go unacknowledged for long enough.
+func (m *Manager) PullFailed(connectionID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.pulls, connectionID)
+}
+
+func (m *Manager) pair(pairID string) *pair {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.pairs[pairID]
+}
+
+// scheduleScan scans a pair's folder once it has been quiet for scanDelay
+func (m *Manager) scheduleScan(p *pair) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if p.scanTimer != nil {
+		p.scanTimer.Stop()
+	}
+	p.scanTimer = time.AfterFunc(scanDelay, func() {
+		p.do(func() {
+			m.scan(p)
+		})
+	})
+}
+
+// scan pushes what changed in a pair's folder since both agents last agreed on it
+func (m *Manager) scan(p *pair) {
+	changes, err := p.scan()
+	if err != nil {
+		logger.Log.Error("[SYNC] Failed to scan sync folder", "pair_id", p.config.ID, "folder", p.config.Folder, "err", err)
+		m.report(p)
+		return
+	}
+	for len(changes) > 0 {
+		batch := changes[:min(len(changes), maxBatch)]
+		changes = changes[len(batch):]
+		err := m.send(&models.Message{
+			Type:    models.AgentMsgSyncChanges,
+			Payload: models.SyncChanges{PairID: p.config.ID, Changes: batch},
+		})
+		if err != nil {
+			logger.Log.Warn("[SYNC] Failed to send changes, they go out with the next scan", "pair_id", p.config.ID, "err", err)
+			break
+		}
+		p.markSent(batch)
+		logger.Log.Info("[SYNC] Sent changes to peer", "pair_id", p.config.ID, "changes", len(batch))
+	}
+	p.save()
+	m.report(p)
+}
+
+// applyChanges deletes what the other agent deleted and pulls what it changed, unless this
+// agent changed the same file since they last agreed on it and its version wins the conflict
+func (m *Manager) applyChanges(p *pair, changes []models.SyncChange) {
+	var acks, pulls []models.SyncChange
+	rescan := false
+	for _, c := range changes {
+		outcome, err := p.apply(c)
+		switch {
+		case err != nil:
+			logger.Log.Warn("[SYNC] Cannot apply change from peer", "pair_id", p.config.ID, "path", c.Path, "err", err)
+		case outcome == outcomeAgreed:
+			acks = append(acks, c)
+		case outcome == outcomePull:
+			pulls = append(pulls, c)
+		case outcome == outcomeKept:
+			rescan = true
+		}
+	}
+	p.save()
+	m.ack(p, acks)
+	for len(pulls) > 0 {
+		batch := pulls[:min(len(pulls), maxBatch)]
+		pulls = pulls[len(batch):]
+		if err := m.pull(p, batch); err != nil {
+			logger.Log.Warn("[SYNC] Failed to request pull, the peer sends its changes again later", "pair_id", p.config.ID, "err", err)
+		}
+	}
+	if rescan {
+		// The versions kept here go back to the other agent
+		m.scan(p)
+		return
+	}
+	m.report(p)
+}
+
+// pull asks the master for a transfer of files from the other agent into the pair's folder
+func (m *Manager) pull(p *pair, changes []models.SyncChange) error {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	connectionID := "sync-" + hex.EncodeToString(id)
+	pl := &pull{pairID: p.config.ID, files: make(map[string]bool, len(changes)), at: time.Now()}
+	files := make([]string, 0, len(changes))
+	for _, c := range changes {
+		pl.files[c.Path] = true
+		files = append(files, c.Path)
+	}
+	m.mu.Lock()
+	m.pulls[connectionID] = pl
+	m.mu.Unlock()
+	err := m.send(&models.Message{
+		Type:    models.AgentMsgSyncPull,
+		Payload: models.SyncPull{PairID: p.config.ID, ConnectionID: connectionID, Files: files},
+	})
+	if err != nil {
+		m.PullFailed(connectionID)
+		return err
+	}
+	logger.Log.Info("[SYNC] Pulling changed files from peer", "pair_id", p.config.ID, "connection_id", connectionID, "files", len(files))
+	return nil
+}
+
+// ack tells the other agent which of its changes this agent now holds
+func (m *Manager) ack(p *pair, acks []models.SyncChange) {
+	for len(acks) > 0 {
+		batch := acks[:min(len(acks), maxBatch)]
+		acks = acks[len(batch):]
+		err := m.send(&models.Message{
+			Type:    models.AgentMsgSyncAck,
+			Payload: models.SyncChanges{PairID: p.config.ID, Changes: batch},
+		})
+		if err != nil {
+			logger.Log.Warn("[SYNC] Failed to acknowledge changes, the peer sends them again later", "pair_id", p.config.ID, "err", err)
+			return
+		}
+	}
+}
+
+// report sends the master the pair's state and the conflicts resolved since the last report
+func (m *Manager) report(p *pair) {
+	if err := m.send(&models.Message{Type: models.AgentMsgSyncReport, Payload: p.report()}); err != nil {
+		logger.Log.Debug("[SYNC] Failed to report sync state", "pair_id", p.config.ID, "err", err)
+		return
+	}
+	p.conflicts = nil
+}
+
+func (m *Manager) send(msg *models.Message) error {
+	m.mu.Lock()
+	agent := m.agent
+	m.mu.Unlock()
+	if agent == nil {
+		return errors.New("not connected to master")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+	defer cancel()
+	return agent.SendWait(ctx, ws.Outbound{Msg: msg})
+}
+
+// removeState deletes the saved state of a pair that was removed
+func removeState(path string) {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		logger.Log.Warn("[SYNC] Failed to remove state of removed sync pair", "path", path, "err", err)
+	}
+}
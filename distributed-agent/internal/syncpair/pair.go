@@ -0,0 +1,400 @@
+package syncpair
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/The-Promised-Neverland/agent/internal/models"
+	"github.com/The-Promised-Neverland/agent/internal/watcher"
+	"github.com/The-Promised-Neverland/agent/pkg/logger"
+)
+
+// outcome is what became of a change from the other agent
+type outcome int
+
+const (
+	outcomeAgreed outcome = iota // this agent holds the change now
+	outcomePull                  // the changed file has to be pulled
+	outcomeKept                  // a conflict kept this agent's version
+)
+
+// fileState is a file's content as of its size and modification time
+type fileState struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	SHA256  string    `json:"sha256"`
+}
+
+func (s fileState) change(path string) models.SyncChange {
+	return models.SyncChange{Path: path, Size: s.Size, ModTime: s.ModTime, SHA256: s.SHA256}
+}
+
+// pairState is what a pair keeps across restarts
+type pairState struct {
+	// Synced is the content both agents last agreed on, by slash-separated path
+	Synced map[string]fileState `json:"synced"`
+	// Local caches the hashes of this agent's files as of the last scan
+	Local map[string]fileState `json:"local"`
+}
+
+// sentChange is a change sent to the other agent and not acknowledged yet
+type sentChange struct {
+	sha256 string // "" for a deletion
+	at     time.Time
+}
+
+// pair is this agent's folder of a sync pair. Its fields are only touched by jobs run on its
+// worker, except scanTimer, which the manager guards.
+type pair struct {
+	config    models.SyncPairConfig
+	root      string
+	statePath string
+	state     pairState
+	sent      map[string]sentChange
+	conflicts []models.SyncConflict // resolved since the last report
+
+	files     int
+	bytes     int64
+	scannedAt time.Time
+	scanErr   string
+
+	jobs      chan func()
+	stop      chan struct{}
+	scanTimer *time.Timer
+}
+
+func newPair(config models.SyncPairConfig, root, statePath string) *pair {
+	p := &pair{
+		config:    config,
+		root:      root,
+		statePath: statePath,
+		state:     pairState{Synced: make(map[string]fileState), Local: make(map[string]fileState)},
+		sent:      make(map[string]sentChange),
+		jobs:      make(chan func(), 256),
+		stop:      make(chan struct{}),
+	}
+	if data, err := os.ReadFile(statePath); err == nil {
+		if err := json.Unmarshal(data, &p.state); err != nil {
+			logger.Log.Warn("[SYNC] Ignoring unreadable sync state, every file is compared again", "path", statePath, "err", err)
+		}
+		if p.state.Synced == nil {
+			p.state.Synced = make(map[string]fileState)
+		}
+		if p.state.Local == nil {
+			p.state.Local = make(map[string]fileState)
+		}
+	}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		logger.Log.Error("[SYNC] Failed to create sync folder", "folder", root, "err", err)
+	}
+	return p
+}
+
+// run works through the pair's jobs until the pair is removed, then forgets its state
+func (p *pair) run() {
+	for {
+		select {
+		case job := <-p.jobs:
+			job()
+		case <-p.stop:
+			removeState(p.statePath)
+			return
+		}
+	}
+}
+
+// do queues job on the pair's worker, unless the pair was removed
+func (p *pair) do(job func()) {
+	select {
+	case p.jobs <- job:
+	case <-p.stop:
+	}
+}
+
+// scan hashes the folder and returns what changed since both agents last agreed on it,
+// leaving out what was sent recently and not acknowledged yet
+func (p *pair) scan() ([]models.SyncChange, error) {
+	filter := watcher.DefaultFilterConfig()
+	local := make(map[string]fileState, len(p.state.Local))
+	var files int
+	var bytes int64
+	err := filepath.Walk(p.root, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && filePath != p.root {
+				return nil // removed during the walk
+			}
+			return err
+		}
+		if !info.Mode().IsRegular() || strings.HasSuffix(filePath, ".part") || !filter.ShouldProcess(filePath) {
+			return nil
+		}
+		rel, err := filepath.Rel(p.root, filePath)
+		if err != nil {
+			return err
+		}
+		st, err := p.hash(filepath.ToSlash(rel), filePath, info)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		local[filepath.ToSlash(rel)] = st
+		files++
+		bytes += info.Size()
+		return nil
+	})
+	p.scannedAt = time.Now()
+	if err != nil {
+		p.scanErr = err.Error()
+		return nil, err
+	}
+	p.scanErr = ""
+	p.state.Local = local
+	p.files, p.bytes = files, bytes
+
+	var changes []models.SyncChange
+	for path, st := range local {
+		if synced, ok := p.state.Synced[path]; ok && synced.SHA256 == st.SHA256 {
+			continue
+		}
+		if !p.sentRecently(path, st.SHA256) {
+			changes = append(changes, st.change(path))
+		}
+	}
+	for path := range p.state.Synced {
+		if _, ok := local[path]; !ok && !p.sentRecently(path, "") {
+			changes = append(changes, models.SyncChange{Path: path, Deleted: true})
+		}
+	}
+	return changes, nil
+}
+
+// hash returns the state of a file, reusing the cached hash while its size and modification
+// time are unchanged
+func (p *pair) hash(path, filePath string, info os.FileInfo) (fileState, error) {
+	if cached, ok := p.state.Local[path]; ok && cached.Size == info.Size() && cached.ModTime.Equal(info.ModTime()) {
+		return cached, nil
+	}
+	f, err := os.Open(filePath)
+	if err != nil {
+		return fileState{}, err
+	}
+	defer f.Close()
+	sum := sha256.New()
+	if _, err := io.Copy(sum, f); err != nil {
+		return fileState{}, err
+	}
+	return fileState{Size: info.Size(), ModTime: info.ModTime(), SHA256: hex.EncodeToString(sum.Sum(nil))}, nil
+}
+
+// current returns the state of a file now, or nil if it does not exist
+func (p *pair) current(path string) (*fileState, error) {
+	filePath := filepath.Join(p.root, filepath.FromSlash(path))
+	info, err := os.Stat(filePath)
+	if os.IsNotExist(err) {
+		delete(p.state.Local, path)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file", path)
+	}
+	st, err := p.hash(path, filePath, info)
+	if err != nil {
+		return nil, err
+	}
+	p.state.Local[path] = st
+	return &st, nil
+}
+
+func (p *pair) sentRecently(path, sha256 string) bool {
+	s, ok := p.sent[path]
+	return ok && s.sha256 == sha256 && time.Since(s.at) < resendAfter
+}
+
+func (p *pair) markSent(changes []models.SyncChange) {
+	now := time.Now()
+	for _, c := range changes {
+		p.sent[c.Path] = sentChange{sha256: c.SHA256, at: now}
+	}
+}
+
+// apply takes a change from the other agent. A file this agent left alone since both last
+// agreed on it takes the change; one it changed as well is a conflict, see resolve.
+func (p *pair) apply(c models.SyncChange) (outcome, error) {
+	name := filepath.FromSlash(c.Path)
+	if !filepath.IsLocal(name) || strings.HasSuffix(name, ".part") {
+		return 0, fmt.Errorf("invalid path %q", c.Path)
+	}
+	if c.Deleted {
+		c.SHA256 = ""
+	}
+	local, err := p.current(c.Path)
+	if err != nil {
+		return 0, err
+	}
+	localSHA := ""
+	if local != nil {
+		localSHA = local.SHA256
+	}
+	if localSHA == c.SHA256 {
+		p.agree(c)
+		return outcomeAgreed, nil
+	}
+	if localSHA != p.state.Synced[c.Path].SHA256 {
+		winner := p.resolve(local, c)
+		p.conflicts = append(p.conflicts, models.SyncConflict{
+			Path:         c.Path,
+			LocalSHA256:  localSHA,
+			RemoteSHA256: c.SHA256,
+			Winner:       winner,
+			At:           time.Now(),
+		})
+		logger.Log.Warn("[SYNC] Conflicting change, both agents changed the file", "pair_id", p.config.ID, "path", c.Path, "winner", winner)
+		if winner == p.config.Side {
+			return outcomeKept, nil
+		}
+	}
+	if !c.Deleted {
+		return outcomePull, nil
+	}
+	filePath := filepath.Join(p.root, name)
+	if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	p.prune(filepath.Dir(filePath))
+	p.agree(c)
+	logger.Log.Info("[SYNC] Deleted file removed on peer", "pair_id", p.config.ID, "path", c.Path)
+	return outcomeAgreed, nil
+}
+
+// resolve picks the side whose version of a file both agents changed is kept. A configured
+// winner always wins; otherwise an edit beats a deletion, then the newer modification wins,
+// and side a wins a tie so both agents come to the same decision.
+func (p *pair) resolve(local *fileState, remote models.SyncChange) string {
+	peer := models.SyncSideA
+	if p.config.Side == models.SyncSideA {
+		peer = models.SyncSideB
+	}
+	switch {
+	case p.config.ConflictWinner == models.SyncSideA || p.config.ConflictWinner == models.SyncSideB:
+		return p.config.ConflictWinner
+	case local == nil:
+		return peer
+	case remote.Deleted:
+		return p.config.Side
+	case local.ModTime.After(remote.ModTime):
+		return p.config.Side
+	case remote.ModTime.After(local.ModTime):
+		return peer
+	}
+	return models.SyncSideA
+}
+
+// agree records a change both agents now hold
+func (p *pair) agree(c models.SyncChange) {
+	if c.Deleted || c.SHA256 == "" {
+		delete(p.state.Synced, c.Path)
+		delete(p.state.Local, c.Path)
+	} else {
+		p.state.Synced[c.Path] = fileState{Size: c.Size, ModTime: c.ModTime, SHA256: c.SHA256}
+	}
+	if s, ok := p.sent[c.Path]; ok && s.sha256 == c.SHA256 {
+		delete(p.sent, c.Path)
+	}
+}
+
+// acked records the changes the other agent applied
+func (p *pair) acked(changes []models.SyncChange) {
+	for _, c := range changes {
+		if filepath.IsLocal(filepath.FromSlash(c.Path)) {
+			if c.Deleted {
+				c.SHA256 = ""
+			}
+			p.agree(c)
+		}
+	}
+	p.save()
+}
+
+// pulled records a file received from the other agent, as the manifest lists it
+func (p *pair) pulled(f models.ManifestFile) (fileState, bool) {
+	info, err := os.Stat(filepath.Join(p.root, filepath.FromSlash(f.Path)))
+	if err != nil || !info.Mode().IsRegular() || info.Size() != f.Size {
+		return fileState{}, false
+	}
+	st := fileState{Size: f.Size, ModTime: info.ModTime(), SHA256: f.SHA256}
+	p.state.Local[f.Path] = st
+	p.state.Synced[f.Path] = st
+	return st, true
+}
+
+// prune removes the empty folders left behind by a deletion, up to the pair's folder
+func (p *pair) prune(dir string) {
+	for dir != p.root && strings.HasPrefix(dir, p.root+string(os.PathSeparator)) {
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+func (p *pair) report() models.SyncReport {
+	pending := 0
+	for path, st := range p.state.Local {
+		if p.state.Synced[path].SHA256 != st.SHA256 {
+			pending++
+		}
+	}
+	for path := range p.state.Synced {
+		if _, ok := p.state.Local[path]; !ok {
+			pending++
+		}
+	}
+	return models.SyncReport{
+		PairID:    p.config.ID,
+		Files:     p.files,
+		Bytes:     p.bytes,
+		Pending:   pending,
+		ScannedAt: p.scannedAt,
+		Error:     p.scanErr,
+		Conflicts: p.conflicts,
+	}
+}
+
+// save writes the pair's state to a temporary file and renames it into place, so a crash
+// never leaves a truncated state behind
+func (p *pair) save() {
+	if err := p.saveState(); err != nil {
+		logger.Log.Warn("[SYNC] Failed to save sync state", "pair_id", p.config.ID, "err", err)
+	}
+}
+
+func (p *pair) saveState() error {
+	data, err := json.Marshal(p.state)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p.statePath), 0700); err != nil {
+		return err
+	}
+	tmp := p.statePath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, p.statePath); err != nil {
+		return errors.Join(err, os.Remove(tmp))
+	}
+	return nil
+}
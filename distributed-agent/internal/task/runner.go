@@ -0,0 +1,171 @@
+package task
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/The-Promised-Neverland/agent/internal/config"
+	"github.com/The-Promised-Neverland/agent/internal/models"
+	"github.com/The-Promised-Neverland/agent/pkg/logger"
+)
+
+const (
+	DefaultTimeout   = 30 * time.Second
+	progressInterval = 2 * time.Second
+	waitDelay        = 2 * time.Second
+	maxOutputBytes   = 256 * 1024 // keep job status well under the master's message limit
+)
+
+// Runner executes tasks assigned by the master and reports their progress
+type Runner struct {
+	config   *config.Config
+	sendFunc func(msg *models.Message) error
+	mu       sync.Mutex
+	running  map[string]context.CancelFunc
+}
+
+func NewRunner(cfg *config.Config, sendFunc func(msg *models.Message) error) *Runner {
+	return &Runner{
+		config:   cfg,
+		sendFunc: sendFunc,
+		running:  make(map[string]context.CancelFunc),
+	}
+}
+
+// Run executes the task and blocks until it finishes, times out or parentCtx is done
+func (r *Runner) Run(parentCtx context.Context, task models.TaskAssignmentPayload) {
+	if task.JobType != models.JobTypeShellCommand {
+		r.report(task.JobID, models.JobStatusFailed, "", fmt.Sprintf("unsupported job type: %s", task.JobType), nil)
+		return
+	}
+	timeout := time.Duration(task.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(parentCtx, timeout)
+	defer cancel()
+	r.mu.Lock()
+	if _, exists := r.running[task.JobID]; exists {
+		r.mu.Unlock()
+		logger.Log.Warn("[TASK] Task already running, ignoring duplicate assignment", "job_id", task.JobID)
+		return
+	}
+	r.running[task.JobID] = cancel
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		delete(r.running, task.JobID)
+		r.mu.Unlock()
+	}()
+
+	output := &cappedBuffer{limit: maxOutputBytes}
+	cmd := shellCommand(ctx, task.Command)
+	cmd.Stdout = output
+	cmd.Stderr = output
+	cmd.WaitDelay = waitDelay // children of the shell may hold the output pipes open
+	logger.Log.Info("[TASK] Starting task", "job_id", task.JobID, "command", task.Command, "timeout", timeout)
+	if err := cmd.Start(); err != nil {
+		r.report(task.JobID, models.JobStatusFailed, "", fmt.Sprintf("failed to start command: %v", err), nil)
+		return
+	}
+	r.report(task.JobID, models.JobStatusRunning, "", "", nil)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.report(task.JobID, models.JobStatusRunning, output.String(), "", nil)
+		case err := <-done:
+			exitCode := 0
+			if cmd.ProcessState != nil {
+				exitCode = cmd.ProcessState.ExitCode()
+			}
+			switch {
+			case errors.Is(ctx.Err(), context.DeadlineExceeded):
+				logger.Log.Warn("[TASK] Task timed out", "job_id", task.JobID, "timeout", timeout)
+				r.report(task.JobID, models.JobStatusFailed, output.String(), fmt.Sprintf("timed out after %s", timeout), &exitCode)
+			case errors.Is(ctx.Err(), context.Canceled):
+				logger.Log.Warn("[TASK] Task cancelled", "job_id", task.JobID)
+				r.report(task.JobID, models.JobStatusFailed, output.String(), "cancelled: agent disconnected or shutting down", &exitCode)
+			case err != nil:
+				logger.Log.Warn("[TASK] Task failed", "job_id", task.JobID, "err", err)
+				r.report(task.JobID, models.JobStatusFailed, output.String(), err.Error(), &exitCode)
+			default:
+				logger.Log.Info("[TASK] Task completed", "job_id", task.JobID)
+				r.report(task.JobID, models.JobStatusCompleted, output.String(), "", &exitCode)
+			}
+			return
+		}
+	}
+}
+
+// CancelAll stops every running task, used when the session ends or the agent shuts down
+func (r *Runner) CancelAll() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, cancel := range r.running {
+		cancel()
+	}
+}
+
+func (r *Runner) report(jobID, status, output, errMsg string, exitCode *int) {
+	if r.sendFunc == nil {
+		return
+	}
+	msg := &models.Message{
+		Type: models.AgentMsgJobStatus,
+		Payload: models.JobStatus{
+			AgentID:   r.config.AgentID(),
+			JobID:     jobID,
+			Status:    status,
+			Output:    output,
+			Error:     errMsg,
+			ExitCode:  exitCode,
+			Timestamp: time.Now().Unix(),
+		},
+	}
+	if err := r.sendFunc(msg); err != nil {
+		logger.Log.Error("[TASK] Failed to report job status", "job_id", jobID, "status", status, "err", err)
+	}
+}
+
+func shellCommand(ctx context.Context, command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.CommandContext(ctx, "cmd", "/C", command)
+	}
+	return exec.CommandContext(ctx, "sh", "-c", command)
+}
+
+// cappedBuffer collects command output, keeping only the last limit bytes
+type cappedBuffer struct {
+	mu    sync.Mutex
+	buf   bytes.Buffer
+	limit int
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n, _ := b.buf.Write(p)
+	if over := b.buf.Len() - b.limit; over > 0 {
+		b.buf.Next(over)
+	}
+	return n, nil
+}
+
+func (b *cappedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
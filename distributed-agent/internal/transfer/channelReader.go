@@ -1,37 +1,60 @@
 package transfer
 
-import "io"
+import (
+	"io"
+
+	"github.com/The-Promised-Neverland/agent/internal/service"
+)
 
 // channelReader implements io.Reader by reading streamed byte chunks from channels.
 // Will allow consumers (e.g. tar/gzip readers, io.Copy) to process chunked data as a continuous byte stream.
+// Chunks are encoded, and sealed, on the way; see sendStream.
 type channelReader struct {
-	dataCh <-chan []byte
-	errCh  <-chan error
-	buffer []byte
+	dataCh   <-chan service.Chunk
+	errCh    <-chan error
+	stream   *sendStream
+	ended    bool // the last record was read
+	buffer   []byte
+	total    int64 // tar bytes taken from the stream so far
+	progress *progressMeter
 }
 
 func (r *channelReader) Read(p []byte) (n int, err error) {
-	if len(r.buffer) > 0 {
-		n = copy(p, r.buffer)
-		r.buffer = r.buffer[n:]
-		return n, nil
+	for len(r.buffer) == 0 {
+		if r.ended {
+			return 0, io.EOF
+		}
+		if r.buffer, err = r.next(); err != nil {
+			return 0, err
+		}
 	}
+	n = copy(p, r.buffer)
+	r.buffer = r.buffer[n:]
+	return n, nil
+}
+
+// next returns the wire bytes of the next chunk, or the end of the stream once the channel closes
+func (r *channelReader) next() ([]byte, error) {
 	select {
 	case chunk, ok := <-r.dataCh:
 		if !ok {
 			select {
-			case err := <-r.errCh:
-				return 0, err
+			case err := <-r.errCh: // nil once closed
+				if err != nil {
+					return nil, err
+				}
 			default:
-				return 0, io.EOF
 			}
+			r.ended = true
+			return r.stream.final(), nil
 		}
-		n = copy(p, chunk)
-		if n < len(chunk) {
-			r.buffer = chunk[n:]
+		r.progress.add(len(chunk.Data))
+		r.total += int64(len(chunk.Data))
+		return r.stream.write(chunk)
+	case err, ok := <-r.errCh:
+		if !ok {
+			r.errCh = nil // closed without an error; wait for the data channel to close too
 		}
-		return n, nil
-	case err := <-r.errCh:
-		return 0, err
+		return nil, err
 	}
 }
@@ -0,0 +1,226 @@
+package transfer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/The-Promised-Neverland/agent/internal/models"
+	"github.com/The-Promised-Neverland/agent/internal/service"
+	"github.com/klauspost/compress/zstd"
+)
+
+// With a codec other than none, the tar stream travels as
+//
+//	preamble: "NLC" | codec ID (1)
+//	records:  kind (1) | length (4, big endian) | payload
+//
+// A stored record carries tar bytes as they are; a compressed one carries one chunk compressed
+// on its own with the codec. The destination writes the decoded tar bytes to its temp tar, so
+// resume offsets keep counting tar bytes. With codec none the stream is the bare tar.
+const (
+	codecMagic       = "NLC"
+	recordStored     = 0
+	recordCompressed = 1
+	recordHeaderSize = 5
+	// maxRecordSize bounds what a decoder buffers or inflates for one record
+	maxRecordSize = 1 << 20
+)
+
+var errBadStream = errors.New("malformed transfer stream")
+
+var codecIDs = map[string]byte{
+	models.TransferCodecGzip: 1,
+	models.TransferCodecZstd: 2,
+}
+
+// validCodec returns codec, or none when it is empty, and fails for codecs this agent lacks
+func validCodec(codec string) (string, error) {
+	if codec == "" {
+		return models.TransferCodecNone, nil
+	}
+	if _, ok := codecIDs[codec]; !ok && codec != models.TransferCodecNone {
+		return "", fmt.Errorf("unsupported transfer codec %q", codec)
+	}
+	return codec, nil
+}
+
+// streamEncoder turns tar chunks into the wire stream of a codec
+type streamEncoder struct {
+	codec    string
+	preamble bool
+	zstd     *zstd.Encoder
+	gzip     *gzip.Writer
+	buf      bytes.Buffer
+}
+
+func newStreamEncoder(codec string) (*streamEncoder, error) {
+	e := &streamEncoder{codec: codec}
+	switch codec {
+	case models.TransferCodecZstd:
+		enc, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		e.zstd = enc
+	case models.TransferCodecGzip:
+		e.gzip = gzip.NewWriter(nil)
+	}
+	return e, nil
+}
+
+// encode returns the wire bytes for a chunk; the first call also carries the preamble.
+// Incompressible chunks, and those that do not shrink, are stored.
+func (e *streamEncoder) encode(chunk service.Chunk) ([]byte, error) {
+	if e.codec == models.TransferCodecNone {
+		return chunk.Data, nil
+	}
+	out := make([]byte, 0, len(chunk.Data)+len(codecMagic)+1+recordHeaderSize)
+	if !e.preamble {
+		out = append(append(out, codecMagic...), codecIDs[e.codec])
+		e.preamble = true
+	}
+	kind, payload := byte(recordStored), chunk.Data
+	if chunk.Compressible {
+		compressed, err := e.compress(chunk.Data)
+		if err != nil {
+			return nil, err
+		}
+		if len(compressed) < len(chunk.Data) {
+			kind, payload = recordCompressed, compressed
+		}
+	}
+	out = append(out, kind)
+	out = binary.BigEndian.AppendUint32(out, uint32(len(payload)))
+	return append(out, payload...), nil
+}
+
+func (e *streamEncoder) compress(data []byte) ([]byte, error) {
+	if e.zstd != nil {
+		return e.zstd.EncodeAll(data, nil), nil
+	}
+	e.buf.Reset()
+	e.gzip.Reset(&e.buf)
+	if _, err := e.gzip.Write(data); err != nil {
+		return nil, err
+	}
+	if err := e.gzip.Close(); err != nil {
+		return nil, err
+	}
+	return bytes.Clone(e.buf.Bytes()), nil
+}
+
+func (e *streamEncoder) close() {
+	if e.zstd != nil {
+		e.zstd.Close()
+	}
+}
+
+// streamDecoder is the destination's side of a streamEncoder: it takes the wire stream in
+// pieces of any size and writes the tar bytes to w
+type streamDecoder struct {
+	codec    string
+	w        io.Writer
+	pending  []byte
+	preamble bool
+	zstd     *zstd.Decoder
+	gzip     *gzip.Reader
+	raw      []byte
+}
+
+func newStreamDecoder(codec string, w io.Writer) (*streamDecoder, error) {
+	d := &streamDecoder{codec: codec, w: w}
+	if codec == models.TransferCodecZstd {
+		dec, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(maxRecordSize))
+		if err != nil {
+			return nil, err
+		}
+		d.zstd = dec
+	}
+	return d, nil
+}
+
+func (d *streamDecoder) Write(p []byte) (int, error) {
+	if d.codec == models.TransferCodecNone {
+		return d.w.Write(p)
+	}
+	d.pending = append(d.pending, p...)
+	if !d.preamble {
+		if len(d.pending) < len(codecMagic)+1 {
+			return len(p), nil
+		}
+		if string(d.pending[:len(codecMagic)]) != codecMagic || d.pending[len(codecMagic)] != codecIDs[d.codec] {
+			return 0, fmt.Errorf("%w: not a %s stream", errBadStream, d.codec)
+		}
+		d.pending = d.pending[len(codecMagic)+1:]
+		d.preamble = true
+	}
+	for len(d.pending) >= recordHeaderSize {
+		kind := d.pending[0]
+		size := int(binary.BigEndian.Uint32(d.pending[1:recordHeaderSize]))
+		if size > maxRecordSize {
+			return 0, fmt.Errorf("%w: record of %d bytes", errBadStream, size)
+		}
+		if len(d.pending) < recordHeaderSize+size {
+			break
+		}
+		payload := d.pending[recordHeaderSize : recordHeaderSize+size]
+		switch kind {
+		case recordStored:
+		case recordCompressed:
+			raw, err := d.decompress(payload)
+			if err != nil {
+				return 0, fmt.Errorf("%w: %v", errBadStream, err)
+			}
+			payload = raw
+		default:
+			return 0, fmt.Errorf("%w: record kind %d", errBadStream, kind)
+		}
+		if _, err := d.w.Write(payload); err != nil {
+			return 0, err
+		}
+		d.pending = d.pending[recordHeaderSize+size:]
+	}
+	// Keep the partial record without holding on to the consumed ones
+	d.pending = append([]byte(nil), d.pending...)
+	return len(p), nil
+}
+
+func (d *streamDecoder) decompress(payload []byte) ([]byte, error) {
+	if d.zstd != nil {
+		raw, err := d.zstd.DecodeAll(payload, d.raw[:0])
+		d.raw = raw
+		return raw, err
+	}
+	var err error
+	if d.gzip == nil {
+		d.gzip, err = gzip.NewReader(bytes.NewReader(payload))
+	} else {
+		err = d.gzip.Reset(bytes.NewReader(payload))
+	}
+	if err != nil {
+		return nil, err
+	}
+	raw, err := io.ReadAll(io.LimitReader(d.gzip, maxRecordSize+1))
+	if err == nil && len(raw) > maxRecordSize {
+		err = fmt.Errorf("record inflates past %d bytes", maxRecordSize)
+	}
+	return raw, err
+}
+
+// finish fails if the stream stopped in the middle of a record
+func (d *streamDecoder) finish() error {
+	if len(d.pending) > 0 {
+		return fmt.Errorf("%w: stream ends inside a record (%d bytes left)", errBadStream, len(d.pending))
+	}
+	return nil
+}
+
+func (d *streamDecoder) close() {
+	if d.zstd != nil {
+		d.zstd.Close()
+	}
+}
@@ -0,0 +1,65 @@
+package transfer
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// relayWindow is how many chunks a receiver lets a relay source send ahead of what it has written
+	relayWindow = 64
+	// relayGrantStep is how many written chunks it takes before the receiver grants more credit
+	relayGrantStep = relayWindow / 4
+	// relayCreditTimeout fails a send whose receiver stopped granting credit
+	relayCreditTimeout = 2 * time.Minute
+)
+
+// creditWindow holds a relay sender back until the receiver has room for the next chunk.
+// Grants are cumulative, so a late or repeated one is harmless.
+type creditWindow struct {
+	mu      sync.Mutex
+	granted uint64
+	changed chan struct{} // closed and replaced on every grant
+}
+
+func newCreditWindow() *creditWindow {
+	return &creditWindow{changed: make(chan struct{})}
+}
+
+// grant lets the sender go up to granted chunks in total
+func (w *creditWindow) grant(granted uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if granted <= w.granted {
+		return
+	}
+	w.granted = granted
+	close(w.changed)
+	w.changed = make(chan struct{})
+}
+
+// wait blocks until chunk seq (counted from 0) may be sent
+func (w *creditWindow) wait(ctx context.Context, seq uint64) error {
+	var timeout *time.Timer
+	for {
+		w.mu.Lock()
+		granted, changed := w.granted, w.changed
+		w.mu.Unlock()
+		if seq < granted {
+			return nil
+		}
+		if timeout == nil {
+			timeout = time.NewTimer(relayCreditTimeout)
+			defer timeout.Stop()
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timeout.C:
+			return fmt.Errorf("no credit for chunk %d after %v, receiver granted %d", seq, relayCreditTimeout, granted)
+		}
+	}
+}
@@ -0,0 +1,317 @@
+package transfer
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/The-Promised-Neverland/agent/internal/enrollment"
+	"github.com/The-Promised-Neverland/agent/internal/models"
+	"github.com/The-Promised-Neverland/agent/internal/ws"
+	"github.com/The-Promised-Neverland/agent/pkg/logger"
+	"golang.org/x/crypto/hkdf"
+)
+
+// An encrypted stream is what the codec produces, sealed with AES-256-GCM as
+//
+//	preamble: "NLE" | version (1) | salt (16)
+//	records:  ciphertext of sealRecordSize bytes + tag, the last one shorter
+//
+// The source draws a new salt for every attempt, so a fallback or resume never reuses a key.
+// The key is HKDF-SHA256 of the X25519 secret, salted, bound to the transfer and both public
+// keys. The nonce counts records; the last record is sealed with a final flag as additional
+// data, so a stream cut at a record boundary does not pass for a complete one.
+const (
+	sealMagic      = "NLE"
+	sealVersion    = 1
+	sealSaltSize   = 16
+	sealRecordSize = 64 * 1024
+	// transferKeyRetention is how long ephemeral keys of a transfer are kept for its attempts
+	transferKeyRetention = time.Hour
+)
+
+var errBadSeal = errors.New("transfer stream failed authentication")
+
+// transferKeys is the key agreement of one role in an encrypted transfer
+type transferKeys struct {
+	private *ecdh.PrivateKey
+	peer    *ecdh.PublicKey // set once the master forwards the other agent's key
+	expiry  *time.Timer
+}
+
+func keyID(connectionID, role string) string {
+	return connectionID + "/" + role
+}
+
+func otherRole(role string) string {
+	if role == models.TransferRoleSource {
+		return models.TransferRoleDestination
+	}
+	return models.TransferRoleSource
+}
+
+// keySigningBytes is what the signature of a TransferKey covers
+func keySigningBytes(connectionID, role string, publicKey []byte) []byte {
+	data := []byte("nebula-transfer-key\x00" + connectionID + "\x00" + role + "\x00")
+	return append(data, publicKey...)
+}
+
+// PrepareKey makes an ephemeral X25519 key for this agent's role in an encrypted transfer and
+// sends its public half, signed, to the master. A later intent for the same role, e.g. for a
+// resume, replaces it.
+func (m *TransferManager) PrepareKey(connectionID, role string) error {
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	signingKey, err := enrollment.EnsureSigningKey(m.config.CredentialPath())
+	if err != nil {
+		return fmt.Errorf("cannot sign the transfer key: %w", err)
+	}
+	public := private.PublicKey().Bytes()
+	keys := &transferKeys{private: private}
+	id := keyID(connectionID, role)
+	keys.expiry = time.AfterFunc(transferKeyRetention, func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if m.keys[id] == keys {
+			delete(m.keys, id)
+		}
+	})
+	m.mu.Lock()
+	if previous := m.keys[id]; previous != nil {
+		previous.expiry.Stop()
+	}
+	m.keys[id] = keys
+	m.mu.Unlock()
+	msg := models.Message{
+		Type: models.AgentMsgTransferKey,
+		Payload: models.TransferKey{
+			ConnectionID: connectionID,
+			Role:         role,
+			PublicKey:    base64.StdEncoding.EncodeToString(public),
+			Signature:    base64.StdEncoding.EncodeToString(ed25519.Sign(signingKey, keySigningBytes(connectionID, role, public))),
+		},
+	}
+	logger.Log.Info("[TRANSFER] Sending ephemeral transfer key", "connection_id", connectionID, "role", role)
+	return m.currentAgent().Send(ws.Outbound{Msg: &msg})
+}
+
+// SetPeerKey takes the other agent's key for a transfer, as forwarded by the master, once its
+// signature checks out against the signing key that agent connected with
+func (m *TransferManager) SetPeerKey(key models.TransferKey) error {
+	signingKey, err := base64.StdEncoding.DecodeString(key.SigningKey)
+	if err != nil || len(signingKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("%w: peer has no valid signing key", errBadSeal)
+	}
+	public, err := base64.StdEncoding.DecodeString(key.PublicKey)
+	if err != nil {
+		return fmt.Errorf("malformed peer key: %w", err)
+	}
+	signature, err := base64.StdEncoding.DecodeString(key.Signature)
+	if err != nil || !ed25519.Verify(ed25519.PublicKey(signingKey), keySigningBytes(key.ConnectionID, key.Role, public), signature) {
+		return fmt.Errorf("%w: bad signature on the %s key", errBadSeal, key.Role)
+	}
+	peer, err := ecdh.X25519().NewPublicKey(public)
+	if err != nil {
+		return fmt.Errorf("malformed peer key: %w", err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := m.keys[keyID(key.ConnectionID, otherRole(key.Role))]
+	if keys == nil {
+		return fmt.Errorf("no key of ours for transfer %s", key.ConnectionID)
+	}
+	keys.peer = peer
+	return nil
+}
+
+// sessionKeys returns this agent's key agreement for a role in a transfer, once complete
+func (m *TransferManager) sessionKeys(connectionID, role string) (*transferKeys, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := m.keys[keyID(connectionID, role)]
+	if keys == nil || keys.peer == nil {
+		return nil, fmt.Errorf("no key agreed for encrypted transfer %s", connectionID)
+	}
+	return keys, nil
+}
+
+// dropKeys forgets the keys of a transfer
+func (m *TransferManager) dropKeys(connectionID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, role := range []string{models.TransferRoleSource, models.TransferRoleDestination} {
+		if keys := m.keys[keyID(connectionID, role)]; keys != nil {
+			keys.expiry.Stop()
+			delete(m.keys, keyID(connectionID, role))
+		}
+	}
+}
+
+// streamAEAD derives the key of one attempt. The source's public key goes first, whichever
+// side derives it.
+func streamAEAD(keys *transferKeys, role, connectionID string, salt []byte) (cipher.AEAD, error) {
+	secret, err := keys.private.ECDH(keys.peer)
+	if err != nil {
+		return nil, err
+	}
+	source, destination := keys.private.PublicKey().Bytes(), keys.peer.Bytes()
+	if role == models.TransferRoleDestination {
+		source, destination = destination, source
+	}
+	info := append(append([]byte("nebula-transfer "+connectionID), source...), destination...)
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, info), key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func sealNonce(aead cipher.AEAD, counter uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], counter)
+	return nonce
+}
+
+func sealFlag(final bool) []byte {
+	if final {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// streamSealer encrypts the source's stream in sealRecordSize records
+type streamSealer struct {
+	aead     cipher.AEAD
+	preamble []byte // sent with the first record
+	buf      []byte
+	counter  uint64
+}
+
+func newStreamSealer(keys *transferKeys, connectionID string) (*streamSealer, error) {
+	salt := make([]byte, sealSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := streamAEAD(keys, models.TransferRoleSource, connectionID, salt)
+	if err != nil {
+		return nil, err
+	}
+	preamble := append([]byte(sealMagic), sealVersion)
+	return &streamSealer{aead: aead, preamble: append(preamble, salt...)}, nil
+}
+
+// seal returns the records p completes, possibly none
+func (s *streamSealer) seal(p []byte) []byte {
+	s.buf = append(s.buf, p...)
+	var out []byte
+	for len(s.buf) >= sealRecordSize {
+		out = s.record(out, s.buf[:sealRecordSize], false)
+		s.buf = s.buf[sealRecordSize:]
+	}
+	s.buf = append([]byte(nil), s.buf...)
+	return out
+}
+
+// final returns the last record, shorter than the others and possibly empty
+func (s *streamSealer) final() []byte {
+	out := s.record(nil, s.buf, true)
+	s.buf = nil
+	return out
+}
+
+func (s *streamSealer) record(out, plaintext []byte, final bool) []byte {
+	out = append(out, s.preamble...)
+	s.preamble = nil
+	out = s.aead.Seal(out, sealNonce(s.aead, s.counter), plaintext, sealFlag(final))
+	s.counter++
+	return out
+}
+
+// streamOpener is the destination's side of a streamSealer: it takes the sealed stream in
+// pieces of any size and writes what it authenticates to w
+type streamOpener struct {
+	keys         *transferKeys
+	connectionID string
+	w            io.Writer
+	aead         cipher.AEAD
+	buf          []byte
+	counter      uint64
+	done         bool
+}
+
+func newStreamOpener(keys *transferKeys, connectionID string, w io.Writer) *streamOpener {
+	return &streamOpener{keys: keys, connectionID: connectionID, w: w}
+}
+
+func (o *streamOpener) Write(p []byte) (int, error) {
+	if o.done {
+		return 0, fmt.Errorf("%w: data after the last record", errBadSeal)
+	}
+	o.buf = append(o.buf, p...)
+	if o.aead == nil {
+		preambleSize := len(sealMagic) + 1 + sealSaltSize
+		if len(o.buf) < preambleSize {
+			return len(p), nil
+		}
+		if string(o.buf[:len(sealMagic)]) != sealMagic || o.buf[len(sealMagic)] != sealVersion {
+			return 0, fmt.Errorf("%w: not an encrypted stream", errBadSeal)
+		}
+		aead, err := streamAEAD(o.keys, models.TransferRoleDestination, o.connectionID, o.buf[len(sealMagic)+1:preambleSize])
+		if err != nil {
+			return 0, err
+		}
+		o.aead = aead
+		o.buf = o.buf[preambleSize:]
+	}
+	// A whole-size record is never the last one
+	recordSize := sealRecordSize + o.aead.Overhead()
+	for len(o.buf) >= recordSize {
+		if err := o.open(o.buf[:recordSize], false); err != nil {
+			return 0, err
+		}
+		o.buf = o.buf[recordSize:]
+	}
+	o.buf = append([]byte(nil), o.buf...)
+	return len(p), nil
+}
+
+// finish opens the last record; it fails if the stream was cut short
+func (o *streamOpener) finish() error {
+	if o.done {
+		return nil
+	}
+	if o.aead == nil {
+		return fmt.Errorf("%w: stream ends before its preamble", errBadSeal)
+	}
+	if err := o.open(o.buf, true); err != nil {
+		return err
+	}
+	o.buf = nil
+	o.done = true
+	return nil
+}
+
+func (o *streamOpener) open(record []byte, final bool) error {
+	plaintext, err := o.aead.Open(record[:0:0], sealNonce(o.aead, o.counter), record, sealFlag(final))
+	if err != nil {
+		return fmt.Errorf("%w: record %d", errBadSeal, o.counter)
+	}
+	o.counter++
+	_, err = o.w.Write(plaintext)
+	return err
+}
@@ -0,0 +1,205 @@
+package transfer
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"errors"
+	"testing"
+)
+
+const (
+	testPreambleSize = len(sealMagic) + 1 + sealSaltSize
+	testTagSize      = 16 // AES-GCM
+	testRecordSize   = sealRecordSize + testTagSize
+)
+
+// newKeyPair returns the source's and the destination's side of one key agreement
+func newKeyPair(t *testing.T) (source, destination *transferKeys) {
+	t.Helper()
+	a, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &transferKeys{private: a, peer: b.PublicKey()}, &transferKeys{private: b, peer: a.PublicKey()}
+}
+
+// sealStream seals plaintext, fed to the sealer in pieces of chunk bytes
+func sealStream(t *testing.T, keys *transferKeys, connectionID string, plaintext []byte, chunk int) []byte {
+	t.Helper()
+	sealer, err := newStreamSealer(keys, connectionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stream []byte
+	for p := plaintext; len(p) > 0; {
+		n := min(chunk, len(p))
+		stream = append(stream, sealer.seal(p[:n])...)
+		p = p[n:]
+	}
+	return append(stream, sealer.final()...)
+}
+
+// openStream opens stream, written to the opener in pieces of chunk bytes
+func openStream(keys *transferKeys, connectionID string, stream []byte, chunk int) ([]byte, error) {
+	var out bytes.Buffer
+	opener := newStreamOpener(keys, connectionID, &out)
+	for p := stream; len(p) > 0; {
+		n := min(chunk, len(p))
+		if _, err := opener.Write(p[:n]); err != nil {
+			return nil, err
+		}
+		p = p[n:]
+	}
+	if err := opener.finish(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	source, destination := newKeyPair(t)
+	tests := []struct {
+		name  string
+		size  int
+		chunk int // size of the pieces written on both sides
+	}{
+		{"empty", 0, 1024},
+		{"one byte", 1, 1024},
+		{"short of one record", sealRecordSize - 1, 1000},
+		{"exactly one record", sealRecordSize, 4096},
+		{"exact multiple of the record size", 3 * sealRecordSize, 7000},
+		{"one byte past a record", sealRecordSize + 1, sealRecordSize},
+		{"several records and a tail", 2*sealRecordSize + 12345, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plaintext := randomBytes(t, tt.size)
+			stream := sealStream(t, source, "c1", plaintext, max(tt.chunk, 1024))
+			records := tt.size/sealRecordSize + 1 // the last one is shorter, possibly empty
+			if want := testPreambleSize + records*testTagSize + tt.size; len(stream) != want {
+				t.Fatalf("sealed %d bytes into %d, want %d", tt.size, len(stream), want)
+			}
+			got, err := openStream(destination, "c1", stream, tt.chunk)
+			if err != nil {
+				t.Fatalf("open: %v", err)
+			}
+			if !bytes.Equal(got, plaintext) {
+				t.Fatalf("opened %d bytes, want the %d sealed", len(got), len(plaintext))
+			}
+		})
+	}
+}
+
+func TestStreamRejected(t *testing.T) {
+	source, destination := newKeyPair(t)
+	_, stranger := newKeyPair(t)
+	plaintext := func(t *testing.T) []byte { return randomBytes(t, 2*sealRecordSize+500) }
+	multiple := func(t *testing.T) []byte { return randomBytes(t, 2*sealRecordSize) }
+
+	tests := []struct {
+		name         string
+		plaintext    func(t *testing.T) []byte
+		alter        func(stream []byte) []byte
+		keys         *transferKeys
+		connectionID string
+	}{
+		{"truncated at a record boundary", plaintext, func(s []byte) []byte {
+			return s[:testPreambleSize+2*testRecordSize]
+		}, destination, "c1"},
+		{"exact multiple truncated before its empty last record", multiple, func(s []byte) []byte {
+			return s[:testPreambleSize+2*testRecordSize]
+		}, destination, "c1"},
+		{"truncated after the preamble", plaintext, func(s []byte) []byte {
+			return s[:testPreambleSize]
+		}, destination, "c1"},
+		{"truncated inside the preamble", plaintext, func(s []byte) []byte {
+			return s[:testPreambleSize-1]
+		}, destination, "c1"},
+		{"truncated inside the last record", plaintext, func(s []byte) []byte {
+			return s[:len(s)-1]
+		}, destination, "c1"},
+		{"tampered first record", plaintext, func(s []byte) []byte {
+			s[testPreambleSize+10] ^= 1
+			return s
+		}, destination, "c1"},
+		{"tampered last record", plaintext, func(s []byte) []byte {
+			s[len(s)-1] ^= 1
+			return s
+		}, destination, "c1"},
+		{"records swapped", plaintext, func(s []byte) []byte {
+			first := testPreambleSize
+			second := first + testRecordSize
+			swapped := append([]byte(nil), s[:first]...)
+			swapped = append(swapped, s[second:second+testRecordSize]...)
+			swapped = append(swapped, s[first:second]...)
+			return append(swapped, s[second+testRecordSize:]...)
+		}, destination, "c1"},
+		{"wrong salt", plaintext, func(s []byte) []byte {
+			s[len(sealMagic)+1] ^= 1
+			return s
+		}, destination, "c1"},
+		{"wrong magic", plaintext, func(s []byte) []byte {
+			s[0] = 'X'
+			return s
+		}, destination, "c1"},
+		{"unknown version", plaintext, func(s []byte) []byte {
+			s[len(sealMagic)] = sealVersion + 1
+			return s
+		}, destination, "c1"},
+		{"data after the last record", plaintext, func(s []byte) []byte {
+			return append(s, 0)
+		}, destination, "c1"},
+		{"wrong keys", plaintext, nil, stranger, "c1"},
+		{"another transfer", plaintext, nil, destination, "c2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream := sealStream(t, source, "c1", tt.plaintext(t), 8192)
+			if tt.alter != nil {
+				stream = tt.alter(stream)
+			}
+			if _, err := openStream(tt.keys, tt.connectionID, stream, 4096); !errors.Is(err, errBadSeal) {
+				t.Fatalf("open error = %v, want %v", err, errBadSeal)
+			}
+		})
+	}
+}
+
+func TestStreamOpenerRejectsWriteAfterFinish(t *testing.T) {
+	source, destination := newKeyPair(t)
+	stream := sealStream(t, source, "c1", []byte("hello"), 1024)
+	var out bytes.Buffer
+	opener := newStreamOpener(destination, "c1", &out)
+	if _, err := opener.Write(stream); err != nil {
+		t.Fatal(err)
+	}
+	if err := opener.finish(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := opener.Write([]byte{0}); !errors.Is(err, errBadSeal) {
+		t.Fatalf("write after finish error = %v, want %v", err, errBadSeal)
+	}
+}
+
+func TestStreamSaltPerAttempt(t *testing.T) {
+	source, _ := newKeyPair(t)
+	first := sealStream(t, source, "c1", []byte("same"), 1024)
+	second := sealStream(t, source, "c1", []byte("same"), 1024)
+	if bytes.Equal(first[:testPreambleSize], second[:testPreambleSize]) || bytes.Equal(first, second) {
+		t.Fatal("two attempts sealed with the same salt")
+	}
+}
@@ -0,0 +1,139 @@
+package transfer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/The-Promised-Neverland/agent/internal/models"
+	"github.com/The-Promised-Neverland/agent/internal/service"
+	"github.com/The-Promised-Neverland/agent/internal/ws"
+	"github.com/The-Promised-Neverland/agent/pkg/logger"
+)
+
+// maxSignatureBytes bounds the block signatures a destination sends for one delta transfer, so
+// they fit a WebSocket message to the master. Files past it are sent whole.
+const maxSignatureBytes = 1 << 20
+
+// deltaBasis is what the source of a delta transfer knows of the destination's files
+type deltaBasis struct {
+	files  service.DeltaBasis
+	expiry *time.Timer
+}
+
+// SendSignatures signs the files this agent already holds from sourceAgentID, so the source of
+// a delta transfer can send only what changed. For a sync pull these are the files it lists,
+// in its target folder.
+func (m *TransferManager) SendSignatures(connectionID, sourceAgentID string, stream StreamSettings) error {
+	sharedPath, err := m.config.SharedFolderPath()
+	if err != nil {
+		return fmt.Errorf("failed to get shared folder path: %w", err)
+	}
+	extractPath := filepath.Join(sharedPath, "transfers", sourceAgentID)
+	if stream.Target != "" {
+		extractPath = filepath.Join(sharedPath, filepath.FromSlash(stream.Target))
+	}
+	signatures := models.TransferSignatures{ConnectionID: connectionID, Files: []models.FileSignature{}}
+	budget := maxSignatureBytes
+	sign := func(filePath string, info os.FileInfo) error {
+		if !info.Mode().IsRegular() || info.Size() < service.DeltaMinSize || strings.HasSuffix(filePath, ".part") {
+			return nil
+		}
+		if budget <= 0 {
+			return filepath.SkipAll
+		}
+		rel, err := filepath.Rel(extractPath, filePath)
+		if err != nil {
+			return err
+		}
+		sig, err := service.SignFile(filePath, filepath.ToSlash(rel))
+		if err != nil {
+			logger.Log.Warn("[TRANSFER] Cannot sign file for a delta transfer, it will be sent whole", "path", filePath, "err", err)
+			return nil
+		}
+		budget -= len(sig.Blocks)
+		if budget < 0 {
+			return filepath.SkipAll
+		}
+		signatures.Files = append(signatures.Files, *sig)
+		return nil
+	}
+	if stream.Files != nil {
+		for _, name := range stream.Files {
+			filePath := filepath.Join(extractPath, filepath.FromSlash(name))
+			info, statErr := os.Stat(filePath)
+			if statErr != nil {
+				continue
+			}
+			if err = sign(filePath, info); err != nil {
+				break
+			}
+		}
+	} else {
+		err = filepath.Walk(extractPath, func(filePath string, info os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) && filePath == extractPath {
+					return filepath.SkipDir
+				}
+				return err
+			}
+			return sign(filePath, info)
+		})
+	}
+	if err != nil && err != filepath.SkipAll {
+		return fmt.Errorf("failed to sign existing files: %w", err)
+	}
+	msg := models.Message{
+		Type:    models.AgentMsgTransferSignatures,
+		Payload: signatures,
+	}
+	logger.Log.Info("[TRANSFER] Sending block signatures for delta transfer", "connection_id", connectionID, "files", len(signatures.Files), "truncated", budget < 0)
+	return m.currentAgent().Send(ws.Outbound{Msg: &msg})
+}
+
+// SetSignatures takes the destination's block signatures for a delta transfer this agent sends,
+// as forwarded by the master. A later set for the same transfer, e.g. for a resume, replaces it.
+func (m *TransferManager) SetSignatures(signatures models.TransferSignatures) {
+	files := make(service.DeltaBasis, len(signatures.Files))
+	for i := range signatures.Files {
+		files[signatures.Files[i].Path] = &signatures.Files[i]
+	}
+	basis := &deltaBasis{files: files}
+	id := signatures.ConnectionID
+	basis.expiry = time.AfterFunc(transferKeyRetention, func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if m.bases[id] == basis {
+			delete(m.bases, id)
+		}
+	})
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if previous := m.bases[id]; previous != nil {
+		previous.expiry.Stop()
+	}
+	m.bases[id] = basis
+}
+
+// deltaBasis returns the destination's block signatures for a delta transfer
+func (m *TransferManager) deltaBasis(connectionID string) (service.DeltaBasis, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	basis := m.bases[connectionID]
+	if basis == nil {
+		return nil, fmt.Errorf("no block signatures for delta transfer %s", connectionID)
+	}
+	return basis.files, nil
+}
+
+// dropBasis forgets the block signatures of a transfer
+func (m *TransferManager) dropBasis(connectionID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if basis := m.bases[connectionID]; basis != nil {
+		basis.expiry.Stop()
+		delete(m.bases, connectionID)
+	}
+}
@@ -2,12 +2,19 @@ package transfer
 
 import (
 	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 
 	"github.com/The-Promised-Neverland/agent/internal/config"
+	"github.com/The-Promised-Neverland/agent/internal/models"
+	"github.com/The-Promised-Neverland/agent/internal/service"
 	"github.com/The-Promised-Neverland/agent/pkg/logger"
 )
 
@@ -21,12 +28,22 @@ func NewTarExtractor(cfg *config.Config) *TarExtractor {
 	}
 }
 
-func (e *TarExtractor) ExtractTar(tarPath string, sourceAgentID string) error {
+// ExtractTar unpacks a received tar into transfers/<sourceAgentID>, or into target, a folder of
+// the shared folder, for a sync pull. Each file is written to a .part file first and only
+// renamed into place, with the source's modification time, once its size and SHA-256 match the
+// manifest. A delta entry is rebuilt from the file already in place.
+func (e *TarExtractor) ExtractTar(tarPath string, sourceAgentID string, target string, manifest *models.TransferManifest) error {
 	sharedPath, err := e.config.SharedFolderPath()
 	if err != nil {
 		return fmt.Errorf("failed to get shared folder path: %w", err)
 	}
 	extractPath := filepath.Join(sharedPath, "transfers", sourceAgentID)
+	if target != "" {
+		if !filepath.IsLocal(filepath.FromSlash(target)) {
+			return fmt.Errorf("sync target %q is outside the shared folder", target)
+		}
+		extractPath = filepath.Join(sharedPath, filepath.FromSlash(target))
+	}
 	if err := os.MkdirAll(extractPath, 0755); err != nil {
 		return fmt.Errorf("failed to create extract directory: %w", err)
 	}
@@ -35,6 +52,11 @@ func (e *TarExtractor) ExtractTar(tarPath string, sourceAgentID string) error {
 		return fmt.Errorf("failed to open tar file: %w", err)
 	}
 	defer tarFile.Close()
+	expected := make(map[string]models.ManifestFile, len(manifest.Files))
+	for _, f := range manifest.Files {
+		expected[f.Path] = f
+	}
+	var corrupt []string
 	tarReader := tar.NewReader(tarFile)
 	for {
 		header, err := tarReader.Next()
@@ -78,25 +100,82 @@ func (e *TarExtractor) ExtractTar(tarPath string, sourceAgentID string) error {
 			if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
 				return fmt.Errorf("failed to create parent directory: %w", err)
 			}
-			outFile, err := os.OpenFile(targetPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.FileMode(header.Mode))
+			want, listed := expected[header.Name]
+			delete(expected, header.Name)
+			partPath := targetPath + ".part"
+			outFile, err := os.OpenFile(partPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.FileMode(header.Mode))
 			if err != nil {
 				return fmt.Errorf("failed to create file: %w", err)
 			}
-			if _, err := io.Copy(outFile, tarReader); err != nil {
+			sum := sha256.New()
+			var written int64
+			if blockSize, isDelta := header.PAXRecords[service.DeltaBlockSizeRecord]; isDelta {
+				written, err = applyDelta(io.MultiWriter(outFile, sum), tarReader, targetPath, blockSize)
+				if errors.Is(err, service.ErrBadDelta) || errors.Is(err, os.ErrNotExist) {
+					logger.Log.Error("Cannot rebuild file from its delta, discarding it", "path", header.Name, "err", err)
+					outFile.Close()
+					os.Remove(partPath)
+					corrupt = append(corrupt, header.Name)
+					continue
+				}
+			} else {
+				written, err = io.Copy(io.MultiWriter(outFile, sum), tarReader)
+			}
+			if err != nil {
 				outFile.Close()
+				os.Remove(partPath)
 				return fmt.Errorf("failed to write file: %w", err)
 			}
 			outFile.Close()
+			if got := hex.EncodeToString(sum.Sum(nil)); !listed || written != want.Size || got != want.SHA256 {
+				logger.Log.Error("Extracted file does not match the manifest, discarding it", "path", header.Name, "listed", listed, "size", written, "sha256", got, "expected", want.SHA256)
+				os.Remove(partPath)
+				corrupt = append(corrupt, header.Name)
+				continue
+			}
+			if err := os.Chtimes(partPath, header.ModTime, header.ModTime); err != nil {
+				logger.Log.Warn("Failed to set modification time of extracted file", "path", header.Name, "err", err)
+			}
+			if err := os.Rename(partPath, targetPath); err != nil {
+				os.Remove(partPath)
+				return fmt.Errorf("failed to move verified file into place: %w", err)
+			}
 			logger.Log.Debug("Extracted file", "path", targetPath, "size", header.Size)
 		default:
 			logger.Log.Warn("Unsupported tar entry type", "type", header.Typeflag, "name", header.Name)
 		}
 	}
+	for name := range expected {
+		logger.Log.Error("File listed in the manifest is missing from the transfer", "path", name)
+		corrupt = append(corrupt, name)
+	}
+	if len(corrupt) > 0 {
+		sort.Strings(corrupt)
+		return &IntegrityError{Paths: corrupt}
+	}
 	logger.Log.Info("Successfully extracted tar to shared folder",
 		"sourceAgent", sourceAgentID,
 		"extractPath", extractPath)
 	return nil
 }
 
+// applyDelta rebuilds a delta entry into w from the file at basisPath
+func applyDelta(w io.Writer, delta io.Reader, basisPath string, blockSize string) (int64, error) {
+	size, err := strconv.ParseInt(blockSize, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: block size %q", service.ErrBadDelta, blockSize)
+	}
+	basis, err := os.Open(basisPath)
+	if err != nil {
+		return 0, err
+	}
+	defer basis.Close()
+	info, err := basis.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return service.ApplyDelta(w, delta, basis, info.Size(), size)
+}
+
 
 
@@ -0,0 +1,55 @@
+package transfer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Relayed chunks travel as binary WebSocket messages, each framed as
+//
+//	version (1) | stream ID length (1) | stream ID | sequence (8, big endian) | payload
+//
+// The stream ID is the connection ID of the transfer and the sequence counts its chunks
+// from 0. The master routes frames by stream ID and forwards them unchanged.
+const frameVersion = 1
+
+var errBadFrame = errors.New("malformed relay frame")
+
+type frame struct {
+	streamID string
+	seq      uint64
+	payload  []byte
+}
+
+func encodeFrame(streamID string, seq uint64, payload []byte) ([]byte, error) {
+	if streamID == "" || len(streamID) > 255 {
+		return nil, fmt.Errorf("%w: stream ID length %d", errBadFrame, len(streamID))
+	}
+	data := make([]byte, 2+len(streamID)+8+len(payload))
+	data[0] = frameVersion
+	data[1] = byte(len(streamID))
+	n := 2 + copy(data[2:], streamID)
+	binary.BigEndian.PutUint64(data[n:], seq)
+	copy(data[n+8:], payload)
+	return data, nil
+}
+
+// decodeFrame parses a binary message. The payload aliases data.
+func decodeFrame(data []byte) (frame, error) {
+	if len(data) < 2 {
+		return frame{}, fmt.Errorf("%w: %d bytes", errBadFrame, len(data))
+	}
+	if data[0] != frameVersion {
+		return frame{}, fmt.Errorf("%w: version %d", errBadFrame, data[0])
+	}
+	idLen := int(data[1])
+	if idLen == 0 || len(data) < 2+idLen+8 {
+		return frame{}, fmt.Errorf("%w: truncated header", errBadFrame)
+	}
+	return frame{
+		streamID: string(data[2 : 2+idLen]),
+		seq:      binary.BigEndian.Uint64(data[2+idLen:]),
+		payload:  data[2+idLen+8:],
+	}, nil
+}
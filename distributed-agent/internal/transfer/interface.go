@@ -1,7 +1,15 @@
 package transfer
 
 import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"io"
 	"os"
+
+	"github.com/The-Promised-Neverland/agent/internal/models"
+	"github.com/The-Promised-Neverland/agent/internal/service"
+	"github.com/The-Promised-Neverland/agent/pkg/logger"
 )
 
 type TransferMode string
@@ -10,6 +18,22 @@ const (
 	ModeRelay TransferMode = "relay"
 )
 
+// StreamSettings are what the master negotiated for a transfer's stream
+type StreamSettings struct {
+	Codec      string
+	Encryption string
+	Delta      bool // the source sends changed blocks of files the destination has, see delta.go
+	Files      []string // a sync pull sends only these files under its path
+	Target     string   // a sync pull extracts into this folder of the shared folder, not transfers/<source>
+}
+
+// ResumePoint is where in the tar stream a resumed send starts. Entry, when set, names the
+// tar entry the destination was in the middle of and must match the source's.
+type ResumePoint struct {
+	Offset int64
+	Entry  string
+}
+
 type TransferContext struct {
 	SourceAgentID    string
 	RequestingAgentID string
@@ -19,19 +43,73 @@ type TransferContext struct {
 	ConnectionID     string
 	ChunkCount       int
 	TotalBytes       int64
+	codec            string         // negotiated by the master, see codec.go
+	keys             *transferKeys  // set for encrypted transfers, see crypto.go
+	basis            service.DeltaBasis // source side of a delta transfer: the destination's block signatures
+	files            []string       // source side of a sync pull: the files it sends
+	target           string         // destination side of a sync pull: where it extracts
+	resume           ResumePoint    // source side: where the stream starts
+	signingKey       ed25519.PrivateKey // source side: signs the manifest
+	nextSeq          uint64         // relay destination: sequence of the next chunk in this attempt
+	lost             error // set once a relayed chunk goes missing; the receive cannot complete
+	progress         *progressMeter // destination side, while receiving
+	stream           *receiveStream // relay destination: turns this attempt's stream back into tar bytes
+	credit           *creditWindow  // relay source side: chunks the destination has room for
+}
+
+// discardTempFile closes and deletes the temp tar of a receive that will not complete
+func (c *TransferContext) discardTempFile() {
+	c.progress.stop()
+	c.progress = nil
+	c.closeStream()
+	if c.TempFile == nil {
+		return
+	}
+	c.TempFile.Close()
+	if err := os.Remove(c.TempFilePath); err != nil {
+		logger.Log.Warn("Failed to remove temp file", "path", c.TempFilePath, "err", err)
+	}
+	c.TempFile = nil
+	c.TempFilePath = ""
+	c.SourceAgentID = ""
+}
+
+// closeStream drops the receive stream of the current attempt with any partial record it holds
+func (c *TransferContext) closeStream() {
+	if c.stream != nil {
+		c.stream.close()
+		c.stream = nil
+	}
+}
+
+// written is how many tar bytes the temp file holds, which is where a resume continues
+func (c *TransferContext) written() (int64, error) {
+	if c.TempFile == nil {
+		return 0, fmt.Errorf("no temp file open")
+	}
+	return c.TempFile.Seek(0, io.SeekCurrent)
+}
+
+// adopt takes over the temp file of an interrupted receive so a resumed attempt appends to it
+func (c *TransferContext) adopt(from *TransferContext) {
+	c.TempFile, c.TempFilePath, c.SourceAgentID = from.TempFile, from.TempFilePath, from.SourceAgentID
+	c.ChunkCount, c.TotalBytes = from.ChunkCount, from.TotalBytes
+	from.TempFile, from.TempFilePath, from.SourceAgentID = nil, "", ""
 }
 
+// Transferer moves one transfer in a given mode. Send and Receive return early with
+// ctx's error once the transfer is cancelled.
 type Transferer interface {
-	Send(path string, requestingAgentID string) error
-	Receive(sourceAgentID string) error
-	WriteChunk(chunk []byte) error
-	Complete() error
+	Send(ctx context.Context, path string, requestingAgentID string) error
+	Receive(ctx context.Context, sourceAgentID string) error
+	WriteChunk(seq uint64, chunk []byte) error
+	Complete(manifest *models.TransferManifest) error
 	GetMode() TransferMode
 }
 
 
 type Extractor interface {
-	ExtractTar(tarPath string, sourceAgentID string) error
+	ExtractTar(tarPath string, sourceAgentID string, target string, manifest *models.TransferManifest) error
 }
 
 
@@ -0,0 +1,96 @@
+package transfer
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/The-Promised-Neverland/agent/internal/models"
+)
+
+// ErrBadManifest means the manifest of a completed transfer is missing or its signature does not hold
+var ErrBadManifest = errors.New("transfer manifest rejected")
+
+// IntegrityError lists the files of a transfer that were missing or did not match the manifest.
+// They are not left in the transfers folder.
+type IntegrityError struct {
+	Paths []string
+}
+
+func (e *IntegrityError) Error() string {
+	return fmt.Sprintf("%d file(s) failed verification: %s", len(e.Paths), strings.Join(e.Paths, ", "))
+}
+
+// manifestBuilder collects per-file SHA-256 sums as the source tars a transfer
+type manifestBuilder struct {
+	mu    sync.Mutex
+	files []models.ManifestFile
+}
+
+func (b *manifestBuilder) add(name string, size int64, sum []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.files = append(b.files, models.ManifestFile{
+		Path:   name,
+		Size:   size,
+		SHA256: hex.EncodeToString(sum),
+	})
+}
+
+// signed returns the manifest of a transfer signed with the source's key
+func (b *manifestBuilder) signed(connectionID string, key ed25519.PrivateKey) (*models.TransferManifest, error) {
+	if key == nil {
+		return nil, fmt.Errorf("no signing key")
+	}
+	b.mu.Lock()
+	manifest := &models.TransferManifest{
+		ConnectionID: connectionID,
+		Files:        append([]models.ManifestFile{}, b.files...),
+	}
+	b.mu.Unlock()
+	data, err := manifestSigningBytes(manifest)
+	if err != nil {
+		return nil, err
+	}
+	manifest.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, data))
+	return manifest, nil
+}
+
+// manifestSigningBytes is what the signature covers: the manifest's JSON without the signature
+func manifestSigningBytes(manifest *models.TransferManifest) ([]byte, error) {
+	unsigned := *manifest
+	unsigned.Signature = ""
+	return json.Marshal(unsigned)
+}
+
+// verifyManifest checks that manifest belongs to the transfer and was signed with publicKey,
+// the key the source announced to the master
+func verifyManifest(manifest *models.TransferManifest, connectionID, publicKey string) error {
+	if manifest == nil {
+		return fmt.Errorf("%w: none sent with the completed status", ErrBadManifest)
+	}
+	if manifest.ConnectionID != connectionID {
+		return fmt.Errorf("%w: it is for transfer %s", ErrBadManifest, manifest.ConnectionID)
+	}
+	key, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return fmt.Errorf("%w: source has no valid signing key", ErrBadManifest)
+	}
+	signature, err := base64.StdEncoding.DecodeString(manifest.Signature)
+	if err != nil {
+		return fmt.Errorf("%w: malformed signature", ErrBadManifest)
+	}
+	data, err := manifestSigningBytes(manifest)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(ed25519.PublicKey(key), data, signature) {
+		return fmt.Errorf("%w: bad signature", ErrBadManifest)
+	}
+	return nil
+}
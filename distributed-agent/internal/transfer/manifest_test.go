@@ -0,0 +1,98 @@
+package transfer
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"testing"
+
+	"github.com/The-Promised-Neverland/agent/internal/models"
+)
+
+func newSigningKey(t *testing.T) (ed25519.PrivateKey, string) {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return private, base64.StdEncoding.EncodeToString(public)
+}
+
+func TestVerifyManifest(t *testing.T) {
+	key, publicKey := newSigningKey(t)
+	otherKey, otherPublicKey := newSigningKey(t)
+	sign := func(key ed25519.PrivateKey, connectionID string) *models.TransferManifest {
+		var b manifestBuilder
+		b.add("dir/a.txt", 3, []byte{0xaa})
+		b.add("b.bin", 1<<20, []byte{0xbb})
+		manifest, err := b.signed(connectionID, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return manifest
+	}
+
+	tests := []struct {
+		name      string
+		manifest  func() *models.TransferManifest
+		publicKey string
+		wantErr   bool
+	}{
+		{"valid", func() *models.TransferManifest { return sign(key, "c1") }, publicKey, false},
+		{"signed with the wrong key", func() *models.TransferManifest { return sign(otherKey, "c1") }, publicKey, true},
+		{"checked against the wrong key", func() *models.TransferManifest { return sign(key, "c1") }, otherPublicKey, true},
+		{"for another transfer", func() *models.TransferManifest { return sign(key, "c2") }, publicKey, true},
+		{"transfer ID changed after signing", func() *models.TransferManifest {
+			m := sign(key, "c2")
+			m.ConnectionID = "c1"
+			return m
+		}, publicKey, true},
+		{"tampered hash", func() *models.TransferManifest {
+			m := sign(key, "c1")
+			m.Files[0].SHA256 = "00"
+			return m
+		}, publicKey, true},
+		{"file added", func() *models.TransferManifest {
+			m := sign(key, "c1")
+			m.Files = append(m.Files, models.ManifestFile{Path: "extra", SHA256: "00"})
+			return m
+		}, publicKey, true},
+		{"file removed", func() *models.TransferManifest {
+			m := sign(key, "c1")
+			m.Files = m.Files[:1]
+			return m
+		}, publicKey, true},
+		{"malformed signature", func() *models.TransferManifest {
+			m := sign(key, "c1")
+			m.Signature = "not base64!"
+			return m
+		}, publicKey, true},
+		{"unsigned", func() *models.TransferManifest {
+			m := sign(key, "c1")
+			m.Signature = ""
+			return m
+		}, publicKey, true},
+		{"missing", func() *models.TransferManifest { return nil }, publicKey, true},
+		{"source without signing key", func() *models.TransferManifest { return sign(key, "c1") }, "", true},
+		{"source key of the wrong size", func() *models.TransferManifest { return sign(key, "c1") }, base64.StdEncoding.EncodeToString([]byte("short")), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyManifest(tt.manifest(), "c1", tt.publicKey)
+			if tt.wantErr && !errors.Is(err, ErrBadManifest) {
+				t.Fatalf("verifyManifest error = %v, want %v", err, ErrBadManifest)
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatalf("verifyManifest error = %v", err)
+			}
+		})
+	}
+}
+
+func TestSignedManifestNeedsKey(t *testing.T) {
+	var b manifestBuilder
+	if _, err := b.signed("c1", nil); err == nil {
+		t.Fatal("manifest signed without a key")
+	}
+}
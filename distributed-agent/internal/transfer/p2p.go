@@ -1,6 +1,7 @@
 package transfer
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net"
@@ -279,7 +280,7 @@ func (p *P2PTransfer) GetMode() TransferMode {
 	return ModeP2P
 }
 
-func (p *P2PTransfer) Send(path string, requestingAgentID string) error {
+func (p *P2PTransfer) Send(ctx context.Context, path string, requestingAgentID string) error {
 	logger.Log.Info("[P2P] Starting P2P transfer", "path", path, "target", requestingAgentID)
 	p2pConn := p.p2pClient.GetActiveConnectionByTarget(requestingAgentID)
 	if p2pConn == nil || p2pConn.Status != "connected" {
@@ -291,17 +292,44 @@ func (p *P2PTransfer) Send(path string, requestingAgentID string) error {
 		return fmt.Errorf("P2P connection not available: status=%v", status)
 	}
 	logger.Log.Info("[P2P] P2P connection available, starting file transfer", "connection_id", p2pConn.ConnectionID, "target", requestingAgentID, "path", path)
-	dataCh, errCh := p.businessService.StreamRequestedFileSystem(path)
-	reader := &channelReader{dataCh: dataCh, errCh: errCh}
+	expectedBytes, err := p.businessService.TransferSize(path, p.ctx.files)
+	if err != nil {
+		logger.Log.Warn("[P2P] Could not size transfer up front", "path", path, "err", err)
+	}
+	resume := p.ctx.resume
+	if resume.Offset > 0 {
+		logger.Log.Info("[P2P] Resuming P2P transfer", "connection_id", p2pConn.ConnectionID, "offset", resume.Offset, "entry", resume.Entry)
+	}
+	stream, err := newSendStream(p.ctx)
+	if err != nil {
+		return err
+	}
+	defer stream.close()
+	manifest := &manifestBuilder{}
+	dataCh, errCh := p.businessService.StreamRequestedFileSystem(ctx, path, p.ctx.files, resume.Offset, resume.Entry, manifest.add, p.ctx.basis)
+	progress := startProgress(p2pConn.ConnectionID, models.TransferRoleSource, resume.Offset, expectedBytes, p.agent)
+	defer progress.stop()
+	reader := &channelReader{dataCh: dataCh, errCh: errCh, stream: stream, progress: progress}
 	if err := p.p2pClient.SendFileOverP2P(p2pConn.ConnectionID, reader); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		return fmt.Errorf("P2P send failed: %w", err)
 	}
-	logger.Log.Info("[P2P] P2P transfer completed successfully, reporting to master")
+	progress.stop()
+	signed, err := manifest.signed(p2pConn.ConnectionID, p.ctx.signingKey)
+	if err != nil {
+		return fmt.Errorf("failed to sign manifest: %w", err)
+	}
+	logger.Log.Info("[P2P] P2P transfer completed successfully, reporting to master", "files", len(signed.Files))
 	doneMsg := models.Message{
 		Type: models.MasterMsgTransferStatus,
 		Payload: map[string]interface{}{
-			"status":   "completed",
-			"agent_id": p.config.AgentID(),
+			"status":        "completed",
+			"agent_id":      p.config.AgentID(),
+			"connection_id": p2pConn.ConnectionID,
+			"total_bytes":   resume.Offset + reader.total,
+			"manifest":      signed,
 		},
 	}
 	p.agent.Send(ws.Outbound{Msg: &doneMsg})
@@ -309,10 +337,19 @@ func (p *P2PTransfer) Send(path string, requestingAgentID string) error {
 	return nil
 }
 
-func (p *P2PTransfer) Receive(sourceAgentID string) error {
+func (p *P2PTransfer) Receive(ctx context.Context, sourceAgentID string) error {
 	logger.Log.Info("[P2P] Preparing to receive P2P transfer", "sourceAgent", sourceAgentID)
-	if err := p.createTempFile(sourceAgentID); err != nil {
-		return fmt.Errorf("failed to create temp file: %w", err)
+	if p.ctx.TempFile == nil {
+		if err := p.createTempFile(sourceAgentID); err != nil {
+			return fmt.Errorf("failed to create temp file: %w", err)
+		}
+	}
+	from, err := p.ctx.written()
+	if err != nil {
+		return err
+	}
+	if from > 0 {
+		logger.Log.Info("[P2P] Resuming P2P receive", "sourceAgent", sourceAgentID, "offset", from, "tempFile", p.ctx.TempFilePath)
 	}
 	time.Sleep(1 * time.Second) // give some time for file creation. OS delay expected
 	p2pConn := p.p2pClient.GetActiveConnectionByTarget(sourceAgentID)
@@ -321,26 +358,36 @@ func (p *P2PTransfer) Receive(sourceAgentID string) error {
 		return fmt.Errorf("P2P connection not available for receiving")
 	}
 	logger.Log.Info("[P2P] P2P connection ready, starting to receive file", "connection_id", p2pConn.ConnectionID, "sourceAgent", sourceAgentID)
-	if err := p.p2pClient.ReceiveFileOverP2P(p2pConn.ConnectionID, p.ctx.TempFile); err != nil {
+	progress := startProgress(p2pConn.ConnectionID, models.TransferRoleDestination, from, 0, p.agent)
+	defer progress.stop()
+	stream, err := newReceiveStream(p.ctx, io.MultiWriter(p.ctx.TempFile, progress))
+	if err != nil {
+		return err
+	}
+	defer stream.close()
+	if err := p.p2pClient.ReceiveFileOverP2P(p2pConn.ConnectionID, stream); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("P2P receive failed: %w", err)
+	}
+	if err := stream.finish(); err != nil {
 		return fmt.Errorf("P2P receive failed: %w", err)
 	}
 	logger.Log.Info("P2P file received successfully, waiting for master to send completed status")
 	return nil
 }
 
-func (p *P2PTransfer) WriteChunk(chunk []byte) error {
+func (p *P2PTransfer) WriteChunk(seq uint64, chunk []byte) error {
 	return fmt.Errorf("WriteChunk not supported in P2P mode. Data is sent over TCP directly to reciever")
 }
 
-func (p *P2PTransfer) Complete() error {
-	return p.completeTransfer()
+func (p *P2PTransfer) Complete(manifest *models.TransferManifest) error {
+	return p.completeTransfer(manifest)
 }
 
 func (p *P2PTransfer) createTempFile(sourceAgentID string) error {
-	if p.ctx.TempFile != nil {
-		p.ctx.TempFile.Close()
-		os.Remove(p.ctx.TempFilePath)
-	}
+	p.ctx.discardTempFile()
 	tempDir := os.TempDir()
 	tempFile, err := os.CreateTemp(tempDir, "transfer_*.tar")
 	if err != nil {
@@ -353,7 +400,7 @@ func (p *P2PTransfer) createTempFile(sourceAgentID string) error {
 	return nil
 }
 
-func (p *P2PTransfer) completeTransfer() error {
+func (p *P2PTransfer) completeTransfer(manifest *models.TransferManifest) error {
 	if p.ctx.TempFile == nil {
 		return fmt.Errorf("no active transfer to complete")
 	}
@@ -365,7 +412,7 @@ func (p *P2PTransfer) completeTransfer() error {
 	p.ctx.TempFile = nil
 	p.ctx.TempFilePath = ""
 	p.ctx.SourceAgentID = ""
-	if err := p.extractor.ExtractTar(tempPath, sourceAgent); err != nil {
+	if err := p.extractor.ExtractTar(tempPath, sourceAgent, p.ctx.target, manifest); err != nil {
 		os.Remove(tempPath)
 		return fmt.Errorf("failed to extract tar: %w", err)
 	}
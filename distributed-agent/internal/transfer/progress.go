@@ -0,0 +1,112 @@
+package transfer
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/The-Promised-Neverland/agent/internal/models"
+	"github.com/The-Promised-Neverland/agent/internal/ws"
+	"github.com/The-Promised-Neverland/agent/pkg/logger"
+)
+
+const progressInterval = time.Second
+
+// progressMeter counts one side of a transfer and reports it to the master every
+// progressInterval until stopped. A nil meter counts nothing.
+type progressMeter struct {
+	connectionID string
+	role         string
+	total        int64
+	from         int64 // bytes already there when a resumed transfer started
+	start        time.Time
+	bytes        atomic.Int64
+	chunks       atomic.Int64
+	agent        *ws.Agent
+	stopCh       chan struct{}
+	stopped      chan struct{}
+	stopOnce     sync.Once
+}
+
+// startProgress counts from from, the bytes a resumed transfer already moved
+func startProgress(connectionID, role string, from, total int64, agent *ws.Agent) *progressMeter {
+	p := &progressMeter{
+		connectionID: connectionID,
+		role:         role,
+		total:        total,
+		from:         from,
+		start:        time.Now(),
+		agent:        agent,
+		stopCh:       make(chan struct{}),
+		stopped:      make(chan struct{}),
+	}
+	p.bytes.Store(from)
+	go p.run()
+	return p
+}
+
+func (p *progressMeter) add(n int) {
+	if p == nil {
+		return
+	}
+	p.bytes.Add(int64(n))
+	p.chunks.Add(1)
+}
+
+// Write counts b as one chunk, so the meter can sit behind an io.MultiWriter
+func (p *progressMeter) Write(b []byte) (int, error) {
+	p.add(len(b))
+	return len(b), nil
+}
+
+// stop sends a last report with the average rate and waits for it to be queued
+func (p *progressMeter) stop() {
+	if p == nil {
+		return
+	}
+	p.stopOnce.Do(func() {
+		close(p.stopCh)
+	})
+	<-p.stopped
+}
+
+func (p *progressMeter) run() {
+	defer close(p.stopped)
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	lastBytes, lastAt := p.from, p.start
+	for {
+		select {
+		case now := <-ticker.C:
+			done := p.bytes.Load()
+			rate := float64(done-lastBytes) / now.Sub(lastAt).Seconds()
+			lastBytes, lastAt = done, now
+			p.send(done, rate)
+		case <-p.stopCh:
+			done := p.bytes.Load()
+			p.send(done, float64(done-p.from)/time.Since(p.start).Seconds())
+			return
+		}
+	}
+}
+
+func (p *progressMeter) send(done int64, rate float64) {
+	progress := models.TransferProgress{
+		ConnectionID: p.connectionID,
+		Role:         p.role,
+		BytesDone:    done,
+		TotalBytes:   p.total,
+		Chunks:       p.chunks.Load(),
+		Rate:         rate,
+	}
+	if rate > 0 && p.total > done {
+		progress.ETASeconds = float64(p.total-done) / rate
+	}
+	msg := models.Message{
+		Type:    models.AgentMsgTransferProgress,
+		Payload: progress,
+	}
+	if err := p.agent.Send(ws.Outbound{Msg: &msg}); err != nil {
+		logger.Log.Warn("[TRANSFER] Failed to report progress", "connection_id", p.connectionID, "err", err)
+	}
+}
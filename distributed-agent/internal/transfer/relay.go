@@ -1,9 +1,11 @@
 package transfer
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
-	"time"
 
 	"github.com/The-Promised-Neverland/agent/internal/config"
 	"github.com/The-Promised-Neverland/agent/internal/models"
@@ -34,49 +36,79 @@ func (r *RelayTransfer) GetMode() TransferMode {
 	return ModeRelay
 }
 
-func (r *RelayTransfer) Send(path string, requestingAgentID string) error {
+func (r *RelayTransfer) Send(ctx context.Context, path string, requestingAgentID string) error {
 	logger.Log.Info("[RELAY] Starting relay mode transfer", "path", path, "target", requestingAgentID)
-	dataCh, errCh := r.businessService.StreamRequestedFileSystem(path)
+	connectionID := r.ctx.ConnectionID
+	if connectionID == "" {
+		return fmt.Errorf("relay transfer needs a connection ID to frame its chunks")
+	}
+	expectedBytes, err := r.businessService.TransferSize(path, r.ctx.files)
+	if err != nil {
+		logger.Log.Warn("[RELAY] Could not size transfer up front", "path", path, "err", err)
+	}
+	resume := r.ctx.resume
+	if resume.Offset > 0 {
+		logger.Log.Info("[RELAY] Resuming relay transfer", "connection_id", connectionID, "offset", resume.Offset, "entry", resume.Entry)
+	}
+	manifest := &manifestBuilder{}
+	dataCh, errCh := r.businessService.StreamRequestedFileSystem(ctx, path, r.ctx.files, resume.Offset, resume.Entry, manifest.add, r.ctx.basis)
 	starterMsg := models.Message{
 		Type: models.MasterMsgTransferStatus,
 		Payload: map[string]interface{}{
-			"status":   "initiated",
-			"agent_id": r.config.AgentID(),
+			"status":        "initiated",
+			"agent_id":      r.config.AgentID(),
+			"connection_id": connectionID,
+			"total_bytes":   expectedBytes,
 		},
 	}
-	r.agent.Send(ws.Outbound{Msg: &starterMsg})
-	logger.Log.Info("[RELAY] Sent 'initiated' status to master, starting to send binary chunks via relay")
-	ticker := time.NewTicker(2 * time.Second)
-	done := make(chan struct{})
-	defer ticker.Stop()
-	go func() {
-		for {
-			select {
-			case <-done:
-				return
-			case <-ticker.C:
-				statusMsg := models.Message{
-					Type: models.MasterMsgTransferStatus,
-					Payload: map[string]interface{}{
-						"status":   "running",
-						"agent_id": r.config.AgentID(),
-					},
-				}
-				r.agent.Send(ws.Outbound{Msg: &statusMsg})
-			}
-		}
-	}()
+	if err := r.agent.SendWait(ctx, ws.Outbound{Msg: &starterMsg}); err != nil {
+		return err
+	}
+	logger.Log.Info("[RELAY] Sent 'initiated' status to master, starting to send binary chunks via relay", "expected_bytes", expectedBytes)
+	stream, err := newSendStream(r.ctx)
+	if err != nil {
+		return err
+	}
+	defer stream.close()
+	progress := startProgress(connectionID, models.TransferRoleSource, resume.Offset, expectedBytes, r.agent)
+	defer progress.stop()
 	totalBytes := 0
+	wireBytes := 0
 	chunkCount := 0
-	for chunk := range dataCh {
-		totalBytes += len(chunk)
+	send := func(encoded []byte) error {
+		if len(encoded) == 0 {
+			return nil
+		}
+		data, err := encodeFrame(connectionID, uint64(chunkCount), encoded)
+		if err != nil {
+			return err
+		}
+		if err := r.ctx.credit.wait(ctx, uint64(chunkCount)); err != nil {
+			return err
+		}
+		wireBytes += len(encoded)
 		chunkCount++
 		if chunkCount%100 == 0 || chunkCount == 1 {
-			logger.Log.Info("[RELAY] Sending binary chunks via relay", "chunk_number", chunkCount, "chunk_bytes", len(chunk), "total_bytes", totalBytes)
+			logger.Log.Info("[RELAY] Sending binary chunks via relay", "chunk_number", chunkCount, "chunk_bytes", len(encoded), "total_bytes", totalBytes, "wire_bytes", wireBytes)
+		}
+		return r.agent.SendWait(ctx, ws.Outbound{Binary: data})
+	}
+	for chunk := range dataCh {
+		encoded, err := stream.write(chunk)
+		if err != nil {
+			return err
+		}
+		totalBytes += len(chunk.Data)
+		if err := send(encoded); err != nil {
+			return err
 		}
-		r.agent.Send(ws.Outbound{Binary: chunk})
+		progress.add(len(chunk.Data))
+	}
+	progress.stop()
+	if err := ctx.Err(); err != nil {
+		logger.Log.Info("[RELAY] Relay transfer cancelled", "connection_id", connectionID, "total_chunks", chunkCount, "total_bytes", totalBytes)
+		return err
 	}
-	close(done)
 	select {
 	case err := <-errCh:
 		if err != nil {
@@ -85,40 +117,87 @@ func (r *RelayTransfer) Send(path string, requestingAgentID string) error {
 		}
 	default:
 	}
-	logger.Log.Info("[RELAY] All binary chunks sent via relay", "total_chunks", chunkCount, "total_bytes", totalBytes)
+	// Only a stream that ended cleanly gets its last record
+	if err := send(stream.final()); err != nil {
+		return err
+	}
+	logger.Log.Info("[RELAY] All binary chunks sent via relay", "total_chunks", chunkCount, "total_bytes", totalBytes, "codec", r.ctx.codec, "encrypted", r.ctx.keys != nil, "wire_bytes", wireBytes)
+	signed, err := manifest.signed(connectionID, r.ctx.signingKey)
+	if err != nil {
+		return fmt.Errorf("failed to sign manifest: %w", err)
+	}
 	doneMsg := models.Message{
 		Type: models.MasterMsgTransferStatus,
 		Payload: map[string]interface{}{
-			"status":   "completed",
-			"agent_id": r.config.AgentID(),
+			"status":        "completed",
+			"agent_id":      r.config.AgentID(),
+			"connection_id": connectionID,
+			"total_bytes":   resume.Offset + int64(totalBytes),
+			"manifest":      signed,
 		},
 	}
-	r.agent.Send(ws.Outbound{Msg: &doneMsg})
+	if err := r.agent.SendWait(ctx, ws.Outbound{Msg: &doneMsg}); err != nil {
+		return err
+	}
 	logger.Log.Info("[RELAY] Sent 'completed' status to master", "total_bytes_sent", totalBytes)
 	return nil
 }
 
-func (r *RelayTransfer) Receive(sourceAgentID string) error {
+func (r *RelayTransfer) Receive(ctx context.Context, sourceAgentID string) error {
 	logger.Log.Info("[RELAY] Preparing to receive relay transfer", "sourceAgent", sourceAgentID)
-	if err := r.createTempFile(sourceAgentID); err != nil {
-		return fmt.Errorf("failed to create temp file: %w", err)
+	if r.ctx.TempFile == nil {
+		if err := r.createTempFile(sourceAgentID); err != nil {
+			return fmt.Errorf("failed to create temp file: %w", err)
+		}
 	}
+	from, err := r.ctx.written()
+	if err != nil {
+		return err
+	}
+	if from > 0 {
+		logger.Log.Info("[RELAY] Resuming relay receive", "sourceAgent", sourceAgentID, "offset", from, "tempFile", r.ctx.TempFilePath)
+	}
+	r.ctx.nextSeq = 0
+	r.ctx.lost = nil
+	r.ctx.progress = startProgress(r.ctx.ConnectionID, models.TransferRoleDestination, from, 0, r.agent)
+	r.ctx.closeStream()
+	if r.ctx.stream, err = newReceiveStream(r.ctx, io.MultiWriter(r.ctx.TempFile, r.ctx.progress)); err != nil {
+		return err
+	}
+	r.grant(relayWindow)
 	logger.Log.Info("[RELAY] Ready to receive binary chunks via relay", "sourceAgent", sourceAgentID)
 	return nil
 }
 
-func (r *RelayTransfer) WriteChunk(chunk []byte) error {
-	if r.ctx.TempFile == nil {
+func (r *RelayTransfer) WriteChunk(seq uint64, chunk []byte) error {
+	if r.ctx.TempFile == nil || r.ctx.stream == nil {
 		logger.Log.Warn("Received binary chunk but no temp file open, dropping chunk", "size", len(chunk), "source_agent", r.ctx.SourceAgentID)
 		return fmt.Errorf("no temp file open")
 	}
-	written, err := r.ctx.TempFile.Write(chunk)
+	if r.ctx.lost != nil {
+		return nil
+	}
+	if seq != r.ctx.nextSeq {
+		r.ctx.lost = fmt.Errorf("stream %s: expected chunk %d, got %d", r.ctx.ConnectionID, r.ctx.nextSeq, seq)
+		logger.Log.Error("[RELAY] Relayed chunk missing, transfer will not be extracted", "err", r.ctx.lost, "source_agent", r.ctx.SourceAgentID)
+		return r.ctx.lost
+	}
+	written, err := r.ctx.stream.Write(chunk)
+	if errors.Is(err, errBadStream) || errors.Is(err, errBadSeal) {
+		r.ctx.lost = fmt.Errorf("stream %s: %w", r.ctx.ConnectionID, err)
+		logger.Log.Error("[RELAY] Relayed chunk cannot be decoded, transfer will not be extracted", "err", err, "codec", r.ctx.codec, "source_agent", r.ctx.SourceAgentID)
+		return r.ctx.lost
+	}
 	if err != nil {
 		logger.Log.Error("[RELAY] Failed to write chunk to temp file", "err", err, "written", written, "chunk_size", len(chunk), "source_agent", r.ctx.SourceAgentID)
 		return fmt.Errorf("failed to write chunk: %w", err)
 	}
+	r.ctx.nextSeq++
 	r.ctx.ChunkCount++
 	r.ctx.TotalBytes += int64(written)
+	if r.ctx.nextSeq%relayGrantStep == 0 {
+		r.grant(r.ctx.nextSeq + relayWindow)
+	}
 	// Log every 100 chunks or first chunk
 	if r.ctx.ChunkCount%100 == 0 || r.ctx.ChunkCount == 1 {
 		logger.Log.Info("[RELAY] Receiving binary chunks via relay", "chunk_number", r.ctx.ChunkCount, "chunk_bytes", len(chunk), "total_bytes", r.ctx.TotalBytes, "source_agent", r.ctx.SourceAgentID)
@@ -126,15 +205,26 @@ func (r *RelayTransfer) WriteChunk(chunk []byte) error {
 	return nil
 }
 
-func (r *RelayTransfer) Complete() error {
-	return r.completeTransfer()
+// grant tells the source, through the master, how many chunks it may have sent in total
+func (r *RelayTransfer) grant(granted uint64) {
+	msg := models.Message{
+		Type: models.AgentMsgTransferCredit,
+		Payload: models.TransferCredit{
+			ConnectionID: r.ctx.ConnectionID,
+			Granted:      granted,
+		},
+	}
+	if err := r.agent.SendWait(context.Background(), ws.Outbound{Msg: &msg}); err != nil {
+		logger.Log.Warn("[RELAY] Failed to grant transfer credit", "connection_id", r.ctx.ConnectionID, "granted", granted, "err", err)
+	}
+}
+
+func (r *RelayTransfer) Complete(manifest *models.TransferManifest) error {
+	return r.completeTransfer(manifest)
 }
 
 func (r *RelayTransfer) createTempFile(sourceAgentID string) error {
-	if r.ctx.TempFile != nil {
-		r.ctx.TempFile.Close()
-		os.Remove(r.ctx.TempFilePath)
-	}
+	r.ctx.discardTempFile()
 	tempDir := os.TempDir()
 	tempFile, err := os.CreateTemp(tempDir, "transfer_*.tar")
 	if err != nil {
@@ -143,14 +233,29 @@ func (r *RelayTransfer) createTempFile(sourceAgentID string) error {
 	r.ctx.TempFile = tempFile
 	r.ctx.TempFilePath = tempFile.Name()
 	r.ctx.SourceAgentID = sourceAgentID
+	r.ctx.ChunkCount = 0
+	r.ctx.TotalBytes = 0
 	logger.Log.Info("Created temp file for relay transfer", "sourceAgent", sourceAgentID, "tempFile", r.ctx.TempFilePath)
 	return nil
 }
 
-func (r *RelayTransfer) completeTransfer() error {
+func (r *RelayTransfer) completeTransfer(manifest *models.TransferManifest) error {
 	if r.ctx.TempFile == nil {
 		return fmt.Errorf("no active transfer to complete")
 	}
+	if lost := r.ctx.lost; lost != nil {
+		r.ctx.discardTempFile()
+		return fmt.Errorf("incomplete relay transfer: %w", lost)
+	}
+	if r.ctx.stream != nil {
+		if err := r.ctx.stream.finish(); err != nil {
+			r.ctx.discardTempFile()
+			return fmt.Errorf("incomplete relay transfer: %w", err)
+		}
+	}
+	r.ctx.closeStream()
+	r.ctx.progress.stop()
+	r.ctx.progress = nil
 	if err := r.ctx.TempFile.Close(); err != nil {
 		logger.Log.Error("Failed to close temp file", "err", err)
 	}
@@ -159,7 +264,7 @@ func (r *RelayTransfer) completeTransfer() error {
 	r.ctx.TempFile = nil
 	r.ctx.TempFilePath = ""
 	r.ctx.SourceAgentID = ""
-	if err := r.extractor.ExtractTar(tempPath, sourceAgent); err != nil {
+	if err := r.extractor.ExtractTar(tempPath, sourceAgent, r.ctx.target, manifest); err != nil {
 		os.Remove(tempPath)
 		return fmt.Errorf("failed to extract tar: %w", err)
 	}
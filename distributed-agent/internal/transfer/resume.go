@@ -0,0 +1,156 @@
+package transfer
+
+import (
+	"archive/tar"
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"github.com/The-Promised-Neverland/agent/internal/models"
+	"github.com/The-Promised-Neverland/agent/internal/ws"
+	"github.com/The-Promised-Neverland/agent/pkg/logger"
+)
+
+// interruptedRetention is how long the temp tar of an interrupted receive waits for a resume
+const interruptedRetention = time.Hour
+
+// Interrupt sets a receive aside after its stream broke, keeping the temp tar so a later
+// Receive with a resume offset can append to it
+func (m *TransferManager) Interrupt(connectionID string) {
+	m.mu.Lock()
+	in := m.receives[connectionID]
+	m.mu.Unlock()
+	if in == nil {
+		return
+	}
+	if m.interrupt(connectionID, in) {
+		// A P2P receive may still be blocked reading the broken stream
+		m.CloseP2PConnection(connectionID)
+	}
+}
+
+// interrupt moves in from the active receives to the interrupted ones, if it is still active
+func (m *TransferManager) interrupt(connectionID string, in *receive) bool {
+	m.mu.Lock()
+	if m.receives[connectionID] != in {
+		m.mu.Unlock()
+		return false
+	}
+	delete(m.receives, connectionID)
+	if in.ctx.TempFile == nil {
+		m.mu.Unlock()
+		in.ctx.discardTempFile()
+		return false
+	}
+	m.interrupted[connectionID] = in
+	in.expiry = time.AfterFunc(interruptedRetention, func() {
+		m.expire(connectionID, in)
+	})
+	m.mu.Unlock()
+	in.ctx.progress.stop()
+	in.ctx.progress = nil
+	written, _ := in.ctx.written()
+	logger.Log.Info("[TRANSFER] Receive interrupted, keeping temp tar for a resume", "connection_id", connectionID, "bytes", written, "tempFile", in.ctx.TempFilePath)
+	return true
+}
+
+// expire deletes an interrupted receive nobody resumed
+func (m *TransferManager) expire(connectionID string, in *receive) {
+	m.mu.Lock()
+	if m.interrupted[connectionID] != in {
+		m.mu.Unlock()
+		return
+	}
+	delete(m.interrupted, connectionID)
+	m.mu.Unlock()
+	logger.Log.Info("[TRANSFER] Interrupted receive was not resumed, discarding it", "connection_id", connectionID, "after", interruptedRetention)
+	in.ctx.discardTempFile()
+}
+
+// RequestResume interrupts the receive of a transfer and asks the master to have its source
+// continue from the checkpoint. Without a temp tar the checkpoint is 0 and the transfer starts over.
+func (m *TransferManager) RequestResume(connectionID string) error {
+	m.Interrupt(connectionID)
+	m.mu.Lock()
+	in := m.interrupted[connectionID]
+	m.mu.Unlock()
+	checkpoint := models.TransferCheckpoint{ConnectionID: connectionID}
+	if in != nil {
+		offset, err := in.ctx.written()
+		if err == nil {
+			checkpoint.EntriesCompleted, checkpoint.Entry, err = scanCheckpoint(in.ctx.TempFilePath, offset)
+		}
+		if err != nil {
+			logger.Log.Warn("[TRANSFER] Could not read checkpoint, transfer will start over", "connection_id", connectionID, "err", err)
+			checkpoint.EntriesCompleted, checkpoint.Entry = 0, ""
+		} else {
+			checkpoint.Offset = offset
+		}
+	}
+	logger.Log.Info("[TRANSFER] Asking master to resume transfer", "connection_id", connectionID, "offset", checkpoint.Offset, "entries_completed", checkpoint.EntriesCompleted, "entry", checkpoint.Entry)
+	msg := models.Message{
+		Type:    models.AgentMsgTransferResume,
+		Payload: checkpoint,
+	}
+	return m.currentAgent().Send(ws.Outbound{Msg: &msg})
+}
+
+// ResumeInterrupted asks to resume every transfer this agent was receiving. It is called after
+// a reconnect, when the master has already failed them.
+func (m *TransferManager) ResumeInterrupted() {
+	m.mu.Lock()
+	ids := make([]string, 0, len(m.receives)+len(m.interrupted))
+	for id := range m.receives {
+		ids = append(ids, id)
+	}
+	for id := range m.interrupted {
+		if m.receives[id] == nil {
+			ids = append(ids, id)
+		}
+	}
+	m.mu.Unlock()
+	for _, id := range ids {
+		if err := m.RequestResume(id); err != nil {
+			logger.Log.Warn("[TRANSFER] Failed to request resume", "connection_id", id, "err", err)
+		}
+	}
+}
+
+// scanCheckpoint reads the first size bytes of a partial tar and reports how many entries
+// arrived whole and the name of the entry cut off at size, if its header arrived
+func scanCheckpoint(path string, size int64) (int, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	in := &countingReader{r: io.LimitReader(f, size)}
+	tr := tar.NewReader(in)
+	completed := 0
+	for {
+		header, err := tr.Next()
+		if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
+			return completed, "", nil
+		}
+		if err != nil {
+			return 0, "", err
+		}
+		// The reader has consumed exactly the header, so the content starts here
+		if in.n+header.Size > size {
+			return completed, header.Name, nil
+		}
+		completed++
+	}
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
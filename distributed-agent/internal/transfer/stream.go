@@ -0,0 +1,88 @@
+package transfer
+
+import (
+	"io"
+
+	"github.com/The-Promised-Neverland/agent/internal/service"
+)
+
+// sendStream turns the source's tar chunks into wire bytes: encoded with the transfer's codec,
+// then sealed if the transfer is encrypted
+type sendStream struct {
+	encoder *streamEncoder
+	sealer  *streamSealer // nil for plaintext transfers
+}
+
+func newSendStream(ctx *TransferContext) (*sendStream, error) {
+	encoder, err := newStreamEncoder(ctx.codec)
+	if err != nil {
+		return nil, err
+	}
+	s := &sendStream{encoder: encoder}
+	if ctx.keys != nil {
+		if s.sealer, err = newStreamSealer(ctx.keys, ctx.ConnectionID); err != nil {
+			encoder.close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// write returns the wire bytes for a chunk, possibly none while a record fills up
+func (s *sendStream) write(chunk service.Chunk) ([]byte, error) {
+	encoded, err := s.encoder.encode(chunk)
+	if err != nil || s.sealer == nil {
+		return encoded, err
+	}
+	return s.sealer.seal(encoded), nil
+}
+
+// final returns what ends the stream once every chunk was written
+func (s *sendStream) final() []byte {
+	if s.sealer == nil {
+		return nil
+	}
+	return s.sealer.final()
+}
+
+func (s *sendStream) close() {
+	s.encoder.close()
+}
+
+// receiveStream undoes a sendStream, writing tar bytes to w
+type receiveStream struct {
+	in      io.Writer
+	opener  *streamOpener // nil for plaintext transfers
+	decoder *streamDecoder
+}
+
+func newReceiveStream(ctx *TransferContext, w io.Writer) (*receiveStream, error) {
+	decoder, err := newStreamDecoder(ctx.codec, w)
+	if err != nil {
+		return nil, err
+	}
+	s := &receiveStream{in: decoder, decoder: decoder}
+	if ctx.keys != nil {
+		s.opener = newStreamOpener(ctx.keys, ctx.ConnectionID, decoder)
+		s.in = s.opener
+	}
+	return s, nil
+}
+
+func (s *receiveStream) Write(p []byte) (int, error) {
+	return s.in.Write(p)
+}
+
+// finish fails if the stream stopped short of its end
+func (s *receiveStream) finish() error {
+	if s.opener != nil {
+		if err := s.opener.finish(); err != nil {
+			return err
+		}
+	}
+	return s.decoder.finish()
+}
+
+func (s *receiveStream) close() {
+	s.decoder.close()
+}
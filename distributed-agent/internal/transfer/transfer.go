@@ -1,9 +1,13 @@
 package transfer
 
 import (
+	"context"
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/The-Promised-Neverland/agent/internal/config"
+	"github.com/The-Promised-Neverland/agent/internal/enrollment"
 	"github.com/The-Promised-Neverland/agent/internal/models"
 	"github.com/The-Promised-Neverland/agent/internal/service"
 	"github.com/The-Promised-Neverland/agent/internal/ws"
@@ -15,88 +19,306 @@ type TransferManager struct {
 	businessService *service.Service
 	agent           *ws.Agent
 	extractor       Extractor
-	currentTransfer Transferer
-	ctx             *TransferContext
+	receives        map[string]*receive      // incoming transfers by connection ID
+	interrupted     map[string]*receive      // receives kept for a resume, see Interrupt
+	credits         map[string]*creditWindow // outgoing relay transfers by connection ID
+	cancels         map[string]*call         // running Send and Receive calls, see cancelKey
+	keys            map[string]*transferKeys // key agreements of encrypted transfers, see keyID
+	bases           map[string]*deltaBasis   // destinations' block signatures for delta transfers this agent sends
+	mu              sync.Mutex
 }
 
-// NewTransferManager creates a new transfer manager and initializes P2P client
-func NewTransferManager(cfg *config.Config, businessService *service.Service, agent *ws.Agent) *TransferManager {
-	extractor := NewTarExtractor(cfg)
-	ctx := &TransferContext{
-		Mode: ModeRelay,
-	}
-	p2pClient := NewP2PClient(cfg.AgentID(), cfg, func(msg *models.Message) error {
-		return agent.Send(ws.Outbound{Msg: msg})
-	})
-	return &TransferManager{
+// receive is a transfer this agent is receiving. Relay frames are routed to it by stream ID.
+type receive struct {
+	transferer Transferer
+	ctx        *TransferContext
+	expiry     *time.Timer // set while interrupted
+}
+
+// call is a running Send or Receive that can be cancelled
+type call struct {
+	cancel context.CancelFunc
+}
+
+// NewTransferManager creates a new transfer manager and initializes P2P client. It outlives
+// WebSocket sessions so interrupted receives survive a reconnect; see SetAgent.
+func NewTransferManager(cfg *config.Config, businessService *service.Service) *TransferManager {
+	m := &TransferManager{
 		config:          cfg,
-		p2pClient:       p2pClient,
 		businessService: businessService,
-		agent:           agent,
-		extractor:       extractor,
-		ctx:             ctx,
+		extractor:       NewTarExtractor(cfg),
+		receives:        make(map[string]*receive),
+		interrupted:     make(map[string]*receive),
+		credits:         make(map[string]*creditWindow),
+		cancels:         make(map[string]*call),
+		keys:            make(map[string]*transferKeys),
+		bases:           make(map[string]*deltaBasis),
 	}
+	m.p2pClient = NewP2PClient(cfg.AgentID(), cfg, func(msg *models.Message) error {
+		return m.currentAgent().Send(ws.Outbound{Msg: msg})
+	})
+	return m
+}
+
+// SetAgent switches the manager to a new WebSocket session. Transfers started afterwards use it.
+func (m *TransferManager) SetAgent(agent *ws.Agent) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.agent = agent
+}
+
+func (m *TransferManager) currentAgent() *ws.Agent {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.agent
 }
 
-func (m *TransferManager) GetTransferer(mode string) (Transferer, error) {
+// newTransferer returns a transferer for one transfer, with a context of its own so
+// several transfers can run at once
+func (m *TransferManager) newTransferer(connectionID string, mode string) (Transferer, *TransferContext, error) {
 	transferMode := TransferMode(mode)
 	if transferMode == "" {
-		return nil, fmt.Errorf("transfer mode not specified - master must coordinate first")
+		return nil, nil, fmt.Errorf("transfer mode not specified - master must coordinate first")
 	}
-	m.ctx.Mode = transferMode
+	ctx := &TransferContext{
+		ConnectionID: connectionID,
+		Mode:         transferMode,
+	}
+	agent := m.currentAgent()
 	switch transferMode {
 	case ModeP2P:
 		if m.p2pClient == nil {
-			return nil, fmt.Errorf("P2P client not initialized")
+			return nil, nil, fmt.Errorf("P2P client not initialized")
 		}
-		m.currentTransfer = NewP2PTransfer(m.ctx, m.p2pClient, m.config, m.businessService, m.agent, m.extractor)
-		return m.currentTransfer, nil
+		return NewP2PTransfer(ctx, m.p2pClient, m.config, m.businessService, agent, m.extractor), ctx, nil
 	case ModeRelay:
-		m.currentTransfer = NewRelayTransfer(m.ctx, m.config, m.businessService, m.agent, m.extractor)
-		return m.currentTransfer, nil
+		return NewRelayTransfer(ctx, m.config, m.businessService, agent, m.extractor), ctx, nil
 	// Add more modes. TURN etc
 	default:
-		return nil, fmt.Errorf("unknown transfer mode: %s", mode)
+		return nil, nil, fmt.Errorf("unknown transfer mode: %s", mode)
 	}
 }
 
-func (m *TransferManager) Send(path string, requestingAgentID string, mode string) error {
-	transferer, err := m.GetTransferer(mode)
+// Send streams path to the requesting agent from resume on. It blocks until the transfer ends
+// or is cancelled. A second Send for the same connection ID replaces the first.
+func (m *TransferManager) Send(connectionID string, path string, requestingAgentID string, mode string, stream StreamSettings, resume ResumePoint) error {
+	transferer, transferCtx, err := m.newTransferer(connectionID, mode)
 	if err != nil {
 		return fmt.Errorf("failed to get transferer: %w", err)
 	}
-	return transferer.Send(path, requestingAgentID)
+	if err := m.applyStreamSettings(transferCtx, stream, models.TransferRoleSource); err != nil {
+		return err
+	}
+	transferCtx.resume = resume
+	if transferCtx.signingKey, err = enrollment.EnsureSigningKey(m.config.CredentialPath()); err != nil {
+		return fmt.Errorf("cannot sign the transfer manifest: %w", err)
+	}
+	if transferCtx.Mode == ModeRelay {
+		transferCtx.credit = newCreditWindow()
+		m.mu.Lock()
+		m.credits[connectionID] = transferCtx.credit
+		m.mu.Unlock()
+		defer func() {
+			m.mu.Lock()
+			if m.credits[connectionID] == transferCtx.credit {
+				delete(m.credits, connectionID)
+			}
+			m.mu.Unlock()
+		}()
+	}
+	ctx, done := m.track(cancelKey("send", connectionID))
+	defer done()
+	return transferer.Send(ctx, path, requestingAgentID)
 }
 
-func (m *TransferManager) Receive(sourceAgentID string, mode string) error {
-	transferer, err := m.GetTransferer(mode)
+// Receive prepares the temp tar for an incoming transfer. In P2P mode it also blocks while reading.
+// With a resumeOffset it appends to the temp tar of the earlier attempt, which must hold exactly
+// that many bytes; otherwise a second Receive for the same connection ID starts the transfer over.
+func (m *TransferManager) Receive(connectionID string, sourceAgentID string, mode string, stream StreamSettings, resumeOffset int64) error {
+	transferer, transferCtx, err := m.newTransferer(connectionID, mode)
 	if err != nil {
 		return fmt.Errorf("failed to get transferer: %w", err)
 	}
+	if err := m.applyStreamSettings(transferCtx, stream, models.TransferRoleDestination); err != nil {
+		return err
+	}
+	in := &receive{transferer: transferer, ctx: transferCtx}
+	m.mu.Lock()
+	previous := m.receives[connectionID]
+	if previous == nil {
+		previous = m.interrupted[connectionID]
+	}
+	delete(m.interrupted, connectionID)
+	m.receives[connectionID] = in
+	m.mu.Unlock()
+	if previous != nil && previous.expiry != nil {
+		previous.expiry.Stop()
+	}
+	if resumeOffset > 0 {
+		written := int64(-1)
+		if previous != nil {
+			written, _ = previous.ctx.written()
+		}
+		if written != resumeOffset {
+			m.mu.Lock()
+			if m.receives[connectionID] == in {
+				delete(m.receives, connectionID)
+			}
+			m.mu.Unlock()
+			if previous != nil {
+				previous.ctx.discardTempFile()
+			}
+			// Ask the source to start over rather than append to bytes we do not have
+			go m.RequestResume(connectionID)
+			return fmt.Errorf("cannot resume %s at offset %d: temp tar holds %d bytes", connectionID, resumeOffset, written)
+		}
+		previous.ctx.progress.stop()
+		transferCtx.adopt(previous.ctx)
+	} else if previous != nil {
+		previous.ctx.discardTempFile()
+	}
+	ctx, done := m.track(cancelKey("receive", connectionID))
+	defer done()
+	if err := transferer.Receive(ctx, sourceAgentID); err != nil {
+		if transferCtx.TempFile != nil && ctx.Err() == nil {
+			// Keep what arrived so the transfer can resume from it
+			m.interrupt(connectionID, in)
+			return err
+		}
+		m.mu.Lock()
+		if m.receives[connectionID] == in {
+			delete(m.receives, connectionID)
+		}
+		m.mu.Unlock()
+		transferCtx.discardTempFile()
+		return err
+	}
+	return nil
+}
 
-	return transferer.Receive(sourceAgentID)
+// applyStreamSettings sets the codec of a transfer, the keys agreed for role if it is encrypted,
+// the destination's block signatures if this agent sends it as a delta, and the files and
+// target of a sync pull
+func (m *TransferManager) applyStreamSettings(transferCtx *TransferContext, stream StreamSettings, role string) error {
+	var err error
+	if transferCtx.codec, err = validCodec(stream.Codec); err != nil {
+		return err
+	}
+	switch stream.Encryption {
+	case "", models.TransferEncryptionNone:
+	case models.TransferEncryptionX25519:
+		transferCtx.keys, err = m.sessionKeys(transferCtx.ConnectionID, role)
+	default:
+		err = fmt.Errorf("unsupported transfer encryption %q", stream.Encryption)
+	}
+	if err == nil && stream.Delta && role == models.TransferRoleSource {
+		transferCtx.basis, err = m.deltaBasis(transferCtx.ConnectionID)
+	}
+	transferCtx.files = stream.Files
+	transferCtx.target = stream.Target
+	return err
 }
 
-func (m *TransferManager) WriteChunk(chunk []byte) error {
-	if m.currentTransfer == nil {
-		return fmt.Errorf("no active transfer")
+// Cancel stops a transfer: a running Send or Receive returns, its P2P connection is closed and
+// the temp tar of an unfinished receive is deleted. It reports whether this agent was receiving it.
+func (m *TransferManager) Cancel(connectionID string) bool {
+	m.mu.Lock()
+	calls := []*call{m.cancels[cancelKey("send", connectionID)], m.cancels[cancelKey("receive", connectionID)]}
+	in := m.receives[connectionID]
+	if in == nil {
+		in = m.interrupted[connectionID]
+	}
+	delete(m.receives, connectionID)
+	delete(m.interrupted, connectionID)
+	m.mu.Unlock()
+	receiving := in != nil && in.ctx.TempFile != nil
+	if in != nil {
+		if in.expiry != nil {
+			in.expiry.Stop()
+		}
+		in.ctx.discardTempFile()
 	}
-	return m.currentTransfer.WriteChunk(chunk)
+	for _, c := range calls {
+		if c != nil {
+			c.cancel()
+		}
+	}
+	m.CloseP2PConnection(connectionID)
+	m.dropKeys(connectionID)
+	m.dropBasis(connectionID)
+	return receiving
 }
 
-func (m *TransferManager) Complete() error {
-	if m.currentTransfer == nil {
-		return fmt.Errorf("no active transfer to complete")
+// cancelKey separates the two sides of a transfer, which share a connection ID when an
+// agent requests files from itself
+func cancelKey(role, connectionID string) string {
+	return role + ":" + connectionID
+}
+
+// track registers a cancellable context under key until done is called. A call still
+// registered under the same key, such as the send a resume replaces, is cancelled.
+func (m *TransferManager) track(key string) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &call{cancel: cancel}
+	m.mu.Lock()
+	previous := m.cancels[key]
+	m.cancels[key] = c
+	m.mu.Unlock()
+	if previous != nil {
+		previous.cancel()
+	}
+	return ctx, func() {
+		cancel()
+		m.mu.Lock()
+		if m.cancels[key] == c {
+			delete(m.cancels, key)
+		}
+		m.mu.Unlock()
 	}
-	return m.currentTransfer.Complete()
 }
 
-func (m *TransferManager) GetContext() *TransferContext {
-	return m.ctx
+// WriteChunk decodes a relay frame and writes its payload to the receive of its stream. The write
+// can wait on granting credit, so it runs without holding m.mu.
+func (m *TransferManager) WriteChunk(data []byte) error {
+	f, err := decodeFrame(data)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	in := m.receives[f.streamID]
+	m.mu.Unlock()
+	if in == nil {
+		return fmt.Errorf("no active transfer for stream %s", f.streamID)
+	}
+	return in.transferer.WriteChunk(f.seq, f.payload)
 }
 
-func (m *TransferManager) SetConnectionID(connectionID string) {
-	m.ctx.ConnectionID = connectionID
+// Grant passes credit from a relay destination to the sending side of the transfer
+func (m *TransferManager) Grant(connectionID string, granted uint64) {
+	m.mu.Lock()
+	window := m.credits[connectionID]
+	m.mu.Unlock()
+	if window != nil {
+		window.grant(granted)
+	}
+}
+
+// Complete extracts a received transfer once its source reported it completed. The manifest
+// must carry a valid signature by signingKey, the source's key as the master knows it, and
+// every extracted file must match it; see IntegrityError.
+func (m *TransferManager) Complete(connectionID string, manifest *models.TransferManifest, signingKey string) error {
+	m.mu.Lock()
+	in := m.receives[connectionID]
+	delete(m.receives, connectionID)
+	m.mu.Unlock()
+	if in == nil {
+		return fmt.Errorf("no active transfer %s to complete", connectionID)
+	}
+	if err := verifyManifest(manifest, connectionID, signingKey); err != nil {
+		in.ctx.discardTempFile()
+		return err
+	}
+	return in.transferer.Complete(manifest)
 }
 
 // AttemptP2PConnection attempts a P2P connection
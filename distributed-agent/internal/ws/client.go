@@ -3,29 +3,39 @@ package ws
 import (
 	"context"
 	"errors"
+	"fmt"
+	"net/http"
 	"runtime"
+	"strconv"
+	"strings"
 
 	"github.com/The-Promised-Neverland/agent/internal/config"
+	"github.com/The-Promised-Neverland/agent/internal/enrollment"
 	"github.com/The-Promised-Neverland/agent/internal/models"
 	"github.com/The-Promised-Neverland/agent/pkg/logger"
 	"github.com/The-Promised-Neverland/agent/pkg/utils"
 	"github.com/gorilla/websocket"
 )
 
+// ErrUnauthorized is returned by Connect when the master rejects the agent's credential
+var ErrUnauthorized = errors.New("master rejected agent credential")
+
 type Outbound struct {
-	Msg    *models.Message
-	Binary []byte
+	Msg     *models.Message
+	Binary  []byte
+	flushed chan struct{} // closed by writePump once the message is on the wire
 }
 
 type Agent struct {
 	Conn               *websocket.Conn
 	Config             *config.Config
 	Handlers           map[string]func(msg *any) error
+	ackFirst           map[string]bool // commands acknowledged before their handler runs
 	sendCh             chan Outbound
 	incomingCh         chan Outbound
 	ctx                context.Context
 	cancel             context.CancelFunc
-	BinaryChunkHandler func(chunk []byte) error // Handler for binary chunks (relay mode)
+	BinaryChunkHandler func(chunk []byte) error // Handler for binary relay frames
 }
 
 func NewAgent(cfg *config.Config, parentCtx context.Context) *Agent {
@@ -33,6 +43,7 @@ func NewAgent(cfg *config.Config, parentCtx context.Context) *Agent {
 	agent := &Agent{
 		Config:     cfg,
 		Handlers:   make(map[string]func(msg *any) error),
+		ackFirst:   make(map[string]bool),
 		sendCh:     make(chan Outbound, 256),
 		incomingCh: make(chan Outbound, 256),
 		ctx:        ctx,
@@ -49,6 +60,14 @@ func (a *Agent) RegisterHandler(msgType string, handler func(msg *any) error) {
 	a.Handlers[msgType] = handler
 }
 
+// RegisterAckFirstHandler registers a handler whose command is answered with "accepted"
+// before it runs, for handlers that may take the connection down (restart, uninstall)
+// or that only hand work off to a long-running transfer.
+func (a *Agent) RegisterAckFirstHandler(msgType string, handler func(msg *any) error) {
+	a.Handlers[msgType] = handler
+	a.ackFirst[msgType] = true
+}
+
 func (a *Agent) Connect() error {
 	baseURL := a.Config.MasterServerConn()
 	osName := runtime.GOOS
@@ -60,10 +79,39 @@ func (a *Agent) Connect() error {
 	case "linux":
 		osName = "Linux"
 	}
+	cred, err := enrollment.EnsureCredential(a.Config)
+	if err != nil {
+		logger.Log.Error("Enrollment error", "err", err)
+		return err
+	}
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+cred.Credential)
+	if key, err := enrollment.EnsureSigningKey(a.Config.CredentialPath()); err != nil {
+		logger.Log.Warn("No manifest signing key, transfers sent by this agent will fail verification", "err", err)
+	} else {
+		header.Set(enrollment.SigningKeyHeader, enrollment.PublicSigningKey(key))
+		// Ephemeral transfer keys are signed with the same key, so encryption needs it too
+		header.Set(models.TransferEncryptionHeader, models.TransferEncryptionX25519)
+	}
+	header.Set(models.TransferCodecsHeader, strings.Join(models.TransferCodecs, ","))
+	header.Set(models.HeartbeatIntervalHeader, strconv.Itoa(int(a.Config.HeartbeatTimer().Seconds())))
 	wsURL := utils.BuildWebSocketURL(baseURL, a.Config.AgentID(), a.Config.AgentName(), osName)
 	logger.Log.Info("Attempting connection", "url", wsURL)
-	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	conn, resp, err := websocket.DefaultDialer.Dial(wsURL, header)
 	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+			// Only a revoked credential is dropped; any other rejection may be the master's
+			// mistake, and without the credential the agent could not reconnect once it is fixed
+			if resp.Header.Get(enrollment.CredentialStatusHeader) == enrollment.CredentialRevoked {
+				logger.Log.Error("Master revoked agent credential, discarding it: set ENROLLMENT_TOKEN to a new token to re-enroll", "credential_id", cred.CredentialID)
+				if discardErr := enrollment.Discard(a.Config.CredentialPath()); discardErr != nil {
+					logger.Log.Warn("Failed to discard revoked credential", "err", discardErr)
+				}
+			} else {
+				logger.Log.Error("Master rejected agent credential, keeping it and retrying", "credential_id", cred.CredentialID)
+			}
+			return fmt.Errorf("%w: %v", ErrUnauthorized, err)
+		}
 		logger.Log.Error("Connection error", "err", err)
 		return err
 	}
@@ -84,6 +132,19 @@ func (a *Agent) Send(out Outbound) error {
 	}
 }
 
+// SendWait queues out like Send, but waits for room in the send buffer instead of
+// dropping it, until ctx is done or the connection closes
+func (a *Agent) SendWait(ctx context.Context, out Outbound) error {
+	select {
+	case <-a.ctx.Done():
+		return errors.New("connection is closed")
+	case <-ctx.Done():
+		return ctx.Err()
+	case a.sendCh <- out:
+		return nil
+	}
+}
+
 func (a *Agent) Close() error {
 	a.cancel()
 	if a.Conn != nil {
@@ -13,6 +13,7 @@ const (
 	readDeadline  = 70 * time.Second
 	writeDeadline = 10 * time.Second
 	pongWait      = 60 * time.Second
+	ackFlushWait  = 2 * time.Second
 )
 
 // setupPingPongHandlers sets up ping/pong handlers to maintain connection health
@@ -78,13 +79,11 @@ func (a *Agent) readPump() {
 					logger.Log.Warn("Incoming channel full for %s, dropping message\n")
 				}
 			case websocket.BinaryMessage:
+				// Relay frames only arrive as fast as this agent grants credit, so wait for room
 				select {
 				case a.incomingCh <- Outbound{Binary: msgBytes}:
 				case <-a.ctx.Done():
 					return
-				default:
-					// TODO: Handling backpressure
-					logger.Log.Warn("Incoming channel full for %s, dropping message\n")
 				}
 			default:
 				logger.Log.Warn("Recieved mssg dropped. Neither TEXT/BINARY")
@@ -107,7 +106,9 @@ func (a *Agent) writePump() {
 			}
 			a.Conn.SetWriteDeadline(time.Now().Add(writeDeadline))
 			if msg.Msg != nil {
-				bytes, err := json.Marshal(*msg.Msg)
+				out := *msg.Msg
+				out.SentAt = time.Now().UnixMilli()
+				bytes, err := json.Marshal(out)
 				if err != nil {
 					logger.Log.Error("Marshalling error", "err", err)
 					continue
@@ -117,6 +118,9 @@ func (a *Agent) writePump() {
 					a.Close()
 					return
 				}
+				if msg.flushed != nil {
+					close(msg.flushed)
+				}
 			} else {
 				if err := a.Conn.WriteMessage(websocket.BinaryMessage, msg.Binary); err != nil {
 					logger.Log.Error("Write error: BINARY", "err", err)
@@ -142,14 +146,7 @@ func (a *Agent) processorPump() {
 		select {
 		case msg := <-a.incomingCh:
 			if msg.Msg != nil {
-				messageRec := *msg.Msg
-				if handler, ok := a.Handlers[messageRec.Type]; ok {
-					if err := handler(&messageRec.Payload); err != nil {
-						logger.Log.Error("Handler error", "type", messageRec.Type, "err", err)
-					}
-				} else {
-					logger.Log.Warn("No handler for message type", "type", messageRec.Type, "payload", messageRec.Payload)
-				}
+				a.dispatch(*msg.Msg)
 			} else {
 				if a.BinaryChunkHandler != nil {
 					if err := a.BinaryChunkHandler(msg.Binary); err != nil {
@@ -165,6 +162,61 @@ func (a *Agent) processorPump() {
 	}
 }
 
+// dispatch runs the handler for a message. Messages carrying an ID are commands the
+// master is waiting on, so they are always answered with an agent_command_result.
+func (a *Agent) dispatch(messageRec models.Message) {
+	handler, ok := a.Handlers[messageRec.Type]
+	if !ok {
+		logger.Log.Warn("No handler for message type", "type", messageRec.Type, "payload", messageRec.Payload)
+		if messageRec.ID != "" {
+			a.sendCommandResult(messageRec, models.CommandStatusError, "no handler for "+messageRec.Type)
+		}
+		return
+	}
+	ackFirst := messageRec.ID != "" && a.ackFirst[messageRec.Type]
+	if ackFirst {
+		flushed := a.sendCommandResult(messageRec, models.CommandStatusAccepted, "")
+		select {
+		case <-flushed:
+		case <-time.After(ackFlushWait):
+			logger.Log.Warn("Command ack not flushed in time, running handler anyway", "type", messageRec.Type, "id", messageRec.ID)
+		case <-a.ctx.Done():
+		}
+	}
+	err := handler(&messageRec.Payload)
+	if err != nil {
+		logger.Log.Error("Handler error", "type", messageRec.Type, "err", err)
+	}
+	if messageRec.ID == "" {
+		return
+	}
+	switch {
+	case err != nil:
+		a.sendCommandResult(messageRec, models.CommandStatusError, err.Error())
+	case !ackFirst:
+		a.sendCommandResult(messageRec, models.CommandStatusOK, "")
+	}
+}
+
+// sendCommandResult queues the answer to a command and returns a channel closed once it is written
+func (a *Agent) sendCommandResult(cmd models.Message, status, errMsg string) <-chan struct{} {
+	flushed := make(chan struct{})
+	result := models.Message{
+		Type:    models.AgentMsgCommandResult,
+		ReplyTo: cmd.ID,
+		Payload: models.CommandResult{
+			Command:   cmd.Type,
+			Status:    status,
+			Error:     errMsg,
+			HandledAt: time.Now().Unix(),
+		},
+	}
+	if err := a.Send(Outbound{Msg: &result, flushed: flushed}); err != nil {
+		logger.Log.Error("Failed to send command result", "type", cmd.Type, "id", cmd.ID, "err", err)
+	}
+	return flushed
+}
+
 // RunPumps starts all pumps and sets up ping/pong handlers
 func (a *Agent) RunPumps() {
 	if a.Conn == nil {
@@ -4,26 +4,83 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/The-Promised-Neverland/master-server/internal/api/handlers"
 	"github.com/The-Promised-Neverland/master-server/internal/api/routers"
+	"github.com/The-Promised-Neverland/master-server/internal/auth"
+	"github.com/The-Promised-Neverland/master-server/internal/command"
+	"github.com/The-Promised-Neverland/master-server/internal/enrollment"
+	"github.com/The-Promised-Neverland/master-server/internal/metrics"
+	"github.com/The-Promised-Neverland/master-server/internal/registry"
 	"github.com/The-Promised-Neverland/master-server/internal/service"
+	"github.com/The-Promised-Neverland/master-server/internal/snapshot"
 	"github.com/The-Promised-Neverland/master-server/internal/sse"
+	"github.com/The-Promised-Neverland/master-server/internal/syncpair"
 	"github.com/The-Promised-Neverland/master-server/internal/ws"
 	"github.com/The-Promised-Neverland/master-server/pkg/system"
 )
 
 func main() {
 	system.InitStartTime()
+	dataDir := os.Getenv("DATA_DIR")
+	if dataDir == "" {
+		dataDir = "data"
+	}
+	enrollmentManager, err := enrollment.NewManager(filepath.Join(dataDir, "enrollment.json"))
+	if err != nil {
+		log.Fatalf("Failed to load enrollment store: %v", err)
+	}
+	apiKeys, err := loadAPIKeys()
+	if err != nil {
+		log.Fatalf("Failed to load API keys: %v", err)
+	}
+	if apiKeys.Len() == 0 {
+		log.Printf("No API keys configured (API_KEYS, API_KEYS_FILE or ADMIN_TOKEN), the REST API will reject every request")
+	}
+	agentRegistry, err := registry.NewFileStore(filepath.Join(dataDir, "agents.json"))
+	if err != nil {
+		log.Fatalf("Failed to load agent registry: %v", err)
+	}
+	metricsStore, err := metrics.NewStore(filepath.Join(dataDir, "metrics"), metrics.DefaultTiers)
+	if err != nil {
+		log.Fatalf("Failed to load metrics history: %v", err)
+	}
+	metricsStore.StartFlusher(time.Minute)
+	snapshotStore, err := snapshot.NewStore(filepath.Join(dataDir, "snapshots"))
+	if err != nil {
+		log.Fatalf("Failed to load directory snapshots: %v", err)
+	}
+	snapshotStore.StartFlusher(time.Minute)
 	sseHub := sse.NewSSEHub()
-	wsHub := ws.NewWSHub(sseHub)
+	queueTTL := command.DefaultQueueTTL
+	if ttl := os.Getenv("COMMAND_QUEUE_TTL"); ttl != "" {
+		if queueTTL, err = time.ParseDuration(ttl); err != nil {
+			log.Fatalf("Invalid COMMAND_QUEUE_TTL %q: %v", ttl, err)
+		}
+	}
+	commandQueue, err := command.NewQueue(filepath.Join(dataDir, "command_queue.json"), queueTTL, sseHub)
+	if err != nil {
+		log.Fatalf("Failed to load command queue: %v", err)
+	}
+	wsHub := ws.NewWSHub(sseHub, agentRegistry, metricsStore, snapshotStore, commandQueue)
+	if interval := os.Getenv("HEARTBEAT_INTERVAL"); interval != "" {
+		if wsHub.HeartbeatInterval, err = time.ParseDuration(interval); err != nil || wsHub.HeartbeatInterval <= 0 {
+			log.Fatalf("Invalid HEARTBEAT_INTERVAL %q", interval)
+		}
+	}
+	if wsHub.SyncPairs, err = syncpair.NewManager(filepath.Join(dataDir, "sync_pairs.json"), wsHub, wsHub, wsHub.TransferManager, sseHub); err != nil {
+		log.Fatalf("Failed to load sync pairs: %v", err)
+	}
 	wsHub.RegisterDefaultHandlers()
 	svc := service.NewService(wsHub, sseHub)
 	handler := handlers.NewHandler(svc)
-	wsHandler := handlers.NewWebSocketHandler(wsHub)
+	wsHandler := handlers.NewWebSocketHandler(wsHub, enrollmentManager)
+	enrollmentHandler := handlers.NewEnrollmentHandler(enrollmentManager)
 	sseHandler := handlers.NewSSEHandler(sseHub)
 	sseHandler.SetService(svc)
-	router := routers.NewRouter(wsHub, sseHub, handler, wsHandler, sseHandler).SetupRouter()
+	router := routers.NewRouter(wsHub, sseHub, handler, wsHandler, sseHandler, enrollmentHandler, apiKeys).SetupRouter()
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8430"
@@ -34,3 +91,23 @@ func main() {
 		log.Fatalf("Failed to start server: %v", err)
 	}
 }
+
+// loadAPIKeys collects REST API keys from API_KEYS ("name:role:key,..."), the JSON file
+// at API_KEYS_FILE, and ADMIN_TOKEN, which is kept as an admin key named "admin".
+func loadAPIKeys() (*auth.KeyStore, error) {
+	keys := auth.NewKeyStore()
+	if err := keys.LoadEnv(os.Getenv("API_KEYS")); err != nil {
+		return nil, err
+	}
+	if path := os.Getenv("API_KEYS_FILE"); path != "" {
+		if err := keys.LoadFile(path); err != nil {
+			return nil, err
+		}
+	}
+	if adminToken := os.Getenv("ADMIN_TOKEN"); adminToken != "" {
+		if err := keys.Add("admin", auth.RoleAdmin, adminToken); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
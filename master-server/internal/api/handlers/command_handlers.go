@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	middleware "github.com/The-Promised-Neverland/master-server/internal/api/middlware"
+	"github.com/The-Promised-Neverland/master-server/internal/auth"
+	"github.com/The-Promised-Neverland/master-server/internal/command"
+	"github.com/The-Promised-Neverland/master-server/internal/models"
+	"github.com/gin-gonic/gin"
+)
+
+// respondCommand maps a command's outcome to an HTTP status: 200 once the agent accepted
+// or completed it, 502 if it reported an error, 504 if it timed out and 202 while pending or queued.
+func respondCommand(c *gin.Context, cmd *models.Command, err error, action string) {
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{
+			"success": false,
+			"message": action + " failed: " + err.Error(),
+		})
+		return
+	}
+	status, success, message := http.StatusAccepted, true, action+" sent, waiting for the agent to answer"
+	switch cmd.Status {
+	case models.CommandStatusQueued:
+		message = action + " queued until the agent reconnects"
+	case models.CommandStatusOK:
+		status, message = http.StatusOK, action+" completed"
+	case models.CommandStatusAccepted:
+		status, message = http.StatusOK, action+" accepted by agent"
+	case models.CommandStatusError:
+		status, success, message = http.StatusBadGateway, false, action+" failed on agent: "+cmd.Error
+	case models.CommandStatusTimedOut:
+		status, success, message = http.StatusGatewayTimeout, false, action+" timed out"
+	}
+	c.JSON(status, gin.H{
+		"success": success,
+		"message": message,
+		"command": cmd,
+	})
+}
+
+func (h *Handler) ListCommands(c *gin.Context) {
+	cmds := h.Service.ListCommands(c.Query("agent_id"))
+	c.JSON(http.StatusOK, models.CommandListResponse{
+		Commands: cmds,
+		Total:    len(cmds),
+	})
+}
+
+func (h *Handler) GetCommand(c *gin.Context) {
+	cmd := h.Service.GetCommand(c.Param("id"))
+	if cmd == nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"message": "command not found",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"command": cmd,
+	})
+}
+
+// cancelRoles is the role needed to cancel a queued command: the one needed to send it.
+// Command types not listed here need admin.
+var cancelRoles = map[string]auth.Role{
+	models.MasterMsgRestartAgent:   auth.RoleOperator,
+	models.MasterMsgAgentUninstall: auth.RoleAdmin,
+}
+
+func (h *Handler) CancelCommand(c *gin.Context) {
+	id := c.Param("id")
+	if queued := h.Service.GetCommand(id); queued != nil {
+		required, ok := cancelRoles[queued.Type]
+		if !ok {
+			required = auth.RoleAdmin
+		}
+		if identity := c.MustGet(middleware.IdentityKey).(auth.Identity); !identity.Role.Allows(required) {
+			fmt.Printf("Denied cancelling %s command %s: key %q has role %s, %s required\n", queued.Type, id, identity.Name, identity.Role, required)
+			c.JSON(http.StatusForbidden, gin.H{
+				"success": false,
+				"message": fmt.Sprintf("%s role required to cancel %s", required, queued.Type),
+			})
+			return
+		}
+	}
+	cmd, err := h.Service.CancelCommand(id)
+	if errors.Is(err, command.ErrNotQueued) {
+		status := http.StatusNotFound
+		if h.Service.GetCommand(id) != nil {
+			status = http.StatusConflict // already delivered
+		}
+		c.JSON(status, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Command cancelled",
+		"command": cmd,
+	})
+}
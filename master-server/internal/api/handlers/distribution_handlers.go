@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/The-Promised-Neverland/master-server/internal/models"
+	"github.com/The-Promised-Neverland/master-server/internal/service"
+	"github.com/The-Promised-Neverland/master-server/internal/transfer"
+	"github.com/The-Promised-Neverland/master-server/internal/ws"
+	"github.com/gin-gonic/gin"
+)
+
+// CreateDistribution sends a path of one agent to many. It answers 201 when every destination
+// is receiving, 207 when only some are and 400 when none is, with the job and the reason of
+// each destination that is not.
+func (h *Handler) CreateDistribution(c *gin.Context) {
+	var req models.CreateDistributionRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"message": "Distribution binding error: " + err.Error(),
+		})
+		return
+	}
+	distribution, err := h.Service.CreateDistribution(req)
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, service.ErrAgentNotFound):
+			status = http.StatusNotFound
+		case errors.Is(err, ws.ErrAgentOffline), errors.Is(err, ws.ErrInvalidSelector), errors.Is(err, service.ErrNoDestinations):
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	status, message := http.StatusCreated, "Distribution started"
+	switch {
+	case distribution.Status == models.TransferStatusFailed:
+		status, message = http.StatusBadRequest, "Distribution could not start: "+distribution.FailureReason
+	case distribution.Failed > 0:
+		status, message = http.StatusMultiStatus, "Distribution started, some destinations cannot receive it"
+	}
+	c.JSON(status, gin.H{
+		"success":      status != http.StatusBadRequest,
+		"message":      message,
+		"distribution": distribution,
+	})
+}
+
+func (h *Handler) ListDistributions(c *gin.Context) {
+	distributions := h.Service.ListDistributions()
+	c.JSON(http.StatusOK, models.DistributionListResponse{
+		Distributions: distributions,
+		Total:         len(distributions),
+	})
+}
+
+func (h *Handler) GetDistribution(c *gin.Context) {
+	distribution := h.Service.GetDistribution(c.Param("id"))
+	if distribution == nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"message": "distribution not found",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success":      true,
+		"distribution": distribution,
+	})
+}
+
+func (h *Handler) CancelDistribution(c *gin.Context) {
+	cancelled, err := h.Service.CancelDistribution(c.Param("id"))
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, transfer.ErrDistributionNotFound):
+			status = http.StatusNotFound
+		case errors.Is(err, transfer.ErrDistributionFinished):
+			status = http.StatusConflict
+		}
+		c.JSON(status, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success":      true,
+		"message":      "Distribution cancelled",
+		"distribution": cancelled,
+	})
+}
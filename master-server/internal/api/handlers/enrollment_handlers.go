@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/The-Promised-Neverland/master-server/internal/enrollment"
+	"github.com/The-Promised-Neverland/master-server/internal/models"
+	"github.com/gin-gonic/gin"
+)
+
+type EnrollmentHandler struct {
+	Manager *enrollment.Manager
+}
+
+func NewEnrollmentHandler(manager *enrollment.Manager) *EnrollmentHandler {
+	return &EnrollmentHandler{Manager: manager}
+}
+
+// MintToken creates a one-time enrollment token (admin only)
+func (eh *EnrollmentHandler) MintToken(c *gin.Context) {
+	var req models.MintEnrollmentTokenRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"success": false,
+				"message": "Token binding error: " + err.Error(),
+			})
+			return
+		}
+	}
+	plain, token, err := eh.Manager.MintToken(req.Label, time.Duration(req.TTLSeconds)*time.Second)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	fmt.Printf("[ENROLL] Enrollment token %s minted (label=%q, expires=%s)\n", token.ID, token.Label, token.ExpiresAt.Format(time.RFC3339))
+	c.JSON(http.StatusCreated, models.Message{
+		Type: "enrollment_token",
+		Payload: models.EnrollmentTokenResponse{
+			TokenID:   token.ID,
+			Token:     plain,
+			ExpiresAt: token.ExpiresAt,
+		},
+	})
+}
+
+// Enroll trades a one-time token for a per-agent credential
+func (eh *EnrollmentHandler) Enroll(c *gin.Context) {
+	var req models.EnrollRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"message": "Enrollment binding error: " + err.Error(),
+		})
+		return
+	}
+	credential, cred, err := eh.Manager.Enroll(req.Token, req.AgentID)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, enrollment.ErrInvalidToken) {
+			status = http.StatusUnauthorized
+		}
+		fmt.Printf("[ENROLL] Enrollment rejected for agent %s from %s: %v\n", req.AgentID, c.ClientIP(), err)
+		c.JSON(status, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	fmt.Printf("[ENROLL] Agent %s (%s) enrolled with credential %s\n", req.AgentID, req.AgentName, cred.ID)
+	c.JSON(http.StatusOK, models.Message{
+		Type: "agent_enrolled",
+		Payload: models.EnrollResponse{
+			AgentID:      req.AgentID,
+			CredentialID: cred.ID,
+			Credential:   credential,
+		},
+	})
+}
+
+// RevokeCredential invalidates an agent's credential (admin only)
+func (eh *EnrollmentHandler) RevokeCredential(c *gin.Context) {
+	agentID := c.Param("id")
+	if err := eh.Manager.Revoke(agentID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	fmt.Printf("[ENROLL] Credential for agent %s revoked\n", agentID)
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Agent credential revoked",
+	})
+}
@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/The-Promised-Neverland/master-server/internal/metrics"
+	"github.com/The-Promised-Neverland/master-server/internal/snapshot"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultSearchLimit = 1000
+	maxSearchLimit     = 10000
+)
+
+// SearchFiles finds entries of the agents' shared folders in the master's copies, including
+// those of offline agents. See snapshot.Query for the filters.
+func (h *Handler) SearchFiles(c *gin.Context) {
+	query, err := searchQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": err.Error()})
+		return
+	}
+	var agentIDs []string
+	for _, value := range c.QueryArray("agent_id") {
+		for _, id := range strings.Split(value, ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				agentIDs = append(agentIDs, id)
+			}
+		}
+	}
+	var online *bool
+	if v := c.Query("online"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": fmt.Sprintf("invalid online %q", v)})
+			return
+		}
+		online = &b
+	}
+	response, err := h.Service.SearchFiles(query, agentIDs, c.Query("selector"), online)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+func searchQuery(c *gin.Context) (snapshot.Query, error) {
+	query := snapshot.Query{
+		Name:       c.Query("name"),
+		PathPrefix: c.Query("path"),
+		Type:       c.Query("type"),
+		Limit:      defaultSearchLimit,
+	}
+	if !snapshot.ValidPattern(query.Name) {
+		return query, fmt.Errorf("invalid name pattern %q", query.Name)
+	}
+	if query.Type != "" && query.Type != "file" && query.Type != "directory" {
+		return query, fmt.Errorf("invalid type %q, expected file or directory", query.Type)
+	}
+	var err error
+	if query.MinSize, err = sizeParam(c, "min_size"); err != nil {
+		return query, err
+	}
+	if query.MaxSize, err = sizeParam(c, "max_size"); err != nil {
+		return query, err
+	}
+	if v := c.Query("modified_after"); v != "" {
+		if query.ModifiedAfter, err = metrics.ParseTime(v); err != nil {
+			return query, err
+		}
+	}
+	if v := c.Query("modified_before"); v != "" {
+		if query.ModifiedBefore, err = metrics.ParseTime(v); err != nil {
+			return query, err
+		}
+	}
+	if v := c.Query("limit"); v != "" {
+		if query.Limit, err = strconv.Atoi(v); err != nil || query.Limit < 1 {
+			return query, fmt.Errorf("invalid limit %q", v)
+		}
+		query.Limit = min(query.Limit, maxSearchLimit)
+	}
+	return query, nil
+}
+
+// sizeParam reads a size in bytes, nil if the parameter is not given
+func sizeParam(c *gin.Context, param string) (*int64, error) {
+	v := c.Query(param)
+	if v == "" {
+		return nil, nil
+	}
+	size, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || size < 0 {
+		return nil, fmt.Errorf("invalid %s %q", param, v)
+	}
+	return &size, nil
+}
+
+// GetAgentSnapshot returns the master's copy of an agent's shared folder, kept while it is offline
+func (h *Handler) GetAgentSnapshot(c *gin.Context) {
+	snapshot := h.Service.GetAgentSnapshot(c.Param("id"))
+	if snapshot == nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"message": "no directory snapshot for agent",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success":  true,
+		"snapshot": snapshot,
+	})
+}
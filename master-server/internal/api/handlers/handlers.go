@@ -1,15 +1,22 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
 	"sync"
+	"time"
 
+	"github.com/The-Promised-Neverland/master-server/internal/metrics"
 	"github.com/The-Promised-Neverland/master-server/internal/models"
 	"github.com/The-Promised-Neverland/master-server/internal/service"
+	"github.com/The-Promised-Neverland/master-server/internal/ws"
 	"github.com/The-Promised-Neverland/master-server/pkg/system"
 	"github.com/gin-gonic/gin"
 )
 
+// maxHistoryPoints caps a history response; the step is widened to fit
+const maxHistoryPoints = 1000
+
 type Handler struct {
 	Service *service.Service
 	Mutex   sync.RWMutex
@@ -53,30 +60,115 @@ func (h *Handler) GetAgent(c *gin.Context) {
 	c.JSON(http.StatusOK, resp)
 }
 
-func (h *Handler) TriggerAgentMetrics(c *gin.Context) {
+// GetAgentMetrics returns fresh metrics from the agent, or its last heartbeat when it does not
+// answer in time. With from, to or step in the query it returns the stored history instead:
+// from/to are RFC3339 or unix seconds (default: the last hour), step is a duration like "5m" or seconds.
+func (h *Handler) GetAgentMetrics(c *gin.Context) {
 	agentID := c.Param("id")
-	h.Service.TriggerAgentforMetrics(agentID)
-	c.JSON(http.StatusAccepted, gin.H{
-		"success": true,
-		"message": "Metrics triggered for agent " + agentID,
+	if c.Query("from") != "" || c.Query("to") != "" || c.Query("step") != "" {
+		h.getMetricsHistory(c, agentID)
+		return
+	}
+	snapshot, err := h.Service.GetAgentMetrics(agentID)
+	if err != nil {
+		status := http.StatusGatewayTimeout
+		if errors.Is(err, service.ErrAgentNotFound) {
+			status = http.StatusNotFound
+		}
+		c.JSON(status, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, models.Message{
+		Type:    models.AgentMsgHeartbeat,
+		Payload: snapshot,
+	})
+}
+
+func (h *Handler) getMetricsHistory(c *gin.Context, agentID string) {
+	to := time.Now()
+	if v := c.Query("to"); v != "" {
+		t, err := metrics.ParseTime(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": err.Error()})
+			return
+		}
+		to = t
+	}
+	from := to.Add(-time.Hour)
+	if v := c.Query("from"); v != "" {
+		t, err := metrics.ParseTime(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": err.Error()})
+			return
+		}
+		from = t
+	}
+	if !from.Before(to) {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "from must be before to"})
+		return
+	}
+	step, err := metrics.ParseStep(c.Query("step"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": err.Error()})
+		return
+	}
+	if minStep := to.Sub(from) / maxHistoryPoints; step < minStep {
+		step = minStep
+	}
+	history, err := h.Service.GetMetricsHistory(agentID, from, to, step)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"success": false, "message": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, models.Message{
+		Type:    models.MasterMsgMetricsHistory,
+		Payload: history,
 	})
 }
 
 func (h *Handler) RestartAgent(c *gin.Context) {
 	agentID := c.Param("id")
-	h.Service.RestartAgent(agentID)
-	c.JSON(http.StatusOK, gin.H{
-		"success": true,
-		"message": "Agent restart initiated",
-	})
+	cmd, err := h.Service.RestartAgent(agentID)
+	respondCommand(c, cmd, err, "Agent restart")
 }
 
 func (h *Handler) UninstallAgent(c *gin.Context) {
 	agentID := c.Param("id")
-	h.Service.UninstallAgent(agentID)
+	cmd, err := h.Service.UninstallAgent(agentID)
+	respondCommand(c, cmd, err, "Agent uninstallation")
+}
+
+// SetAgentLabels replaces the agent's labels, which distributions select destinations by
+func (h *Handler) SetAgentLabels(c *gin.Context) {
+	var req models.SetLabelsRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"message": "Labels binding error: " + err.Error(),
+		})
+		return
+	}
+	agent, err := h.Service.SetAgentLabels(c.Param("id"), req.Labels)
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, service.ErrAgentNotFound):
+			status = http.StatusNotFound
+		case errors.Is(err, ws.ErrInvalidLabels):
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
-		"message": "Agent uninstallation initiated",
+		"agent":   agent,
 	})
 }
 
@@ -84,7 +176,8 @@ func (h *Handler) GetAgentFileSystem(c *gin.Context) {
 	requestingAgentID := c.Param("id")           // Agent that wants to receive the file (requesting agent)
 	sourceAgentID := c.Param("getFromAgent")     // Agent that has the file (source agent)
 	var req struct {
-		Path string `json:"path" binding:"required"`
+		Path  string `json:"path" binding:"required"`
+		Delta bool   `json:"delta"` // send only the blocks that changed in files the requesting agent has
 	}
 	if err := c.BindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
@@ -108,9 +201,23 @@ func (h *Handler) GetAgentFileSystem(c *gin.Context) {
 		})
 		return
 	}
-	h.Service.GetAgentFileSystem(requestingAgentID, sourceAgentID, req.Path)
+	transfer, err := h.Service.GetAgentFileSystem(requestingAgentID, sourceAgentID, req.Path, req.Delta)
+	if err != nil {
+		response := gin.H{
+			"success": false,
+			"message": "Transfer failed to start: " + err.Error(),
+		}
+		if transfer != nil {
+			response["transfer_id"] = transfer.ID
+			response["transfer"] = transfer
+		}
+		c.JSON(http.StatusBadGateway, response)
+		return
+	}
 	c.JSON(http.StatusOK, gin.H{
-		"success": true,
-		"message": "Requested file will be available in your shared folder shortly",
+		"success":     true,
+		"message":     "Requested file will be available in your shared folder shortly",
+		"transfer_id": transfer.ID,
+		"transfer":    transfer,
 	})
 }
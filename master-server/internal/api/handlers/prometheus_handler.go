@@ -0,0 +1,14 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// PrometheusMetrics serves agent and master metrics for Prometheus scrapes
+func (h *Handler) PrometheusMetrics(c *gin.Context) {
+	c.Status(http.StatusOK)
+	c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	h.Service.WritePrometheusMetrics(c.Writer)
+}
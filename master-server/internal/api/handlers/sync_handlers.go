@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/The-Promised-Neverland/master-server/internal/models"
+	"github.com/The-Promised-Neverland/master-server/internal/service"
+	"github.com/The-Promised-Neverland/master-server/internal/syncpair"
+	"github.com/gin-gonic/gin"
+)
+
+func (h *Handler) CreateSyncPair(c *gin.Context) {
+	var req models.CreateSyncPairRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"message": "Sync pair binding error: " + err.Error(),
+		})
+		return
+	}
+	pair, err := h.Service.CreateSyncPair(req)
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, service.ErrAgentNotFound):
+			status = http.StatusNotFound
+		case errors.Is(err, syncpair.ErrInvalidPair):
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{
+		"success": true,
+		"pair":    pair,
+	})
+}
+
+func (h *Handler) ListSyncPairs(c *gin.Context) {
+	pairs := h.Service.ListSyncPairs()
+	c.JSON(http.StatusOK, models.SyncPairListResponse{
+		Pairs: pairs,
+		Total: len(pairs),
+	})
+}
+
+func (h *Handler) GetSyncPair(c *gin.Context) {
+	pair := h.Service.GetSyncPair(c.Param("id"))
+	if pair == nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"message": "sync pair not found",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"pair":    pair,
+	})
+}
+
+func (h *Handler) DeleteSyncPair(c *gin.Context) {
+	pair, err := h.Service.DeleteSyncPair(c.Param("id"))
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, syncpair.ErrPairNotFound) {
+			status = http.StatusNotFound
+		}
+		c.JSON(status, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Sync pair deleted, both folders are kept as they are",
+		"pair":    pair,
+	})
+}
@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/The-Promised-Neverland/master-server/internal/models"
+	"github.com/gin-gonic/gin"
+)
+
+func (h *Handler) CreateTask(c *gin.Context) {
+	var req models.CreateTaskRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"message": "Task binding error: " + err.Error(),
+		})
+		return
+	}
+	task, err := h.Service.CreateTask(req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusAccepted, models.TaskResponse{Task: task})
+}
+
+func (h *Handler) ListTasks(c *gin.Context) {
+	tasks := h.Service.ListTasks()
+	c.JSON(http.StatusOK, models.TaskListResponse{
+		Tasks: tasks,
+		Total: len(tasks),
+	})
+}
+
+func (h *Handler) GetTask(c *gin.Context) {
+	taskID := c.Param("id")
+	task := h.Service.GetTask(taskID)
+	if task == nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"message": "task not found",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, models.TaskResponse{Task: task})
+}
@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/The-Promised-Neverland/master-server/internal/models"
+	"github.com/The-Promised-Neverland/master-server/internal/service"
+	"github.com/The-Promised-Neverland/master-server/internal/transfer"
+	"github.com/The-Promised-Neverland/master-server/internal/ws"
+	"github.com/gin-gonic/gin"
+)
+
+// PushFileSystem sends a path of the agent to one or more destinations. It answers 200 when
+// every transfer started, 207 when only some did and 400 when none did, with one result per
+// destination.
+func (h *Handler) PushFileSystem(c *gin.Context) {
+	var req models.PushRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"message": "Push binding error: " + err.Error(),
+		})
+		return
+	}
+	results, err := h.Service.PushFileSystem(c.Param("id"), req)
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, service.ErrAgentNotFound):
+			status = http.StatusNotFound
+		case errors.Is(err, ws.ErrAgentOffline):
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	started := 0
+	for _, result := range results {
+		if result.Error == "" {
+			started++
+		}
+	}
+	status, message := http.StatusOK, "Transfers started"
+	switch {
+	case started == 0:
+		status, message = http.StatusBadRequest, "No transfer started"
+	case started < len(results):
+		status, message = http.StatusMultiStatus, "Some transfers did not start"
+	}
+	c.JSON(status, gin.H{
+		"success": started > 0,
+		"message": message,
+		"results": results,
+	})
+}
+
+func (h *Handler) ListTransfers(c *gin.Context) {
+	transfers := h.Service.ListTransfers()
+	c.JSON(http.StatusOK, models.TransferListResponse{
+		Transfers: transfers,
+		Total:     len(transfers),
+	})
+}
+
+func (h *Handler) GetTransfer(c *gin.Context) {
+	t := h.Service.GetTransfer(c.Param("id"))
+	if t == nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"message": "transfer not found",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success":  true,
+		"transfer": t,
+	})
+}
+
+func (h *Handler) CancelTransfer(c *gin.Context) {
+	cancelled, err := h.Service.CancelTransfer(c.Param("id"))
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, transfer.ErrTransferNotFound):
+			status = http.StatusNotFound
+		case errors.Is(err, transfer.ErrTransferFinished):
+			status = http.StatusConflict
+		}
+		c.JSON(status, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success":  true,
+		"message":  "Transfer cancelled",
+		"transfer": cancelled,
+	})
+}
+
+func (h *Handler) ResumeTransfer(c *gin.Context) {
+	resumed, err := h.Service.ResumeTransfer(c.Param("id"))
+	if err != nil {
+		status := http.StatusConflict
+		if errors.Is(err, transfer.ErrTransferNotFound) {
+			status = http.StatusNotFound
+		}
+		c.JSON(status, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{
+		"success":  true,
+		"message":  "Resume requested, waiting for the destination's checkpoint",
+		"transfer": resumed,
+	})
+}
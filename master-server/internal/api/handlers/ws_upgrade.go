@@ -1,26 +1,72 @@
 package handlers
 
 import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/The-Promised-Neverland/master-server/internal/enrollment"
+	"github.com/The-Promised-Neverland/master-server/internal/models"
 	"github.com/The-Promised-Neverland/master-server/internal/ws"
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
 )
 
 type WebSocketHandler struct {
-	Hub *ws.WSHub
+	Hub        *ws.WSHub
+	Enrollment *enrollment.Manager
 }
 
-func NewWebSocketHandler(hub *ws.WSHub) *WebSocketHandler {
-	return &WebSocketHandler{Hub: hub}
+func NewWebSocketHandler(hub *ws.WSHub, enrollmentManager *enrollment.Manager) *WebSocketHandler {
+	return &WebSocketHandler{
+		Hub:        hub,
+		Enrollment: enrollmentManager,
+	}
 }
 
 func (wsh *WebSocketHandler) UpgradeHandler(c *gin.Context) {
 	name := c.Query("name")
 	id := c.Query("id")
 	os := c.Query("os")
+	if id == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"message": "agent id is required",
+		})
+		return
+	}
+	credential := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	credentialID, err := wsh.Enrollment.Authenticate(id, credential)
+	if err != nil {
+		fmt.Printf("Rejected connection -> ID: %s, Name: %s, Remote: %s: %v\n", id, name, c.ClientIP(), err)
+		if errors.Is(err, enrollment.ErrCredentialRevoked) {
+			c.Header(enrollment.CredentialStatusHeader, enrollment.CredentialRevoked)
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	signingKey := c.GetHeader("X-Signing-Key")
+	if key, err := base64.StdEncoding.DecodeString(signingKey); signingKey != "" && (err != nil || len(key) != ed25519.PublicKeySize) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"message": "X-Signing-Key must be a base64 Ed25519 public key",
+		})
+		return
+	}
+	codecs := headerList(c, models.TransferCodecsHeader)
+	encryption := headerList(c, models.TransferEncryptionHeader)
+	var heartbeat time.Duration
+	if seconds, err := strconv.Atoi(c.GetHeader(models.HeartbeatIntervalHeader)); err == nil && seconds > 0 {
+		heartbeat = time.Duration(seconds) * time.Second
+	}
 	upgrader := websocket.Upgrader{
 		CheckOrigin: func(r *http.Request) bool {
 			return true
@@ -31,6 +77,17 @@ func (wsh *WebSocketHandler) UpgradeHandler(c *gin.Context) {
 		fmt.Printf("Failed to upgrade WebSocket: %v\n", err)
 		return
 	}
-	fmt.Printf("New connection -> ID: %s, Name: %s, OS: %s\n", id, name, os)
-	wsh.Hub.Connect(name, id, os, conn)
+	fmt.Printf("New connection -> ID: %s, Name: %s, OS: %s, Credential: %s, Codecs: %v, Encryption: %v, Heartbeat: %v\n", id, name, os, credentialID, codecs, encryption, heartbeat)
+	wsh.Hub.Connect(name, id, os, credentialID, signingKey, codecs, encryption, heartbeat, conn)
+}
+
+// headerList reads a comma separated, case insensitive list header
+func headerList(c *gin.Context, name string) []string {
+	var values []string
+	for _, value := range strings.Split(c.GetHeader(name), ",") {
+		if value = strings.TrimSpace(strings.ToLower(value)); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
 }
@@ -0,0 +1,24 @@
+package middleware
+
+import "testing"
+
+func TestRedactAccessToken(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{"no query", "/sse", "/sse"},
+		{"token only", "/sse?access_token=secret", "/sse?access_token=REDACTED"},
+		{"token among other parameters", "/sse?agent=a1&access_token=secret", "/sse?access_token=REDACTED&agent=a1"},
+		{"no token", "/api/v1/agents?label=env%3Dprod", "/api/v1/agents?label=env%3Dprod"},
+		{"unparsable query", "/sse?access_token=secret;%zz", "/sse?REDACTED"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := redactAccessToken(tt.path); got != tt.want {
+				t.Fatalf("redactAccessToken(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
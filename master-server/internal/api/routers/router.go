@@ -3,49 +3,101 @@ package routers
 import (
 	"github.com/The-Promised-Neverland/master-server/internal/api/handlers"
 	middleware "github.com/The-Promised-Neverland/master-server/internal/api/middlware"
+	"github.com/The-Promised-Neverland/master-server/internal/auth"
 	"github.com/The-Promised-Neverland/master-server/internal/sse"
 	"github.com/The-Promised-Neverland/master-server/internal/ws"
 	"github.com/gin-gonic/gin"
 )
 
 type Router struct {
-	WSHub      *ws.WSHub
-	SSEHub     *sse.SSEHub
-	Handler    *handlers.Handler
-	WSHandler  *handlers.WebSocketHandler
-	SSEHandler *handlers.SSEHandler
+	WSHub             *ws.WSHub
+	SSEHub            *sse.SSEHub
+	Handler           *handlers.Handler
+	WSHandler         *handlers.WebSocketHandler
+	SSEHandler        *handlers.SSEHandler
+	EnrollmentHandler *handlers.EnrollmentHandler
+	APIKeys           *auth.KeyStore
 }
 
-func NewRouter(wshub *ws.WSHub, sseHub *sse.SSEHub, handler *handlers.Handler, wsh *handlers.WebSocketHandler, sseH *handlers.SSEHandler) *Router {
+func NewRouter(wshub *ws.WSHub, sseHub *sse.SSEHub, handler *handlers.Handler, wsh *handlers.WebSocketHandler, sseH *handlers.SSEHandler, enrollH *handlers.EnrollmentHandler, apiKeys *auth.KeyStore) *Router {
 	return &Router{
-		WSHub:      wshub,
-		SSEHub:     sseHub,
-		Handler:    handler,
-		WSHandler:  wsh,
-		SSEHandler: sseH,
+		WSHub:             wshub,
+		SSEHub:            sseHub,
+		Handler:           handler,
+		WSHandler:         wsh,
+		SSEHandler:        sseH,
+		EnrollmentHandler: enrollH,
+		APIKeys:           apiKeys,
 	}
 }
 
 func (rtr *Router) SetupRouter() *gin.Engine {
-	router := gin.Default()
+	router := gin.New()
+	router.Use(middleware.AccessLogger(), gin.Recovery())
 	router.Use(middleware.CorsMiddleware())
 
 	router.GET("/health", rtr.Handler.HealthCheck)
 
+	viewer := middleware.RequireRole(rtr.APIKeys, auth.RoleViewer)
+	operator := middleware.RequireRole(rtr.APIKeys, auth.RoleOperator)
+	admin := middleware.RequireRole(rtr.APIKeys, auth.RoleAdmin)
+
+	router.GET("/metrics", viewer, rtr.Handler.PrometheusMetrics) // Prometheus scrape endpoint
+
 	v1 := router.Group("/api/v1")
 	{
 		agents := v1.Group("/agents")
 		{
-			agents.GET("", rtr.Handler.ListAgents)                                      // list all agents
-			agents.GET("/:id", rtr.Handler.GetAgent)                                    // get agent data (last seen, isOnline, downtime)
-			agents.GET("/:id/metrics", rtr.Handler.TriggerAgentMetrics)                 // get agent metrics
-			agents.POST("/:id/restart", rtr.Handler.RestartAgent)                       // restart a agent
-			agents.POST("/:id/uninstall", rtr.Handler.UninstallAgent)                   // uninstall a agent
-			agents.POST("/:id/filesystem/:getFromAgent", rtr.Handler.GetAgentFileSystem) // get agent filesystem data
+			agents.GET("", viewer, rtr.Handler.ListAgents)                                         // list all agents
+			agents.GET("/:id", viewer, rtr.Handler.GetAgent)                                       // get agent data (last seen, isOnline, downtime)
+			agents.GET("/:id/metrics", viewer, rtr.Handler.GetAgentMetrics)                        // get agent metrics
+			agents.POST("/:id/restart", operator, rtr.Handler.RestartAgent)                        // restart a agent
+			agents.PUT("/:id/labels", operator, rtr.Handler.SetAgentLabels)                        // replace an agent's labels
+			agents.GET("/:id/snapshot", viewer, rtr.Handler.GetAgentSnapshot)                      // get the master's copy of an agent's shared folder
+			agents.POST("/:id/filesystem/:getFromAgent", operator, rtr.Handler.GetAgentFileSystem) // get agent filesystem data
+			agents.POST("/:id/push", operator, rtr.Handler.PushFileSystem)                         // send a path of the agent to other agents
+			agents.POST("/:id/uninstall", admin, rtr.Handler.UninstallAgent)                       // uninstall a agent
+			agents.DELETE("/:id/credential", admin, rtr.EnrollmentHandler.RevokeCredential)        // revoke an agent's credential
+		}
+		tasks := v1.Group("/tasks")
+		{
+			tasks.POST("", admin, rtr.Handler.CreateTask)  // dispatch a task to an agent
+			tasks.GET("", viewer, rtr.Handler.ListTasks)   // list all tasks
+			tasks.GET("/:id", viewer, rtr.Handler.GetTask) // get task status, output and error
+		}
+		commands := v1.Group("/commands")
+		{
+			commands.GET("", viewer, rtr.Handler.ListCommands)           // list queued and tracked commands, ?agent_id= to filter
+			commands.GET("/:id", viewer, rtr.Handler.GetCommand)         // get a command's outcome
+			commands.DELETE("/:id", operator, rtr.Handler.CancelCommand) // cancel a command queued for an offline agent
+		}
+		transfers := v1.Group("/transfers")
+		{
+			transfers.GET("", viewer, rtr.Handler.ListTransfers)                // list transfers, newest first
+			transfers.GET("/:id", viewer, rtr.Handler.GetTransfer)              // get a transfer's mode, progress and outcome
+			transfers.DELETE("/:id", operator, rtr.Handler.CancelTransfer)      // cancel an unfinished transfer on both agents
+			transfers.POST("/:id/resume", operator, rtr.Handler.ResumeTransfer) // resume a failed transfer from the destination's checkpoint
+		}
+		distributions := v1.Group("/distributions")
+		{
+			distributions.POST("", operator, rtr.Handler.CreateDistribution)       // send a path of one agent to a list or label selector of agents
+			distributions.GET("", viewer, rtr.Handler.ListDistributions)           // list distributions, newest first
+			distributions.GET("/:id", viewer, rtr.Handler.GetDistribution)         // get a distribution's status per destination
+			distributions.DELETE("/:id", operator, rtr.Handler.CancelDistribution) // cancel an unfinished distribution on every agent
+		}
+		syncPairs := v1.Group("/sync")
+		{
+			syncPairs.POST("", operator, rtr.Handler.CreateSyncPair)       // mirror a folder of one agent with a folder of another
+			syncPairs.GET("", viewer, rtr.Handler.ListSyncPairs)           // list sync pairs with each side's state and recent conflicts
+			syncPairs.GET("/:id", viewer, rtr.Handler.GetSyncPair)         // get a sync pair's state
+			syncPairs.DELETE("/:id", operator, rtr.Handler.DeleteSyncPair) // stop syncing a pair, keeping both folders
 		}
+		v1.GET("/files/search", viewer, rtr.Handler.SearchFiles)              // find files across the agents' shared folders, online or not
+		v1.POST("/enroll", rtr.EnrollmentHandler.Enroll)                      // agent trades a one-time token for a credential
+		v1.POST("/enrollment/tokens", admin, rtr.EnrollmentHandler.MintToken) // mint a one-time enrollment token
 	}
 	router.GET("/ws", rtr.WSHandler.UpgradeHandler)
-	router.GET("/sse", rtr.SSEHandler.StreamHandler)
+	router.GET("/sse", middleware.RequireStreamRole(rtr.APIKeys, auth.RoleViewer), rtr.SSEHandler.StreamHandler)
 
 	return router
 }
@@ -0,0 +1,151 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Role is the access level granted to an API key. Roles are ordered: each role
+// can do everything the roles below it can.
+type Role string
+
+const (
+	RoleViewer   Role = "viewer"   // list/get agents, metrics, tasks and the SSE stream
+	RoleOperator Role = "operator" // restart agents and start transfers
+	RoleAdmin    Role = "admin"    // uninstall, run commands, manage enrollment
+)
+
+var roleRank = map[Role]int{
+	RoleViewer:   1,
+	RoleOperator: 2,
+	RoleAdmin:    3,
+}
+
+var (
+	ErrMissingKey = errors.New("api key required")
+	ErrInvalidKey = errors.New("api key is invalid")
+)
+
+func ParseRole(s string) (Role, error) {
+	role := Role(strings.ToLower(strings.TrimSpace(s)))
+	if _, ok := roleRank[role]; !ok {
+		return "", fmt.Errorf("unknown role %q", s)
+	}
+	return role, nil
+}
+
+// Allows reports whether r is at least the required role
+func (r Role) Allows(required Role) bool {
+	return roleRank[r] >= roleRank[required]
+}
+
+// Identity is the caller behind an API key
+type Identity struct {
+	Name string `json:"name"`
+	Role Role   `json:"role"`
+}
+
+type keyEntry struct {
+	Name string `json:"name"`
+	Role string `json:"role"`
+	Key  string `json:"key"`
+}
+
+// KeyStore resolves API keys to identities. Only SHA-256 hashes of the keys are kept in memory.
+type KeyStore struct {
+	keys map[string]Identity // hex(sha256(key)) -> identity
+	mu   sync.RWMutex
+}
+
+func NewKeyStore() *KeyStore {
+	return &KeyStore{
+		keys: make(map[string]Identity),
+	}
+}
+
+func (ks *KeyStore) Add(name string, role Role, key string) error {
+	if key == "" {
+		return fmt.Errorf("api key %q is empty", name)
+	}
+	if _, ok := roleRank[role]; !ok {
+		return fmt.Errorf("api key %q has unknown role %q", name, role)
+	}
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.keys[hashKey(key)] = Identity{Name: name, Role: role}
+	return nil
+}
+
+// LoadEnv parses entries of the form "name:role:key" separated by commas
+func (ks *KeyStore) LoadEnv(value string) error {
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) != 3 {
+			return fmt.Errorf("invalid API_KEYS entry %q, expected name:role:key", entry)
+		}
+		role, err := ParseRole(parts[1])
+		if err != nil {
+			return err
+		}
+		if err := ks.Add(parts[0], role, parts[2]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadFile reads a JSON array of {"name", "role", "key"} objects
+func (ks *KeyStore) LoadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read api keys file: %w", err)
+	}
+	var entries []keyEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("failed to parse api keys file: %w", err)
+	}
+	for _, e := range entries {
+		role, err := ParseRole(e.Role)
+		if err != nil {
+			return err
+		}
+		if err := ks.Add(e.Name, role, e.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ks *KeyStore) Len() int {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	return len(ks.keys)
+}
+
+func (ks *KeyStore) Authenticate(key string) (Identity, error) {
+	if key == "" {
+		return Identity{}, ErrMissingKey
+	}
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	identity, ok := ks.keys[hashKey(key)]
+	if !ok {
+		return Identity{}, ErrInvalidKey
+	}
+	return identity, nil
+}
+
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,242 @@
+package command
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/The-Promised-Neverland/master-server/internal/models"
+	"github.com/The-Promised-Neverland/master-server/internal/sse"
+	"github.com/google/uuid"
+)
+
+// DefaultQueueTTL is how long a command waits for an offline agent before it expires
+const DefaultQueueTTL = 15 * time.Minute
+
+var ErrNotQueued = errors.New("command is not queued")
+
+// Queue holds commands for offline agents until they reconnect, in order per agent.
+// With a path it rewrites a JSON file on every change so queued commands survive a restart.
+type Queue struct {
+	path   string
+	ttl    time.Duration
+	agents map[string][]*models.QueuedCommand
+	sseHub *sse.SSEHub
+	mu     sync.Mutex
+}
+
+func NewQueue(path string, ttl time.Duration, sseHub *sse.SSEHub) (*Queue, error) {
+	if ttl <= 0 {
+		ttl = DefaultQueueTTL
+	}
+	q := &Queue{
+		path:   path,
+		ttl:    ttl,
+		agents: make(map[string][]*models.QueuedCommand),
+		sseHub: sseHub,
+	}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+		case err != nil:
+			return nil, fmt.Errorf("failed to read command queue: %w", err)
+		default:
+			var queued []*models.QueuedCommand
+			if err := json.Unmarshal(data, &queued); err != nil {
+				return nil, fmt.Errorf("failed to parse command queue: %w", err)
+			}
+			for _, qc := range queued {
+				q.agents[qc.AgentID] = append(q.agents[qc.AgentID], qc)
+			}
+		}
+	}
+	go q.sweep()
+	return q, nil
+}
+
+// Enqueue holds msg for agentID and returns the queued command
+func (q *Queue) Enqueue(agentID string, msg models.Message) (*models.Command, error) {
+	now := time.Now()
+	qc := &models.QueuedCommand{
+		Command: models.Command{
+			ID:       uuid.New().String(),
+			AgentID:  agentID,
+			Type:     msg.Type,
+			Status:   models.CommandStatusQueued,
+			QueuedAt: &now,
+			SentAt:   now,
+			Deadline: now.Add(q.ttl),
+		},
+		Payload: msg.Payload,
+	}
+	q.mu.Lock()
+	q.agents[agentID] = append(q.agents[agentID], qc)
+	if err := q.saveLocked(); err != nil {
+		q.agents[agentID] = q.agents[agentID][:len(q.agents[agentID])-1]
+		q.mu.Unlock()
+		return nil, err
+	}
+	snapshot := qc.Command
+	q.mu.Unlock()
+	fmt.Printf("[COMMAND] %s (%s) queued for offline agent %s until %s\n", qc.ID, qc.Type, agentID, qc.Deadline.Format(time.RFC3339))
+	publish(q.sseHub, &snapshot)
+	return &snapshot, nil
+}
+
+// Drain removes and returns the agent's unexpired commands in the order they were queued
+func (q *Queue) Drain(agentID string) []models.QueuedCommand {
+	q.mu.Lock()
+	queued := q.agents[agentID]
+	if len(queued) == 0 {
+		q.mu.Unlock()
+		return nil
+	}
+	delete(q.agents, agentID)
+	if err := q.saveLocked(); err != nil {
+		fmt.Printf("Failed to save command queue: %v\n", err)
+	}
+	q.mu.Unlock()
+	now := time.Now()
+	ready := make([]models.QueuedCommand, 0, len(queued))
+	for _, qc := range queued {
+		if now.After(qc.Deadline) {
+			q.finish(qc, models.CommandStatusExpired)
+			continue
+		}
+		ready = append(ready, *qc)
+	}
+	return ready
+}
+
+// Cancel removes a queued command before it is delivered
+func (q *Queue) Cancel(commandID string) (*models.Command, error) {
+	q.mu.Lock()
+	for agentID, queued := range q.agents {
+		for i, qc := range queued {
+			if qc.ID != commandID {
+				continue
+			}
+			q.removeLocked(agentID, i)
+			if err := q.saveLocked(); err != nil {
+				fmt.Printf("Failed to save command queue: %v\n", err)
+			}
+			q.mu.Unlock()
+			return q.finish(qc, models.CommandStatusCancelled), nil
+		}
+	}
+	q.mu.Unlock()
+	return nil, fmt.Errorf("%w: %s", ErrNotQueued, commandID)
+}
+
+func (q *Queue) Get(commandID string) *models.Command {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, queued := range q.agents {
+		for _, qc := range queued {
+			if qc.ID == commandID {
+				snapshot := qc.Command
+				return &snapshot
+			}
+		}
+	}
+	return nil
+}
+
+// List returns queued commands, oldest first, optionally only those for agentID
+func (q *Queue) List(agentID string) []*models.Command {
+	q.mu.Lock()
+	cmds := make([]*models.Command, 0)
+	for id, queued := range q.agents {
+		if agentID != "" && id != agentID {
+			continue
+		}
+		for _, qc := range queued {
+			snapshot := qc.Command
+			cmds = append(cmds, &snapshot)
+		}
+	}
+	q.mu.Unlock()
+	sort.Slice(cmds, func(i, j int) bool {
+		return cmds[i].QueuedAt.Before(*cmds[j].QueuedAt)
+	})
+	return cmds
+}
+
+func (q *Queue) finish(qc *models.QueuedCommand, status string) *models.Command {
+	now := time.Now()
+	snapshot := qc.Command
+	snapshot.Status = status
+	snapshot.AnsweredAt = &now
+	fmt.Printf("[COMMAND] Queued %s (%s) for agent %s %s\n", snapshot.ID, snapshot.Type, snapshot.AgentID, status)
+	publish(q.sseHub, &snapshot)
+	return &snapshot
+}
+
+func (q *Queue) removeLocked(agentID string, i int) {
+	queued := append(q.agents[agentID][:i:i], q.agents[agentID][i+1:]...)
+	if len(queued) == 0 {
+		delete(q.agents, agentID)
+		return
+	}
+	q.agents[agentID] = queued
+}
+
+// sweep expires commands whose agent did not come back in time
+func (q *Queue) sweep() {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		now := time.Now()
+		var expired []*models.QueuedCommand
+		q.mu.Lock()
+		for agentID, queued := range q.agents {
+			for i := len(queued) - 1; i >= 0; i-- {
+				if now.After(queued[i].Deadline) {
+					expired = append(expired, queued[i])
+					q.removeLocked(agentID, i)
+					queued = q.agents[agentID]
+				}
+			}
+		}
+		if len(expired) > 0 {
+			if err := q.saveLocked(); err != nil {
+				fmt.Printf("Failed to save command queue: %v\n", err)
+			}
+		}
+		q.mu.Unlock()
+		for _, qc := range expired {
+			q.finish(qc, models.CommandStatusExpired)
+		}
+	}
+}
+
+func (q *Queue) saveLocked() error {
+	if q.path == "" {
+		return nil
+	}
+	queued := make([]*models.QueuedCommand, 0)
+	for _, cmds := range q.agents {
+		queued = append(queued, cmds...)
+	}
+	sort.SliceStable(queued, func(i, j int) bool {
+		return queued[i].QueuedAt.Before(*queued[j].QueuedAt)
+	})
+	data, err := json.MarshalIndent(queued, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(q.path), 0700); err != nil {
+		return fmt.Errorf("failed to create command queue directory: %w", err)
+	}
+	tmp := q.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write command queue: %w", err)
+	}
+	return os.Rename(tmp, q.path)
+}
@@ -0,0 +1,243 @@
+package command
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/The-Promised-Neverland/master-server/internal/models"
+	"github.com/The-Promised-Neverland/master-server/internal/sse"
+	"github.com/google/uuid"
+)
+
+const (
+	// DefaultTimeout is how long a command may stay pending before it is marked timed_out
+	DefaultTimeout = 30 * time.Second
+	// retention is how long answered commands stay queryable
+	retention     = time.Hour
+	sweepInterval = 5 * time.Second
+)
+
+var (
+	ErrUnknownCommand = errors.New("unknown command")
+	ErrWrongAgent     = errors.New("command was sent to another agent")
+)
+
+type entry struct {
+	cmd     *models.Command
+	done    chan struct{} // closed on the first answer (or timeout)
+	settled chan struct{} // closed once the status can no longer change
+}
+
+// Tracker records master->agent commands and the agent_command_result answering each one.
+// An accepted command can still move to ok or error, and late answers after a timeout are
+// recorded as well, so the tracker keeps the real outcome.
+type Tracker struct {
+	commands map[string]*entry
+	sseHub   *sse.SSEHub
+	mu       sync.RWMutex
+}
+
+func NewTracker(sseHub *sse.SSEHub) *Tracker {
+	t := &Tracker{
+		commands: make(map[string]*entry),
+		sseHub:   sseHub,
+	}
+	go t.sweep()
+	return t
+}
+
+// Track registers a new pending command of msgType for agentID
+func (t *Tracker) Track(agentID string, msgType string, timeout time.Duration) *models.Command {
+	return t.track(&models.Command{
+		ID:      uuid.New().String(),
+		AgentID: agentID,
+		Type:    msgType,
+	}, timeout)
+}
+
+// TrackDelivered registers a command taken off the offline queue, keeping its ID
+func (t *Tracker) TrackDelivered(queued models.Command, timeout time.Duration) *models.Command {
+	return t.track(&queued, timeout)
+}
+
+func (t *Tracker) track(cmd *models.Command, timeout time.Duration) *models.Command {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	now := time.Now()
+	cmd.Status = models.CommandStatusPending
+	cmd.SentAt = now
+	cmd.Deadline = now.Add(timeout)
+	t.mu.Lock()
+	t.commands[cmd.ID] = &entry{cmd: cmd, done: make(chan struct{}), settled: make(chan struct{})}
+	snapshot := *cmd
+	t.mu.Unlock()
+	t.publish(&snapshot)
+	return &snapshot
+}
+
+// Resolve applies an agent_command_result from agentID to the command it replies to
+func (t *Tracker) Resolve(agentID string, commandID string, result models.CommandResultPayload) error {
+	switch result.Status {
+	case models.CommandStatusAccepted, models.CommandStatusOK, models.CommandStatusError:
+	default:
+		return fmt.Errorf("invalid command result status %q", result.Status)
+	}
+	t.mu.Lock()
+	e := t.commands[commandID]
+	if e == nil {
+		t.mu.Unlock()
+		return fmt.Errorf("%w: %s", ErrUnknownCommand, commandID)
+	}
+	if e.cmd.AgentID != agentID {
+		t.mu.Unlock()
+		return fmt.Errorf("%w: %s", ErrWrongAgent, commandID)
+	}
+	if (e.cmd.Status == models.CommandStatusOK || e.cmd.Status == models.CommandStatusError) ||
+		(e.cmd.Status == models.CommandStatusAccepted && result.Status == models.CommandStatusAccepted) {
+		t.mu.Unlock()
+		return nil
+	}
+	now := time.Now()
+	e.cmd.Status = result.Status
+	e.cmd.Error = result.Error
+	e.cmd.AnsweredAt = &now
+	t.closeLocked(e)
+	snapshot := *e.cmd
+	t.mu.Unlock()
+	t.publish(&snapshot)
+	return nil
+}
+
+// Fail marks a command that never reached the agent
+func (t *Tracker) Fail(commandID string, reason string) {
+	t.mu.Lock()
+	e := t.commands[commandID]
+	if e == nil {
+		t.mu.Unlock()
+		return
+	}
+	e.cmd.Status = models.CommandStatusError
+	e.cmd.Error = reason
+	t.closeLocked(e)
+	snapshot := *e.cmd
+	t.mu.Unlock()
+	t.publish(&snapshot)
+}
+
+// Wait blocks until the command has an answer or timed out, or until wait elapses,
+// and returns the command as it stands then.
+func (t *Tracker) Wait(commandID string, wait time.Duration) *models.Command {
+	return t.wait(commandID, wait, func(e *entry) <-chan struct{} { return e.done })
+}
+
+// WaitSettled is like Wait but also waits past "accepted" for the final ok or error
+func (t *Tracker) WaitSettled(commandID string, wait time.Duration) *models.Command {
+	return t.wait(commandID, wait, func(e *entry) <-chan struct{} { return e.settled })
+}
+
+func (t *Tracker) wait(commandID string, wait time.Duration, ch func(e *entry) <-chan struct{}) *models.Command {
+	t.mu.RLock()
+	e := t.commands[commandID]
+	t.mu.RUnlock()
+	if e == nil {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ch(e):
+	case <-timer.C:
+	}
+	return t.Get(commandID)
+}
+
+func (t *Tracker) Get(commandID string) *models.Command {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	e := t.commands[commandID]
+	if e == nil {
+		return nil
+	}
+	snapshot := *e.cmd
+	return &snapshot
+}
+
+// List returns known commands, newest first, optionally only those sent to agentID
+func (t *Tracker) List(agentID string) []*models.Command {
+	t.mu.RLock()
+	cmds := make([]*models.Command, 0, len(t.commands))
+	for _, e := range t.commands {
+		if agentID != "" && e.cmd.AgentID != agentID {
+			continue
+		}
+		snapshot := *e.cmd
+		cmds = append(cmds, &snapshot)
+	}
+	t.mu.RUnlock()
+	sort.Slice(cmds, func(i, j int) bool {
+		return cmds[i].SentAt.After(cmds[j].SentAt)
+	})
+	return cmds
+}
+
+// closeLocked signals waiters for the command's current status
+func (t *Tracker) closeLocked(e *entry) {
+	select {
+	case <-e.done:
+	default:
+		close(e.done)
+	}
+	if e.cmd.Status == models.CommandStatusAccepted {
+		return
+	}
+	select {
+	case <-e.settled:
+	default:
+		close(e.settled)
+	}
+}
+
+// sweep times out pending commands past their deadline and forgets old ones
+func (t *Tracker) sweep() {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		now := time.Now()
+		var timedOut []*models.Command
+		t.mu.Lock()
+		for id, e := range t.commands {
+			switch {
+			case e.cmd.Status == models.CommandStatusPending && now.After(e.cmd.Deadline):
+				e.cmd.Status = models.CommandStatusTimedOut
+				t.closeLocked(e)
+				snapshot := *e.cmd
+				timedOut = append(timedOut, &snapshot)
+			case e.cmd.Status != models.CommandStatusPending && now.Sub(e.cmd.SentAt) > retention:
+				delete(t.commands, id)
+			}
+		}
+		t.mu.Unlock()
+		for _, cmd := range timedOut {
+			fmt.Printf("[COMMAND] %s (%s) to agent %s timed out\n", cmd.ID, cmd.Type, cmd.AgentID)
+			t.publish(cmd)
+		}
+	}
+}
+
+func (t *Tracker) publish(cmd *models.Command) {
+	publish(t.sseHub, cmd)
+}
+
+func publish(sseHub *sse.SSEHub, cmd *models.Command) {
+	if sseHub == nil {
+		return
+	}
+	sseHub.Broadcast(models.Message{
+		Type:    models.SSEMsgCommandUpdate,
+		Payload: cmd,
+	})
+}
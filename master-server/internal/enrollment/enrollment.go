@@ -0,0 +1,252 @@
+package enrollment
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	DefaultTokenTTL = 24 * time.Hour
+	// CredentialStatusHeader tells an agent whose /ws upgrade was rejected why, so it only
+	// discards its credential when it can no longer be used
+	CredentialStatusHeader = "X-Credential-Status"
+	CredentialRevoked      = "revoked"
+)
+
+var (
+	ErrInvalidToken      = errors.New("enrollment token is invalid, expired or already used")
+	ErrInvalidCredential = errors.New("agent credential is invalid")
+	ErrCredentialRevoked = errors.New("agent credential was revoked")
+	ErrNotBound          = errors.New("credential is not bound to this agent")
+)
+
+// Token is a one-time enrollment token minted by an admin. Only its hash is kept.
+type Token struct {
+	ID        string     `json:"id"`
+	Hash      string     `json:"hash"`
+	Label     string     `json:"label,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+	UsedBy    string     `json:"used_by,omitempty"`
+}
+
+// Credential is the long-lived secret an agent presents on every /ws upgrade
+type Credential struct {
+	ID         string     `json:"id"`
+	AgentID    string     `json:"agent_id"`
+	SecretHash string     `json:"secret_hash"`
+	TokenID    string     `json:"token_id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+type state struct {
+	Tokens      map[string]*Token      `json:"tokens"`
+	Credentials map[string]*Credential `json:"credentials"`
+	Bindings    map[string]string      `json:"bindings"` // agent ID -> credential ID
+}
+
+// Manager mints enrollment tokens, issues agent credentials and verifies them.
+// State is written to a JSON file so credentials survive master restarts.
+type Manager struct {
+	path  string
+	state state
+	mu    sync.RWMutex
+}
+
+func NewManager(path string) (*Manager, error) {
+	m := &Manager{
+		path: path,
+		state: state{
+			Tokens:      make(map[string]*Token),
+			Credentials: make(map[string]*Credential),
+			Bindings:    make(map[string]string),
+		},
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read enrollment store: %w", err)
+	}
+	if err := json.Unmarshal(data, &m.state); err != nil {
+		return nil, fmt.Errorf("failed to parse enrollment store: %w", err)
+	}
+	if m.state.Tokens == nil {
+		m.state.Tokens = make(map[string]*Token)
+	}
+	if m.state.Credentials == nil {
+		m.state.Credentials = make(map[string]*Credential)
+	}
+	if m.state.Bindings == nil {
+		m.state.Bindings = make(map[string]string)
+	}
+	return m, nil
+}
+
+// MintToken creates a one-time enrollment token. The plain token is only returned here.
+func (m *Manager) MintToken(label string, ttl time.Duration) (string, *Token, error) {
+	if ttl <= 0 {
+		ttl = DefaultTokenTTL
+	}
+	secret, err := randomSecret()
+	if err != nil {
+		return "", nil, err
+	}
+	now := time.Now()
+	token := &Token{
+		ID:        uuid.New().String(),
+		Hash:      hash(secret),
+		Label:     label,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.state.Tokens[token.ID] = token
+	if err := m.saveLocked(); err != nil {
+		delete(m.state.Tokens, token.ID)
+		return "", nil, err
+	}
+	snapshot := *token
+	return token.ID + "." + secret, &snapshot, nil
+}
+
+// Enroll trades a one-time token for a credential bound to agentID.
+// A previously bound credential for the same agent is revoked.
+func (m *Manager) Enroll(plainToken string, agentID string) (string, *Credential, error) {
+	if agentID == "" {
+		return "", nil, errors.New("agent_id is required")
+	}
+	tokenID, secret, ok := strings.Cut(plainToken, ".")
+	if !ok {
+		return "", nil, ErrInvalidToken
+	}
+	credSecret, err := randomSecret()
+	if err != nil {
+		return "", nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	token, exists := m.state.Tokens[tokenID]
+	now := time.Now()
+	if !exists || token.UsedAt != nil || now.After(token.ExpiresAt) || !hashEqual(token.Hash, secret) {
+		return "", nil, ErrInvalidToken
+	}
+	token.UsedAt = &now
+	token.UsedBy = agentID
+	cred := &Credential{
+		ID:         uuid.New().String(),
+		AgentID:    agentID,
+		SecretHash: hash(credSecret),
+		TokenID:    token.ID,
+		CreatedAt:  now,
+	}
+	if oldID, bound := m.state.Bindings[agentID]; bound {
+		if old := m.state.Credentials[oldID]; old != nil && old.RevokedAt == nil {
+			old.RevokedAt = &now
+		}
+	}
+	m.state.Credentials[cred.ID] = cred
+	m.state.Bindings[agentID] = cred.ID
+	if err := m.saveLocked(); err != nil {
+		return "", nil, err
+	}
+	snapshot := *cred
+	return cred.ID + "." + credSecret, &snapshot, nil
+}
+
+// Authenticate checks that plainCredential is valid and bound to agentID.
+// It returns the credential ID on success, and ErrCredentialRevoked for a revoked or
+// replaced credential.
+func (m *Manager) Authenticate(agentID string, plainCredential string) (string, error) {
+	credID, secret, ok := strings.Cut(plainCredential, ".")
+	if !ok {
+		return "", ErrInvalidCredential
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	cred, exists := m.state.Credentials[credID]
+	if !exists || !hashEqual(cred.SecretHash, secret) {
+		return "", ErrInvalidCredential
+	}
+	if cred.RevokedAt != nil {
+		return "", ErrCredentialRevoked
+	}
+	if cred.AgentID != agentID || m.state.Bindings[agentID] != credID {
+		return "", ErrNotBound
+	}
+	return credID, nil
+}
+
+// BoundCredential returns the credential ID an agent is bound to, if any
+func (m *Manager) BoundCredential(agentID string) string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.state.Bindings[agentID]
+}
+
+// Revoke invalidates the credential bound to agentID. The agent must re-enroll.
+func (m *Manager) Revoke(agentID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	credID, bound := m.state.Bindings[agentID]
+	if !bound {
+		return fmt.Errorf("agent %s has no credential", agentID)
+	}
+	now := time.Now()
+	if cred := m.state.Credentials[credID]; cred != nil && cred.RevokedAt == nil {
+		cred.RevokedAt = &now
+	}
+	delete(m.state.Bindings, agentID)
+	return m.saveLocked()
+}
+
+func (m *Manager) saveLocked() error {
+	if m.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(m.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(m.path), 0700); err != nil {
+		return fmt.Errorf("failed to create enrollment store directory: %w", err)
+	}
+	tmp := m.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write enrollment store: %w", err)
+	}
+	return os.Rename(tmp, m.path)
+}
+
+func randomSecret() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate secret: %w", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func hash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func hashEqual(storedHash string, secret string) bool {
+	return subtle.ConstantTimeCompare([]byte(storedHash), []byte(hash(secret))) == 1
+}
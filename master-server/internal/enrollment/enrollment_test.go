@@ -0,0 +1,150 @@
+package enrollment
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestManager(t *testing.T) *Manager {
+	t.Helper()
+	m, err := NewManager(filepath.Join(t.TempDir(), "enrollment.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func mint(t *testing.T, m *Manager) string {
+	t.Helper()
+	plain, _, err := m.MintToken("test", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return plain
+}
+
+func TestEnrollToken(t *testing.T) {
+	tests := []struct {
+		name    string
+		token   func(m *Manager, plain string) string
+		wantErr error
+	}{
+		{"valid", func(m *Manager, plain string) string { return plain }, nil},
+		{"expired", func(m *Manager, plain string) string {
+			id, _, _ := strings.Cut(plain, ".")
+			m.state.Tokens[id].ExpiresAt = time.Now().Add(-time.Second)
+			return plain
+		}, ErrInvalidToken},
+		{"wrong secret", func(m *Manager, plain string) string {
+			id, _, _ := strings.Cut(plain, ".")
+			return id + ".0000"
+		}, ErrInvalidToken},
+		{"unknown token", func(m *Manager, plain string) string { return "nope.nope" }, ErrInvalidToken},
+		{"malformed", func(m *Manager, plain string) string { return "no-separator" }, ErrInvalidToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestManager(t)
+			plain := tt.token(m, mint(t, m))
+			credential, cred, err := m.Enroll(plain, "a1")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Enroll error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if cred.AgentID != "a1" || !strings.HasPrefix(credential, cred.ID+".") {
+				t.Fatalf("credential %q for %+v", credential, cred)
+			}
+		})
+	}
+}
+
+func TestEnrollTokenSingleUse(t *testing.T) {
+	m := newTestManager(t)
+	plain := mint(t, m)
+	if _, _, err := m.Enroll(plain, "a1"); err != nil {
+		t.Fatal(err)
+	}
+	for _, agentID := range []string{"a1", "a2"} {
+		if _, _, err := m.Enroll(plain, agentID); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("second use by %s: error = %v, want %v", agentID, err, ErrInvalidToken)
+		}
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	tests := []struct {
+		name       string
+		agentID    string
+		credential func(m *Manager, plain string) string
+		wantErr    error
+	}{
+		{"valid", "a1", func(m *Manager, plain string) string { return plain }, nil},
+		{"wrong secret", "a1", func(m *Manager, plain string) string {
+			id, _, _ := strings.Cut(plain, ".")
+			return id + ".0000"
+		}, ErrInvalidCredential},
+		{"malformed", "a1", func(m *Manager, plain string) string { return "no-separator" }, ErrInvalidCredential},
+		{"unknown", "a1", func(m *Manager, plain string) string { return "nope.nope" }, ErrInvalidCredential},
+		{"other agent", "a2", func(m *Manager, plain string) string { return plain }, ErrNotBound},
+		{"revoked", "a1", func(m *Manager, plain string) string {
+			if err := m.Revoke("a1"); err != nil {
+				t.Fatal(err)
+			}
+			return plain
+		}, ErrCredentialRevoked},
+		{"replaced by re-enrollment", "a1", func(m *Manager, plain string) string {
+			if _, _, err := m.Enroll(mint(t, m), "a1"); err != nil {
+				t.Fatal(err)
+			}
+			return plain
+		}, ErrCredentialRevoked},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestManager(t)
+			plain, cred, err := m.Enroll(mint(t, m), "a1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			credID, err := m.Authenticate(tt.agentID, tt.credential(m, plain))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Authenticate error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && credID != cred.ID {
+				t.Fatalf("Authenticate = %s, want %s", credID, cred.ID)
+			}
+		})
+	}
+}
+
+func TestCredentialSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "enrollment.json")
+	m, err := NewManager(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plainToken, _, err := m.MintToken("test", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, _, err := m.Enroll(plainToken, "a1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restarted, err := NewManager(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := restarted.Authenticate("a1", plain); err != nil {
+		t.Fatalf("credential rejected after restart: %v", err)
+	}
+	if _, _, err := restarted.Enroll(plainToken, "a2"); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("used token accepted after restart: %v", err)
+	}
+}
@@ -0,0 +1,357 @@
+package metrics
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sample is one heartbeat reading from an agent
+type Sample struct {
+	Timestamp   time.Time
+	CPUUsage    float64
+	MemoryUsage float64
+	DiskUsage   float64
+	Uptime      uint64
+}
+
+// Point is a raw sample or the average of all samples in a rollup bucket
+type Point struct {
+	Timestamp   time.Time `json:"timestamp"`
+	CPUUsage    float64   `json:"cpu_usage"`
+	MemoryUsage float64   `json:"memory_usage"`
+	DiskUsage   float64   `json:"disk_usage"`
+	Uptime      uint64    `json:"uptime"`
+	Samples     int       `json:"samples"`
+}
+
+func (p *Point) merge(o Point) {
+	total := float64(p.Samples + o.Samples)
+	p.CPUUsage = (p.CPUUsage*float64(p.Samples) + o.CPUUsage*float64(o.Samples)) / total
+	p.MemoryUsage = (p.MemoryUsage*float64(p.Samples) + o.MemoryUsage*float64(o.Samples)) / total
+	p.DiskUsage = (p.DiskUsage*float64(p.Samples) + o.DiskUsage*float64(o.Samples)) / total
+	p.Uptime = o.Uptime // points are merged in time order, keep the latest
+	p.Samples += o.Samples
+}
+
+// Tier is one level of the store. Resolution 0 keeps raw samples.
+type Tier struct {
+	Resolution time.Duration
+	Retention  time.Duration
+}
+
+// DefaultTiers keeps an hour of raw heartbeats, a day of 1m rollups and 30 days of 1h rollups
+var DefaultTiers = []Tier{
+	{Resolution: 0, Retention: time.Hour},
+	{Resolution: time.Minute, Retention: 24 * time.Hour},
+	{Resolution: time.Hour, Retention: 30 * 24 * time.Hour},
+}
+
+type series struct {
+	AgentID string    `json:"agent_id"`
+	Tiers   [][]Point `json:"tiers"`
+	Open    []*Point  `json:"open"` // bucket still being filled, per rollup tier
+	dirty   bool
+}
+
+// Store is an embedded per-agent time-series store with downsampled rollups.
+// Each agent's series is kept in memory and flushed to its own JSON file in dir.
+type Store struct {
+	dir    string
+	tiers  []Tier
+	series map[string]*series
+	mu     sync.Mutex
+	now    func() time.Time // the clock retention is measured against
+	// flushMu keeps Delete from removing a file while Flush is still writing it
+	flushMu sync.Mutex
+}
+
+func NewStore(dir string, tiers []Tier) (*Store, error) {
+	if len(tiers) == 0 {
+		tiers = DefaultTiers
+	}
+	s := &Store{
+		dir:    dir,
+		tiers:  tiers,
+		series: make(map[string]*series),
+		now:    time.Now,
+	}
+	if dir == "" {
+		return s, nil
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read metrics file %s: %w", file, err)
+		}
+		var ser series
+		if err := json.Unmarshal(data, &ser); err != nil {
+			return nil, fmt.Errorf("failed to parse metrics file %s: %w", file, err)
+		}
+		if ser.AgentID == "" || len(ser.Tiers) != len(tiers) || len(ser.Open) != len(tiers) {
+			fmt.Printf("Skipping metrics file %s: tier layout changed\n", file)
+			continue
+		}
+		s.series[ser.AgentID] = &ser
+	}
+	return s, nil
+}
+
+// Record appends a sample to the raw tier and folds it into every rollup bucket
+func (s *Store) Record(agentID string, sample Sample) {
+	if sample.Timestamp.IsZero() {
+		sample.Timestamp = s.now()
+	}
+	p := Point{
+		Timestamp:   sample.Timestamp,
+		CPUUsage:    sample.CPUUsage,
+		MemoryUsage: sample.MemoryUsage,
+		DiskUsage:   sample.DiskUsage,
+		Uptime:      sample.Uptime,
+		Samples:     1,
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ser := s.series[agentID]
+	if ser == nil {
+		ser = &series{
+			AgentID: agentID,
+			Tiers:   make([][]Point, len(s.tiers)),
+			Open:    make([]*Point, len(s.tiers)),
+		}
+		s.series[agentID] = ser
+	}
+	for i, tier := range s.tiers {
+		if tier.Resolution == 0 {
+			ser.Tiers[i] = append(ser.Tiers[i], p)
+		} else {
+			bucket := p.Timestamp.Truncate(tier.Resolution)
+			if open := ser.Open[i]; open != nil && !open.Timestamp.Equal(bucket) {
+				ser.Tiers[i] = append(ser.Tiers[i], *open)
+				ser.Open[i] = nil
+			}
+			if ser.Open[i] == nil {
+				ser.Open[i] = &Point{Timestamp: bucket}
+			}
+			ser.Open[i].merge(p)
+		}
+		ser.Tiers[i] = prune(ser.Tiers[i], p.Timestamp.Add(-tier.Retention))
+	}
+	ser.dirty = true
+}
+
+// Query returns points in [from, to] averaged into step-sized buckets. It reads from the
+// finest tier whose retention still covers from, so step is raised to that tier's resolution.
+func (s *Store) Query(agentID string, from, to time.Time, step time.Duration) ([]Point, time.Duration) {
+	now := s.now()
+	tierIdx := len(s.tiers) - 1
+	for i, tier := range s.tiers {
+		// a minute of slack so "the last hour" still reads the one-hour raw tier
+		if now.Sub(from) <= tier.Retention+time.Minute {
+			tierIdx = i
+			break
+		}
+	}
+	if res := s.tiers[tierIdx].Resolution; step < res {
+		step = res
+	}
+
+	s.mu.Lock()
+	var points []Point
+	if ser := s.series[agentID]; ser != nil {
+		s.pruneLocked(ser, now)
+		for _, p := range ser.Tiers[tierIdx] {
+			if !p.Timestamp.Before(from) && !p.Timestamp.After(to) {
+				points = append(points, p)
+			}
+		}
+		if open := ser.Open[tierIdx]; open != nil && !open.Timestamp.Before(from) && !open.Timestamp.After(to) {
+			points = append(points, *open)
+		}
+	}
+	s.mu.Unlock()
+
+	if step <= s.tiers[tierIdx].Resolution || step <= 0 {
+		return points, step
+	}
+	buckets := make([]Point, 0)
+	for _, p := range points {
+		bucket := p.Timestamp.Truncate(step)
+		if n := len(buckets); n > 0 && buckets[n-1].Timestamp.Equal(bucket) {
+			buckets[n-1].merge(p)
+			continue
+		}
+		p.Timestamp = bucket
+		buckets = append(buckets, p)
+	}
+	return buckets, step
+}
+
+// Latest returns the most recent raw sample recorded for the agent
+func (s *Store) Latest(agentID string) (Point, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ser := s.series[agentID]
+	if ser == nil {
+		return Point{}, false
+	}
+	for i, tier := range s.tiers {
+		if tier.Resolution == 0 && len(ser.Tiers[i]) > 0 {
+			return ser.Tiers[i][len(ser.Tiers[i])-1], true
+		}
+	}
+	return Point{}, false
+}
+
+// StartFlusher writes changed series to disk every interval
+func (s *Store) StartFlusher(interval time.Duration) {
+	if s.dir == "" {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := s.Flush(); err != nil {
+				fmt.Printf("Failed to flush metrics: %v\n", err)
+			}
+		}
+	}()
+}
+
+// Flush writes every series that changed since the last flush
+func (s *Store) Flush() error {
+	if s.dir == "" {
+		return nil
+	}
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+	s.mu.Lock()
+	pending := make(map[string][]byte)
+	now := s.now()
+	for id, ser := range s.series {
+		s.pruneLocked(ser, now) // agents that went offline record nothing that would prune them
+		if !ser.dirty {
+			continue
+		}
+		data, err := json.Marshal(ser)
+		if err != nil {
+			s.mu.Unlock()
+			return err
+		}
+		pending[id] = data
+		ser.dirty = false
+	}
+	s.mu.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return fmt.Errorf("failed to create metrics directory: %w", err)
+	}
+	var errs []error
+	for id, data := range pending {
+		path := s.path(id)
+		tmp := path + ".tmp"
+		if err := os.WriteFile(tmp, data, 0600); err != nil {
+			errs = append(errs, err)
+			s.markDirty(id)
+			continue
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			errs = append(errs, err)
+			s.markDirty(id)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Delete forgets an agent's series and removes its file
+func (s *Store) Delete(agentID string) error {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+	s.mu.Lock()
+	delete(s.series, agentID)
+	s.mu.Unlock()
+	if s.dir == "" {
+		return nil
+	}
+	if err := os.Remove(s.path(agentID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove metrics file: %w", err)
+	}
+	return nil
+}
+
+func (s *Store) path(agentID string) string {
+	return filepath.Join(s.dir, url.PathEscape(agentID)+".json")
+}
+
+// pruneLocked drops the points of ser that every tier's retention has run out for at now
+func (s *Store) pruneLocked(ser *series, now time.Time) {
+	for i, tier := range s.tiers {
+		cutoff := now.Add(-tier.Retention)
+		if pruned := prune(ser.Tiers[i], cutoff); len(pruned) != len(ser.Tiers[i]) {
+			ser.Tiers[i] = pruned
+			ser.dirty = true
+		}
+		if open := ser.Open[i]; open != nil && open.Timestamp.Before(cutoff) {
+			ser.Open[i] = nil
+			ser.dirty = true
+		}
+	}
+}
+
+func (s *Store) markDirty(agentID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ser := s.series[agentID]; ser != nil {
+		ser.dirty = true
+	}
+}
+
+// ParseStep accepts a Go duration ("30s", "5m") or a number of seconds
+func ParseStep(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return d, nil
+	}
+	seconds, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	if err != nil || seconds < 0 {
+		return 0, fmt.Errorf("invalid step %q", value)
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// ParseTime accepts RFC3339 or unix seconds
+func ParseTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	seconds, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q", value)
+	}
+	return time.Unix(seconds, 0), nil
+}
+
+func prune(points []Point, cutoff time.Time) []Point {
+	i := sort.Search(len(points), func(i int) bool {
+		return !points[i].Timestamp.Before(cutoff)
+	})
+	return points[i:] // append reallocates once capacity runs out, dropping the pruned prefix
+}
@@ -0,0 +1,133 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+)
+
+var testNow = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+func newTestStore(t *testing.T, dir string, now *time.Time) *Store {
+	t.Helper()
+	s, err := NewStore(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.now = func() time.Time { return *now }
+	return s
+}
+
+func TestRollup(t *testing.T) {
+	now := testNow
+	s := newTestStore(t, "", &now)
+	for i, cpu := range []float64{10, 20, 30, 40} {
+		s.Record("a1", Sample{Timestamp: testNow.Add(time.Duration(i) * 20 * time.Second), CPUUsage: cpu, Uptime: uint64(i)})
+	}
+
+	ser := s.series["a1"]
+	if raw := ser.Tiers[0]; len(raw) != 4 {
+		t.Fatalf("raw tier has %d points, want 4", len(raw))
+	}
+	// 0s, 20s and 40s fill the first minute; the sample at 60s closes it
+	if minutes := ser.Tiers[1]; len(minutes) != 1 || !minutes[0].Timestamp.Equal(testNow) || minutes[0].CPUUsage != 20 || minutes[0].Samples != 3 || minutes[0].Uptime != 2 {
+		t.Fatalf("closed minute buckets = %+v", minutes)
+	}
+	if open := ser.Open[1]; open == nil || !open.Timestamp.Equal(testNow.Add(time.Minute)) || open.CPUUsage != 40 || open.Samples != 1 {
+		t.Fatalf("open minute bucket = %+v", open)
+	}
+	if hours := ser.Tiers[2]; len(hours) != 0 {
+		t.Fatalf("closed hour buckets = %+v", hours)
+	}
+	if open := ser.Open[2]; open == nil || !open.Timestamp.Equal(testNow) || open.CPUUsage != 25 || open.Samples != 4 || open.Uptime != 3 {
+		t.Fatalf("open hour bucket = %+v", open)
+	}
+}
+
+func TestQueryTierSelection(t *testing.T) {
+	now := testNow
+	s := newTestStore(t, "", &now)
+	// a sample a minute for three days, the last one at now
+	for at := testNow.Add(-72 * time.Hour); !at.After(testNow); at = at.Add(time.Minute) {
+		s.Record("a1", Sample{Timestamp: at, CPUUsage: 50})
+	}
+
+	tests := []struct {
+		name       string
+		from       time.Duration // before now
+		step       time.Duration
+		wantStep   time.Duration
+		wantPoints int
+		wantFirst  int // samples in the first point
+	}{
+		{"last 30 minutes from the raw tier", 30 * time.Minute, 0, 0, 31, 1},
+		{"the last hour still reads the raw tier", time.Hour, 0, 0, 61, 1},
+		{"raw samples averaged per step", 30 * time.Minute, 10 * time.Minute, 10 * time.Minute, 4, 10},
+		{"3 hours from the minute tier", 3 * time.Hour, 0, time.Minute, 181, 1},
+		{"step raised to the minute tier's resolution", 3 * time.Hour, 30 * time.Second, time.Minute, 181, 1},
+		{"minute buckets averaged per step", 3 * time.Hour, time.Hour, time.Hour, 4, 60},
+		{"2 days from the hour tier", 48 * time.Hour, 0, time.Hour, 49, 60},
+		{"a month from the hour tier", 30 * 24 * time.Hour, 0, time.Hour, 73, 60},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			points, step := s.Query("a1", testNow.Add(-tt.from), testNow, tt.step)
+			if step != tt.wantStep {
+				t.Errorf("step = %v, want %v", step, tt.wantStep)
+			}
+			if len(points) != tt.wantPoints {
+				t.Fatalf("%d points, want %d", len(points), tt.wantPoints)
+			}
+			if points[0].Samples != tt.wantFirst {
+				t.Errorf("first point averages %d samples, want %d", points[0].Samples, tt.wantFirst)
+			}
+			for _, p := range points {
+				if p.CPUUsage != 50 {
+					t.Fatalf("point %+v, want cpu 50", p)
+				}
+			}
+		})
+	}
+
+	if points, _ := s.Query("unknown", testNow.Add(-time.Hour), testNow, 0); points != nil {
+		t.Errorf("points for an unknown agent: %+v", points)
+	}
+}
+
+// An agent that went offline records nothing that would prune its series, so flushing and
+// querying prune it against the clock
+func TestPruneWithoutNewSamples(t *testing.T) {
+	now := testNow
+	dir := t.TempDir()
+	s := newTestStore(t, dir, &now)
+	s.Record("a1", Sample{Timestamp: testNow, CPUUsage: 50})
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	now = testNow.Add(2 * time.Hour)
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	ser := s.series["a1"]
+	if len(ser.Tiers[0]) != 0 {
+		t.Fatalf("raw tier kept %d points past its retention", len(ser.Tiers[0]))
+	}
+	if ser.Open[1] == nil || ser.Open[2] == nil {
+		t.Fatal("rollups pruned before their retention")
+	}
+	reloaded, err := NewStore(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := reloaded.Latest("a1"); ok {
+		t.Fatal("pruned raw sample was not flushed away")
+	}
+
+	now = testNow.Add(25 * time.Hour)
+	if points, _ := s.Query("a1", testNow.Add(-time.Hour), now, 0); len(points) != 1 {
+		t.Fatalf("%d points from the hour tier, want 1", len(points))
+	}
+	if ser.Open[1] != nil {
+		t.Fatal("minute rollup kept past its retention")
+	}
+}
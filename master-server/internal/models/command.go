@@ -0,0 +1,67 @@
+package models
+
+import "time"
+
+const (
+	MasterMsgRestartAgent   = "master_restart_request"
+	MasterMsgAgentUninstall = "master_uninstall_initiated"
+
+	AgentMsgCommandResult = "agent_command_result"
+
+	SSEMsgCommandUpdate = "command_update"
+
+	// CommandStatusQueued: the agent is offline, the command waits for it to reconnect
+	CommandStatusQueued = "queued"
+	// CommandStatusPending: sent, no answer yet
+	CommandStatusPending = "pending"
+	// CommandStatusAccepted: the agent acknowledged a command it acts on after replying (restart, uninstall)
+	CommandStatusAccepted = "accepted"
+	// CommandStatusOK: the agent's handler finished without error
+	CommandStatusOK = "ok"
+	// CommandStatusError: the agent's handler failed or the command is unknown to it
+	CommandStatusError = "error"
+	// CommandStatusTimedOut: no answer before the deadline
+	CommandStatusTimedOut = "timed_out"
+	// CommandStatusExpired: the agent did not reconnect before the queued command's TTL
+	CommandStatusExpired = "expired"
+	// CommandStatusCancelled: removed from the queue through the API
+	CommandStatusCancelled = "cancelled"
+)
+
+// Command is a master->agent message the master waits on for an agent_command_result
+type Command struct {
+	ID         string     `json:"id"`
+	AgentID    string     `json:"agent_id"`
+	Type       string     `json:"type"`
+	Status     string     `json:"status"`
+	Error      string     `json:"error,omitempty"`
+	QueuedAt   *time.Time `json:"queued_at,omitempty"`
+	SentAt     time.Time  `json:"sent_at"`
+	Deadline   time.Time  `json:"deadline"`
+	AnsweredAt *time.Time `json:"answered_at,omitempty"`
+}
+
+// Done reports whether the agent answered the command or it can no longer be answered
+func (c *Command) Done() bool {
+	return c.Status != CommandStatusPending && c.Status != CommandStatusQueued
+}
+
+// QueuedCommand is a command held for an offline agent, with the payload to deliver.
+// Deadline is when it expires if the agent has not reconnected.
+type QueuedCommand struct {
+	Command
+	Payload any `json:"payload,omitempty"`
+}
+
+// CommandResultPayload is the payload of agent_command_result; the envelope's reply_to holds the command ID
+type CommandResultPayload struct {
+	Command   string `json:"command"`
+	Status    string `json:"status"`
+	Error     string `json:"error,omitempty"`
+	HandledAt int64  `json:"handled_at"`
+}
+
+type CommandListResponse struct {
+	Commands []*Command `json:"commands"`
+	Total    int        `json:"total"`
+}
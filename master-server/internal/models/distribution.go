@@ -0,0 +1,58 @@
+package models
+
+import "time"
+
+const (
+	SSEMsgDistributionUpdate = "distribution_update"
+
+	// DistributionStatusPartial is a finished distribution that reached only some destinations
+	DistributionStatusPartial = "partial"
+)
+
+// DistributionTarget is one destination of a distribution
+type DistributionTarget struct {
+	AgentID      string            `json:"agent_id"`
+	Status       string            `json:"status"` // "pending", "running", "completed", "failed", "cancelled"
+	Progress     *TransferProgress `json:"progress,omitempty"`
+	Error        string            `json:"error,omitempty"`
+	CorruptPaths []string          `json:"corrupt_paths,omitempty"` // files the destination could not verify against the manifest
+	EndedAt      *time.Time        `json:"ended_at,omitempty"`
+}
+
+// Distribution sends one path of a source agent to many destinations. The source produces the
+// tar stream once and the master relays each chunk to every destination still receiving it.
+// Its ID is the connection_id sent to the source and to every destination.
+type Distribution struct {
+	ID               string               `json:"id"`
+	SourceAgentID    string               `json:"source_agent_id"`
+	Path             string               `json:"path"`
+	Selector         string               `json:"selector,omitempty"` // label selector the destinations were picked with
+	Codec            string               `json:"codec"`              // one codec every agent of the job supports
+	Status           string               `json:"status"`             // "pending", "running", "completed", "partial", "failed", "cancelled"
+	Destinations     []DistributionTarget `json:"destinations"`
+	Succeeded        int                  `json:"succeeded"`
+	Failed           int                  `json:"failed"`            // destinations that failed or were cancelled
+	BytesTransferred int64                `json:"bytes_transferred"` // relayed once, whatever the number of destinations
+	Chunks           int                  `json:"chunks"`
+	TotalBytes       int64                `json:"total_bytes,omitempty"` // estimated by the source before sending
+	StartedAt        time.Time            `json:"started_at"`
+	EndedAt          *time.Time           `json:"ended_at,omitempty"`
+	FailureReason    string               `json:"failure_reason,omitempty"`
+}
+
+func (d *Distribution) Done() bool {
+	return d.EndedAt != nil
+}
+
+// CreateDistributionRequest picks destinations by ID, by label selector or both
+type CreateDistributionRequest struct {
+	SourceAgentID string   `json:"source_agent_id" binding:"required"`
+	Path          string   `json:"path" binding:"required"`
+	Destinations  []string `json:"destinations"`
+	Selector      string   `json:"selector"` // "key=value,key2=value2": agents with all of these labels
+}
+
+type DistributionListResponse struct {
+	Distributions []*Distribution `json:"distributions"`
+	Total         int             `json:"total"`
+}
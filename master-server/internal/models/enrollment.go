@@ -0,0 +1,26 @@
+package models
+
+import "time"
+
+type MintEnrollmentTokenRequest struct {
+	Label      string `json:"label,omitempty"`
+	TTLSeconds int    `json:"ttl_seconds,omitempty"` // default: 24h
+}
+
+type EnrollmentTokenResponse struct {
+	TokenID   string    `json:"token_id"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type EnrollRequest struct {
+	Token     string `json:"token" binding:"required"`
+	AgentID   string `json:"agent_id" binding:"required"`
+	AgentName string `json:"agent_name,omitempty"`
+}
+
+type EnrollResponse struct {
+	AgentID      string `json:"agent_id"`
+	CredentialID string `json:"credential_id"`
+	Credential   string `json:"credential"`
+}
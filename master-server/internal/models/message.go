@@ -10,11 +10,31 @@ const (
 	MasterMsgP2PTransferStart   = "master_p2p_transfer_start"
 	MasterMsgRelayTransferStart = "master_relay_transfer_start"
 	MasterMsgRelayFallback      = "master_relay_fallback"
+	MasterMsgTransferCancel     = "master_transfer_cancel"
+	MasterMsgTransferCredit     = "master_transfer_credit"
+	MasterMsgTransferResume     = "master_transfer_resume"
+	MasterMsgTransferKey        = "master_transfer_key"
+	MasterMsgTransferSignatures = "master_transfer_signatures"
+	MasterMsgTransferPushResult = "master_transfer_push_result"
+	MasterMsgTaskAssignment     = "master_task_assigned"
+
+	MasterMsgMetricsRequest = "master_metrics_request"
+
+	AgentMsgHeartbeat       = "agent_metrics"
+	AgentMsgJobStatus       = "agent_job_status"
+	AgentMsgMetricsResponse = "agent_metrics_response"
+
+	SSEMsgTaskUpdate = "task_update"
 )
 
+// Message is the WebSocket/SSE envelope. ID, ReplyTo and SentAt are optional: commands the
+// master tracks carry an ID, the agent's agent_command_result points back at it with ReplyTo.
 type Message struct {
 	Type    string `json:"type"`
 	Payload any    `json:"payload,omitempty"`
+	ID      string `json:"id,omitempty"`
+	ReplyTo string `json:"reply_to,omitempty"`
+	SentAt  int64  `json:"sent_at,omitempty"` // unix milliseconds, set when written to the socket
 }
 
 type HealthCheck struct {
@@ -23,10 +43,20 @@ type HealthCheck struct {
 }
 
 type AgentInfo struct {
-	AgentID  string    `json:"agent_id"`
-	Name     string    `json:"agent_name,omitempty"`
-	OS       string    `json:"agent_os"`
-	LastSeen time.Time `json:"agent_last_seen"`
+	AgentID           string            `json:"agent_id"`
+	Name              string            `json:"agent_name,omitempty"`
+	OS                string            `json:"agent_os"`
+	LastSeen          time.Time         `json:"agent_last_seen"`
+	CredentialID      string            `json:"credential_id,omitempty"`
+	Online            bool              `json:"online"`
+	ConnectedSince    *time.Time        `json:"connected_since,omitempty"`
+	DisconnectedSince *time.Time        `json:"disconnected_since,omitempty"`
+	Labels            map[string]string `json:"labels,omitempty"`
+}
+
+// SetLabelsRequest replaces an agent's labels
+type SetLabelsRequest struct {
+	Labels map[string]string `json:"labels"`
 }
 
 type Metrics struct {
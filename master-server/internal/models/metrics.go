@@ -0,0 +1,32 @@
+package models
+
+import (
+	"time"
+
+	"github.com/The-Promised-Neverland/master-server/internal/metrics"
+)
+
+const MasterMsgMetricsHistory = "agent_metrics_history"
+
+// MetricsSnapshot answers GET /agents/:id/metrics. Source is "live" when the agent replied
+// in time and "cached" when it is the last heartbeat, AgeSeconds old.
+type MetricsSnapshot struct {
+	AgentID     string                 `json:"agent_id"`
+	HostMetrics map[string]interface{} `json:"host_metrics"`
+	Timestamp   int64                  `json:"timestamp"`
+	AgeSeconds  float64                `json:"age_seconds"`
+	Source      string                 `json:"source"`
+}
+
+const (
+	MetricsSourceLive   = "live"
+	MetricsSourceCached = "cached"
+)
+
+type MetricsHistory struct {
+	AgentID     string          `json:"agent_id"`
+	From        time.Time       `json:"from"`
+	To          time.Time       `json:"to"`
+	StepSeconds int64           `json:"step_seconds"`
+	Points      []metrics.Point `json:"points"`
+}
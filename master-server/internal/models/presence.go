@@ -0,0 +1,33 @@
+package models
+
+import "time"
+
+const (
+	SSEMsgAgentOnline  = "agent_online"
+	SSEMsgAgentOffline = "agent_offline"
+
+	// PresenceReasonConnected: the agent opened a WebSocket
+	PresenceReasonConnected = "connected"
+	// PresenceReasonTimeout: no message within the stale window, the connection is presumed half-open
+	PresenceReasonTimeout = "timeout"
+	// PresenceReasonCloseFrame: the agent closed the WebSocket cleanly
+	PresenceReasonCloseFrame = "close_frame"
+	// PresenceReasonReadError: reading from the socket failed without a close frame
+	PresenceReasonReadError = "read_error"
+	// PresenceReasonWriteError: writing to the socket failed
+	PresenceReasonWriteError = "write_error"
+	// PresenceReasonReplaced: the same agent ID connected again
+	PresenceReasonReplaced = "replaced"
+
+	// HeartbeatIntervalHeader carries, when an agent connects, the seconds between its heartbeats
+	HeartbeatIntervalHeader = "X-Heartbeat-Interval"
+)
+
+// PresenceEvent is the payload of agent_online and agent_offline
+type PresenceEvent struct {
+	AgentID   string    `json:"agent_id"`
+	Name      string    `json:"agent_name,omitempty"`
+	Reason    string    `json:"reason"`
+	LastSeen  time.Time `json:"agent_last_seen"`
+	Timestamp time.Time `json:"timestamp"`
+}
@@ -0,0 +1,66 @@
+package models
+
+import "time"
+
+const (
+	AgentMsgDirectorySnapshot = "agent_directory_snapshot"
+	AgentMsgDirectoryDelta    = "agent_directory_delta"
+
+	MasterMsgSnapshotRequest = "master_directory_snapshot_request"
+)
+
+// DirectorySnapshot is an agent's whole shared folder at Version. An agent sends a large folder
+// in Parts messages of the same version, each with a page of Files and the totals of the whole
+// folder; the master publishes it once assembled, as one part.
+type DirectorySnapshot struct {
+	AgentID   string        `json:"agent_id"`
+	Timestamp string        `json:"timestamp"`
+	Version   uint64        `json:"version"`
+	Part      int           `json:"part"`
+	Parts     int           `json:"parts"`
+	Directory DirectoryInfo `json:"directory"`
+}
+
+type DirectoryInfo struct {
+	Files      []FileInfo `json:"files"`
+	TotalFiles int        `json:"total_files"`
+	TotalSize  int64      `json:"total_size"`
+}
+
+type FileInfo struct {
+	Name     string `json:"name"`
+	Path     string `json:"path"` // relative to the agent's shared folder
+	Size     int64  `json:"size"`
+	Modified string `json:"modified"` // RFC 3339
+	Type     string `json:"type"`     // "file" or "directory"
+}
+
+// DirectoryDelta turns an agent's folder at BaseVersion into its folder at Version
+type DirectoryDelta struct {
+	AgentID     string     `json:"agent_id"`
+	Timestamp   string     `json:"timestamp"`
+	Version     uint64     `json:"version"`
+	BaseVersion uint64     `json:"base_version"`
+	Added       []FileInfo `json:"added,omitempty"`
+	Modified    []FileInfo `json:"modified,omitempty"`
+	Removed     []string   `json:"removed,omitempty"` // paths
+	TotalFiles  int        `json:"total_files"`
+	TotalSize   int64      `json:"total_size"`
+}
+
+// FileSearchResult is an entry of an agent's shared folder as the master last knew it.
+// SourceAgentID and Path are what POST /api/v1/agents/{destination}/filesystem/{source_agent_id}
+// takes to pull it, which needs the agent online.
+type FileSearchResult struct {
+	SourceAgentID string `json:"source_agent_id"`
+	AgentName     string `json:"agent_name,omitempty"`
+	Online        bool   `json:"online"`
+	FileInfo
+	SnapshotAt time.Time `json:"snapshot_at"` // when the master last updated its copy of the agent's folder
+}
+
+type FileSearchResponse struct {
+	Results   []FileSearchResult `json:"results"`
+	Total     int                `json:"total"`     // matches, including those past the limit
+	Truncated bool               `json:"truncated"` // results stop at the limit
+}
@@ -0,0 +1,109 @@
+package models
+
+import "time"
+
+const (
+	SSEMsgSyncUpdate = "sync_update"
+
+	MasterMsgSyncPairs   = "master_sync_pairs"
+	MasterMsgSyncChanges = "master_sync_changes"
+	MasterMsgSyncAck     = "master_sync_ack"
+
+	AgentMsgSyncChanges = "agent_sync_changes"
+	AgentMsgSyncAck     = "agent_sync_ack"
+	AgentMsgSyncPull    = "agent_sync_pull"
+	AgentMsgSyncReport  = "agent_sync_report"
+
+	SyncSideA = "a"
+	SyncSideB = "b"
+
+	// SyncWinnerNewest keeps the most recently modified version of a file both agents changed.
+	// An edit always wins over a deletion.
+	SyncWinnerNewest = "newest"
+
+	SyncStatusActive  = "active"  // both agents online
+	SyncStatusWaiting = "waiting" // an agent is offline; its changes sync when it reconnects
+)
+
+// SyncEndpoint is one agent's folder in a sync pair
+type SyncEndpoint struct {
+	AgentID string         `json:"agent_id"`
+	Folder  string         `json:"folder"` // relative to the agent's shared folder
+	Online  bool           `json:"online"`
+	State   *SyncSideState `json:"state,omitempty"`
+}
+
+// SyncSideState is an agent's latest agent_sync_report for its folder of a pair
+type SyncSideState struct {
+	Files      int       `json:"files"`
+	Bytes      int64     `json:"bytes"`
+	Pending    int       `json:"pending"` // local changes the other agent has not applied yet
+	ScannedAt  time.Time `json:"scanned_at"`
+	Error      string    `json:"error,omitempty"`
+	ReportedAt time.Time `json:"reported_at"`
+}
+
+// SyncConflict is a file both agents changed since they last agreed on it. Hashes are empty
+// for a deleted file.
+type SyncConflict struct {
+	Path         string    `json:"path"`
+	DetectedBy   string    `json:"detected_by"` // side that received the other's change
+	LocalSHA256  string    `json:"local_sha256,omitempty"`
+	RemoteSHA256 string    `json:"remote_sha256,omitempty"`
+	Winner       string    `json:"winner"` // side whose version was kept
+	At           time.Time `json:"at"`
+}
+
+// SyncPair mirrors folder A of one agent with folder B of another. Changes on either side are
+// pushed to the other, deletions included.
+type SyncPair struct {
+	ID             string         `json:"id"`
+	A              SyncEndpoint   `json:"a"`
+	B              SyncEndpoint   `json:"b"`
+	ConflictWinner string         `json:"conflict_winner"`     // "newest", "a" or "b"
+	Status         string         `json:"status"`              // "active", "waiting"
+	Conflicts      []SyncConflict `json:"conflicts,omitempty"` // most recent last
+	CreatedAt      time.Time      `json:"created_at"`
+}
+
+// Side returns the endpoint of side, "a" or "b"
+func (p *SyncPair) Side(side string) *SyncEndpoint {
+	if side == SyncSideA {
+		return &p.A
+	}
+	return &p.B
+}
+
+// SideOf returns which side of the pair agentID is, or "" if neither
+func (p *SyncPair) SideOf(agentID string) string {
+	switch agentID {
+	case p.A.AgentID:
+		return SyncSideA
+	case p.B.AgentID:
+		return SyncSideB
+	}
+	return ""
+}
+
+// SyncPairConfig is an agent's side of a pair, as sent to it in master_sync_pairs
+type SyncPairConfig struct {
+	ID             string `json:"id"`
+	Side           string `json:"side"`
+	Folder         string `json:"folder"`
+	PeerAgentID    string `json:"peer_agent_id"`
+	PeerFolder     string `json:"peer_folder"`
+	ConflictWinner string `json:"conflict_winner"`
+}
+
+type CreateSyncPairRequest struct {
+	AgentA         string `json:"agent_a" binding:"required"`
+	FolderA        string `json:"folder_a" binding:"required"`
+	AgentB         string `json:"agent_b" binding:"required"`
+	FolderB        string `json:"folder_b" binding:"required"`
+	ConflictWinner string `json:"conflict_winner"` // defaults to "newest"
+}
+
+type SyncPairListResponse struct {
+	Pairs []*SyncPair `json:"pairs"`
+	Total int         `json:"total"`
+}
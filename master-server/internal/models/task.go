@@ -2,6 +2,17 @@ package models
 
 import "time"
 
+const (
+	TaskTypeShellCommand = "shell_command"
+
+	TaskStatusPending   = "pending"
+	TaskStatusRunning   = "running"
+	TaskStatusCompleted = "completed"
+	TaskStatusFailed    = "failed"
+
+	DefaultTaskTimeout = 30 // seconds
+)
+
 type Task struct {
 	ID          string    `json:"id"`
 	Type        string    `json:"type"`        // "shell_command", "python_script", etc.
@@ -13,6 +24,7 @@ type Task struct {
 	CompletedAt *time.Time `json:"completed_at,omitempty"`
 	Output      string    `json:"output,omitempty"`
 	Error       string    `json:"error,omitempty"`
+	ExitCode    *int      `json:"exit_code,omitempty"`
 	Timeout     int       `json:"timeout"` // Timeout in seconds
 }
 
@@ -32,6 +44,10 @@ type TaskListResponse struct {
 	Total int     `json:"total"`
 }
 
-
-
-
+// TaskAssignmentPayload is sent to the agent with master_task_assigned
+type TaskAssignmentPayload struct {
+	JobID   string `json:"job_id"`
+	JobType string `json:"job_type"`
+	Command string `json:"command"`
+	Timeout int    `json:"timeout"` // seconds
+}
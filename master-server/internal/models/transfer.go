@@ -0,0 +1,131 @@
+package models
+
+import "time"
+
+const (
+	SSEMsgTransferUpdate   = "transfer_update"
+	SSEMsgTransferProgress = "transfer_progress"
+
+	AgentMsgTransferProgress   = "agent_transfer_progress"
+	AgentMsgTransferCredit     = "agent_transfer_credit"
+	AgentMsgTransferResume     = "agent_transfer_resume"
+	AgentMsgTransferKey        = "agent_transfer_key"
+	AgentMsgTransferSignatures = "agent_transfer_signatures"
+	AgentMsgTransferPush       = "agent_transfer_push"
+
+	TransferRoleSource      = "source"
+	TransferRoleDestination = "destination"
+
+	TransferModeP2P   = "p2p"
+	TransferModeRelay = "relay"
+
+	TransferCodecNone = "none"
+	TransferCodecGzip = "gzip"
+	TransferCodecZstd = "zstd"
+
+	// TransferCodecsHeader lists, when an agent connects, the codecs it can send and receive
+	TransferCodecsHeader = "X-Transfer-Codecs"
+
+	TransferEncryptionNone   = "none"
+	TransferEncryptionX25519 = "x25519-aes-256-gcm"
+
+	// TransferEncryptionHeader lists, when an agent connects, the encryption suites it supports
+	TransferEncryptionHeader = "X-Transfer-Encryption"
+
+	TransferStatusPending   = "pending" // negotiating P2P or waiting for the source to start sending
+	TransferStatusRunning   = "running"
+	TransferStatusCompleted = "completed"
+	TransferStatusFailed    = "failed"
+	TransferStatusCancelled = "cancelled"
+)
+
+// TransferFallback records a switch between modes, e.g. P2P to relay after the hole punch failed
+type TransferFallback struct {
+	From   string    `json:"from"`
+	To     string    `json:"to"`
+	Reason string    `json:"reason"`
+	At     time.Time `json:"at"`
+}
+
+// TransferResume records a restart of a failed transfer from the destination's checkpoint
+type TransferResume struct {
+	Offset           int64     `json:"offset"` // tar bytes the destination already had
+	EntriesCompleted int       `json:"entries_completed"`
+	Entry            string    `json:"entry,omitempty"` // tar entry cut off at Offset
+	At               time.Time `json:"at"`
+}
+
+// TransferProgress is one agent's view of a running transfer, from agent_transfer_progress
+type TransferProgress struct {
+	BytesDone  int64     `json:"bytes_done"`
+	TotalBytes int64     `json:"total_bytes,omitempty"` // known to the source only
+	Chunks     int64     `json:"chunks"`
+	Rate       float64   `json:"rate_bytes_per_sec"`
+	ETASeconds float64   `json:"eta_seconds,omitempty"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// TransferKey is an agent's ephemeral public key for its role in an encrypted transfer. The
+// master forwards it to the other agent with the signing key the sender connected with.
+type TransferKey struct {
+	ConnectionID string `json:"connection_id"`
+	Role         string `json:"role"`       // role of the agent the key belongs to
+	PublicKey    string `json:"public_key"` // base64 X25519 public key
+	Signature    string `json:"signature"`  // base64 Ed25519 signature by the agent's signing key
+	SigningKey   string `json:"signing_key,omitempty"`
+}
+
+// Transfer is one GetAgentFileSystem request, one destination of a push, or the changes of a sync
+// pair one agent pulls from the other. Its ID is the connection_id sent to both agents.
+type Transfer struct {
+	ID                 string             `json:"id"`
+	SourceAgentID      string             `json:"source_agent_id"`
+	DestinationAgentID string             `json:"destination_agent_id"`
+	Path               string             `json:"path"`
+	Mode               string             `json:"mode"`            // "p2p", "relay"
+	Codec              string             `json:"codec"`           // "none", "gzip", "zstd"
+	Encryption         string             `json:"encryption"`      // "none", "x25519-aes-256-gcm"
+	Delta              bool               `json:"delta,omitempty"` // only changed blocks of files the destination has are sent
+	Push               bool               `json:"push,omitempty"`  // started for the source rather than the destination
+	SyncPairID         string             `json:"sync_pair_id,omitempty"`
+	Files              []string           `json:"files,omitempty"`  // only these files under Path, for a sync pair
+	Target             string             `json:"target,omitempty"` // folder the destination extracts into instead of transfers/<source>
+	Status             string             `json:"status"`           // "pending", "running", "completed", "failed", "cancelled"
+	Fallbacks          []TransferFallback `json:"fallbacks,omitempty"`
+	Resumes            []TransferResume   `json:"resumes,omitempty"`
+	BytesTransferred   int64              `json:"bytes_transferred"`
+	Chunks             int                `json:"chunks"`
+	TotalBytes         int64              `json:"total_bytes,omitempty"` // estimated by the source before sending
+	RateBytesPerSec    float64            `json:"rate_bytes_per_sec,omitempty"`
+	ETASeconds         float64            `json:"eta_seconds,omitempty"`
+	Source             *TransferProgress  `json:"source_progress,omitempty"`
+	Destination        *TransferProgress  `json:"destination_progress,omitempty"`
+	StartedAt          time.Time          `json:"started_at"`
+	EndedAt            *time.Time         `json:"ended_at,omitempty"`
+	FailureReason      string             `json:"failure_reason,omitempty"`
+	CorruptPaths       []string           `json:"corrupt_paths,omitempty"` // files the destination could not verify against the manifest
+}
+
+func (t *Transfer) Done() bool {
+	return t.Status == TransferStatusCompleted || t.Status == TransferStatusFailed || t.Status == TransferStatusCancelled
+}
+
+// PushRequest sends a path of the source agent to each of destinations
+type PushRequest struct {
+	Path         string   `json:"path" binding:"required"`
+	Destinations []string `json:"destinations" binding:"required,min=1"`
+	Delta        bool     `json:"delta"`
+}
+
+// PushResult is the transfer started for one destination of a push, or why none was
+type PushResult struct {
+	DestinationAgentID string    `json:"destination_agent_id"`
+	TransferID         string    `json:"transfer_id,omitempty"`
+	Transfer           *Transfer `json:"transfer,omitempty"`
+	Error              string    `json:"error,omitempty"`
+}
+
+type TransferListResponse struct {
+	Transfers []*Transfer `json:"transfers"`
+	Total     int         `json:"total"`
+}
@@ -0,0 +1,103 @@
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// FileStore keeps records in memory and rewrites a JSON file on every change
+type FileStore struct {
+	path    string
+	records map[string]AgentRecord
+	mu      sync.RWMutex
+}
+
+func NewFileStore(path string) (*FileStore, error) {
+	s := &FileStore{
+		path:    path,
+		records: make(map[string]AgentRecord),
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read agent registry: %w", err)
+	}
+	var records []AgentRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("failed to parse agent registry: %w", err)
+	}
+	for _, r := range records {
+		s.records[r.ID] = r
+	}
+	return s, nil
+}
+
+func (s *FileStore) List() []AgentRecord {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.listLocked()
+}
+
+func (s *FileStore) Upsert(record AgentRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	previous, existed := s.records[record.ID]
+	s.records[record.ID] = record
+	if err := s.saveLocked(); err != nil {
+		if existed {
+			s.records[record.ID] = previous
+		} else {
+			delete(s.records, record.ID)
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *FileStore) Delete(agentID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	previous, existed := s.records[agentID]
+	if !existed {
+		return nil
+	}
+	delete(s.records, agentID)
+	if err := s.saveLocked(); err != nil {
+		s.records[agentID] = previous
+		return err
+	}
+	return nil
+}
+
+func (s *FileStore) listLocked() []AgentRecord {
+	records := make([]AgentRecord, 0, len(s.records))
+	for _, r := range s.records {
+		records = append(records, r)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].ID < records[j].ID
+	})
+	return records
+}
+
+func (s *FileStore) saveLocked() error {
+	data, err := json.MarshalIndent(s.listLocked(), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return fmt.Errorf("failed to create agent registry directory: %w", err)
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write agent registry: %w", err)
+	}
+	return os.Rename(tmp, s.path)
+}
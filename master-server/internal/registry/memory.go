@@ -0,0 +1,45 @@
+package registry
+
+import (
+	"sort"
+	"sync"
+)
+
+// MemoryStore keeps records in memory only; everything is lost on restart
+type MemoryStore struct {
+	records map[string]AgentRecord
+	mu      sync.RWMutex
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		records: make(map[string]AgentRecord),
+	}
+}
+
+func (s *MemoryStore) List() []AgentRecord {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	records := make([]AgentRecord, 0, len(s.records))
+	for _, r := range s.records {
+		records = append(records, r)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].ID < records[j].ID
+	})
+	return records
+}
+
+func (s *MemoryStore) Upsert(record AgentRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[record.ID] = record
+	return nil
+}
+
+func (s *MemoryStore) Delete(agentID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records, agentID)
+	return nil
+}
@@ -0,0 +1,21 @@
+package registry
+
+import "time"
+
+// AgentRecord is the last-known state of an agent, kept across master restarts
+type AgentRecord struct {
+	ID             string            `json:"id"`
+	Name           string            `json:"name"`
+	OS             string            `json:"os"`
+	LastSeen       time.Time         `json:"last_seen"`
+	PublicEndpoint string            `json:"public_endpoint,omitempty"`
+	CredentialID   string            `json:"credential_id,omitempty"`
+	Labels         map[string]string `json:"labels,omitempty"`
+}
+
+// Store persists agent records behind the WSHub
+type Store interface {
+	List() []AgentRecord
+	Upsert(record AgentRecord) error
+	Delete(agentID string) error
+}
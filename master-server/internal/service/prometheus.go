@@ -0,0 +1,135 @@
+package service
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/The-Promised-Neverland/master-server/internal/metrics"
+)
+
+type promAgent struct {
+	id, name, os     string
+	online           bool
+	lastSeen         time.Time
+	send, in, stream int
+}
+
+// WritePrometheusMetrics writes agent and master metrics in the Prometheus text exposition format
+func (s *Service) WritePrometheusMetrics(w io.Writer) {
+	s.WSHub.Mutex.RLock()
+	agents := make([]promAgent, 0, len(s.WSHub.Connections))
+	for id, c := range s.WSHub.Connections {
+		if c.Name == "frontend" || id == "" {
+			continue
+		}
+		agents = append(agents, promAgent{
+			id:       id,
+			name:     c.Name,
+			os:       c.OS,
+			online:   c.Conn != nil,
+			lastSeen: c.LastSeen,
+			send:     len(c.SendCh),
+			in:       len(c.IncomingCh),
+			stream:   len(c.StreamCh),
+		})
+	}
+	s.WSHub.Mutex.RUnlock()
+	sort.Slice(agents, func(i, j int) bool { return agents[i].id < agents[j].id })
+
+	now := time.Now()
+	online := 0
+	family(w, "nebula_agent_online", "gauge", "1 if the agent has an open WebSocket connection")
+	for _, a := range agents {
+		value := 0
+		if a.online {
+			value = 1
+			online++
+		}
+		sample(w, "nebula_agent_online", agentLabels(a), float64(value))
+	}
+	family(w, "nebula_agent_last_seen_age_seconds", "gauge", "Seconds since the last message from the agent")
+	for _, a := range agents {
+		sample(w, "nebula_agent_last_seen_age_seconds", agentLabels(a), now.Sub(a.lastSeen).Seconds())
+	}
+
+	latest := make(map[string]metrics.Point, len(agents))
+	for _, a := range agents {
+		if point, ok := s.WSHub.Metrics.Latest(a.id); ok {
+			latest[a.id] = point
+		}
+	}
+	hostGauge := func(name, help string, value func(metrics.Point) float64) {
+		family(w, name, "gauge", help)
+		for _, a := range agents {
+			if point, ok := latest[a.id]; ok {
+				sample(w, name, agentLabels(a), value(point))
+			}
+		}
+	}
+	hostGauge("nebula_agent_cpu_usage_percent", "Latest reported CPU usage", func(p metrics.Point) float64 { return p.CPUUsage })
+	hostGauge("nebula_agent_memory_usage_percent", "Latest reported memory usage", func(p metrics.Point) float64 { return p.MemoryUsage })
+	hostGauge("nebula_agent_disk_usage_percent", "Latest reported disk usage", func(p metrics.Point) float64 { return p.DiskUsage })
+	hostGauge("nebula_agent_uptime_seconds", "Latest reported host uptime", func(p metrics.Point) float64 { return float64(p.Uptime) })
+
+	family(w, "nebula_master_connections", "gauge", "Agents with an open WebSocket connection")
+	sample(w, "nebula_master_connections", "", float64(online))
+	family(w, "nebula_master_known_agents", "gauge", "Agents known to the registry, online or not")
+	sample(w, "nebula_master_known_agents", "", float64(len(agents)))
+	family(w, "nebula_master_channel_depth", "gauge", "Messages queued in a connection channel")
+	for _, a := range agents {
+		if !a.online {
+			continue
+		}
+		sample(w, "nebula_master_channel_depth", labels("agent_id", a.id, "channel", "send"), float64(a.send))
+		sample(w, "nebula_master_channel_depth", labels("agent_id", a.id, "channel", "incoming"), float64(a.in))
+		sample(w, "nebula_master_channel_depth", labels("agent_id", a.id, "channel", "stream"), float64(a.stream))
+	}
+	family(w, "nebula_master_sse_clients", "gauge", "Connected SSE clients")
+	sample(w, "nebula_master_sse_clients", "", float64(s.SSEHub.ClientCount()))
+	family(w, "nebula_master_dropped_messages_total", "counter", "Messages dropped because a channel was full")
+	sample(w, "nebula_master_dropped_messages_total", labels("channel", "send"), float64(s.WSHub.Dropped.Send.Load()))
+	sample(w, "nebula_master_dropped_messages_total", labels("channel", "incoming"), float64(s.WSHub.Dropped.Incoming.Load()))
+	sample(w, "nebula_master_dropped_messages_total", labels("channel", "stream"), float64(s.WSHub.Dropped.Stream.Load()))
+	sample(w, "nebula_master_dropped_messages_total", labels("channel", "sse_broadcast"), float64(s.SSEHub.DroppedBroadcast.Load()))
+	sample(w, "nebula_master_dropped_messages_total", labels("channel", "sse_client"), float64(s.SSEHub.DroppedClient.Load()))
+
+	p2p, relay := 0, 0
+	if tm := s.WSHub.TransferManager; tm != nil {
+		p2p = tm.GetP2PCoordinator().ActiveCount()
+		relay = tm.GetRelayCoordinator().ActiveCount()
+	}
+	family(w, "nebula_master_active_transfers", "gauge", "Transfers in progress by mode")
+	sample(w, "nebula_master_active_transfers", labels("mode", "p2p"), float64(p2p))
+	sample(w, "nebula_master_active_transfers", labels("mode", "relay"), float64(relay))
+}
+
+func agentLabels(a promAgent) string {
+	return labels("agent_id", a.id, "name", a.name, "os", a.os)
+}
+
+func family(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func sample(w io.Writer, name, labels string, value float64) {
+	fmt.Fprintf(w, "%s%s %g\n", name, labels, value)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labels renders key/value pairs as {k="v",...}
+func labels(kv ...string) string {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i+1 < len(kv); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `%s="%s"`, kv[i], labelEscaper.Replace(kv[i+1]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
@@ -2,13 +2,36 @@ package service
 
 import (
 	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+	"time"
 
+	"github.com/The-Promised-Neverland/master-server/internal/metrics"
 	"github.com/The-Promised-Neverland/master-server/internal/models"
+	"github.com/The-Promised-Neverland/master-server/internal/snapshot"
 	"github.com/The-Promised-Neverland/master-server/internal/sse"
-	"github.com/The-Promised-Neverland/master-server/internal/transfer"
 	"github.com/The-Promised-Neverland/master-server/internal/ws"
 )
 
+// metricsRequestTimeout bounds how long GET /agents/:id/metrics waits for a live answer
+const metricsRequestTimeout = 3 * time.Second
+
+const (
+	// commandWaitTimeout bounds how long REST calls such as RestartAgent wait for the agent's answer
+	commandWaitTimeout = 5 * time.Second
+	// acceptedGrace is how long an accepted command may still turn into an error before the call returns
+	acceptedGrace = time.Second
+)
+
+var (
+	ErrAgentNotFound = errors.New("agent not found")
+	ErrNoMetrics     = errors.New("no metrics available for agent")
+	// ErrNoDestinations is returned for a distribution whose list and selector name no agent
+	ErrNoDestinations = errors.New("no destination agents given or matched")
+)
+
 type Service struct {
 	WSHub  *ws.WSHub
 	SSEHub *sse.SSEHub
@@ -29,23 +52,91 @@ func (s *Service) GetAllAgents() []*models.AgentInfo {
 		if agent.Name == "frontend" || id == "" {
 			continue
 		}
-		info := &models.AgentInfo{
-			AgentID:  id,
-			Name:     agent.Name,
-			OS:       agent.OS,
-			LastSeen: agent.LastSeen,
-		}
-		agents = append(agents, info)
+		agents = append(agents, agentInfo(id, agent))
 	}
 	return agents
 }
 
-func (s *Service) TriggerAgentforMetrics(agentID string) {
-	req := models.Message{
-		Type:    "master_metrics_request",
-		Payload: nil,
+// agentInfo describes a connection; the caller holds WSHub.Mutex
+func agentInfo(agentID string, c *ws.Connection) *models.AgentInfo {
+	info := &models.AgentInfo{
+		AgentID:      agentID,
+		Name:         c.Name,
+		OS:           c.OS,
+		LastSeen:     c.LastSeen,
+		CredentialID: c.CredentialID,
+		Online:       c.Conn != nil,
+		Labels:       maps.Clone(c.Labels),
+	}
+	if !c.ConnectedSince.IsZero() {
+		connectedSince := c.ConnectedSince
+		info.ConnectedSince = &connectedSince
 	}
-	s.WSHub.Send(agentID, transfer.Outbound{Msg: &req})
+	if !c.DisconnectedSince.IsZero() {
+		disconnectedSince := c.DisconnectedSince
+		info.DisconnectedSince = &disconnectedSince
+	}
+	return info
+}
+
+// GetAgentMetrics asks the agent for fresh host metrics and waits up to metricsRequestTimeout.
+// When the agent is offline or too slow, the last cached reading is returned with its age.
+func (s *Service) GetAgentMetrics(agentID string) (*models.MetricsSnapshot, error) {
+	s.WSHub.Mutex.RLock()
+	_, exists := s.WSHub.Connections[agentID]
+	s.WSHub.Mutex.RUnlock()
+	if !exists {
+		return nil, ErrAgentNotFound
+	}
+	reply, err := s.WSHub.Request(agentID, models.MasterMsgMetricsRequest, nil, metricsRequestTimeout)
+	if err == nil {
+		if hostMetrics, ok := reply["host_metrics"].(map[string]interface{}); ok {
+			return &models.MetricsSnapshot{
+				AgentID:     agentID,
+				HostMetrics: hostMetrics,
+				Timestamp:   time.Now().Unix(),
+				Source:      models.MetricsSourceLive,
+			}, nil
+		}
+		err = errors.New("metrics response has no host_metrics")
+	}
+	// The agent may have been removed, e.g. by an uninstall, while the request was pending
+	s.WSHub.Mutex.RLock()
+	connection := s.WSHub.Connections[agentID]
+	if connection == nil {
+		s.WSHub.Mutex.RUnlock()
+		return nil, fmt.Errorf("%w: %s", ErrAgentNotFound, agentID)
+	}
+	cached, cachedAt := connection.LastMetrics, connection.LastMetricsAt
+	s.WSHub.Mutex.RUnlock()
+	if cached == nil {
+		return nil, fmt.Errorf("%w: %v", ErrNoMetrics, err)
+	}
+	return &models.MetricsSnapshot{
+		AgentID:     agentID,
+		HostMetrics: cached,
+		Timestamp:   cachedAt.Unix(),
+		AgeSeconds:  time.Since(cachedAt).Seconds(),
+		Source:      models.MetricsSourceCached,
+	}, nil
+}
+
+// GetMetricsHistory returns the agent's stored metrics between from and to, averaged per step
+func (s *Service) GetMetricsHistory(agentID string, from, to time.Time, step time.Duration) (*models.MetricsHistory, error) {
+	if s.GetAgent(agentID) == nil {
+		return nil, fmt.Errorf("%w: %s", ErrAgentNotFound, agentID)
+	}
+	points, step := s.WSHub.Metrics.Query(agentID, from, to, step)
+	if points == nil {
+		points = []metrics.Point{}
+	}
+	return &models.MetricsHistory{
+		AgentID:     agentID,
+		From:        from,
+		To:          to,
+		StepSeconds: int64(step / time.Second),
+		Points:      points,
+	}, nil
 }
 
 func (s *Service) IsAgentOnline(agentID string) (bool, error) {
@@ -69,12 +160,7 @@ func (s *Service) GetAgent(agentID string) *models.AgentInfo {
 	if agent == nil {
 		return nil
 	}
-	return &models.AgentInfo{
-		AgentID:  agentID,
-		Name:     agent.Name,
-		OS:       agent.OS,
-		LastSeen: agent.LastSeen,
-	}
+	return agentInfo(agentID, agent)
 }
 
 func (s *Service) SendAgentListToFrontend() {
@@ -86,32 +172,284 @@ func (s *Service) SendAgentListToFrontend() {
 	s.SSEHub.Broadcast(msg)
 }
 
-func (s *Service) RestartAgent(agentID string) {
-	req := models.Message{
-		Type:    "master_restart_request",
-		Payload: nil,
+func (s *Service) RestartAgent(agentID string) (*models.Command, error) {
+	return s.runCommand(agentID, models.Message{Type: models.MasterMsgRestartAgent})
+}
+
+func (s *Service) UninstallAgent(agentID string) (*models.Command, error) {
+	return s.runCommand(agentID, models.Message{Type: models.MasterMsgAgentUninstall})
+}
+
+// runCommand sends a tracked command and waits up to commandWaitTimeout for the agent's answer.
+// A command still pending afterwards, or queued for an offline agent, can be polled by ID.
+func (s *Service) runCommand(agentID string, msg models.Message) (*models.Command, error) {
+	cmd, err := s.WSHub.SendCommand(agentID, msg)
+	if err != nil {
+		return nil, err
+	}
+	if cmd.Done() || cmd.Status == models.CommandStatusQueued {
+		return cmd, nil
+	}
+	cmd = s.WSHub.Commands.Wait(cmd.ID, commandWaitTimeout)
+	if cmd != nil && cmd.Status == models.CommandStatusAccepted {
+		cmd = s.WSHub.Commands.WaitSettled(cmd.ID, acceptedGrace)
 	}
-	s.WSHub.Send(agentID, transfer.Outbound{Msg: &req})
+	return cmd, nil
 }
 
-func (s *Service) UninstallAgent(agentID string) {
-	req := models.Message{
-		Type:    "master_uninstall_initiated",
-		Payload: nil,
+func (s *Service) GetCommand(commandID string) *models.Command {
+	if cmd := s.WSHub.Queue.Get(commandID); cmd != nil {
+		return cmd
 	}
-	s.WSHub.Send(agentID, transfer.Outbound{Msg: &req})
+	return s.WSHub.Commands.Get(commandID)
+}
+
+// ListCommands returns queued commands first, then those sent in the last hour
+func (s *Service) ListCommands(agentID string) []*models.Command {
+	return append(s.WSHub.Queue.List(agentID), s.WSHub.Commands.List(agentID)...)
 }
 
-func (s *Service) GetAgentFileSystem(requestingAgentID string, sourceAgentID string, path string) {
+// CancelCommand drops a command still queued for an offline agent
+func (s *Service) CancelCommand(commandID string) (*models.Command, error) {
+	return s.WSHub.Queue.Cancel(commandID)
+}
+
+// GetAgentFileSystem starts a transfer of path from the source agent to the requesting agent
+// and returns it as registered. A transfer that could not start is returned as failed. With
+// delta, files the requesting agent already has are patched rather than sent whole.
+func (s *Service) GetAgentFileSystem(requestingAgentID string, sourceAgentID string, path string, delta bool) (*models.Transfer, error) {
 	if s.WSHub.TransferManager == nil {
-		return
+		return nil, errors.New("transfer manager not initialized")
 	}
 	req := models.Message{
 		Type: models.MasterMsgTransferIntent,
 		Payload: map[string]interface{}{
 			"requesting_agent_id": requestingAgentID,
 			"path":                path,
+			"delta":               delta,
 		},
 	}
-	s.WSHub.TransferManager.HandleAgentRequestFile(&req, sourceAgentID) // Trigger the transfer logic
+	transferID, err := s.WSHub.TransferManager.HandleAgentRequestFile(&req, sourceAgentID) // Trigger the transfer logic
+	if transferID == "" {
+		return nil, err
+	}
+	return s.WSHub.TransferManager.Registry().Get(transferID), err
+}
+
+// PushFileSystem starts a transfer of a path from the source agent to each destination, and
+// returns one result per destination
+func (s *Service) PushFileSystem(sourceAgentID string, req models.PushRequest) ([]models.PushResult, error) {
+	if s.WSHub.TransferManager == nil {
+		return nil, errors.New("transfer manager not initialized")
+	}
+	online, err := s.IsAgentOnline(sourceAgentID)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrAgentNotFound, sourceAgentID)
+	}
+	if !online {
+		return nil, fmt.Errorf("%w: %s", ws.ErrAgentOffline, sourceAgentID)
+	}
+	return s.WSHub.TransferManager.Push(sourceAgentID, req.Path, req.Destinations, req.Delta), nil
+}
+
+// SetAgentLabels replaces the labels of a known agent, online or not
+func (s *Service) SetAgentLabels(agentID string, labels map[string]string) (*models.AgentInfo, error) {
+	known, err := s.WSHub.SetLabels(agentID, labels)
+	if err != nil {
+		return nil, err
+	}
+	if !known {
+		return nil, fmt.Errorf("%w: %s", ErrAgentNotFound, agentID)
+	}
+	return s.GetAgent(agentID), nil
+}
+
+// CreateDistribution sends a path of the source agent to the listed destinations and to every
+// other agent the selector matches
+func (s *Service) CreateDistribution(req models.CreateDistributionRequest) (*models.Distribution, error) {
+	online, err := s.IsAgentOnline(req.SourceAgentID)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrAgentNotFound, req.SourceAgentID)
+	}
+	if !online {
+		return nil, fmt.Errorf("%w: %s", ws.ErrAgentOffline, req.SourceAgentID)
+	}
+	destinations := append([]string(nil), req.Destinations...)
+	if req.Selector != "" {
+		selector, err := ws.ParseSelector(req.Selector)
+		if err != nil {
+			return nil, err
+		}
+		for _, agentID := range s.WSHub.MatchingAgents(selector) {
+			if agentID != req.SourceAgentID {
+				destinations = append(destinations, agentID)
+			}
+		}
+	}
+	if len(destinations) == 0 {
+		return nil, ErrNoDestinations
+	}
+	return s.WSHub.TransferManager.Distributor().Start(req.SourceAgentID, req.Path, req.Selector, destinations), nil
+}
+
+// GetAgentSnapshot returns the master's copy of an agent's shared folder, online or not
+func (s *Service) GetAgentSnapshot(agentID string) *models.DirectorySnapshot {
+	return s.WSHub.Snapshots.Get(agentID)
+}
+
+// SearchFiles searches the copies of the agents' shared folders. The agents listed, those matching
+// the label selector and, when online is set, those online or offline narrow the agents searched.
+func (s *Service) SearchFiles(query snapshot.Query, agentIDs []string, selector string, online *bool) (*models.FileSearchResponse, error) {
+	var matching map[string]bool
+	if selector != "" {
+		pairs, err := ws.ParseSelector(selector)
+		if err != nil {
+			return nil, err
+		}
+		matching = make(map[string]bool)
+		for _, agentID := range s.WSHub.MatchingAgents(pairs) {
+			matching[agentID] = true
+		}
+	}
+	s.WSHub.Mutex.RLock()
+	agents := make(map[string]*models.AgentInfo)
+	for id, c := range s.WSHub.Connections {
+		if c.Name != "frontend" && id != "" {
+			agents[id] = &models.AgentInfo{AgentID: id, Name: c.Name, Online: c.Conn != nil}
+		}
+	}
+	s.WSHub.Mutex.RUnlock()
+	if len(agentIDs) > 0 || matching != nil || online != nil {
+		query.AgentIDs = make(map[string]bool)
+		for id, agent := range agents {
+			if (len(agentIDs) > 0 && !slices.Contains(agentIDs, id)) ||
+				(matching != nil && !matching[id]) ||
+				(online != nil && agent.Online != *online) {
+				continue
+			}
+			query.AgentIDs[id] = true
+		}
+	}
+	results, total := s.WSHub.Snapshots.Search(query)
+	for i := range results {
+		if agent := agents[results[i].SourceAgentID]; agent != nil {
+			results[i].AgentName, results[i].Online = agent.Name, agent.Online
+		}
+	}
+	if results == nil {
+		results = []models.FileSearchResult{}
+	}
+	return &models.FileSearchResponse{
+		Results:   results,
+		Total:     total,
+		Truncated: len(results) < total,
+	}, nil
+}
+
+func (s *Service) ListDistributions() []*models.Distribution {
+	return s.WSHub.TransferManager.Distributor().List()
+}
+
+func (s *Service) GetDistribution(distributionID string) *models.Distribution {
+	return s.WSHub.TransferManager.Distributor().Get(distributionID)
+}
+
+// CancelDistribution stops an unfinished distribution on its source and every destination
+func (s *Service) CancelDistribution(distributionID string) (*models.Distribution, error) {
+	return s.WSHub.TransferManager.Distributor().Cancel(distributionID)
+}
+
+func (s *Service) ListTransfers() []*models.Transfer {
+	return s.WSHub.TransferManager.Registry().List()
+}
+
+func (s *Service) GetTransfer(transferID string) *models.Transfer {
+	return s.WSHub.TransferManager.Registry().Get(transferID)
+}
+
+// CancelTransfer aborts an unfinished transfer on both agents
+func (s *Service) CancelTransfer(transferID string) (*models.Transfer, error) {
+	return s.WSHub.TransferManager.CancelTransfer(transferID)
+}
+
+// ResumeTransfer asks the destination of a failed transfer to resume it from its checkpoint
+func (s *Service) ResumeTransfer(transferID string) (*models.Transfer, error) {
+	return s.WSHub.TransferManager.RequestResume(transferID)
+}
+
+// CreateSyncPair mirrors a folder of one known agent with a folder of another
+func (s *Service) CreateSyncPair(req models.CreateSyncPairRequest) (*models.SyncPair, error) {
+	for _, agentID := range []string{req.AgentA, req.AgentB} {
+		if _, err := s.IsAgentOnline(agentID); err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrAgentNotFound, agentID)
+		}
+	}
+	return s.WSHub.SyncPairs.Create(req)
+}
+
+func (s *Service) ListSyncPairs() []*models.SyncPair {
+	return s.WSHub.SyncPairs.List()
+}
+
+func (s *Service) GetSyncPair(pairID string) *models.SyncPair {
+	return s.WSHub.SyncPairs.Get(pairID)
+}
+
+// DeleteSyncPair stops syncing a pair; the agents keep their folders as they are
+func (s *Service) DeleteSyncPair(pairID string) (*models.SyncPair, error) {
+	return s.WSHub.SyncPairs.Delete(pairID)
+}
+
+func (s *Service) CreateTask(req models.CreateTaskRequest) (*models.Task, error) {
+	if req.Type != models.TaskTypeShellCommand {
+		return nil, fmt.Errorf("unsupported task type: %s", req.Type)
+	}
+	agentID := req.AgentID
+	if agentID == "" {
+		agentID = s.pickTaskAgent()
+		if agentID == "" {
+			return nil, errors.New("no online agent available")
+		}
+	} else {
+		online, err := s.IsAgentOnline(agentID)
+		if err != nil {
+			return nil, err
+		}
+		if !online {
+			return nil, errors.New("target agent is offline")
+		}
+	}
+	return s.WSHub.TaskManager.Dispatch(req, agentID), nil
+}
+
+func (s *Service) GetTask(taskID string) *models.Task {
+	return s.WSHub.TaskManager.Get(taskID)
+}
+
+func (s *Service) ListTasks() []*models.Task {
+	return s.WSHub.TaskManager.List()
+}
+
+// pickTaskAgent returns the online agent with the fewest active tasks
+func (s *Service) pickTaskAgent() string {
+	s.WSHub.Mutex.RLock()
+	candidates := make([]string, 0, len(s.WSHub.Connections))
+	for id, agent := range s.WSHub.Connections {
+		if agent.Name == "frontend" || id == "" || agent.Conn == nil {
+			continue
+		}
+		candidates = append(candidates, id)
+	}
+	s.WSHub.Mutex.RUnlock()
+	sort.Strings(candidates)
+	best := ""
+	bestLoad := 0
+	for _, id := range candidates {
+		load := s.WSHub.TaskManager.ActiveCount(id)
+		if best == "" || load < bestLoad {
+			best = id
+			bestLoad = load
+		}
+	}
+	return best
 }
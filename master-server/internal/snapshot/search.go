@@ -0,0 +1,101 @@
+package snapshot
+
+import (
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/The-Promised-Neverland/master-server/internal/models"
+)
+
+// Query selects entries of the copies. Zero fields match every entry.
+type Query struct {
+	Name           string // glob matched against the entry's name, ignoring case; see path.Match
+	PathPrefix     string // folder whose entries match at any depth, or an entry's own path
+	Type           string // "file" or "directory"
+	MinSize        *int64
+	MaxSize        *int64
+	ModifiedAfter  time.Time       // inclusive
+	ModifiedBefore time.Time       // exclusive
+	AgentIDs       map[string]bool // nil for every agent
+	Limit          int             // 0 for no limit
+}
+
+// ValidPattern reports whether a name glob is well formed
+func ValidPattern(pattern string) bool {
+	_, err := path.Match(pattern, "")
+	return err == nil
+}
+
+// Search returns the entries matching q, by agent then path, up to q.Limit, and the number of
+// matches. Paths are compared with '/' separators whatever the agent's OS; results keep the
+// agent's own.
+func (s *Store) Search(q Query) ([]models.FileSearchResult, int) {
+	name := strings.ToLower(q.Name)
+	prefix := strings.Trim(strings.ReplaceAll(q.PathPrefix, `\`, "/"), "/")
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	agentIDs := make([]string, 0, len(s.folders))
+	for id, f := range s.folders {
+		if f.files != nil && (q.AgentIDs == nil || q.AgentIDs[id]) {
+			agentIDs = append(agentIDs, id)
+		}
+	}
+	sort.Strings(agentIDs)
+	var results []models.FileSearchResult
+	total := 0
+	for _, id := range agentIDs {
+		f := s.folders[id]
+		var matches []models.FileInfo
+		for _, file := range f.files {
+			if q.matches(file, name, prefix) {
+				matches = append(matches, file)
+			}
+		}
+		total += len(matches)
+		if q.Limit > 0 && len(results) >= q.Limit {
+			continue
+		}
+		sort.Slice(matches, func(i, j int) bool { return matches[i].Path < matches[j].Path })
+		for _, file := range matches {
+			if q.Limit > 0 && len(results) >= q.Limit {
+				break
+			}
+			results = append(results, models.FileSearchResult{
+				SourceAgentID: id,
+				FileInfo:      file,
+				SnapshotAt:    f.updatedAt,
+			})
+		}
+	}
+	return results, total
+}
+
+// matches takes the lowercased name glob and the slash-separated prefix without surrounding slashes
+func (q *Query) matches(file models.FileInfo, name, prefix string) bool {
+	if q.Type != "" && file.Type != q.Type {
+		return false
+	}
+	if (q.MinSize != nil && file.Size < *q.MinSize) || (q.MaxSize != nil && file.Size > *q.MaxSize) {
+		return false
+	}
+	if name != "" {
+		if ok, _ := path.Match(name, strings.ToLower(file.Name)); !ok {
+			return false
+		}
+	}
+	if prefix != "" {
+		p := strings.ReplaceAll(file.Path, `\`, "/")
+		if p != prefix && !strings.HasPrefix(p, prefix+"/") {
+			return false
+		}
+	}
+	if !q.ModifiedAfter.IsZero() || !q.ModifiedBefore.IsZero() {
+		modified, err := time.Parse(time.RFC3339, file.Modified)
+		if err != nil || modified.Before(q.ModifiedAfter) || (!q.ModifiedBefore.IsZero() && !modified.Before(q.ModifiedBefore)) {
+			return false
+		}
+	}
+	return true
+}
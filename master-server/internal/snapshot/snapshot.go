@@ -0,0 +1,317 @@
+package snapshot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/The-Promised-Neverland/master-server/internal/models"
+)
+
+// Store keeps the master's copy of each agent's shared folder. An agent sends its folder whole
+// when it connects and periodically, and a versioned delta for each change in between. A delta
+// applies only to the copy at its base version: a copy at any other version missed a message,
+// and the agent is asked for its folder whole again.
+// Copies are kept for offline agents too, and flushed to a JSON file per agent in dir.
+type Store struct {
+	dir     string
+	folders map[string]*folder
+	mu      sync.RWMutex
+	// flushMu keeps Delete from removing a file while Flush is still writing it
+	flushMu sync.Mutex
+}
+
+type folder struct {
+	version    uint64
+	timestamp  string
+	files      map[string]models.FileInfo // by path
+	totalFiles int
+	totalSize  int64
+	updatedAt  time.Time // when the master last changed the copy
+	dirty      bool
+	// assembling holds the parts of a full snapshot received so far
+	assembling *models.DirectorySnapshot
+	// requested is set once the agent was asked for a full snapshot, so deltas arriving before it
+	// do not ask again
+	requested bool
+}
+
+// record is a folder as flushed to disk
+type record struct {
+	AgentID    string            `json:"agent_id"`
+	Version    uint64            `json:"version"`
+	Timestamp  string            `json:"timestamp"`
+	UpdatedAt  time.Time         `json:"updated_at"`
+	TotalFiles int               `json:"total_files"`
+	TotalSize  int64             `json:"total_size"`
+	Files      []models.FileInfo `json:"files"`
+}
+
+func NewStore(dir string) (*Store, error) {
+	s := &Store{
+		dir:     dir,
+		folders: make(map[string]*folder),
+	}
+	if dir == "" {
+		return s, nil
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read snapshot file %s: %w", file, err)
+		}
+		var r record
+		if err := json.Unmarshal(data, &r); err != nil {
+			return nil, fmt.Errorf("failed to parse snapshot file %s: %w", file, err)
+		}
+		f := &folder{
+			version:    r.Version,
+			timestamp:  r.Timestamp,
+			files:      make(map[string]models.FileInfo, len(r.Files)),
+			totalFiles: r.TotalFiles,
+			totalSize:  r.TotalSize,
+			updatedAt:  r.UpdatedAt,
+		}
+		for _, file := range r.Files {
+			f.files[file.Path] = file
+		}
+		s.folders[r.AgentID] = f
+	}
+	return s, nil
+}
+
+// AddSnapshot takes one part of an agent's full snapshot. Once the last part arrived it replaces
+// the agent's copy and is returned whole; until then it returns nil.
+func (s *Store) AddSnapshot(agentID string, payload map[string]interface{}) (*models.DirectorySnapshot, error) {
+	var part models.DirectorySnapshot
+	if err := decode(payload, &part); err != nil {
+		return nil, fmt.Errorf("malformed directory snapshot: %w", err)
+	}
+	part.AgentID = agentID
+	part.Parts = max(part.Parts, 1) // agents without deltas send their folder in one message
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f := s.folder(agentID)
+	switch {
+	case part.Part == 0:
+		f.assembling = &part
+	case f.assembling == nil || f.assembling.Version != part.Version || f.assembling.Part+1 != part.Part:
+		f.assembling = nil
+		return nil, fmt.Errorf("directory snapshot part %d/%d of version %d is out of sequence", part.Part+1, part.Parts, part.Version)
+	default:
+		f.assembling.Directory.Files = append(f.assembling.Directory.Files, part.Directory.Files...)
+		f.assembling.Part = part.Part
+	}
+	if f.assembling.Part+1 < f.assembling.Parts {
+		return nil, nil
+	}
+	whole := f.assembling
+	f.assembling = nil
+	f.requested = false
+	f.version, f.timestamp = whole.Version, whole.Timestamp
+	f.totalFiles, f.totalSize = whole.Directory.TotalFiles, whole.Directory.TotalSize
+	f.updatedAt, f.dirty = time.Now(), true
+	f.files = make(map[string]models.FileInfo, len(whole.Directory.Files))
+	for _, file := range whole.Directory.Files {
+		f.files[file.Path] = file
+	}
+	whole.Part, whole.Parts = 0, 1
+	return whole, nil
+}
+
+// ApplyDelta applies an agent's delta to its copy and returns it. When the copy is not at the
+// delta's base version it returns nil and whether the agent should be asked for a full snapshot,
+// which is only once until one arrives.
+func (s *Store) ApplyDelta(agentID string, payload map[string]interface{}) (*models.DirectoryDelta, bool, error) {
+	var delta models.DirectoryDelta
+	if err := decode(payload, &delta); err != nil {
+		return nil, false, fmt.Errorf("malformed directory delta: %w", err)
+	}
+	delta.AgentID = agentID
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f := s.folder(agentID)
+	if f.files == nil || f.version != delta.BaseVersion {
+		request := !f.requested
+		f.requested = true
+		return nil, request, nil
+	}
+	for _, path := range delta.Removed {
+		delete(f.files, path)
+	}
+	for _, file := range delta.Added {
+		f.files[file.Path] = file
+	}
+	for _, file := range delta.Modified {
+		f.files[file.Path] = file
+	}
+	f.version, f.timestamp = delta.Version, delta.Timestamp
+	f.totalFiles, f.totalSize = delta.TotalFiles, delta.TotalSize
+	f.updatedAt, f.dirty = time.Now(), true
+	return &delta, false, nil
+}
+
+// Get returns the copy of an agent's folder with its files sorted by path, nil if there is none
+func (s *Store) Get(agentID string) *models.DirectorySnapshot {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	f := s.folders[agentID]
+	if f == nil || f.files == nil {
+		return nil
+	}
+	return &models.DirectorySnapshot{
+		AgentID:   agentID,
+		Timestamp: f.timestamp,
+		Version:   f.version,
+		Parts:     1,
+		Directory: models.DirectoryInfo{
+			Files:      f.sortedFiles(),
+			TotalFiles: f.totalFiles,
+			TotalSize:  f.totalSize,
+		},
+	}
+}
+
+func (f *folder) sortedFiles() []models.FileInfo {
+	files := make([]models.FileInfo, 0, len(f.files))
+	for _, file := range f.files {
+		files = append(files, file)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return files
+}
+
+// AgentDisconnected drops a snapshot the agent was still sending. Its copy stays.
+func (s *Store) AgentDisconnected(agentID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if f := s.folders[agentID]; f != nil {
+		f.assembling = nil
+		f.requested = false
+	}
+}
+
+// StartFlusher writes changed copies to disk every interval
+func (s *Store) StartFlusher(interval time.Duration) {
+	if s.dir == "" {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := s.Flush(); err != nil {
+				fmt.Printf("Failed to flush directory snapshots: %v\n", err)
+			}
+		}
+	}()
+}
+
+// Flush writes every copy that changed since the last flush
+func (s *Store) Flush() error {
+	if s.dir == "" {
+		return nil
+	}
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+	s.mu.Lock()
+	pending := make(map[string][]byte)
+	for id, f := range s.folders {
+		if !f.dirty {
+			continue
+		}
+		data, err := json.Marshal(record{
+			AgentID:    id,
+			Version:    f.version,
+			Timestamp:  f.timestamp,
+			UpdatedAt:  f.updatedAt,
+			TotalFiles: f.totalFiles,
+			TotalSize:  f.totalSize,
+			Files:      f.sortedFiles(),
+		})
+		if err != nil {
+			s.mu.Unlock()
+			return err
+		}
+		pending[id] = data
+		f.dirty = false
+	}
+	s.mu.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return fmt.Errorf("failed to create snapshot directory: %w", err)
+	}
+	var errs []error
+	for id, data := range pending {
+		path := s.path(id)
+		tmp := path + ".tmp"
+		if err := os.WriteFile(tmp, data, 0600); err != nil {
+			errs = append(errs, err)
+			s.markDirty(id)
+			continue
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			errs = append(errs, err)
+			s.markDirty(id)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Delete forgets the copy of a removed agent's folder and removes its file
+func (s *Store) Delete(agentID string) error {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+	s.mu.Lock()
+	delete(s.folders, agentID)
+	s.mu.Unlock()
+	if s.dir == "" {
+		return nil
+	}
+	if err := os.Remove(s.path(agentID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove snapshot file: %w", err)
+	}
+	return nil
+}
+
+func (s *Store) path(agentID string) string {
+	return filepath.Join(s.dir, url.PathEscape(agentID)+".json")
+}
+
+func (s *Store) markDirty(agentID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if f := s.folders[agentID]; f != nil {
+		f.dirty = true
+	}
+}
+
+func (s *Store) folder(agentID string) *folder {
+	f := s.folders[agentID]
+	if f == nil {
+		f = &folder{}
+		s.folders[agentID] = f
+	}
+	return f
+}
+
+func decode(payload map[string]interface{}, v any) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/The-Promised-Neverland/master-server/internal/models"
@@ -19,6 +20,9 @@ type SSEHub struct {
 	Connections map[string]*Connection
 	BroadCastCh chan models.Message
 	Mutex       sync.RWMutex
+
+	DroppedBroadcast atomic.Uint64 // broadcast channel full
+	DroppedClient    atomic.Uint64 // a client's send channel full
 }
 
 func NewSSEHub() *SSEHub {
@@ -43,6 +47,7 @@ func (h *SSEHub) Broadcastpump() {
 			select {
 			case conn.SendCh <- data:
 			default:
+				h.DroppedClient.Add(1)
 				fmt.Printf("SSE send channel full for %s, dropping message\n", conn.ID)
 			}
 		}
@@ -54,10 +59,17 @@ func (h *SSEHub) Broadcast(msg models.Message) {
 	select {
 	case h.BroadCastCh <- msg:
 	default:
+		h.DroppedBroadcast.Add(1)
 		fmt.Printf("SSE broadcast channel full, dropping message\n")
 	}
 }
 
+func (h *SSEHub) ClientCount() int {
+	h.Mutex.RLock()
+	defer h.Mutex.RUnlock()
+	return len(h.Connections)
+}
+
 func (h *SSEHub) Connect(id string) *Connection {
 	h.Mutex.Lock()
 	defer h.Mutex.Unlock()
@@ -0,0 +1,439 @@
+package syncpair
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/The-Promised-Neverland/master-server/internal/models"
+	"github.com/The-Promised-Neverland/master-server/internal/sse"
+	"github.com/The-Promised-Neverland/master-server/internal/transfer"
+	"github.com/google/uuid"
+)
+
+const (
+	// maxConflicts is how many recent conflicts a pair keeps
+	maxConflicts = 50
+	// maxPullFiles bounds the files of one sync pull, so its intent fits a WebSocket message
+	maxPullFiles = 1000
+)
+
+var (
+	ErrPairNotFound = errors.New("sync pair not found")
+	ErrInvalidPair  = errors.New("invalid sync pair")
+)
+
+// Manager holds the sync pairs defined on the master. The agents do the syncing: each watches
+// its folder and pushes its changes to the other through the master, which only forwards them
+// and starts the transfers an agent asks for to pull the files it is missing.
+// With a path it rewrites a JSON file on every change so pairs survive a restart.
+type Manager struct {
+	path          string
+	pairs         map[string]*models.SyncPair
+	messageSender transfer.MessageSender
+	connGetter    transfer.ConnectionGetter
+	transfers     *transfer.TransferManager
+	sseHub        *sse.SSEHub
+	mu            sync.Mutex
+}
+
+func NewManager(path string, messageSender transfer.MessageSender, connGetter transfer.ConnectionGetter, transfers *transfer.TransferManager, sseHub *sse.SSEHub) (*Manager, error) {
+	m := &Manager{
+		path:          path,
+		pairs:         make(map[string]*models.SyncPair),
+		messageSender: messageSender,
+		connGetter:    connGetter,
+		transfers:     transfers,
+		sseHub:        sseHub,
+	}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+		case err != nil:
+			return nil, fmt.Errorf("failed to read sync pairs: %w", err)
+		default:
+			var pairs []*models.SyncPair
+			if err := json.Unmarshal(data, &pairs); err != nil {
+				return nil, fmt.Errorf("failed to parse sync pairs: %w", err)
+			}
+			for _, p := range pairs {
+				m.pairs[p.ID] = p
+			}
+		}
+	}
+	return m, nil
+}
+
+// Create defines a pair and sends it to both agents, which start with a full sync of the two
+// folders
+func (m *Manager) Create(req models.CreateSyncPairRequest) (*models.SyncPair, error) {
+	winner := req.ConflictWinner
+	if winner == "" {
+		winner = models.SyncWinnerNewest
+	}
+	if winner != models.SyncWinnerNewest && winner != models.SyncSideA && winner != models.SyncSideB {
+		return nil, fmt.Errorf("%w: conflict_winner must be %q, %q or %q", ErrInvalidPair, models.SyncWinnerNewest, models.SyncSideA, models.SyncSideB)
+	}
+	if req.AgentA == req.AgentB {
+		return nil, fmt.Errorf("%w: both folders are on agent %s", ErrInvalidPair, req.AgentA)
+	}
+	folderA, err := cleanFolder(req.FolderA)
+	if err != nil {
+		return nil, err
+	}
+	folderB, err := cleanFolder(req.FolderB)
+	if err != nil {
+		return nil, err
+	}
+	pair := &models.SyncPair{
+		ID:             uuid.New().String(),
+		A:              models.SyncEndpoint{AgentID: req.AgentA, Folder: folderA},
+		B:              models.SyncEndpoint{AgentID: req.AgentB, Folder: folderB},
+		ConflictWinner: winner,
+		CreatedAt:      time.Now(),
+	}
+	m.mu.Lock()
+	for _, other := range m.pairs {
+		for _, endpoint := range []models.SyncEndpoint{pair.A, pair.B} {
+			for _, taken := range []models.SyncEndpoint{other.A, other.B} {
+				if endpoint.AgentID == taken.AgentID && overlaps(endpoint.Folder, taken.Folder) {
+					m.mu.Unlock()
+					return nil, fmt.Errorf("%w: %s on agent %s overlaps %s of sync pair %s", ErrInvalidPair, endpoint.Folder, endpoint.AgentID, taken.Folder, other.ID)
+				}
+			}
+		}
+	}
+	m.pairs[pair.ID] = pair
+	if err := m.saveLocked(); err != nil {
+		delete(m.pairs, pair.ID)
+		m.mu.Unlock()
+		return nil, err
+	}
+	snapshot := m.snapshotLocked(pair)
+	m.mu.Unlock()
+	fmt.Printf("[SYNC] Pair %s created: %s:%s <-> %s:%s, conflict winner %s\n", pair.ID, pair.A.AgentID, pair.A.Folder, pair.B.AgentID, pair.B.Folder, winner)
+	m.sendPairs(pair.A.AgentID)
+	m.sendPairs(pair.B.AgentID)
+	m.publish(snapshot)
+	return snapshot, nil
+}
+
+// Delete removes a pair. Both agents stop syncing it; their folders are left as they are.
+func (m *Manager) Delete(pairID string) (*models.SyncPair, error) {
+	m.mu.Lock()
+	pair := m.pairs[pairID]
+	if pair == nil {
+		m.mu.Unlock()
+		return nil, fmt.Errorf("%w: %s", ErrPairNotFound, pairID)
+	}
+	delete(m.pairs, pairID)
+	if err := m.saveLocked(); err != nil {
+		m.pairs[pairID] = pair
+		m.mu.Unlock()
+		return nil, err
+	}
+	snapshot := m.snapshotLocked(pair)
+	m.mu.Unlock()
+	fmt.Printf("[SYNC] Pair %s deleted\n", pairID)
+	m.sendPairs(pair.A.AgentID)
+	m.sendPairs(pair.B.AgentID)
+	return snapshot, nil
+}
+
+func (m *Manager) Get(pairID string) *models.SyncPair {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	pair := m.pairs[pairID]
+	if pair == nil {
+		return nil
+	}
+	return m.snapshotLocked(pair)
+}
+
+// List returns all pairs, newest first
+func (m *Manager) List() []*models.SyncPair {
+	m.mu.Lock()
+	pairs := make([]*models.SyncPair, 0, len(m.pairs))
+	for _, pair := range m.pairs {
+		pairs = append(pairs, m.snapshotLocked(pair))
+	}
+	m.mu.Unlock()
+	sort.Slice(pairs, func(i, j int) bool {
+		return pairs[i].CreatedAt.After(pairs[j].CreatedAt)
+	})
+	return pairs
+}
+
+// AgentConnected sends an agent the pairs it is part of. The agent drops the ones it no longer is.
+// Its online peers get their pairs again too, which has them resend the changes the agent missed
+// while it was away.
+func (m *Manager) AgentConnected(agentID string) {
+	m.sendPairs(agentID)
+	peers := make(map[string]bool)
+	m.mu.Lock()
+	for _, pair := range m.pairs {
+		if side := pair.SideOf(agentID); side != "" {
+			peers[pair.Side(otherSide(side)).AgentID] = true
+		}
+	}
+	m.mu.Unlock()
+	for peerID := range peers {
+		if m.connGetter.GetConnection(peerID) != nil {
+			m.sendPairs(peerID)
+		}
+	}
+}
+
+// sendPairs sends agentID its side of every pair it is part of
+func (m *Manager) sendPairs(agentID string) {
+	m.mu.Lock()
+	configs := make([]models.SyncPairConfig, 0)
+	for _, pair := range m.pairs {
+		side := pair.SideOf(agentID)
+		if side == "" {
+			continue
+		}
+		local, peer := pair.Side(side), pair.Side(otherSide(side))
+		configs = append(configs, models.SyncPairConfig{
+			ID:             pair.ID,
+			Side:           side,
+			Folder:         local.Folder,
+			PeerAgentID:    peer.AgentID,
+			PeerFolder:     peer.Folder,
+			ConflictWinner: pair.ConflictWinner,
+		})
+	}
+	m.mu.Unlock()
+	m.messageSender.Send(agentID, transfer.Outbound{Msg: &models.Message{
+		Type: models.MasterMsgSyncPairs,
+		Payload: map[string]interface{}{
+			"pairs": configs,
+		},
+	}})
+}
+
+// Forward passes an agent's changes, or its acknowledgement of changes it applied, on to the
+// other agent of the pair. An offline agent misses them; its peer sends unacknowledged changes
+// again later.
+func (m *Manager) Forward(agentID string, msg *models.Message) error {
+	payload, ok := msg.Payload.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("invalid %s payload", msg.Type)
+	}
+	pairID, _ := payload["pair_id"].(string)
+	_, peer, err := m.member(pairID, agentID)
+	if err != nil {
+		return err
+	}
+	forwardType := models.MasterMsgSyncChanges
+	if msg.Type == models.AgentMsgSyncAck {
+		forwardType = models.MasterMsgSyncAck
+	}
+	m.messageSender.Send(peer.AgentID, transfer.Outbound{Msg: &models.Message{
+		Type:    forwardType,
+		Payload: payload,
+	}})
+	return nil
+}
+
+// Pull starts a transfer of files from the other agent of a pair into the requesting agent's
+// folder, as a delta against the versions it has. The agent picks the connection ID so it can
+// tell the transfer apart when it completes.
+func (m *Manager) Pull(agentID string, payload map[string]interface{}) error {
+	pairID, _ := payload["pair_id"].(string)
+	local, peer, err := m.member(pairID, agentID)
+	if err != nil {
+		return err
+	}
+	connectionID, _ := payload["connection_id"].(string)
+	if connectionID == "" || m.transfers.Registry().Get(connectionID) != nil {
+		return fmt.Errorf("sync pull for pair %s needs a new connection_id", pairID)
+	}
+	raw, _ := payload["files"].([]interface{})
+	if len(raw) == 0 || len(raw) > maxPullFiles {
+		return fmt.Errorf("sync pull for pair %s must list 1 to %d files", pairID, maxPullFiles)
+	}
+	files := make([]string, 0, len(raw))
+	for _, f := range raw {
+		name, _ := f.(string)
+		if !filepath.IsLocal(name) {
+			return fmt.Errorf("sync pull for pair %s lists invalid path %q", pairID, name)
+		}
+		files = append(files, name)
+	}
+	if m.connGetter.GetConnection(peer.AgentID) == nil {
+		return fmt.Errorf("sync pull for pair %s: agent %s is offline", pairID, peer.AgentID)
+	}
+	req := models.Message{
+		Type: models.MasterMsgTransferIntent,
+		Payload: map[string]interface{}{
+			"requesting_agent_id": agentID,
+			"connection_id":       connectionID,
+			"path":                peer.Folder,
+			"delta":               true,
+			"sync_pair_id":        pairID,
+			"files":               files,
+			"target":              local.Folder,
+		},
+	}
+	fmt.Printf("[SYNC] Agent %s pulls %d files of pair %s from agent %s, connection_id=%s\n", agentID, len(files), pairID, peer.AgentID, connectionID)
+	_, err = m.transfers.HandleAgentRequestFile(&req, peer.AgentID)
+	return err
+}
+
+// report is an agent_sync_report
+type report struct {
+	PairID    string                `json:"pair_id"`
+	Files     int                   `json:"files"`
+	Bytes     int64                 `json:"bytes"`
+	Pending   int                   `json:"pending"`
+	ScannedAt time.Time             `json:"scanned_at"`
+	Error     string                `json:"error"`
+	Conflicts []models.SyncConflict `json:"conflicts"` // found since the last report
+}
+
+// Report records an agent's state of its folder of a pair and the conflicts it resolved
+func (m *Manager) Report(agentID string, payload map[string]interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	var r report
+	if err := json.Unmarshal(data, &r); err != nil {
+		return fmt.Errorf("malformed sync report: %w", err)
+	}
+	m.mu.Lock()
+	pair := m.pairs[r.PairID]
+	side := ""
+	if pair != nil {
+		side = pair.SideOf(agentID)
+	}
+	if side == "" {
+		m.mu.Unlock()
+		return fmt.Errorf("%w: %s with agent %s", ErrPairNotFound, r.PairID, agentID)
+	}
+	pair.Side(side).State = &models.SyncSideState{
+		Files:      r.Files,
+		Bytes:      r.Bytes,
+		Pending:    r.Pending,
+		ScannedAt:  r.ScannedAt,
+		Error:      r.Error,
+		ReportedAt: time.Now(),
+	}
+	for _, conflict := range r.Conflicts {
+		conflict.DetectedBy = side
+		fmt.Printf("[SYNC] Conflict on %s of pair %s, kept side %s\n", conflict.Path, pair.ID, conflict.Winner)
+		pair.Conflicts = append(pair.Conflicts, conflict)
+	}
+	if len(pair.Conflicts) > maxConflicts {
+		pair.Conflicts = append([]models.SyncConflict(nil), pair.Conflicts[len(pair.Conflicts)-maxConflicts:]...)
+	}
+	if err := m.saveLocked(); err != nil {
+		fmt.Printf("Failed to save sync pairs: %v\n", err)
+	}
+	snapshot := m.snapshotLocked(pair)
+	m.mu.Unlock()
+	m.publish(snapshot)
+	return nil
+}
+
+// member returns agentID's endpoint of a pair and the other one
+func (m *Manager) member(pairID, agentID string) (models.SyncEndpoint, models.SyncEndpoint, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	pair := m.pairs[pairID]
+	if pair == nil {
+		return models.SyncEndpoint{}, models.SyncEndpoint{}, fmt.Errorf("%w: %s", ErrPairNotFound, pairID)
+	}
+	side := pair.SideOf(agentID)
+	if side == "" {
+		return models.SyncEndpoint{}, models.SyncEndpoint{}, fmt.Errorf("agent %s is not part of sync pair %s", agentID, pairID)
+	}
+	return *pair.Side(side), *pair.Side(otherSide(side)), nil
+}
+
+// snapshotLocked copies a pair with its agents' presence; the caller holds m.mu
+func (m *Manager) snapshotLocked(pair *models.SyncPair) *models.SyncPair {
+	snapshot := *pair
+	snapshot.Conflicts = append([]models.SyncConflict(nil), pair.Conflicts...)
+	for _, endpoint := range []*models.SyncEndpoint{&snapshot.A, &snapshot.B} {
+		endpoint.Online = m.connGetter.GetConnection(endpoint.AgentID) != nil
+		if endpoint.State != nil {
+			state := *endpoint.State
+			endpoint.State = &state
+		}
+	}
+	snapshot.Status = models.SyncStatusWaiting
+	if snapshot.A.Online && snapshot.B.Online {
+		snapshot.Status = models.SyncStatusActive
+	}
+	return &snapshot
+}
+
+func (m *Manager) publish(pair *models.SyncPair) {
+	if m.sseHub == nil {
+		return
+	}
+	m.sseHub.Broadcast(models.Message{
+		Type:    models.SSEMsgSyncUpdate,
+		Payload: pair,
+	})
+}
+
+func (m *Manager) saveLocked() error {
+	if m.path == "" {
+		return nil
+	}
+	pairs := make([]*models.SyncPair, 0, len(m.pairs))
+	for _, pair := range m.pairs {
+		pairs = append(pairs, pair)
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		return pairs[i].CreatedAt.Before(pairs[j].CreatedAt)
+	})
+	data, err := json.MarshalIndent(pairs, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(m.path), 0700); err != nil {
+		return fmt.Errorf("failed to create sync pairs directory: %w", err)
+	}
+	tmp := m.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write sync pairs: %w", err)
+	}
+	return os.Rename(tmp, m.path)
+}
+
+// cleanFolder checks a pair folder lies inside the shared folder, outside the transfers an
+// agent pulls, and returns it slash-separated
+func cleanFolder(folder string) (string, error) {
+	folder = path.Clean(strings.ReplaceAll(folder, "\\", "/"))
+	if folder == "." || !filepath.IsLocal(folder) {
+		return "", fmt.Errorf("%w: folder %q must be a folder inside the shared folder", ErrInvalidPair, folder)
+	}
+	if overlaps(folder, "transfers") {
+		return "", fmt.Errorf("%w: folder %q is inside transfers", ErrInvalidPair, folder)
+	}
+	return folder, nil
+}
+
+// overlaps reports whether one folder is the other or contains it
+func overlaps(a, b string) bool {
+	return a == b || strings.HasPrefix(a, b+"/") || strings.HasPrefix(b, a+"/")
+}
+
+func otherSide(side string) string {
+	if side == models.SyncSideA {
+		return models.SyncSideB
+	}
+	return models.SyncSideA
+}
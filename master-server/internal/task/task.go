@@ -0,0 +1,209 @@
+package task
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/The-Promised-Neverland/master-server/internal/models"
+	"github.com/The-Promised-Neverland/master-server/internal/sse"
+	"github.com/The-Promised-Neverland/master-server/internal/transfer"
+	"github.com/google/uuid"
+)
+
+const (
+	// resultGrace is how long the master waits past a task's own timeout before
+	// giving up on hearing back from the agent.
+	resultGrace = 15 * time.Second
+	// taskRetention is how long finished tasks stay listed
+	taskRetention = 24 * time.Hour
+)
+
+type TaskManager struct {
+	tasks         map[string]*models.Task
+	messageSender transfer.MessageSender
+	sseHub        *sse.SSEHub
+	mu            sync.RWMutex
+}
+
+func NewTaskManager(messageSender transfer.MessageSender, sseHub *sse.SSEHub) *TaskManager {
+	return &TaskManager{
+		tasks:         make(map[string]*models.Task),
+		messageSender: messageSender,
+		sseHub:        sseHub,
+	}
+}
+
+// Dispatch records a new task for agentID and sends the assignment to the agent
+func (m *TaskManager) Dispatch(req models.CreateTaskRequest, agentID string) *models.Task {
+	timeout := req.Timeout
+	if timeout <= 0 {
+		timeout = models.DefaultTaskTimeout
+	}
+	t := &models.Task{
+		ID:        uuid.New().String(),
+		Type:      req.Type,
+		Command:   req.Command,
+		AgentID:   agentID,
+		Status:    models.TaskStatusPending,
+		CreatedAt: time.Now(),
+		Timeout:   timeout,
+	}
+	m.mu.Lock()
+	m.pruneLocked()
+	m.tasks[t.ID] = t
+	snapshot := *t
+	m.mu.Unlock()
+	m.publish(&snapshot)
+	assignMsg := models.Message{
+		Type: models.MasterMsgTaskAssignment,
+		Payload: models.TaskAssignmentPayload{
+			JobID:   t.ID,
+			JobType: t.Type,
+			Command: t.Command,
+			Timeout: t.Timeout,
+		},
+	}
+	m.messageSender.Send(agentID, transfer.Outbound{Msg: &assignMsg})
+	fmt.Printf("[TASK] Task %s (%s) dispatched to agent %s, timeout=%ds\n", t.ID, t.Type, agentID, timeout)
+	go m.watchResult(t.ID, time.Duration(timeout)*time.Second+resultGrace)
+	return &snapshot
+}
+
+func (m *TaskManager) Get(taskID string) *models.Task {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	t, ok := m.tasks[taskID]
+	if !ok {
+		return nil
+	}
+	snapshot := *t
+	return &snapshot
+}
+
+// List returns all known tasks, newest first
+func (m *TaskManager) List() []*models.Task {
+	m.mu.RLock()
+	tasks := make([]*models.Task, 0, len(m.tasks))
+	for _, t := range m.tasks {
+		snapshot := *t
+		tasks = append(tasks, &snapshot)
+	}
+	m.mu.RUnlock()
+	sort.Slice(tasks, func(i, j int) bool {
+		return tasks[i].CreatedAt.After(tasks[j].CreatedAt)
+	})
+	return tasks
+}
+
+// ActiveCount returns the number of pending or running tasks on an agent
+func (m *TaskManager) ActiveCount(agentID string) int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	count := 0
+	for _, t := range m.tasks {
+		if t.AgentID == agentID && !isFinished(t.Status) {
+			count++
+		}
+	}
+	return count
+}
+
+// HandleJobStatus applies an agent_job_status report to the matching task
+func (m *TaskManager) HandleJobStatus(agentID string, payload map[string]interface{}) error {
+	jobID, _ := payload["job_id"].(string)
+	status, _ := payload["status"].(string)
+	if jobID == "" || status == "" {
+		return fmt.Errorf("job_id and status are required")
+	}
+	m.mu.Lock()
+	t, ok := m.tasks[jobID]
+	if !ok {
+		m.mu.Unlock()
+		return fmt.Errorf("unknown task %s", jobID)
+	}
+	if t.AgentID != agentID {
+		m.mu.Unlock()
+		return fmt.Errorf("task %s is not assigned to agent %s", jobID, agentID)
+	}
+	if isFinished(t.Status) {
+		m.mu.Unlock()
+		return nil
+	}
+	now := time.Now()
+	if output, ok := payload["output"].(string); ok {
+		t.Output = output
+	}
+	if errMsg, ok := payload["error"].(string); ok && errMsg != "" {
+		t.Error = errMsg
+	}
+	if code, ok := payload["exit_code"].(float64); ok {
+		exitCode := int(code)
+		t.ExitCode = &exitCode
+	}
+	switch status {
+	case models.TaskStatusRunning:
+		if t.StartedAt == nil {
+			t.StartedAt = &now
+		}
+		t.Status = models.TaskStatusRunning
+	case models.TaskStatusCompleted, models.TaskStatusFailed:
+		if t.StartedAt == nil {
+			t.StartedAt = &now
+		}
+		t.CompletedAt = &now
+		t.Status = status
+	default:
+		m.mu.Unlock()
+		return fmt.Errorf("unknown job status %q", status)
+	}
+	snapshot := *t
+	m.mu.Unlock()
+	if isFinished(snapshot.Status) {
+		fmt.Printf("[TASK] Task %s on agent %s finished with status %s\n", snapshot.ID, agentID, snapshot.Status)
+	}
+	m.publish(&snapshot)
+	return nil
+}
+
+// watchResult fails the task if the agent never reports a final status
+func (m *TaskManager) watchResult(taskID string, wait time.Duration) {
+	time.Sleep(wait)
+	m.mu.Lock()
+	t, ok := m.tasks[taskID]
+	if !ok || isFinished(t.Status) {
+		m.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	t.Status = models.TaskStatusFailed
+	t.Error = "no result received from agent"
+	t.CompletedAt = &now
+	snapshot := *t
+	m.mu.Unlock()
+	fmt.Printf("[TASK] Task %s on agent %s timed out waiting for a result\n", taskID, snapshot.AgentID)
+	m.publish(&snapshot)
+}
+
+func (m *TaskManager) pruneLocked() {
+	for id, t := range m.tasks {
+		if t.CompletedAt != nil && time.Since(*t.CompletedAt) > taskRetention {
+			delete(m.tasks, id)
+		}
+	}
+}
+
+func (m *TaskManager) publish(t *models.Task) {
+	if m.sseHub == nil {
+		return
+	}
+	m.sseHub.Broadcast(models.Message{
+		Type:    models.SSEMsgTaskUpdate,
+		Payload: t,
+	})
+}
+
+func isFinished(status string) bool {
+	return status == models.TaskStatusCompleted || status == models.TaskStatusFailed
+}
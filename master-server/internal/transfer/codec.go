@@ -0,0 +1,26 @@
+package transfer
+
+import (
+	"slices"
+
+	"github.com/The-Promised-Neverland/master-server/internal/models"
+)
+
+// codecPreference is the order the master picks a transfer codec in
+var codecPreference = []string{models.TransferCodecZstd, models.TransferCodecGzip}
+
+// negotiateCodec picks the first codec in codecPreference both agents support. Agents that
+// did not list any codecs when they connected only take the bare tar.
+func (m *TransferManager) negotiateCodec(requestingAgentID, sourceAgentID string) string {
+	requestingConn := m.connGetter.GetConnection(requestingAgentID)
+	sourceConn := m.connGetter.GetConnection(sourceAgentID)
+	if requestingConn == nil || sourceConn == nil {
+		return models.TransferCodecNone
+	}
+	for _, codec := range codecPreference {
+		if slices.Contains(requestingConn.TransferCodecs(), codec) && slices.Contains(sourceConn.TransferCodecs(), codec) {
+			return codec
+		}
+	}
+	return models.TransferCodecNone
+}
@@ -0,0 +1,24 @@
+package transfer
+
+import (
+	"fmt"
+
+	"github.com/The-Promised-Neverland/master-server/internal/models"
+)
+
+// AddTransferSignatures forwards the block signatures the destination of a delta transfer
+// computed for the files it already has to the source
+func (m *TransferManager) AddTransferSignatures(agentID string, payload map[string]interface{}) error {
+	connectionID, _ := payload["connection_id"].(string)
+	t := m.registry.Get(connectionID)
+	if t == nil {
+		return fmt.Errorf("%w: %s", ErrTransferNotFound, connectionID)
+	}
+	if t.DestinationAgentID != agentID {
+		return fmt.Errorf("agent %s is not the destination of transfer %s", agentID, connectionID)
+	}
+	return m.forwardPrepared(connectionID, prepareSignatures, t.SourceAgentID, &models.Message{
+		Type:    models.MasterMsgTransferSignatures,
+		Payload: payload,
+	})
+}
@@ -0,0 +1,611 @@
+package transfer
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/The-Promised-Neverland/master-server/internal/models"
+	"github.com/The-Promised-Neverland/master-server/internal/sse"
+	"github.com/google/uuid"
+)
+
+var (
+	ErrDistributionNotFound = errors.New("distribution not found")
+	ErrDistributionFinished = errors.New("distribution already finished")
+)
+
+// distribution is a job and the relay state of its stream. Credit is the least any destination
+// still receiving granted, so the source never runs further ahead than the slowest of them.
+type distribution struct {
+	job         *models.Distribution
+	granted     map[string]uint64 // chunks each destination has room for, counted from the first
+	sourceReady bool
+	credit      uint64 // credit last sent to the source
+	progressAt  time.Time
+}
+
+// Distributor runs distribution jobs. The source sends one relayed stream, as for a single
+// destination, and the master copies every chunk to each destination. Encryption, delta and
+// resume are per pair of agents, so a distribution has none of them.
+type Distributor struct {
+	messageSender MessageSender
+	connGetter    ConnectionGetter
+	sseHub        *sse.SSEHub
+	jobs          map[string]*distribution
+	mu            sync.Mutex
+}
+
+func NewDistributor(messageSender MessageSender, connGetter ConnectionGetter, sseHub *sse.SSEHub) *Distributor {
+	return &Distributor{
+		messageSender: messageSender,
+		connGetter:    connGetter,
+		sseHub:        sseHub,
+		jobs:          make(map[string]*distribution),
+	}
+}
+
+// Start sends path from the source to each destination. A destination that is offline or the
+// source itself is recorded as failed, and a repeated one is listed once. The job fails at
+// once when no destination is left to receive it.
+func (d *Distributor) Start(sourceAgentID, path, selector string, destinations []string) *models.Distribution {
+	now := time.Now()
+	job := &models.Distribution{
+		ID:            uuid.New().String(),
+		SourceAgentID: sourceAgentID,
+		Path:          path,
+		Selector:      selector,
+		Status:        models.TransferStatusPending,
+		Destinations:  make([]models.DistributionTarget, 0, len(destinations)),
+		StartedAt:     now,
+	}
+	var receivers []string
+	for _, agentID := range destinations {
+		if slices.ContainsFunc(job.Destinations, func(t models.DistributionTarget) bool { return t.AgentID == agentID }) {
+			continue
+		}
+		target := models.DistributionTarget{AgentID: agentID, Status: models.TransferStatusPending}
+		switch {
+		case agentID == sourceAgentID:
+			target.Error = "the source cannot be a destination"
+		case d.connGetter.GetConnection(agentID) == nil:
+			target.Error = "destination agent is offline"
+		default:
+			receivers = append(receivers, agentID)
+		}
+		if target.Error != "" {
+			target.Status = models.TransferStatusFailed
+			target.EndedAt = &now
+		}
+		job.Destinations = append(job.Destinations, target)
+	}
+	job.Codec = d.negotiateCodec(sourceAgentID, receivers)
+	dist := &distribution{job: job, granted: make(map[string]uint64)}
+	d.mu.Lock()
+	d.pruneLocked()
+	d.jobs[job.ID] = dist
+	switch {
+	case d.connGetter.GetConnection(sourceAgentID) == nil:
+		d.failLocked(dist, "source agent is offline")
+		receivers = nil
+	case len(receivers) == 0:
+		d.failLocked(dist, "no destination can receive it")
+	}
+	tallyLocked(job)
+	snapshot := copyDistribution(job)
+	d.mu.Unlock()
+	d.publish(snapshot)
+	fmt.Printf("[DISTRIBUTION] Distribution %s of %s from %s to %d of %d destinations, codec %s\n", job.ID, path, sourceAgentID, len(receivers), len(job.Destinations), job.Codec)
+	if len(receivers) == 0 {
+		return snapshot
+	}
+	startMsg := models.Message{
+		Type: models.MasterMsgRelayTransferStart,
+		Payload: map[string]interface{}{
+			"connection_id":       job.ID,
+			"path":                path,
+			"requesting_agent_id": job.ID,
+			"transfer_mode":       models.TransferModeRelay,
+			"codec":               job.Codec,
+			"encryption":          models.TransferEncryptionNone,
+		},
+	}
+	d.messageSender.Send(sourceAgentID, Outbound{Msg: &startMsg})
+	for _, agentID := range receivers {
+		receiveMsg := models.Message{
+			Type: models.MasterMsgTransferStatus,
+			Payload: map[string]interface{}{
+				"status":          "initiated",
+				"source_agent_id": sourceAgentID,
+				"transfer_mode":   models.TransferModeRelay,
+				"connection_id":   job.ID,
+				"codec":           job.Codec,
+				"encryption":      models.TransferEncryptionNone,
+			},
+		}
+		d.messageSender.Send(agentID, Outbound{Msg: &receiveMsg})
+	}
+	return snapshot
+}
+
+// Has reports whether id is a distribution rather than a single transfer
+func (d *Distributor) Has(id string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.jobs[id] != nil
+}
+
+// Receivers returns the destinations a chunk of the distribution's stream goes to. It is empty
+// once the job is finished, or when sourceAgentID is not the job's source.
+func (d *Distributor) Receivers(id, sourceAgentID string) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	dist := d.jobs[id]
+	if dist == nil || dist.job.Done() || dist.job.SourceAgentID != sourceAgentID {
+		return nil
+	}
+	return dist.receiversLocked()
+}
+
+// Relayed counts a chunk of n payload bytes copied to the receivers
+func (d *Distributor) Relayed(id string, n int) {
+	d.mu.Lock()
+	dist := d.jobs[id]
+	if dist == nil || dist.job.Done() {
+		d.mu.Unlock()
+		return
+	}
+	dist.job.BytesTransferred += int64(n)
+	dist.job.Chunks++
+	snapshot := d.progressDueLocked(dist)
+	d.mu.Unlock()
+	d.publish(snapshot)
+}
+
+// SourceRunning records that the source started sending. Credit the destinations granted
+// before that goes to the source now.
+func (d *Distributor) SourceRunning(id, sourceAgentID string, totalBytes int64) {
+	d.mu.Lock()
+	dist := d.jobs[id]
+	if dist == nil || dist.job.Done() || dist.job.SourceAgentID != sourceAgentID {
+		d.mu.Unlock()
+		return
+	}
+	if totalBytes > 0 {
+		dist.job.TotalBytes = totalBytes
+	}
+	dist.sourceReady = true
+	dist.job.Status = models.TransferStatusRunning
+	for i := range dist.job.Destinations {
+		if dist.job.Destinations[i].Status == models.TransferStatusPending {
+			dist.job.Destinations[i].Status = models.TransferStatusRunning
+		}
+	}
+	credit := dist.creditLocked()
+	snapshot := copyDistribution(dist.job)
+	d.mu.Unlock()
+	d.publish(snapshot)
+	d.sendCredit(sourceAgentID, id, credit)
+}
+
+// SourceCompleted finishes the job once the source sent everything, and forwards its signed
+// manifest to each receiver to verify what it got
+func (d *Distributor) SourceCompleted(id, sourceAgentID string, totalBytes int64, manifest interface{}, signingKey string) {
+	d.mu.Lock()
+	dist := d.jobs[id]
+	if dist == nil || dist.job.Done() || dist.job.SourceAgentID != sourceAgentID {
+		d.mu.Unlock()
+		return
+	}
+	if totalBytes > 0 {
+		dist.job.TotalBytes = totalBytes
+	}
+	now := time.Now()
+	var receivers []string
+	for i := range dist.job.Destinations {
+		t := &dist.job.Destinations[i]
+		if receiving(*t) {
+			receivers = append(receivers, t.AgentID)
+			t.Status = models.TransferStatusCompleted
+			t.EndedAt = &now
+		}
+	}
+	dist.job.EndedAt = &now
+	tallyLocked(dist.job)
+	dist.job.Status = outcome(dist.job)
+	snapshot := copyDistribution(dist.job)
+	d.mu.Unlock()
+	d.publish(snapshot)
+	for _, agentID := range receivers {
+		completedMsg := models.Message{
+			Type: models.MasterMsgTransferStatus,
+			Payload: map[string]interface{}{
+				"status":             "completed",
+				"agent_id":           sourceAgentID,
+				"source_agent_id":    sourceAgentID,
+				"transfer_mode":      models.TransferModeRelay,
+				"connection_id":      id,
+				"manifest":           manifest,
+				"source_signing_key": signingKey,
+			},
+		}
+		d.messageSender.Send(agentID, Outbound{Msg: &completedMsg})
+	}
+	fmt.Printf("[DISTRIBUTION] Distribution %s %s after %v, %d bytes to %d of %d destinations\n", id, snapshot.Status, now.Sub(snapshot.StartedAt).Round(time.Millisecond), snapshot.BytesTransferred, len(receivers), len(snapshot.Destinations))
+}
+
+// SourceFailed fails the job and tells the receivers to discard what arrived. A distribution
+// does not resume, so nothing is kept.
+func (d *Distributor) SourceFailed(id, sourceAgentID, reason string) {
+	d.mu.Lock()
+	dist := d.jobs[id]
+	if dist == nil || dist.job.Done() || dist.job.SourceAgentID != sourceAgentID {
+		d.mu.Unlock()
+		return
+	}
+	receivers := d.failLocked(dist, reason)
+	snapshot := copyDistribution(dist.job)
+	d.mu.Unlock()
+	d.publish(snapshot)
+	d.sendCancel(receivers, id, reason)
+}
+
+// Reject fails one destination, typically because files did not match the source's manifest.
+// Like Registry.Reject it also applies once the job finished, which then becomes partial.
+func (d *Distributor) Reject(id, agentID, reason string, corruptPaths []string) {
+	d.drop(id, agentID, reason, corruptPaths, false)
+}
+
+// Drop fails a destination that stopped taking chunks and tells it to discard what arrived
+func (d *Distributor) Drop(id, agentID, reason string) {
+	d.drop(id, agentID, reason, nil, true)
+}
+
+func (d *Distributor) drop(id, agentID, reason string, corruptPaths []string, cancel bool) {
+	d.mu.Lock()
+	dist := d.jobs[id]
+	if dist == nil {
+		d.mu.Unlock()
+		return
+	}
+	t := dist.target(agentID)
+	if t == nil || (t.Status != models.TransferStatusCompleted && !receiving(*t)) {
+		d.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	t.Status = models.TransferStatusFailed
+	t.Error = reason
+	t.CorruptPaths = append([]string(nil), corruptPaths...)
+	t.EndedAt = &now
+	sourceAgentID := dist.job.SourceAgentID
+	stopSource := false
+	var credit uint64
+	tallyLocked(dist.job)
+	switch {
+	case dist.job.Done():
+		dist.job.Status = outcome(dist.job)
+	case len(dist.receiversLocked()) == 0:
+		d.failLocked(dist, "every destination failed")
+		stopSource = true
+	default:
+		// The slowest destination may have been the one holding the source back
+		credit = dist.creditLocked()
+	}
+	snapshot := copyDistribution(dist.job)
+	d.mu.Unlock()
+	fmt.Printf("[DISTRIBUTION] Destination %s of distribution %s failed: %s\n", agentID, id, reason)
+	d.publish(snapshot)
+	if cancel {
+		d.sendCancel([]string{agentID}, id, reason)
+	}
+	if stopSource {
+		d.sendCancel([]string{sourceAgentID}, id, "every destination failed")
+	}
+	d.sendCredit(sourceAgentID, id, credit)
+}
+
+// Grant records the credit a destination granted and passes the least of all on to the source.
+// It reports whether id is a distribution, in which case the grant is handled.
+func (d *Distributor) Grant(id, agentID string, granted uint64) bool {
+	d.mu.Lock()
+	dist := d.jobs[id]
+	if dist == nil {
+		d.mu.Unlock()
+		return false
+	}
+	var credit uint64
+	if t := dist.target(agentID); t != nil && receiving(*t) && granted > dist.granted[agentID] {
+		dist.granted[agentID] = granted
+		credit = dist.creditLocked()
+	}
+	sourceAgentID := dist.job.SourceAgentID
+	d.mu.Unlock()
+	d.sendCredit(sourceAgentID, id, credit)
+	return true
+}
+
+// Progress records an agent's progress report. It reports whether id is a distribution.
+func (d *Distributor) Progress(id, agentID, role string, progress models.TransferProgress) bool {
+	progress.UpdatedAt = time.Now()
+	d.mu.Lock()
+	dist := d.jobs[id]
+	if dist == nil {
+		d.mu.Unlock()
+		return false
+	}
+	var snapshot *models.Distribution
+	switch {
+	case dist.job.Done():
+	case role == models.TransferRoleSource && agentID == dist.job.SourceAgentID:
+		if progress.TotalBytes > 0 {
+			dist.job.TotalBytes = progress.TotalBytes
+		}
+		snapshot = d.progressDueLocked(dist)
+	case role == models.TransferRoleDestination:
+		if t := dist.target(agentID); t != nil && receiving(*t) {
+			t.Progress = &progress
+			snapshot = d.progressDueLocked(dist)
+		}
+	}
+	d.mu.Unlock()
+	d.publish(snapshot)
+	return true
+}
+
+// AgentDisconnected fails the jobs an agent was the source of, and its place in the jobs it
+// was receiving
+func (d *Distributor) AgentDisconnected(agentID string) {
+	d.mu.Lock()
+	var sourced, received []string
+	for id, dist := range d.jobs {
+		if dist.job.Done() {
+			continue
+		}
+		if dist.job.SourceAgentID == agentID {
+			sourced = append(sourced, id)
+		} else if t := dist.target(agentID); t != nil && receiving(*t) {
+			received = append(received, id)
+		}
+	}
+	d.mu.Unlock()
+	for _, id := range sourced {
+		d.SourceFailed(id, agentID, "source agent disconnected")
+	}
+	for _, id := range received {
+		d.drop(id, agentID, "destination agent disconnected", nil, false)
+	}
+}
+
+// Cancel stops an unfinished job on its source and every destination still receiving
+func (d *Distributor) Cancel(id string) (*models.Distribution, error) {
+	d.mu.Lock()
+	dist := d.jobs[id]
+	switch {
+	case dist == nil:
+		d.mu.Unlock()
+		return nil, fmt.Errorf("%w: %s", ErrDistributionNotFound, id)
+	case dist.job.Done():
+		d.mu.Unlock()
+		return nil, fmt.Errorf("%w: %s", ErrDistributionFinished, id)
+	}
+	const reason = "cancelled by user"
+	receivers := dist.receiversLocked()
+	now := time.Now()
+	for i := range dist.job.Destinations {
+		if t := &dist.job.Destinations[i]; receiving(*t) {
+			t.Status = models.TransferStatusCancelled
+			t.Error = reason
+			t.EndedAt = &now
+		}
+	}
+	dist.job.Status = models.TransferStatusCancelled
+	dist.job.FailureReason = reason
+	dist.job.EndedAt = &now
+	tallyLocked(dist.job)
+	snapshot := copyDistribution(dist.job)
+	d.mu.Unlock()
+	d.publish(snapshot)
+	d.sendCancel(append(receivers, snapshot.SourceAgentID), id, reason)
+	return snapshot, nil
+}
+
+func (d *Distributor) Get(id string) *models.Distribution {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	dist := d.jobs[id]
+	if dist == nil {
+		return nil
+	}
+	return copyDistribution(dist.job)
+}
+
+// List returns distributions newest first
+func (d *Distributor) List() []*models.Distribution {
+	d.mu.Lock()
+	jobs := make([]*models.Distribution, 0, len(d.jobs))
+	for _, dist := range d.jobs {
+		jobs = append(jobs, copyDistribution(dist.job))
+	}
+	d.mu.Unlock()
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].StartedAt.After(jobs[j].StartedAt)
+	})
+	return jobs
+}
+
+// negotiateCodec picks the first codec in codecPreference the source and every receiver support
+func (d *Distributor) negotiateCodec(sourceAgentID string, receivers []string) string {
+	agents := append([]string{sourceAgentID}, receivers...)
+	for _, codec := range codecPreference {
+		shared := true
+		for _, agentID := range agents {
+			conn := d.connGetter.GetConnection(agentID)
+			if conn == nil || !slices.Contains(conn.TransferCodecs(), codec) {
+				shared = false
+				break
+			}
+		}
+		if shared {
+			return codec
+		}
+	}
+	return models.TransferCodecNone
+}
+
+// failLocked fails the job and every destination still receiving, and returns those destinations
+func (d *Distributor) failLocked(dist *distribution, reason string) []string {
+	receivers := dist.receiversLocked()
+	now := time.Now()
+	for i := range dist.job.Destinations {
+		if t := &dist.job.Destinations[i]; receiving(*t) {
+			t.Status = models.TransferStatusFailed
+			t.Error = reason
+			t.EndedAt = &now
+		}
+	}
+	dist.job.Status = models.TransferStatusFailed
+	dist.job.FailureReason = reason
+	dist.job.EndedAt = &now
+	tallyLocked(dist.job)
+	fmt.Printf("[DISTRIBUTION] Distribution %s failed: %s\n", dist.job.ID, reason)
+	return receivers
+}
+
+func (d *Distributor) sendCredit(sourceAgentID, id string, granted uint64) {
+	if granted == 0 {
+		return
+	}
+	d.messageSender.Send(sourceAgentID, Outbound{Msg: &models.Message{
+		Type: models.MasterMsgTransferCredit,
+		Payload: map[string]interface{}{
+			"connection_id": id,
+			"granted":       granted,
+		},
+	}})
+}
+
+func (d *Distributor) sendCancel(agentIDs []string, id, reason string) {
+	for _, agentID := range agentIDs {
+		d.messageSender.Send(agentID, Outbound{Msg: &models.Message{
+			Type: models.MasterMsgTransferCancel,
+			Payload: map[string]interface{}{
+				"connection_id": id,
+				"reason":        reason,
+			},
+		}})
+	}
+}
+
+func (d *Distributor) pruneLocked() {
+	for id, dist := range d.jobs {
+		if dist.job.EndedAt != nil && time.Since(*dist.job.EndedAt) > registryRetention {
+			delete(d.jobs, id)
+		}
+	}
+}
+
+// progressDueLocked returns a snapshot to publish if the job's last update is old enough
+func (d *Distributor) progressDueLocked(dist *distribution) *models.Distribution {
+	now := time.Now()
+	if now.Sub(dist.progressAt) < progressPublishInterval {
+		return nil
+	}
+	dist.progressAt = now
+	return copyDistribution(dist.job)
+}
+
+func (d *Distributor) publish(job *models.Distribution) {
+	if job == nil || d.sseHub == nil {
+		return
+	}
+	d.sseHub.Broadcast(models.Message{
+		Type:    models.SSEMsgDistributionUpdate,
+		Payload: job,
+	})
+}
+
+func (dist *distribution) target(agentID string) *models.DistributionTarget {
+	for i := range dist.job.Destinations {
+		if dist.job.Destinations[i].AgentID == agentID {
+			return &dist.job.Destinations[i]
+		}
+	}
+	return nil
+}
+
+func (dist *distribution) receiversLocked() []string {
+	var receivers []string
+	for _, t := range dist.job.Destinations {
+		if receiving(t) {
+			receivers = append(receivers, t.AgentID)
+		}
+	}
+	return receivers
+}
+
+// creditLocked returns the credit to send the source, or 0 while the source has not started
+// or no receiver raised the least grant since the last one
+func (dist *distribution) creditLocked() uint64 {
+	if !dist.sourceReady || dist.job.Done() {
+		return 0
+	}
+	least, found := uint64(0), false
+	for _, t := range dist.job.Destinations {
+		if !receiving(t) {
+			continue
+		}
+		if granted := dist.granted[t.AgentID]; !found || granted < least {
+			least, found = granted, true
+		}
+	}
+	if !found || least <= dist.credit {
+		return 0
+	}
+	dist.credit = least
+	return least
+}
+
+func receiving(t models.DistributionTarget) bool {
+	return t.Status == models.TransferStatusPending || t.Status == models.TransferStatusRunning
+}
+
+func tallyLocked(job *models.Distribution) {
+	job.Succeeded, job.Failed = 0, 0
+	for _, t := range job.Destinations {
+		switch t.Status {
+		case models.TransferStatusCompleted:
+			job.Succeeded++
+		case models.TransferStatusFailed, models.TransferStatusCancelled:
+			job.Failed++
+		}
+	}
+}
+
+// outcome is the status of a job whose source finished sending
+func outcome(job *models.Distribution) string {
+	switch {
+	case job.Succeeded == 0:
+		return models.TransferStatusFailed
+	case job.Succeeded < len(job.Destinations):
+		return models.DistributionStatusPartial
+	}
+	return models.TransferStatusCompleted
+}
+
+func copyDistribution(job *models.Distribution) *models.Distribution {
+	snapshot := *job
+	snapshot.Destinations = make([]models.DistributionTarget, len(job.Destinations))
+	for i, t := range job.Destinations {
+		t.CorruptPaths = append([]string(nil), t.CorruptPaths...)
+		if t.Progress != nil {
+			progress := *t.Progress
+			t.Progress = &progress
+		}
+		snapshot.Destinations[i] = t
+	}
+	return &snapshot
+}
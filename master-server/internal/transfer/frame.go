@@ -0,0 +1,42 @@
+package transfer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Relayed chunks travel as binary WebSocket messages, each framed as
+//
+//	version (1) | stream ID length (1) | stream ID | sequence (8, big endian) | payload
+//
+// The stream ID is the transfer ID and the sequence counts the stream's chunks from 0,
+// so one connection can carry several transfers and a receiver can spot a lost chunk.
+const FrameVersion = 1
+
+var ErrBadFrame = errors.New("malformed relay frame")
+
+type Frame struct {
+	StreamID string
+	Seq      uint64
+	Payload  []byte
+}
+
+// DecodeFrame parses a binary message. Payload aliases data.
+func DecodeFrame(data []byte) (Frame, error) {
+	if len(data) < 2 {
+		return Frame{}, fmt.Errorf("%w: %d bytes", ErrBadFrame, len(data))
+	}
+	if data[0] != FrameVersion {
+		return Frame{}, fmt.Errorf("%w: version %d", ErrBadFrame, data[0])
+	}
+	idLen := int(data[1])
+	if idLen == 0 || len(data) < 2+idLen+8 {
+		return Frame{}, fmt.Errorf("%w: truncated header", ErrBadFrame)
+	}
+	return Frame{
+		StreamID: string(data[2 : 2+idLen]),
+		Seq:      binary.BigEndian.Uint64(data[2+idLen:]),
+		Payload:  data[2+idLen+8:],
+	}, nil
+}
@@ -26,5 +26,8 @@ type ConnectionGetter interface {
 
 type ConnectionInfo interface {
 	GetPublicEndpoint() string
-	SetRelayTo(agentID string)
+	AddRelay(transferID string, agentID string)
+	RemoveRelay(transferID string)
+	TransferCodecs() []string
+	TransferEncryption() []string
 }
@@ -0,0 +1,47 @@
+package transfer
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/The-Promised-Neverland/master-server/internal/models"
+)
+
+// negotiateEncryption picks end-to-end encryption when both agents support it
+func (m *TransferManager) negotiateEncryption(requestingAgentID, sourceAgentID string) string {
+	requestingConn := m.connGetter.GetConnection(requestingAgentID)
+	sourceConn := m.connGetter.GetConnection(sourceAgentID)
+	if requestingConn == nil || sourceConn == nil {
+		return models.TransferEncryptionNone
+	}
+	if slices.Contains(requestingConn.TransferEncryption(), models.TransferEncryptionX25519) && slices.Contains(sourceConn.TransferEncryption(), models.TransferEncryptionX25519) {
+		return models.TransferEncryptionX25519
+	}
+	return models.TransferEncryptionNone
+}
+
+// AddTransferKey forwards an agent's ephemeral key to the other agent of the transfer, along
+// with the signing key the sender connected with. The agents verify the keys themselves.
+func (m *TransferManager) AddTransferKey(agentID, signingKey string, key models.TransferKey) error {
+	t := m.registry.Get(key.ConnectionID)
+	if t == nil {
+		return fmt.Errorf("%w: %s", ErrTransferNotFound, key.ConnectionID)
+	}
+	var peerID, item string
+	switch {
+	case key.Role == models.TransferRoleSource && t.SourceAgentID == agentID:
+		peerID, item = t.DestinationAgentID, prepareSourceKey
+	case key.Role == models.TransferRoleDestination && t.DestinationAgentID == agentID:
+		peerID, item = t.SourceAgentID, prepareDestinationKey
+	default:
+		return fmt.Errorf("agent %s is not the %s of transfer %s", agentID, key.Role, key.ConnectionID)
+	}
+	if key.PublicKey == "" || key.Signature == "" {
+		return fmt.Errorf("transfer key of %s is missing its public key or signature", agentID)
+	}
+	key.SigningKey = signingKey
+	return m.forwardPrepared(key.ConnectionID, item, peerID, &models.Message{
+		Type:    models.MasterMsgTransferKey,
+		Payload: key,
+	})
+}
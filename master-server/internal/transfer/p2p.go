@@ -9,7 +9,6 @@ import (
 	"time"
 
 	"github.com/The-Promised-Neverland/master-server/internal/models"
-	"github.com/google/uuid"
 )
 
 const (
@@ -94,39 +93,47 @@ func (m *TransferManager) InitiateP2PTransfer(confirmed P2PConnectionConfirmed)
 	}
 	transferMsg := models.Message{
 		Type:    models.MasterMsgP2PTransferStart,
-		Payload: transferPayload,
+		Payload: m.attemptPayload(confirmed.ConnectionID, transferPayload),
 	}
 	m.messageSender.Send(confirmed.SourceAgent, Outbound{Msg: &transferMsg})
 	fmt.Printf("[P2P] P2P transfer start command sent to source_agent=%s, connection_id=%s - waiting for transfer to start\n", confirmed.SourceAgent, confirmed.ConnectionID)
+	receiveMsg := models.Message{
+		Type: models.MasterMsgTransferStatus,
+		Payload: m.attemptPayload(confirmed.ConnectionID, map[string]interface{}{
+			"status":          "initiated",
+			"source_agent_id": confirmed.SourceAgent,
+			"transfer_mode":   "p2p",
+			"connection_id":   confirmed.ConnectionID,
+		}),
+	}
+	m.messageSender.Send(confirmed.RequestingAgent, Outbound{Msg: &receiveMsg})
 }
 
-func (p *P2PCoordinator) AttemptP2PConnection(requestingAgentID, sourceAgentID, path string) (string, bool) {
+func (p *P2PCoordinator) AttemptP2PConnection(connectionID, requestingAgentID, sourceAgentID, path string) bool {
 	fmt.Printf("[P2P] Attempting P2P connection: requesting_agent=%s <-> source_agent=%s, path=%s\n", requestingAgentID, sourceAgentID, path)
 	_, err1 := p.GetAgentEndpoint(requestingAgentID)
 	_, err2 := p.GetAgentEndpoint(sourceAgentID)
 	if err1 != nil || err2 != nil {
 		fmt.Printf("[P2P] FAILED: Endpoints not available, requesting_agent=%s (err=%v), source_agent=%s (err=%v)\n", requestingAgentID, err1, sourceAgentID, err2)
-		return "", false
+		return false
 	}
 	fmt.Printf("[P2P] Endpoints available, starting P2P connection test...\n")
-	connectionID, err := p.StartP2PConnectionTest(requestingAgentID, sourceAgentID, path)
-	if err != nil {
+	if err := p.StartP2PConnectionTest(connectionID, requestingAgentID, sourceAgentID, path); err != nil {
 		fmt.Printf("[P2P] FAILED: P2P connection test failed to start: %v\n", err)
-		return "", false
+		return false
 	}
 	fmt.Printf("[P2P] P2P connection test started, connection_id=%s, source_agent=%s -> requesting_agent=%s\n", connectionID, sourceAgentID, requestingAgentID)
-	return connectionID, true
+	return true
 }
 
-func (p *P2PCoordinator) StartP2PConnectionTest(requestingAgent, sourceAgent, path string) (string, error) {
-	connectionID := uuid.New().String()
+func (p *P2PCoordinator) StartP2PConnectionTest(connectionID, requestingAgent, sourceAgent, path string) error {
 	requestingEndpoint, err := p.GetAgentEndpoint(requestingAgent)
 	if err != nil {
-		return "", fmt.Errorf("failed to get requesting agent endpoint: %w", err)
+		return fmt.Errorf("failed to get requesting agent endpoint: %w", err)
 	}
 	sourceEndpoint, err := p.GetAgentEndpoint(sourceAgent)
 	if err != nil {
-		return "", fmt.Errorf("failed to get source agent endpoint: %w", err)
+		return fmt.Errorf("failed to get source agent endpoint: %w", err)
 	}
 	ctx, cancel := context.WithCancel(context.Background())
 	state := &P2PTransferState{
@@ -150,7 +157,7 @@ func (p *P2PCoordinator) StartP2PConnectionTest(requestingAgent, sourceAgent, pa
 	p.activeTransfers[connectionID] = state
 	p.mu.Unlock()
 	go p.testConnectionWithRetries(ctx, connectionID, requestingEndpoint, sourceEndpoint)
-	return connectionID, nil
+	return nil
 }
 
 func (p *P2PCoordinator) testConnectionWithRetries(ctx context.Context, connectionID, requestingEndpoint, sourceEndpoint string) {
@@ -393,8 +400,28 @@ func (p *P2PCoordinator) GetFailedTransfer(connectionID string) *FailedTransferI
 	}
 }
 
+// ActiveCount returns P2P transfers that are negotiating or connected
+func (p *P2PCoordinator) ActiveCount() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	count := 0
+	for _, state := range p.activeTransfers {
+		state.mu.RLock()
+		if state.Status != "failed" && state.Status != "relay" {
+			count++
+		}
+		state.mu.RUnlock()
+	}
+	return count
+}
+
+// RemoveTransfer forgets a transfer and stops its negotiation, if still running
 func (p *P2PCoordinator) RemoveTransfer(connectionID string) {
 	p.mu.Lock()
+	state := p.activeTransfers[connectionID]
 	delete(p.activeTransfers, connectionID)
 	p.mu.Unlock()
+	if state != nil && state.CancelFunc != nil {
+		state.CancelFunc()
+	}
 }
@@ -0,0 +1,123 @@
+package transfer
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/The-Promised-Neverland/master-server/internal/models"
+)
+
+// prepareTimeout is how long a transfer waits for what its agents send before it can start
+const prepareTimeout = 30 * time.Second
+
+// Things a transfer may wait for before it starts
+const (
+	prepareSourceKey      = "source key"
+	prepareDestinationKey = "destination key"
+	prepareSignatures     = "block signatures"
+)
+
+// preparation is an attempt waiting for its agents: the ephemeral keys of an encrypted
+// transfer and the destination's block signatures for a delta transfer. The master only
+// forwards them to the other agent.
+type preparation struct {
+	waiting map[string]bool // still missing
+	start   func()
+	timer   *time.Timer
+}
+
+// announce negotiates how a transfer's attempt is streamed, sends its intent to both agents
+// and starts it, once the agents sent what the attempt needs
+func (m *TransferManager) announce(connectionID, requestingAgentID, sourceAgentID, path string, payloadMap map[string]interface{}) error {
+	m.registry.SetCodec(connectionID, m.negotiateCodec(requestingAgentID, sourceAgentID))
+	m.registry.SetEncryption(connectionID, m.negotiateEncryption(requestingAgentID, sourceAgentID))
+	t := m.registry.Get(connectionID)
+	if t == nil {
+		return fmt.Errorf("%w: %s", ErrTransferNotFound, connectionID)
+	}
+	waiting := make(map[string]bool)
+	if t.Encryption != models.TransferEncryptionNone {
+		waiting[prepareSourceKey] = true
+		waiting[prepareDestinationKey] = true
+	}
+	if t.Delta {
+		waiting[prepareSignatures] = true
+	}
+	if len(waiting) == 0 {
+		m.NotifyTransferIntent(t)
+		return m.start(connectionID, requestingAgentID, sourceAgentID, path, payloadMap)
+	}
+	prep := &preparation{
+		waiting: waiting,
+		start: func() {
+			m.start(connectionID, requestingAgentID, sourceAgentID, path, payloadMap)
+		},
+	}
+	prep.timer = time.AfterFunc(prepareTimeout, func() {
+		m.prepMu.Lock()
+		missing := make([]string, 0, len(prep.waiting))
+		for item := range prep.waiting {
+			missing = append(missing, item)
+		}
+		m.prepMu.Unlock()
+		if m.takePreparation(connectionID, prep) {
+			reason := "timed out waiting for " + strings.Join(missing, ", ")
+			fmt.Printf("[TRANSFER] FAILED: %s, connection_id=%s\n", reason, connectionID)
+			m.registry.Finish(connectionID, models.TransferStatusFailed, reason)
+		}
+	})
+	m.prepMu.Lock()
+	if previous := m.preparations[connectionID]; previous != nil {
+		previous.timer.Stop()
+	}
+	m.preparations[connectionID] = prep
+	m.prepMu.Unlock()
+	m.NotifyTransferIntent(t)
+	fmt.Printf("[TRANSFER] Waiting for agents to prepare transfer %s (encryption=%s, delta=%t)\n", connectionID, t.Encryption, t.Delta)
+	return nil
+}
+
+// forwardPrepared sends what an agent prepared for a transfer on to the other agent, and starts
+// the transfer once nothing is missing. What is forwarded is queued ahead of the start
+// messages, so both agents hold it by then.
+func (m *TransferManager) forwardPrepared(connectionID, item, peerID string, msg *models.Message) error {
+	m.prepMu.Lock()
+	prep := m.preparations[connectionID]
+	m.prepMu.Unlock()
+	if prep == nil {
+		return fmt.Errorf("transfer %s is not being prepared", connectionID)
+	}
+	m.messageSender.Send(peerID, Outbound{Msg: msg})
+	fmt.Printf("[TRANSFER] Forwarded %s of transfer %s to agent=%s\n", item, connectionID, peerID)
+	m.prepMu.Lock()
+	delete(prep.waiting, item)
+	ready := len(prep.waiting) == 0
+	m.prepMu.Unlock()
+	if ready && m.takePreparation(connectionID, prep) {
+		go prep.start()
+	}
+	return nil
+}
+
+// takePreparation removes prep if it is still the transfer's pending one
+func (m *TransferManager) takePreparation(connectionID string, prep *preparation) bool {
+	m.prepMu.Lock()
+	defer m.prepMu.Unlock()
+	if m.preparations[connectionID] != prep {
+		return false
+	}
+	delete(m.preparations, connectionID)
+	prep.timer.Stop()
+	return true
+}
+
+// dropPreparation forgets a transfer's pending preparation
+func (m *TransferManager) dropPreparation(connectionID string) {
+	m.prepMu.Lock()
+	defer m.prepMu.Unlock()
+	if prep := m.preparations[connectionID]; prep != nil {
+		prep.timer.Stop()
+		delete(m.preparations, connectionID)
+	}
+}
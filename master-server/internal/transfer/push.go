@@ -0,0 +1,49 @@
+package transfer
+
+import (
+	"fmt"
+
+	"github.com/The-Promised-Neverland/master-server/internal/models"
+)
+
+// Push starts a transfer of path from the source agent to each destination, the same way as a
+// destination's request: P2P first, relay when P2P is not possible. Every destination gets a
+// result in the order given. An offline or repeated destination, or the source itself, gets no
+// transfer; neither does one whose transfer could not start, which is returned as failed.
+func (m *TransferManager) Push(sourceAgentID, path string, destinations []string, delta bool) []models.PushResult {
+	fmt.Printf("[TRANSFER] Push requested: source_agent=%s, path=%s, destinations=%d\n", sourceAgentID, path, len(destinations))
+	results := make([]models.PushResult, 0, len(destinations))
+	seen := make(map[string]bool, len(destinations))
+	for _, destinationAgentID := range destinations {
+		result := models.PushResult{DestinationAgentID: destinationAgentID}
+		switch {
+		case destinationAgentID == sourceAgentID:
+			result.Error = "an agent cannot push to itself"
+		case seen[destinationAgentID]:
+			result.Error = "destination listed more than once"
+		case m.connGetter.GetConnection(destinationAgentID) == nil:
+			result.Error = "destination agent is offline"
+		default:
+			req := models.Message{
+				Type: models.MasterMsgTransferIntent,
+				Payload: map[string]interface{}{
+					"requesting_agent_id": destinationAgentID,
+					"path":                path,
+					"delta":               delta,
+					"push":                true,
+				},
+			}
+			transferID, err := m.HandleAgentRequestFile(&req, sourceAgentID)
+			if transferID != "" {
+				result.TransferID = transferID
+				result.Transfer = m.registry.Get(transferID)
+			}
+			if err != nil {
+				result.Error = err.Error()
+			}
+		}
+		seen[destinationAgentID] = true
+		results = append(results, result)
+	}
+	return results
+}
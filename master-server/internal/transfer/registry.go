@@ -0,0 +1,446 @@
+package transfer
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/The-Promised-Neverland/master-server/internal/models"
+	"github.com/The-Promised-Neverland/master-server/internal/sse"
+)
+
+const (
+	// registryRetention is how long finished transfers stay listed
+	registryRetention = 24 * time.Hour
+	// progressPublishInterval rate-limits transfer_progress per transfer
+	progressPublishInterval = time.Second
+)
+
+var (
+	ErrTransferNotFound = errors.New("transfer not found")
+	ErrTransferFinished = errors.New("transfer already finished")
+	// ErrTransferNotResumable is returned for transfers that completed or were cancelled
+	ErrTransferNotResumable = errors.New("transfer cannot be resumed")
+)
+
+// Registry tracks every transfer requested through the master, whatever its mode
+type Registry struct {
+	transfers  map[string]*models.Transfer
+	progressAt map[string]time.Time // last transfer_progress per transfer
+	sseHub     *sse.SSEHub
+	mu         sync.RWMutex
+}
+
+func NewRegistry(sseHub *sse.SSEHub) *Registry {
+	return &Registry{
+		transfers:  make(map[string]*models.Transfer),
+		progressAt: make(map[string]time.Time),
+		sseHub:     sseHub,
+	}
+}
+
+// Create registers a pending transfer of path from source to destination
+func (r *Registry) Create(id, sourceAgentID, destinationAgentID, path string) *models.Transfer {
+	t := &models.Transfer{
+		ID:                 id,
+		SourceAgentID:      sourceAgentID,
+		DestinationAgentID: destinationAgentID,
+		Path:               path,
+		Status:             models.TransferStatusPending,
+		StartedAt:          time.Now(),
+	}
+	r.mu.Lock()
+	r.pruneLocked()
+	r.transfers[id] = t
+	snapshot := copyTransfer(t)
+	r.mu.Unlock()
+	r.publish(snapshot)
+	return snapshot
+}
+
+// SetMode records the mode chosen for a transfer before it starts
+func (r *Registry) SetMode(id, mode string) {
+	r.update(id, func(t *models.Transfer) {
+		t.Mode = mode
+	})
+}
+
+// SetCodec records the codec negotiated for a transfer
+func (r *Registry) SetCodec(id, codec string) {
+	r.update(id, func(t *models.Transfer) {
+		t.Codec = codec
+	})
+}
+
+// SetEncryption records the encryption negotiated for a transfer
+func (r *Registry) SetEncryption(id, encryption string) {
+	r.update(id, func(t *models.Transfer) {
+		t.Encryption = encryption
+	})
+}
+
+// SetDelta marks a transfer that only sends changed blocks of files the destination has
+func (r *Registry) SetDelta(id string) {
+	r.update(id, func(t *models.Transfer) {
+		t.Delta = true
+	})
+}
+
+// SetPush marks a transfer started for its source
+func (r *Registry) SetPush(id string) {
+	r.update(id, func(t *models.Transfer) {
+		t.Push = true
+	})
+}
+
+// SetSync marks a transfer that pulls files of a sync pair into the destination's folder target
+func (r *Registry) SetSync(id, pairID, target string, files []string) {
+	r.update(id, func(t *models.Transfer) {
+		t.SyncPairID = pairID
+		t.Target = target
+		t.Files = files
+	})
+}
+
+// Running marks a transfer whose source started sending
+func (r *Registry) Running(id string) {
+	r.update(id, func(t *models.Transfer) {
+		t.Status = models.TransferStatusRunning
+	})
+}
+
+// Fallback switches a transfer to relay mode
+func (r *Registry) Fallback(id, reason string) {
+	r.update(id, func(t *models.Transfer) {
+		t.Fallbacks = append(t.Fallbacks, models.TransferFallback{
+			From:   t.Mode,
+			To:     models.TransferModeRelay,
+			Reason: reason,
+			At:     time.Now(),
+		})
+		t.Mode = models.TransferModeRelay
+		t.Status = models.TransferStatusPending
+	})
+}
+
+// AddBytes counts a relayed chunk. It is called per chunk, so it only publishes rate-limited progress.
+func (r *Registry) AddBytes(id string, n int) {
+	r.mu.Lock()
+	t := r.transfers[id]
+	if t == nil || t.Done() {
+		r.mu.Unlock()
+		return
+	}
+	t.BytesTransferred += int64(n)
+	t.Chunks++
+	aggregateProgress(t)
+	snapshot := r.progressDueLocked(t)
+	r.mu.Unlock()
+	r.publishProgress(snapshot)
+}
+
+// SetTotal records the source's estimate of the transfer size
+func (r *Registry) SetTotal(id string, total int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if t := r.transfers[id]; t != nil && !t.Done() && total > 0 {
+		t.TotalBytes = total
+	}
+}
+
+// Progress records an agent's progress report for its side of the transfer
+func (r *Registry) Progress(id, role string, progress models.TransferProgress) {
+	progress.UpdatedAt = time.Now()
+	r.mu.Lock()
+	t := r.transfers[id]
+	if t == nil || t.Done() {
+		r.mu.Unlock()
+		return
+	}
+	switch role {
+	case models.TransferRoleSource:
+		t.Source = &progress
+		if progress.TotalBytes > 0 {
+			t.TotalBytes = progress.TotalBytes
+		}
+	case models.TransferRoleDestination:
+		t.Destination = &progress
+	default:
+		r.mu.Unlock()
+		return
+	}
+	if t.Mode == models.TransferModeP2P && progress.BytesDone > t.BytesTransferred {
+		t.BytesTransferred = progress.BytesDone
+	}
+	started := t.Status == models.TransferStatusPending
+	if started {
+		t.Status = models.TransferStatusRunning
+	}
+	aggregateProgress(t)
+	var update *models.Transfer
+	if started {
+		update = copyTransfer(t)
+	}
+	snapshot := r.progressDueLocked(t)
+	r.mu.Unlock()
+	if update != nil {
+		r.publish(update)
+	}
+	r.publishProgress(snapshot)
+}
+
+// ReportBytes records the byte count an agent reported, for modes the master does not relay
+func (r *Registry) ReportBytes(id string, total int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if t := r.transfers[id]; t != nil && total > t.BytesTransferred {
+		t.BytesTransferred = total
+	}
+}
+
+// Cancel marks an unfinished transfer cancelled and returns it
+func (r *Registry) Cancel(id, reason string) (*models.Transfer, error) {
+	r.mu.Lock()
+	t := r.transfers[id]
+	switch {
+	case t == nil:
+		r.mu.Unlock()
+		return nil, fmt.Errorf("%w: %s", ErrTransferNotFound, id)
+	case t.Done():
+		r.mu.Unlock()
+		return nil, fmt.Errorf("%w: %s", ErrTransferFinished, id)
+	}
+	finishLocked(t, models.TransferStatusCancelled, reason)
+	snapshot := copyTransfer(t)
+	r.mu.Unlock()
+	r.publish(snapshot)
+	return snapshot, nil
+}
+
+// Finish moves a transfer to completed, failed or cancelled
+func (r *Registry) Finish(id, status, reason string) {
+	r.update(id, func(t *models.Transfer) {
+		finishLocked(t, status, reason)
+	})
+}
+
+func finishLocked(t *models.Transfer, status, reason string) {
+	now := time.Now()
+	t.Status = status
+	t.FailureReason = reason
+	t.EndedAt = &now
+	t.ETASeconds = 0
+	fmt.Printf("[TRANSFER] Transfer %s (%s) %s -> %s %s after %v, %d bytes\n", t.ID, t.Mode, t.SourceAgentID, t.DestinationAgentID, status, now.Sub(t.StartedAt).Round(time.Millisecond), t.BytesTransferred)
+}
+
+// Reject fails a transfer its destination could not complete, typically because files did not
+// match the source's manifest. Unlike Finish it also applies to a transfer the source already
+// reported completed.
+func (r *Registry) Reject(id, destinationAgentID, reason string, corruptPaths []string) {
+	r.mu.Lock()
+	t := r.transfers[id]
+	if t == nil || t.DestinationAgentID != destinationAgentID || t.Status == models.TransferStatusCancelled || t.Status == models.TransferStatusFailed {
+		r.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	t.Status = models.TransferStatusFailed
+	t.FailureReason = reason
+	t.CorruptPaths = append([]string(nil), corruptPaths...)
+	t.EndedAt = &now
+	t.ETASeconds = 0
+	snapshot := copyTransfer(t)
+	r.mu.Unlock()
+	fmt.Printf("[TRANSFER] Transfer %s rejected by destination %s: %s\n", id, destinationAgentID, reason)
+	r.publish(snapshot)
+}
+
+// FailAgent fails every unfinished transfer the agent takes part in and returns them
+func (r *Registry) FailAgent(agentID, reason string) []*models.Transfer {
+	r.mu.RLock()
+	var ids []string
+	for id, t := range r.transfers {
+		if !t.Done() && (t.SourceAgentID == agentID || t.DestinationAgentID == agentID) {
+			ids = append(ids, id)
+		}
+	}
+	r.mu.RUnlock()
+	failed := make([]*models.Transfer, 0, len(ids))
+	for _, id := range ids {
+		r.Finish(id, models.TransferStatusFailed, reason)
+		if t := r.Get(id); t != nil {
+			failed = append(failed, t)
+		}
+	}
+	return failed
+}
+
+// Resume puts a failed or unfinished transfer back to pending, to restart from the
+// destination's checkpoint. Completed and cancelled transfers cannot be resumed.
+func (r *Registry) Resume(id string, resume models.TransferResume) (*models.Transfer, error) {
+	resume.At = time.Now()
+	r.mu.Lock()
+	t := r.transfers[id]
+	switch {
+	case t == nil:
+		r.mu.Unlock()
+		return nil, fmt.Errorf("%w: %s", ErrTransferNotFound, id)
+	case t.Status == models.TransferStatusCompleted || t.Status == models.TransferStatusCancelled:
+		r.mu.Unlock()
+		return nil, fmt.Errorf("%w: %s is %s", ErrTransferNotResumable, id, t.Status)
+	}
+	t.Resumes = append(t.Resumes, resume)
+	t.Status = models.TransferStatusPending
+	t.EndedAt = nil
+	t.FailureReason = ""
+	t.CorruptPaths = nil
+	t.BytesTransferred = resume.Offset
+	t.RateBytesPerSec = 0
+	t.ETASeconds = 0
+	t.Source = nil
+	t.Destination = nil
+	snapshot := copyTransfer(t)
+	r.mu.Unlock()
+	fmt.Printf("[TRANSFER] Transfer %s resuming at offset %d (%d entries done)\n", id, resume.Offset, resume.EntriesCompleted)
+	r.publish(snapshot)
+	return snapshot, nil
+}
+
+// ResumePoint returns the latest resume of a transfer, or nil if it never resumed
+func (r *Registry) ResumePoint(id string) *models.TransferResume {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	t := r.transfers[id]
+	if t == nil || len(t.Resumes) == 0 {
+		return nil
+	}
+	resume := t.Resumes[len(t.Resumes)-1]
+	return &resume
+}
+
+// ActiveBySource returns the ID of the unfinished transfer the agent is sending, if any
+func (r *Registry) ActiveBySource(agentID string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for id, t := range r.transfers {
+		if !t.Done() && t.SourceAgentID == agentID {
+			return id
+		}
+	}
+	return ""
+}
+
+func (r *Registry) Get(id string) *models.Transfer {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	t := r.transfers[id]
+	if t == nil {
+		return nil
+	}
+	return copyTransfer(t)
+}
+
+// List returns transfers newest first
+func (r *Registry) List() []*models.Transfer {
+	r.mu.RLock()
+	transfers := make([]*models.Transfer, 0, len(r.transfers))
+	for _, t := range r.transfers {
+		transfers = append(transfers, copyTransfer(t))
+	}
+	r.mu.RUnlock()
+	sort.Slice(transfers, func(i, j int) bool {
+		return transfers[i].StartedAt.After(transfers[j].StartedAt)
+	})
+	return transfers
+}
+
+// update applies fn to an unfinished transfer and publishes the result
+func (r *Registry) update(id string, fn func(t *models.Transfer)) {
+	r.mu.Lock()
+	t := r.transfers[id]
+	if t == nil || t.Done() {
+		r.mu.Unlock()
+		return
+	}
+	fn(t)
+	snapshot := copyTransfer(t)
+	r.mu.Unlock()
+	r.publish(snapshot)
+}
+
+func (r *Registry) pruneLocked() {
+	for id, t := range r.transfers {
+		if t.EndedAt != nil && time.Since(*t.EndedAt) > registryRetention {
+			delete(r.transfers, id)
+			delete(r.progressAt, id)
+		}
+	}
+}
+
+func (r *Registry) publish(t *models.Transfer) {
+	if r.sseHub == nil {
+		return
+	}
+	r.sseHub.Broadcast(models.Message{
+		Type:    models.SSEMsgTransferUpdate,
+		Payload: t,
+	})
+}
+
+func copyTransfer(t *models.Transfer) *models.Transfer {
+	snapshot := *t
+	snapshot.Fallbacks = append([]models.TransferFallback(nil), t.Fallbacks...)
+	snapshot.Resumes = append([]models.TransferResume(nil), t.Resumes...)
+	snapshot.CorruptPaths = append([]string(nil), t.CorruptPaths...)
+	if t.Source != nil {
+		source := *t.Source
+		snapshot.Source = &source
+	}
+	if t.Destination != nil {
+		destination := *t.Destination
+		snapshot.Destination = &destination
+	}
+	return &snapshot
+}
+
+// aggregateProgress sets the transfer's rate and ETA from the side furthest behind: the
+// destination once it reports, else the source. Relayed bytes are the master's own count.
+func aggregateProgress(t *models.Transfer) {
+	done, rate := t.BytesTransferred, t.RateBytesPerSec
+	switch {
+	case t.Destination != nil:
+		done, rate = t.Destination.BytesDone, t.Destination.Rate
+	case t.Source != nil:
+		rate = t.Source.Rate
+		if t.Mode == models.TransferModeP2P {
+			done = t.Source.BytesDone
+		}
+	}
+	t.RateBytesPerSec = rate
+	t.ETASeconds = 0
+	if rate > 0 && t.TotalBytes > done {
+		t.ETASeconds = float64(t.TotalBytes-done) / rate
+	}
+}
+
+// progressDueLocked returns a snapshot to publish if the transfer's last transfer_progress is old enough
+func (r *Registry) progressDueLocked(t *models.Transfer) *models.Transfer {
+	now := time.Now()
+	if now.Sub(r.progressAt[t.ID]) < progressPublishInterval {
+		return nil
+	}
+	r.progressAt[t.ID] = now
+	return copyTransfer(t)
+}
+
+func (r *Registry) publishProgress(t *models.Transfer) {
+	if t == nil || r.sseHub == nil {
+		return
+	}
+	r.sseHub.Broadcast(models.Message{
+		Type:    models.SSEMsgTransferProgress,
+		Payload: t,
+	})
+}
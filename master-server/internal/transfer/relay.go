@@ -2,6 +2,7 @@ package transfer
 
 import (
 	"fmt"
+	"sync"
 
 	"github.com/The-Promised-Neverland/master-server/internal/models"
 )
@@ -9,15 +10,38 @@ import (
 type RelayCoordinator struct {
 	messageSender MessageSender
 	connGetter    ConnectionGetter
+	active        map[string]struct{} // relayed transfer IDs
+	mu            sync.RWMutex
 }
 
 func NewRelayCoordinator(messageSender MessageSender, connGetter ConnectionGetter) *RelayCoordinator {
 	return &RelayCoordinator{
 		messageSender: messageSender,
 		connGetter:    connGetter,
+		active:        make(map[string]struct{}),
 	}
 }
 
+// track records a relayed transfer. A source can relay several transfers at once, each on its own stream.
+func (r *RelayCoordinator) track(transferID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.active[transferID] = struct{}{}
+}
+
+// Finish is called when the relayed transfer completes, fails or is cancelled
+func (r *RelayCoordinator) Finish(transferID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.active, transferID)
+}
+
+func (r *RelayCoordinator) ActiveCount() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.active)
+}
+
 func (r *RelayCoordinator) GetMode() TransferMode {
 	return ModeRelay
 }
@@ -37,7 +61,9 @@ func (r *RelayCoordinator) InitiateTransfer(requestingAgentID, sourceAgentID str
 		fmt.Printf("[RELAY] FAILED: Source agent=%s not connected\n", sourceAgentID)
 		return ModeRelay, fmt.Errorf("source agent %s not connected", sourceAgentID)
 	}
-	sourceConn.SetRelayTo(requestingAgentID)
+	connectionID, _ := payload["connection_id"].(string)
+	sourceConn.AddRelay(connectionID, requestingAgentID)
+	r.track(connectionID)
 	payload["transfer_mode"] = "relay"
 	transferMsg := models.Message{
 		Type:    models.MasterMsgRelayTransferStart,
@@ -50,9 +76,21 @@ func (r *RelayCoordinator) InitiateTransfer(requestingAgentID, sourceAgentID str
 		"source_agent_id": sourceAgentID,
 		"transfer_mode":   "relay",
 	}
-	if connectionID, ok := payload["connection_id"].(string); ok && connectionID != "" {
+	if connectionID != "" {
 		receivePayload["connection_id"] = connectionID
 	}
+	if offset, ok := payload["resume_offset"]; ok {
+		receivePayload["resume_offset"] = offset
+	}
+	if codec, ok := payload["codec"]; ok {
+		receivePayload["codec"] = codec
+	}
+	if encryption, ok := payload["encryption"]; ok {
+		receivePayload["encryption"] = encryption
+	}
+	if target, ok := payload["target"]; ok {
+		receivePayload["target"] = target
+	}
 	receiveMsg := models.Message{
 		Type:    models.MasterMsgTransferStatus,
 		Payload: receivePayload,
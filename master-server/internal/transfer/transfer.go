@@ -2,8 +2,11 @@ package transfer
 
 import (
 	"fmt"
+	"sync"
 
 	"github.com/The-Promised-Neverland/master-server/internal/models"
+	"github.com/The-Promised-Neverland/master-server/internal/sse"
+	"github.com/google/uuid"
 )
 
 type TransferManager struct {
@@ -13,9 +16,13 @@ type TransferManager struct {
 	connGetter          ConnectionGetter
 	p2pConfirmedChannel chan P2PConnectionConfirmed
 	p2pFailedChannel    chan P2PConnectionFailed
+	registry            *Registry
+	distributor         *Distributor
+	prepMu              sync.Mutex
+	preparations        map[string]*preparation // transfers waiting for their agents before starting, by ID
 }
 
-func NewTransferManager(messageSender MessageSender, connGetter ConnectionGetter) *TransferManager {
+func NewTransferManager(messageSender MessageSender, connGetter ConnectionGetter, sseHub *sse.SSEHub) *TransferManager {
 	p2pConfirmedCh := make(chan P2PConnectionConfirmed, 5)
 	p2pFailedCh := make(chan P2PConnectionFailed, 5)
 	manager := &TransferManager{
@@ -25,6 +32,9 @@ func NewTransferManager(messageSender MessageSender, connGetter ConnectionGetter
 		p2pFailedChannel:    p2pFailedCh,
 		p2pCoordinator:      NewP2PCoordinator(messageSender, connGetter, p2pConfirmedCh, p2pFailedCh),
 		relayCoordinator:    NewRelayCoordinator(messageSender, connGetter),
+		registry:            NewRegistry(sseHub),
+		distributor:         NewDistributor(messageSender, connGetter, sseHub),
+		preparations:        make(map[string]*preparation),
 	}
 	go manager.handleP2PConfirmations()
 	go manager.handleP2PFailures()
@@ -51,67 +61,264 @@ func (m *TransferManager) handleP2PFailures() {
 		if failed.Path != "" {
 			payloadMap["path"] = failed.Path
 		}
+		m.attemptPayload(failed.ConnectionID, payloadMap)
+		m.registry.Fallback(failed.ConnectionID, failed.Reason)
 		if _, err := m.relayCoordinator.InitiateTransfer(failed.RequestingAgent, failed.SourceAgent, payloadMap); err != nil {
 			fmt.Printf("[TRANSFER] FAILED: Relay fallback initiation failed: %v\n", err)
+			m.registry.Finish(failed.ConnectionID, models.TransferStatusFailed, err.Error())
 		} else {
 			fmt.Printf("[TRANSFER] SUCCESS: Relay fallback initiated successfully\n")
 		}
 	}
 }
 
-// NotifyTransferIntent sends transfer intent notification to both agents
-func (m *TransferManager) NotifyTransferIntent(requestingAgentID, sourceAgentID, path, connectionID string) {
-	intentPayload := map[string]interface{}{
-		"requesting_agent_id": requestingAgentID,
-		"source_agent_id":     sourceAgentID,
-		"path":                path,
-	}
-	if connectionID != "" {
-		intentPayload["connection_id"] = connectionID
-	}
-	intentMsg := models.Message{
-		Type:    models.MasterMsgTransferIntent,
-		Payload: intentPayload,
+// NotifyTransferIntent sends transfer intent notification to both agents, with the codec,
+// encryption and delta option of the transfer, the files and target of a sync pull and the
+// role each agent plays in it
+func (m *TransferManager) NotifyTransferIntent(t *models.Transfer) {
+	intent := func(role string) *models.Message {
+		payload := map[string]interface{}{
+			"requesting_agent_id": t.DestinationAgentID,
+			"source_agent_id":     t.SourceAgentID,
+			"path":                t.Path,
+			"connection_id":       t.ID,
+			"role":                role,
+			"codec":               t.Codec,
+			"encryption":          t.Encryption,
+			"delta":               t.Delta,
+		}
+		syncPayload(t, payload)
+		return &models.Message{
+			Type:    models.MasterMsgTransferIntent,
+			Payload: payload,
+		}
 	}
-	m.messageSender.Send(requestingAgentID, Outbound{Msg: &intentMsg})
-	m.messageSender.Send(sourceAgentID, Outbound{Msg: &intentMsg})
-	fmt.Printf("[AUDIT] Transfer intent sent to requesting_agent=%s\n", requestingAgentID)
-	fmt.Printf("[AUDIT] Transfer intent sent to source_agent=%s\n", sourceAgentID)
+	m.messageSender.Send(t.DestinationAgentID, Outbound{Msg: intent(models.TransferRoleDestination)})
+	m.messageSender.Send(t.SourceAgentID, Outbound{Msg: intent(models.TransferRoleSource)})
+	fmt.Printf("[AUDIT] Transfer intent sent to requesting_agent=%s\n", t.DestinationAgentID)
+	fmt.Printf("[AUDIT] Transfer intent sent to source_agent=%s\n", t.SourceAgentID)
 }
 
-func (m *TransferManager) HandleAgentRequestFile(msg *models.Message, sourceAgentID string) error {
+// HandleAgentRequestFile registers the transfer and starts it over P2P, or relay when P2P is
+// not possible. The returned transfer ID is the connection_id both agents see. An encrypted or
+// delta transfer starts once its agents are prepared, so its errors only show in the registry.
+func (m *TransferManager) HandleAgentRequestFile(msg *models.Message, sourceAgentID string) (string, error) {
 	payloadMap, ok := msg.Payload.(map[string]interface{})
 	if !ok {
-		return fmt.Errorf("invalid payload format")
+		return "", fmt.Errorf("invalid payload format")
 	}
 	requestingAgentID, ok := payloadMap["requesting_agent_id"].(string)
 	if !ok || requestingAgentID == "" {
-		return fmt.Errorf("requesting_agent_id is missing")
+		return "", fmt.Errorf("requesting_agent_id is missing")
 	}
 	path, _ := payloadMap["path"].(string)
 	fmt.Printf("[TRANSFER] File transfer request received: requesting_agent=%s wants file from source_agent=%s, path=%s\n", requestingAgentID, sourceAgentID, path)
-	connectionID := ""
-	if id, ok := payloadMap["connection_id"].(string); ok && id != "" {
-		connectionID = id
+	connectionID, _ := payloadMap["connection_id"].(string)
+	if connectionID == "" {
+		connectionID = uuid.New().String()
+		payloadMap["connection_id"] = connectionID
 	}
-	m.NotifyTransferIntent(requestingAgentID, sourceAgentID, path, connectionID)
+	m.registry.Create(connectionID, sourceAgentID, requestingAgentID, path)
+	if delta, _ := payloadMap["delta"].(bool); delta {
+		m.registry.SetDelta(connectionID)
+	}
+	if push, _ := payloadMap["push"].(bool); push {
+		m.registry.SetPush(connectionID)
+	}
+	if pairID, _ := payloadMap["sync_pair_id"].(string); pairID != "" {
+		target, _ := payloadMap["target"].(string)
+		files, _ := payloadMap["files"].([]string)
+		m.registry.SetSync(connectionID, pairID, target, files)
+	}
+	return connectionID, m.announce(connectionID, requestingAgentID, sourceAgentID, path, payloadMap)
+}
+
+// start connects the agents of a registered transfer over P2P, or relay when P2P is not possible
+func (m *TransferManager) start(connectionID, requestingAgentID, sourceAgentID, path string, payloadMap map[string]interface{}) error {
 	fmt.Printf("[TRANSFER] Attempting P2P connection between requesting_agent=%s and source_agent=%s\n", requestingAgentID, sourceAgentID)
-	connectionID, connectionOK := m.p2pCoordinator.AttemptP2PConnection(requestingAgentID, sourceAgentID, path)
-	if !connectionOK {
+	if !m.p2pCoordinator.AttemptP2PConnection(connectionID, requestingAgentID, sourceAgentID, path) {
 		fmt.Printf("[TRANSFER] FAILED: P2P connection attempt failed (endpoints not available), falling back to relay mode\n")
 		fmt.Printf("[TRANSFER] Initiating relay transfer: source_agent=%s -> requesting_agent=%s\n", sourceAgentID, requestingAgentID)
-		_, relayErr := m.relayCoordinator.InitiateTransfer(requestingAgentID, sourceAgentID, payloadMap)
+		m.registry.SetMode(connectionID, models.TransferModeRelay)
+		_, relayErr := m.relayCoordinator.InitiateTransfer(requestingAgentID, sourceAgentID, m.attemptPayload(connectionID, payloadMap))
 		if relayErr != nil {
 			fmt.Printf("[TRANSFER] FAILED: Relay transfer initiation failed: %v\n", relayErr)
+			m.registry.Finish(connectionID, models.TransferStatusFailed, relayErr.Error())
 		} else {
 			fmt.Printf("[TRANSFER] SUCCESS: Relay transfer initiated successfully\n")
 		}
 		return relayErr
 	}
+	m.registry.SetMode(connectionID, models.TransferModeP2P)
 	fmt.Printf("[TRANSFER] SUCCESS: P2P connection attempt started, connection_id=%s, waiting for both agents to confirm...\n", connectionID)
 	return nil
 }
 
+// attemptPayload adds the transfer's codec, encryption, delta option, sync files and target
+// and latest resume point, if any, to a start message for either agent
+func (m *TransferManager) attemptPayload(transferID string, payload map[string]interface{}) map[string]interface{} {
+	if t := m.registry.Get(transferID); t != nil {
+		if t.Codec != "" {
+			payload["codec"] = t.Codec
+		}
+		if t.Encryption != "" {
+			payload["encryption"] = t.Encryption
+		}
+		if t.Delta {
+			payload["delta"] = true
+		}
+		syncPayload(t, payload)
+	}
+	if resume := m.registry.ResumePoint(transferID); resume != nil {
+		payload["resume_offset"] = resume.Offset
+		if resume.Entry != "" {
+			payload["resume_entry"] = resume.Entry
+		}
+	}
+	return payload
+}
+
+// syncPayload adds the files and target of a sync pull to a payload for either agent
+func syncPayload(t *models.Transfer, payload map[string]interface{}) {
+	if t.SyncPairID == "" {
+		return
+	}
+	payload["sync_pair_id"] = t.SyncPairID
+	payload["files"] = t.Files
+	payload["target"] = t.Target
+}
+
+// stopAttempt drops the preparation, relay route and P2P negotiation of a transfer's current
+// attempt
+func (m *TransferManager) stopAttempt(t *models.Transfer) {
+	m.dropPreparation(t.ID)
+	if sourceConn := m.connGetter.GetConnection(t.SourceAgentID); sourceConn != nil {
+		sourceConn.RemoveRelay(t.ID)
+	}
+	m.relayCoordinator.Finish(t.ID)
+	m.p2pCoordinator.RemoveTransfer(t.ID)
+}
+
+// AgentDisconnected fails the transfers and distributions of an agent that went offline. The
+// source of a failed transfer stops sending; its destination keeps what arrived so it can
+// resume later.
+func (m *TransferManager) AgentDisconnected(agentID string) {
+	m.distributor.AgentDisconnected(agentID)
+	for _, t := range m.registry.FailAgent(agentID, "agent disconnected") {
+		m.stopAttempt(t)
+		if t.SourceAgentID == t.DestinationAgentID {
+			continue
+		}
+		if t.DestinationAgentID == agentID {
+			cancelMsg := models.Message{
+				Type: models.MasterMsgTransferCancel,
+				Payload: map[string]interface{}{
+					"connection_id": t.ID,
+					"reason":        "destination agent disconnected",
+				},
+			}
+			m.messageSender.Send(t.SourceAgentID, Outbound{Msg: &cancelMsg})
+			continue
+		}
+		failedMsg := models.Message{
+			Type: models.MasterMsgTransferStatus,
+			Payload: map[string]interface{}{
+				"status":          "transfer_failed",
+				"agent_id":        t.SourceAgentID,
+				"source_agent_id": t.SourceAgentID,
+				"transfer_mode":   t.Mode,
+				"connection_id":   t.ID,
+				"reason":          "source agent disconnected",
+			},
+		}
+		m.messageSender.Send(t.DestinationAgentID, Outbound{Msg: &failedMsg})
+	}
+}
+
+// ResumeTransfer restarts a transfer from the checkpoint its destination reported. The
+// source must be online; a completed or cancelled transfer cannot resume.
+func (m *TransferManager) ResumeTransfer(requestingAgentID, transferID string, checkpoint models.TransferResume) (*models.Transfer, error) {
+	t := m.registry.Get(transferID)
+	switch {
+	case t == nil:
+		return nil, fmt.Errorf("%w: %s", ErrTransferNotFound, transferID)
+	case t.DestinationAgentID != requestingAgentID:
+		return nil, fmt.Errorf("agent %s is not the destination of transfer %s", requestingAgentID, transferID)
+	case t.Status == models.TransferStatusCompleted || t.Status == models.TransferStatusCancelled:
+		return nil, fmt.Errorf("%w: %s is %s", ErrTransferNotResumable, transferID, t.Status)
+	case m.connGetter.GetConnection(t.SourceAgentID) == nil:
+		return nil, fmt.Errorf("source agent %s not connected", t.SourceAgentID)
+	}
+	m.stopAttempt(t)
+	if _, err := m.registry.Resume(transferID, checkpoint); err != nil {
+		return nil, err
+	}
+	// Either agent may have restarted with other codecs or keys since the transfer was
+	// negotiated, so the attempt is announced again
+	payloadMap := map[string]interface{}{
+		"requesting_agent_id": t.DestinationAgentID,
+		"connection_id":       transferID,
+		"path":                t.Path,
+	}
+	err := m.announce(transferID, t.DestinationAgentID, t.SourceAgentID, t.Path, payloadMap)
+	return m.registry.Get(transferID), err
+}
+
+// RequestResume asks the destination of a failed transfer for its checkpoint, which it answers
+// with agent_transfer_resume
+func (m *TransferManager) RequestResume(transferID string) (*models.Transfer, error) {
+	t := m.registry.Get(transferID)
+	switch {
+	case t == nil:
+		return nil, fmt.Errorf("%w: %s", ErrTransferNotFound, transferID)
+	case t.Status != models.TransferStatusFailed:
+		return nil, fmt.Errorf("%w: %s is %s, only failed transfers resume", ErrTransferNotResumable, transferID, t.Status)
+	case m.connGetter.GetConnection(t.DestinationAgentID) == nil:
+		return nil, fmt.Errorf("destination agent %s not connected", t.DestinationAgentID)
+	case m.connGetter.GetConnection(t.SourceAgentID) == nil:
+		return nil, fmt.Errorf("source agent %s not connected", t.SourceAgentID)
+	}
+	resumeMsg := models.Message{
+		Type: models.MasterMsgTransferResume,
+		Payload: map[string]interface{}{
+			"connection_id": transferID,
+		},
+	}
+	m.messageSender.Send(t.DestinationAgentID, Outbound{Msg: &resumeMsg})
+	fmt.Printf("[TRANSFER] Asked requesting_agent=%s for the checkpoint of transfer %s\n", t.DestinationAgentID, transferID)
+	return t, nil
+}
+
+// CancelTransfer stops an unfinished transfer: both agents are told to abort, the relay
+// route is dropped and the transfer is marked cancelled
+func (m *TransferManager) CancelTransfer(transferID string) (*models.Transfer, error) {
+	t, err := m.registry.Cancel(transferID, "cancelled by user")
+	if err != nil {
+		return nil, err
+	}
+	m.dropPreparation(transferID)
+	if sourceConn := m.connGetter.GetConnection(t.SourceAgentID); sourceConn != nil {
+		sourceConn.RemoveRelay(transferID)
+	}
+	if t.Mode == models.TransferModeRelay {
+		m.relayCoordinator.Finish(transferID)
+	}
+	m.p2pCoordinator.RemoveTransfer(transferID)
+	cancelMsg := models.Message{
+		Type: models.MasterMsgTransferCancel,
+		Payload: map[string]interface{}{
+			"connection_id": transferID,
+			"reason":        t.FailureReason,
+		},
+	}
+	m.messageSender.Send(t.SourceAgentID, Outbound{Msg: &cancelMsg})
+	if t.DestinationAgentID != t.SourceAgentID {
+		m.messageSender.Send(t.DestinationAgentID, Outbound{Msg: &cancelMsg})
+	}
+	fmt.Printf("[TRANSFER] Cancel sent to source_agent=%s and requesting_agent=%s, connection_id=%s\n", t.SourceAgentID, t.DestinationAgentID, transferID)
+	return t, nil
+}
+
 func (m *TransferManager) GetP2PCoordinator() *P2PCoordinator {
 	return m.p2pCoordinator
 }
@@ -120,6 +327,14 @@ func (m *TransferManager) GetRelayCoordinator() *RelayCoordinator {
 	return m.relayCoordinator
 }
 
+func (m *TransferManager) Registry() *Registry {
+	return m.registry
+}
+
+func (m *TransferManager) Distributor() *Distributor {
+	return m.distributor
+}
+
 func (m *TransferManager) HandleP2PFailureFallback(connectionID string) {
 	failedTransfer := m.p2pCoordinator.GetFailedTransfer(connectionID)
 	if failedTransfer == nil {
@@ -144,30 +359,32 @@ func (m *TransferManager) initiateRelayFallback(connectionID, requestingAgentID,
 	if sourceConn == nil {
 		return fmt.Errorf("source agent %s not connected", sourceAgentID)
 	}
-	sourceConn.SetRelayTo(requestingAgentID)
+	m.registry.Fallback(connectionID, "p2p transfer failed")
+	sourceConn.AddRelay(connectionID, requestingAgentID)
+	m.relayCoordinator.track(connectionID)
 	relayMsg := models.Message{
 		Type: models.MasterMsgRelayFallback,
-		Payload: map[string]interface{}{
+		Payload: m.attemptPayload(connectionID, map[string]interface{}{
 			"connection_id":       connectionID,
 			"requesting_agent_id": requestingAgentID,
 			"source_agent_id":     sourceAgentID,
 			"transfer_mode":       "relay",
 			"fallback":            true,
 			"action":              "send",
-		},
+		}),
 	}
 	m.messageSender.Send(sourceAgentID, Outbound{Msg: &relayMsg})
 	fmt.Printf("[TRANSFER] Sent relay fallback command to SOURCE agent=%s (action=SEND), connection_id=%s\n", sourceAgentID, connectionID)
 	requestingMsg := models.Message{
 		Type: models.MasterMsgRelayFallback,
-		Payload: map[string]interface{}{
+		Payload: m.attemptPayload(connectionID, map[string]interface{}{
 			"connection_id":       connectionID,
 			"requesting_agent_id": requestingAgentID,
 			"source_agent_id":     sourceAgentID,
 			"transfer_mode":       "relay",
 			"fallback":            true,
 			"action":              "receive",
-		},
+		}),
 	}
 	m.messageSender.Send(requestingAgentID, Outbound{Msg: &requestingMsg})
 	fmt.Printf("[TRANSFER] Sent relay fallback command to REQUESTING agent=%s (action=RECEIVE), connection_id=%s\n", requestingAgentID, connectionID)
@@ -3,6 +3,7 @@ package ws
 import (
 	"context"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/The-Promised-Neverland/master-server/internal/transfer"
@@ -10,20 +11,48 @@ import (
 )
 
 type Connection struct {
-	Name           string
-	Id             string
-	Conn           *websocket.Conn
-	OS             string
-	LastSeen       time.Time
-	SendCh         chan transfer.Outbound
-	IncomingCh     chan transfer.Outbound
-	StreamCh       chan []byte
-	RelayTo        string
-	Ctx            context.Context
-	Cancel         context.CancelFunc
-	wg             sync.WaitGroup
-	ConnMutex      sync.RWMutex
-	PublicEndpoint string
+	Name              string
+	Id                string
+	Conn              *websocket.Conn
+	OS                string
+	LastSeen          time.Time     // any frame, text or binary, moves it
+	Heartbeat         time.Duration // interval the agent announced, or the hub's default
+	ConnectedSince    time.Time     // start of the current session, zero while offline
+	DisconnectedSince time.Time     // end of the last session, zero while online
+	SendCh            chan transfer.Outbound
+	IncomingCh        chan transfer.Outbound
+	StreamCh          chan []byte
+	relays            map[string]*relayRoute // stream (transfer) ID -> where its frames go
+	streamIn          atomic.Int64           // binary chunks read into StreamCh
+	streamOut         atomic.Int64           // binary chunks handled by DataStreamPump
+	Ctx               context.Context
+	Cancel            context.CancelFunc
+	wg                sync.WaitGroup
+	ConnMutex         sync.RWMutex
+	PublicEndpoint    string
+	CredentialID      string
+	SigningKey        string                 // base64 Ed25519 public key the agent signs transfer manifests with
+	Codecs            []string               // transfer codecs the agent supports, from X-Transfer-Codecs
+	Encryption        []string               // transfer encryption suites the agent supports, from X-Transfer-Encryption
+	LastMetrics       map[string]interface{} // host_metrics of the latest heartbeat or metrics response
+	LastMetricsAt     time.Time
+	Labels            map[string]string // set through the API, used to select agents as a group
+	persistedAt       time.Time
+	uninstalled       bool // the agent accepted an uninstall; it is forgotten once it disconnects
+}
+
+// TransferCodecs returns the transfer codecs the agent listed when it connected
+func (c *Connection) TransferCodecs() []string {
+	c.ConnMutex.RLock()
+	defer c.ConnMutex.RUnlock()
+	return c.Codecs
+}
+
+// TransferEncryption returns the transfer encryption suites the agent listed when it connected
+func (c *Connection) TransferEncryption() []string {
+	c.ConnMutex.RLock()
+	defer c.ConnMutex.RUnlock()
+	return c.Encryption
 }
 
 func (c *Connection) GetPublicEndpoint() string {
@@ -32,20 +61,106 @@ func (c *Connection) GetPublicEndpoint() string {
 	return c.PublicEndpoint
 }
 
-func (c *Connection) SetRelayTo(agentID string) {
+// relayRoute is one stream this connection's agent sends through the master. Credit the
+// destination grants is held until the source reports it started sending.
+type relayRoute struct {
+	destination string
+	nextSeq     uint64
+	granted     uint64 // chunks the destination has room for, counted from the first
+	sourceReady bool
+}
+
+// AddRelay forwards the frames of stream transferID to agentID
+func (c *Connection) AddRelay(transferID string, agentID string) {
+	c.ConnMutex.Lock()
+	defer c.ConnMutex.Unlock()
+	if c.relays == nil {
+		c.relays = make(map[string]*relayRoute)
+	}
+	c.relays[transferID] = &relayRoute{destination: agentID}
+}
+
+// RemoveRelay stops relaying the frames of stream transferID
+func (c *Connection) RemoveRelay(transferID string) {
+	c.ConnMutex.Lock()
+	defer c.ConnMutex.Unlock()
+	delete(c.relays, transferID)
+}
+
+// relayDestination returns the agent the stream is relayed to, or "" if it is not relayed
+func (c *Connection) relayDestination(transferID string) string {
+	c.ConnMutex.RLock()
+	defer c.ConnMutex.RUnlock()
+	if route := c.relays[transferID]; route != nil {
+		return route.destination
+	}
+	return ""
+}
+
+// relayFrame returns where a frame goes and how many frames of its stream were skipped before it
+func (c *Connection) relayFrame(frame transfer.Frame) (string, uint64) {
 	c.ConnMutex.Lock()
 	defer c.ConnMutex.Unlock()
-	c.RelayTo = agentID
+	route := c.relays[frame.StreamID]
+	if route == nil {
+		return "", 0
+	}
+	var skipped uint64
+	if frame.Seq > route.nextSeq {
+		skipped = frame.Seq - route.nextSeq
+	}
+	route.nextSeq = frame.Seq + 1
+	return route.destination, skipped
+}
+
+// grantRelay raises the stream's credit and reports whether it can go to the source yet
+func (c *Connection) grantRelay(transferID string, granted uint64) bool {
+	c.ConnMutex.Lock()
+	defer c.ConnMutex.Unlock()
+	route := c.relays[transferID]
+	if route == nil || granted <= route.granted {
+		return false
+	}
+	route.granted = granted
+	return route.sourceReady
+}
+
+// relaySourceReady marks the stream's source as sending and returns the credit granted so far
+func (c *Connection) relaySourceReady(transferID string) uint64 {
+	c.ConnMutex.Lock()
+	defer c.ConnMutex.Unlock()
+	route := c.relays[transferID]
+	if route == nil {
+		return 0
+	}
+	route.sourceReady = true
+	return route.granted
+}
+
+func (c *Connection) relayStreams() []string {
+	c.ConnMutex.RLock()
+	defer c.ConnMutex.RUnlock()
+	ids := make([]string, 0, len(c.relays))
+	for id := range c.relays {
+		ids = append(ids, id)
+	}
+	return ids
 }
 
 func NewConnection(name string, id string, os string, conn *websocket.Conn) *Connection {
 	ctx, cancel := context.WithCancel(context.Background())
+	var connectedSince time.Time
+	if conn != nil {
+		connectedSince = time.Now()
+	}
 	return &Connection{
 		Name:           name,
 		Id:             id,
 		Conn:           conn,
 		OS:             os,
 		LastSeen:       time.Now(),
+		Heartbeat:      DefaultHeartbeatInterval,
+		ConnectedSince: connectedSince,
 		SendCh:         make(chan transfer.Outbound, 1024*64),
 		IncomingCh:     make(chan transfer.Outbound, 1024*64),
 		StreamCh:       make(chan []byte, 1024*64),
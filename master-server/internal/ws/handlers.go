@@ -1,20 +1,30 @@
 package ws
 
 import (
+	"errors"
 	"fmt"
+	"time"
 
+	"github.com/The-Promised-Neverland/master-server/internal/metrics"
 	"github.com/The-Promised-Neverland/master-server/internal/models"
 	"github.com/The-Promised-Neverland/master-server/internal/transfer"
 )
 
 // RegisterDefaultHandlers registers all default message handlers for the WSHub
 func (h *WSHub) RegisterDefaultHandlers() {
-	h.RegisterHandler("agent_metrics", func(msg *models.Message, c *Connection) error {
+	h.RegisterHandler(models.AgentMsgHeartbeat, func(msg *models.Message, c *Connection) error {
 		if payloadMap, ok := msg.Payload.(map[string]interface{}); ok {
+			if hostMetrics, ok := payloadMap["host_metrics"].(map[string]interface{}); ok {
+				h.recordHostMetrics(c, hostMetrics)
+			}
 			if endpoint, hasEndpoint := payloadMap["public_endpoint"].(string); hasEndpoint && endpoint != "" {
 				h.Mutex.Lock()
+				changed := c.PublicEndpoint != endpoint
 				c.PublicEndpoint = endpoint
 				h.Mutex.Unlock()
+				if changed {
+					h.persistConnection(c)
+				}
 				delete(payloadMap, "public_endpoint")
 				delete(payloadMap, "nat_type")
 				msg.Payload = payloadMap
@@ -23,6 +33,41 @@ func (h *WSHub) RegisterDefaultHandlers() {
 		return nil
 	})
 
+	h.RegisterHandler(models.AgentMsgMetricsResponse, func(msg *models.Message, c *Connection) error {
+		payloadMap, ok := msg.Payload.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("invalid metrics response payload")
+		}
+		if hostMetrics, ok := payloadMap["host_metrics"].(map[string]interface{}); ok {
+			h.recordHostMetrics(c, hostMetrics)
+		}
+		h.resolveRequest(c.Id, payloadMap)
+		return nil
+	})
+
+	h.RegisterHandler(models.AgentMsgCommandResult, func(msg *models.Message, c *Connection) error {
+		payloadMap, ok := msg.Payload.(map[string]interface{})
+		if !ok || msg.ReplyTo == "" {
+			return fmt.Errorf("invalid command result")
+		}
+		result := models.CommandResultPayload{}
+		result.Command, _ = payloadMap["command"].(string)
+		result.Status, _ = payloadMap["status"].(string)
+		result.Error, _ = payloadMap["error"].(string)
+		if result.Status == models.CommandStatusError {
+			fmt.Printf("[COMMAND] Agent %s failed %s (%s): %s\n", c.Id, result.Command, msg.ReplyTo, result.Error)
+		}
+		if err := h.Commands.Resolve(c.Id, msg.ReplyTo, result); err != nil {
+			return err
+		}
+		if cmd := h.Commands.Get(msg.ReplyTo); cmd != nil && cmd.Type == models.MasterMsgAgentUninstall {
+			h.Mutex.Lock()
+			c.uninstalled = cmd.Status != models.CommandStatusError
+			h.Mutex.Unlock()
+		}
+		return nil
+	})
+
 	h.RegisterHandler(models.MasterMsgTransferStatus, func(msg *models.Message, c *Connection) error {
 		payloadMap, ok := msg.Payload.(map[string]interface{})
 		if !ok {
@@ -32,6 +77,29 @@ func (h *WSHub) RegisterDefaultHandlers() {
 		if !hasStatus || status == "" {
 			return nil
 		}
+		registry := h.TransferManager.Registry()
+		transferID, _ := payloadMap["connection_id"].(string)
+		if h.TransferManager.Distributor().Has(transferID) {
+			h.distributionStatus(c, transferID, status, payloadMap)
+			return nil
+		}
+		if role, _ := payloadMap["role"].(string); role == models.TransferRoleDestination && status == "transfer_failed" {
+			// The destination could not complete what the source sent, e.g. files did not match the manifest
+			reason, _ := payloadMap["reason"].(string)
+			fmt.Printf("Destination agent %s failed transfer %s: %s\n", c.Id, transferID, reason)
+			registry.Reject(transferID, c.Id, reason, corruptPaths(payloadMap))
+			return nil
+		}
+		if transferID == "" {
+			transferID = registry.ActiveBySource(c.Id)
+		}
+		relayTo := c.relayDestination(transferID)
+		destination := relayTo
+		mode := models.TransferModeRelay
+		if t := registry.Get(transferID); t != nil && !t.Done() && relayTo == "" && t.Mode == models.TransferModeP2P && t.SourceAgentID == c.Id {
+			destination = t.DestinationAgentID
+			mode = models.TransferModeP2P
+		}
 		switch status {
 		case "p2p_success":
 			connectionID, ok2 := payloadMap["connection_id"].(string)
@@ -48,33 +116,338 @@ func (h *WSHub) RegisterDefaultHandlers() {
 				h.TransferManager.GetP2PCoordinator().HandleP2PFailure(connectionID, reason)
 				h.TransferManager.HandleP2PFailureFallback(connectionID)
 			}
+		case "initiated", "running":
+			if total, ok := payloadMap["total_bytes"].(float64); ok {
+				registry.SetTotal(transferID, int64(total))
+			}
+			registry.Running(transferID)
+			if relayTo != "" && status == "initiated" {
+				if granted := c.relaySourceReady(transferID); granted > 0 {
+					h.sendCredit(c, transferID, granted)
+				}
+			}
 		case "completed", "transfer_failed":
+			if relayTo != "" {
+				h.waitRelayed(c)
+				h.TransferManager.GetRelayCoordinator().Finish(transferID)
+			}
+			if status == "completed" {
+				if total, ok := payloadMap["total_bytes"].(float64); ok {
+					registry.ReportBytes(transferID, int64(total))
+				}
+				registry.Finish(transferID, models.TransferStatusCompleted, "")
+			} else {
+				reason, _ := payloadMap["reason"].(string)
+				registry.Finish(transferID, models.TransferStatusFailed, reason)
+			}
 			connectionID, ok2 := payloadMap["connection_id"].(string)
 			if ok2 && connectionID != "" && h.TransferManager != nil && h.TransferManager.GetP2PCoordinator() != nil {
 				fmt.Printf("Transfer %s completed, cleaning up P2P state for %s\n", status, connectionID)
 				h.TransferManager.GetP2PCoordinator().RemoveTransfer(connectionID)
 			}
 		}
-		if c.RelayTo != "" {
+		// The coordinators already sent "initiated" to the destination; a second one would
+		// make it reopen its temp file after the first chunks arrived
+		if destination != "" && status != "initiated" && (relayTo != "" || status == "completed" || status == "transfer_failed") {
 			statusMsg := models.Message{
 				Type: models.MasterMsgTransferStatus,
 				Payload: map[string]interface{}{
 					"status":          status,
 					"agent_id":        c.Id,
 					"source_agent_id": c.Id,
-					"transfer_mode":   "relay",
+					"transfer_mode":   mode,
 				},
 			}
-			if connectionID, ok := payloadMap["connection_id"].(string); ok && connectionID != "" {
-				statusMsg.Payload.(map[string]interface{})["connection_id"] = connectionID
+			if transferID != "" {
+				statusMsg.Payload.(map[string]interface{})["connection_id"] = transferID
 			}
 			if reason, ok := payloadMap["reason"].(string); ok && reason != "" {
 				statusMsg.Payload.(map[string]interface{})["reason"] = reason
 			}
-			h.Send(c.RelayTo, transfer.Outbound{Msg: &statusMsg})
-			fmt.Printf("Forwarded '%s' status to destination agent %s from source agent %s (relay mode)\n", status, c.RelayTo, c.Id)
+			if status == "completed" {
+				// The destination verifies the manifest against the key the source connected with
+				statusMsg.Payload.(map[string]interface{})["manifest"] = payloadMap["manifest"]
+				statusMsg.Payload.(map[string]interface{})["source_signing_key"] = c.SigningKey
+			}
+			h.Send(destination, transfer.Outbound{Msg: &statusMsg})
+			fmt.Printf("Forwarded '%s' status to destination agent %s from source agent %s (%s mode)\n", status, destination, c.Id, mode)
+			if relayTo != "" && (status == "completed" || status == "transfer_failed") {
+				c.RemoveRelay(transferID)
+			}
+		}
+		return nil
+	})
+
+	h.RegisterHandler(models.AgentMsgTransferProgress, func(msg *models.Message, c *Connection) error {
+		payloadMap, ok := msg.Payload.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("invalid transfer progress payload")
+		}
+		transferID, _ := payloadMap["connection_id"].(string)
+		role, _ := payloadMap["role"].(string)
+		if transferID == "" {
+			return fmt.Errorf("transfer progress without connection_id")
 		}
+		progress := models.TransferProgress{}
+		if v, ok := payloadMap["bytes_done"].(float64); ok {
+			progress.BytesDone = int64(v)
+		}
+		if v, ok := payloadMap["total_bytes"].(float64); ok {
+			progress.TotalBytes = int64(v)
+		}
+		if v, ok := payloadMap["chunks"].(float64); ok {
+			progress.Chunks = int64(v)
+		}
+		progress.Rate, _ = payloadMap["rate_bytes_per_sec"].(float64)
+		progress.ETASeconds, _ = payloadMap["eta_seconds"].(float64)
+		if h.TransferManager.Distributor().Progress(transferID, c.Id, role, progress) {
+			return nil
+		}
+		h.TransferManager.Registry().Progress(transferID, role, progress)
 		return nil
 	})
 
+	h.RegisterHandler(models.AgentMsgTransferCredit, func(msg *models.Message, c *Connection) error {
+		payloadMap, ok := msg.Payload.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("invalid transfer credit payload")
+		}
+		transferID, _ := payloadMap["connection_id"].(string)
+		granted, _ := payloadMap["granted"].(float64)
+		if h.TransferManager.Distributor().Grant(transferID, c.Id, uint64(granted)) {
+			return nil
+		}
+		t := h.TransferManager.Registry().Get(transferID)
+		if t == nil || t.Done() || t.DestinationAgentID != c.Id {
+			return nil
+		}
+		h.Mutex.RLock()
+		sourceConn := h.Connections[t.SourceAgentID]
+		h.Mutex.RUnlock()
+		if sourceConn != nil && sourceConn.grantRelay(transferID, uint64(granted)) {
+			h.sendCredit(sourceConn, transferID, uint64(granted))
+		}
+		return nil
+	})
+
+	h.RegisterHandler(models.AgentMsgTransferKey, func(msg *models.Message, c *Connection) error {
+		payloadMap, ok := msg.Payload.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("invalid transfer key payload")
+		}
+		key := models.TransferKey{}
+		key.ConnectionID, _ = payloadMap["connection_id"].(string)
+		key.Role, _ = payloadMap["role"].(string)
+		key.PublicKey, _ = payloadMap["public_key"].(string)
+		key.Signature, _ = payloadMap["signature"].(string)
+		// The receiving agent checks the signature against the key this agent connected with
+		return h.TransferManager.AddTransferKey(c.Id, c.SigningKey, key)
+	})
+
+	h.RegisterHandler(models.AgentMsgTransferSignatures, func(msg *models.Message, c *Connection) error {
+		payloadMap, ok := msg.Payload.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("invalid transfer signatures payload")
+		}
+		return h.TransferManager.AddTransferSignatures(c.Id, payloadMap)
+	})
+
+	h.RegisterHandler(models.AgentMsgTransferResume, func(msg *models.Message, c *Connection) error {
+		payloadMap, ok := msg.Payload.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("invalid transfer resume payload")
+		}
+		transferID, _ := payloadMap["connection_id"].(string)
+		checkpoint := models.TransferResume{}
+		if v, ok := payloadMap["offset"].(float64); ok {
+			checkpoint.Offset = int64(v)
+		}
+		if v, ok := payloadMap["entries_completed"].(float64); ok {
+			checkpoint.EntriesCompleted = int(v)
+		}
+		checkpoint.Entry, _ = payloadMap["entry"].(string)
+		_, err := h.TransferManager.ResumeTransfer(c.Id, transferID, checkpoint)
+		if errors.Is(err, transfer.ErrTransferNotFound) || errors.Is(err, transfer.ErrTransferNotResumable) {
+			// Nothing will resume it, so the agent can drop what it kept
+			h.enqueue(c, transfer.Outbound{Msg: &models.Message{
+				Type: models.MasterMsgTransferCancel,
+				Payload: map[string]interface{}{
+					"connection_id": transferID,
+					"reason":        err.Error(),
+				},
+			}})
+		}
+		if err != nil {
+			return fmt.Errorf("resume transfer %s: %w", transferID, err)
+		}
+		fmt.Printf("[TRANSFER] Agent %s resumed transfer %s at offset %d\n", c.Id, transferID, checkpoint.Offset)
+		return nil
+	})
+
+	h.RegisterHandler(models.AgentMsgTransferPush, func(msg *models.Message, c *Connection) error {
+		payloadMap, ok := msg.Payload.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("invalid transfer push payload")
+		}
+		path, _ := payloadMap["path"].(string)
+		delta, _ := payloadMap["delta"].(bool)
+		requestID, _ := payloadMap["request_id"].(string)
+		var destinations []string
+		if ids, ok := payloadMap["destinations"].([]interface{}); ok {
+			for _, id := range ids {
+				if destinationAgentID, ok := id.(string); ok && destinationAgentID != "" {
+					destinations = append(destinations, destinationAgentID)
+				}
+			}
+		}
+		if path == "" || len(destinations) == 0 {
+			return fmt.Errorf("transfer push needs a path and at least one destination")
+		}
+		results := h.TransferManager.Push(c.Id, path, destinations, delta)
+		h.enqueue(c, transfer.Outbound{Msg: &models.Message{
+			Type: models.MasterMsgTransferPushResult,
+			Payload: map[string]interface{}{
+				"request_id": requestID,
+				"path":       path,
+				"results":    results,
+			},
+		}})
+		return nil
+	})
+
+	syncForward := func(msg *models.Message, c *Connection) error {
+		return h.SyncPairs.Forward(c.Id, msg)
+	}
+	h.RegisterHandler(models.AgentMsgSyncChanges, syncForward)
+	h.RegisterHandler(models.AgentMsgSyncAck, syncForward)
+
+	h.RegisterHandler(models.AgentMsgSyncPull, func(msg *models.Message, c *Connection) error {
+		payloadMap, ok := msg.Payload.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("invalid sync pull payload")
+		}
+		return h.SyncPairs.Pull(c.Id, payloadMap)
+	})
+
+	h.RegisterHandler(models.AgentMsgSyncReport, func(msg *models.Message, c *Connection) error {
+		payloadMap, ok := msg.Payload.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("invalid sync report payload")
+		}
+		return h.SyncPairs.Report(c.Id, payloadMap)
+	})
+
+	h.RegisterHandler(models.AgentMsgJobStatus, func(msg *models.Message, c *Connection) error {
+		payloadMap, ok := msg.Payload.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("invalid job status payload")
+		}
+		return h.TaskManager.HandleJobStatus(c.Id, payloadMap)
+	})
+
+	h.RegisterHandler(models.AgentMsgDirectorySnapshot, func(msg *models.Message, c *Connection) error {
+		payloadMap, ok := msg.Payload.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("invalid directory snapshot payload")
+		}
+		snapshot, err := h.Snapshots.AddSnapshot(c.Id, payloadMap)
+		if err != nil || snapshot == nil {
+			return err
+		}
+		if h.SSEHub != nil {
+			h.SSEHub.Broadcast(models.Message{Type: models.AgentMsgDirectorySnapshot, Payload: snapshot})
+		}
+		return nil
+	})
+
+	h.RegisterHandler(models.AgentMsgDirectoryDelta, func(msg *models.Message, c *Connection) error {
+		payloadMap, ok := msg.Payload.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("invalid directory delta payload")
+		}
+		delta, requestFull, err := h.Snapshots.ApplyDelta(c.Id, payloadMap)
+		if err != nil {
+			return err
+		}
+		if requestFull {
+			fmt.Printf("Directory delta from %s does not apply to the master's copy, asking for a full snapshot\n", c.Id)
+			h.enqueue(c, transfer.Outbound{Msg: &models.Message{Type: models.MasterMsgSnapshotRequest, Payload: map[string]interface{}{}}})
+		}
+		if delta != nil && h.SSEHub != nil {
+			h.SSEHub.Broadcast(models.Message{Type: models.AgentMsgDirectoryDelta, Payload: delta})
+		}
+		return nil
+	})
+}
+
+// sendCredit tells a relay source how many chunks of the stream it may have sent in total
+func (h *WSHub) sendCredit(source *Connection, transferID string, granted uint64) {
+	h.enqueue(source, transfer.Outbound{Msg: &models.Message{
+		Type: models.MasterMsgTransferCredit,
+		Payload: map[string]interface{}{
+			"connection_id": transferID,
+			"granted":       granted,
+		},
+	}})
+}
+
+// distributionStatus handles a transfer status sent for a distribution's stream: the source
+// starting, finishing or failing it, or one destination failing to complete it
+func (h *WSHub) distributionStatus(c *Connection, distributionID, status string, payloadMap map[string]interface{}) {
+	distributor := h.TransferManager.Distributor()
+	reason, _ := payloadMap["reason"].(string)
+	total, _ := payloadMap["total_bytes"].(float64)
+	if role, _ := payloadMap["role"].(string); role == models.TransferRoleDestination {
+		if status == "transfer_failed" {
+			distributor.Reject(distributionID, c.Id, reason, corruptPaths(payloadMap))
+		}
+		return
+	}
+	switch status {
+	case "initiated", "running":
+		distributor.SourceRunning(distributionID, c.Id, int64(total))
+	case "completed":
+		// Every receiver must have its last chunks before it verifies the manifest
+		h.waitRelayed(c)
+		distributor.SourceCompleted(distributionID, c.Id, int64(total), payloadMap["manifest"], c.SigningKey)
+	case "transfer_failed":
+		distributor.SourceFailed(distributionID, c.Id, reason)
+	}
+}
+
+// corruptPaths reads the files a destination could not verify from its transfer_failed status
+func corruptPaths(payloadMap map[string]interface{}) []string {
+	var paths []string
+	if raw, ok := payloadMap["corrupt_paths"].([]interface{}); ok {
+		for _, p := range raw {
+			if path, ok := p.(string); ok {
+				paths = append(paths, path)
+			}
+		}
+	}
+	return paths
+}
+
+// recordHostMetrics caches the reading on the connection and appends it to the history store
+func (h *WSHub) recordHostMetrics(c *Connection, hostMetrics map[string]interface{}) {
+	h.Mutex.Lock()
+	c.LastMetrics = hostMetrics
+	c.LastMetricsAt = time.Now()
+	h.Mutex.Unlock()
+	if h.Metrics != nil {
+		h.Metrics.Record(c.Id, sampleFromHostMetrics(hostMetrics))
+	}
+}
+
+// sampleFromHostMetrics reads a heartbeat's host_metrics. The master's clock is used
+// for the timestamp so series stay ordered even when agent clocks drift.
+func sampleFromHostMetrics(hostMetrics map[string]interface{}) metrics.Sample {
+	sample := metrics.Sample{Timestamp: time.Now()}
+	sample.CPUUsage, _ = hostMetrics["cpu_usage"].(float64)
+	sample.MemoryUsage, _ = hostMetrics["memory_usage"].(float64)
+	sample.DiskUsage, _ = hostMetrics["disk_usage"].(float64)
+	if uptime, ok := hostMetrics["uptime"].(float64); ok && uptime > 0 {
+		sample.Uptime = uint64(uptime)
+	}
+	return sample
 }
@@ -0,0 +1,76 @@
+package ws
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrInvalidLabels   = errors.New("invalid labels")
+	ErrInvalidSelector = errors.New("invalid label selector")
+)
+
+// SetLabels replaces the labels of a known agent and persists them. It reports whether the agent is known.
+func (h *WSHub) SetLabels(agentID string, labels map[string]string) (bool, error) {
+	for key, value := range labels {
+		if !validLabel(key) || (value != "" && !validLabel(value)) {
+			return false, fmt.Errorf("%w: %q=%q, keys and values cannot hold spaces, commas or '='", ErrInvalidLabels, key, value)
+		}
+	}
+	h.Mutex.Lock()
+	c := h.Connections[agentID]
+	if c == nil || c.Name == "frontend" {
+		h.Mutex.Unlock()
+		return false, nil
+	}
+	c.Labels = maps.Clone(labels)
+	h.Mutex.Unlock()
+	h.persistConnection(c)
+	return true, nil
+}
+
+// MatchingAgents returns the known agents, online or not, whose labels include every pair of the selector
+func (h *WSHub) MatchingAgents(selector map[string]string) []string {
+	h.Mutex.RLock()
+	var ids []string
+	for id, c := range h.Connections {
+		if c.Name == "frontend" || id == "" {
+			continue
+		}
+		matches := true
+		for key, value := range selector {
+			if actual, ok := c.Labels[key]; !ok || actual != value {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			ids = append(ids, id)
+		}
+	}
+	h.Mutex.RUnlock()
+	sort.Strings(ids)
+	return ids
+}
+
+// ParseSelector reads a selector such as "env=prod,region=eu". A key alone matches agents that
+// have the label with an empty value.
+func ParseSelector(selector string) (map[string]string, error) {
+	pairs := make(map[string]string)
+	for _, term := range strings.Split(selector, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(term), "=")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if !validLabel(key) || (value != "" && !validLabel(value)) {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidSelector, selector)
+		}
+		pairs[key] = value
+	}
+	return pairs, nil
+}
+
+func validLabel(s string) bool {
+	return s != "" && !strings.ContainsAny(s, " \t,=")
+}
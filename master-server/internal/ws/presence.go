@@ -0,0 +1,74 @@
+package ws
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/The-Promised-Neverland/master-server/internal/models"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// DefaultHeartbeatInterval is how often agents that do not announce their interval are
+	// expected to send agent_metrics
+	DefaultHeartbeatInterval = 3 * time.Second
+	// staleHeartbeats is how many heartbeats an agent may miss before its connection is
+	// presumed half-open
+	staleHeartbeats = 5
+	// sweepInterval is how often connections are checked for staleness
+	sweepInterval = time.Second
+)
+
+// staleAfter is how long the agent may stay silent; the caller holds WSHub.Mutex
+func (c *Connection) staleAfter() time.Duration {
+	return staleHeartbeats * c.Heartbeat
+}
+
+// sweepStale closes stale agent connections every sweepInterval until the hub is done
+func (h *WSHub) sweepStale() {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		h.sweep()
+	}
+}
+
+// sweep closes agent connections silent for longer than their stale window, so a half-open
+// TCP connection goes offline without waiting for the read deadline
+func (h *WSHub) sweep() {
+	var stale []*Connection
+	var conns []*websocket.Conn
+	h.Mutex.RLock()
+	now := h.now()
+	for _, c := range h.Connections {
+		if c.Conn != nil && c.Name != "frontend" && now.Sub(c.LastSeen) > c.staleAfter() {
+			stale = append(stale, c)
+			conns = append(conns, c.Conn)
+		}
+	}
+	h.Mutex.RUnlock()
+	for i, c := range stale {
+		fmt.Printf("Agent %s silent for %v, marking offline\n", c.Id, now.Sub(c.LastSeen).Round(time.Second))
+		h.closeConnection(c, conns[i], models.PresenceReasonTimeout)
+	}
+}
+
+// publishPresence sends agent_online or agent_offline to SSE clients
+func (h *WSHub) publishPresence(c *Connection, msgType string, reason string) {
+	if h.SSEHub == nil || c.Id == "" || c.Name == "frontend" {
+		return
+	}
+	h.Mutex.RLock()
+	event := models.PresenceEvent{
+		AgentID:   c.Id,
+		Name:      c.Name,
+		Reason:    reason,
+		LastSeen:  c.LastSeen,
+		Timestamp: time.Now(),
+	}
+	h.Mutex.RUnlock()
+	h.SSEHub.Broadcast(models.Message{
+		Type:    msgType,
+		Payload: event,
+	})
+}
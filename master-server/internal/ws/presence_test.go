@@ -0,0 +1,154 @@
+package ws
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/The-Promised-Neverland/master-server/internal/registry"
+	"github.com/The-Promised-Neverland/master-server/internal/snapshot"
+	"github.com/gorilla/websocket"
+)
+
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// connectAgent connects an agent announcing heartbeat (0 for none) to h and returns the
+// agent's side of the WebSocket
+func connectAgent(t *testing.T, h *WSHub, id string, heartbeat time.Duration) *websocket.Conn {
+	t.Helper()
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade: %v", err)
+			return
+		}
+		h.Connect("agent-"+id, id, "Linux", "", "", nil, nil, heartbeat, conn)
+	}))
+	t.Cleanup(server.Close)
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	waitFor(t, func() bool { return h.GetConnection(id) != nil })
+	return client
+}
+
+func newTestHub(t *testing.T, clock *fakeClock, heartbeat time.Duration) *WSHub {
+	t.Helper()
+	snapshots, err := snapshot.NewStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewWSHub(nil, registry.NewMemoryStore(), nil, snapshots, nil)
+	h.Mutex.Lock()
+	h.now = clock.Now
+	h.HeartbeatInterval = heartbeat
+	h.Mutex.Unlock()
+	return h
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met within 2s")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func (h *WSHub) online(id string) bool {
+	h.Mutex.RLock()
+	c := h.Connections[id]
+	h.Mutex.RUnlock()
+	if c == nil {
+		return false
+	}
+	c.ConnMutex.RLock()
+	defer c.ConnMutex.RUnlock()
+	return c.Conn != nil
+}
+
+func (h *WSHub) lastSeen(id string) time.Time {
+	h.Mutex.RLock()
+	defer h.Mutex.RUnlock()
+	return h.Connections[id].LastSeen
+}
+
+func TestSweepStale(t *testing.T) {
+	tests := []struct {
+		name       string
+		heartbeat  time.Duration // announced by the agent, 0 for the hub's default
+		hubDefault time.Duration
+		silentOK   time.Duration // still online after this much silence
+		silentBad  time.Duration // offline after this much
+	}{
+		{"hub default", 0, DefaultHeartbeatInterval, 15 * time.Second, 16 * time.Second},
+		{"configured hub default", 0, 10 * time.Second, 50 * time.Second, 51 * time.Second},
+		{"announced interval", 30 * time.Second, DefaultHeartbeatInterval, 150 * time.Second, 151 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := &fakeClock{now: time.Unix(1_700_000_000, 0)}
+			h := newTestHub(t, clock, tt.hubDefault)
+			connectAgent(t, h, "a1", tt.heartbeat)
+
+			clock.Advance(tt.silentOK)
+			h.sweep()
+			if !h.online("a1") {
+				t.Fatalf("agent went offline after %v of silence", tt.silentOK)
+			}
+			clock.Advance(tt.silentBad - tt.silentOK)
+			h.sweep()
+			if h.online("a1") {
+				t.Fatalf("agent still online after %v of silence", tt.silentBad)
+			}
+		})
+	}
+}
+
+func TestBinaryFramesKeepAgentOnline(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1_700_000_000, 0)}
+	h := newTestHub(t, clock, DefaultHeartbeatInterval)
+	client := connectAgent(t, h, "a1", 0)
+
+	// A relay source busy sending chunks: no heartbeat gets through, but frames keep coming
+	for i := 0; i < 5; i++ {
+		clock.Advance(10 * time.Second)
+		seenBefore := h.lastSeen("a1")
+		if err := client.WriteMessage(websocket.BinaryMessage, []byte("not a frame")); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		waitFor(t, func() bool { return h.lastSeen("a1").After(seenBefore) })
+		h.sweep()
+		if !h.online("a1") {
+			t.Fatalf("agent sending binary frames marked offline after %d chunks", i+1)
+		}
+	}
+	clock.Advance(16 * time.Second)
+	h.sweep()
+	if h.online("a1") {
+		t.Fatal("agent still online after the frames stopped")
+	}
+}
@@ -2,6 +2,7 @@ package ws
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"time"
 
@@ -15,36 +16,105 @@ const (
 	pongWait       = 60 * time.Second
 	pingPeriod     = 30 * time.Second
 	writeWait      = 10 * time.Second
+
+	relayDrainTimeout = 5 * time.Second
+	// relayStallTimeout bounds how long a chunk waits for room in the destination's send
+	// channel. Credit keeps it from filling, so a stall means the destination is stuck.
+	relayStallTimeout = 30 * time.Second
 )
 
 func (h *WSHub) DataStreamPump(c *Connection) {
 	for {
 		select {
 		case chunk := <-c.StreamCh:
-			if c.RelayTo == "" {
-				continue
-			}
-			fmt.Printf("Transfer in progress... %s -> %s: %d bytes\n", c.Id, c.RelayTo, len(chunk))
-			h.Mutex.RLock()
-			destConn := h.Connections[c.RelayTo]
-			h.Mutex.RUnlock()
-			if destConn == nil {
-				continue
-			}
-			select {
-			case destConn.SendCh <- transfer.Outbound{Binary: chunk}:
-			default:
-				fmt.Printf("Send channel full for %s\n", c.RelayTo)
-			}
+			h.relayChunk(c, chunk)
+			c.streamOut.Add(1)
+		case <-c.Ctx.Done():
+			return
+		}
+	}
+}
+
+// relayChunk forwards a frame unchanged to the destination of its stream, or to every
+// receiver of a distribution. Frames of streams that are not (or no longer) relayed are dropped.
+func (h *WSHub) relayChunk(c *Connection, chunk []byte) {
+	frame, err := transfer.DecodeFrame(chunk)
+	if err != nil {
+		fmt.Printf("Dropping binary message from %s: %v\n", c.Id, err)
+		return
+	}
+	relayTo, skipped := c.relayFrame(frame)
+	if relayTo == "" {
+		h.fanOutChunk(c, frame, chunk)
+		return
+	}
+	if skipped > 0 {
+		fmt.Printf("[RELAY] Stream %s from %s skipped %d chunks before seq %d\n", frame.StreamID, c.Id, skipped, frame.Seq)
+	}
+	if h.forwardChunk(c, relayTo, frame, chunk) {
+		h.TransferManager.Registry().AddBytes(frame.StreamID, len(frame.Payload))
+	}
+}
+
+// fanOutChunk copies a frame of a distribution to each destination still receiving it. One
+// that stalls is dropped from the job so the others keep going; one that went offline is
+// failed by AgentDisconnected.
+func (h *WSHub) fanOutChunk(c *Connection, frame transfer.Frame, chunk []byte) {
+	distributor := h.TransferManager.Distributor()
+	receivers := distributor.Receivers(frame.StreamID, c.Id)
+	if len(receivers) == 0 {
+		return
+	}
+	for _, agentID := range receivers {
+		if !h.forwardChunk(c, agentID, frame, chunk) && c.Ctx.Err() == nil && h.GetConnection(agentID) != nil {
+			distributor.Drop(frame.StreamID, agentID, fmt.Sprintf("relayed chunk %d could not be delivered", frame.Seq))
+		}
+	}
+	distributor.Relayed(frame.StreamID, len(frame.Payload))
+}
+
+// forwardChunk queues a relayed frame for an agent and reports whether it was queued
+func (h *WSHub) forwardChunk(c *Connection, agentID string, frame transfer.Frame, chunk []byte) bool {
+	h.Mutex.RLock()
+	destConn := h.Connections[agentID]
+	h.Mutex.RUnlock()
+	if destConn == nil {
+		return false
+	}
+	select {
+	case destConn.SendCh <- transfer.Outbound{Binary: chunk}:
+		return true
+	case <-c.Ctx.Done():
+	case <-destConn.Ctx.Done():
+	case <-time.After(relayStallTimeout):
+		h.Dropped.Stream.Add(1)
+		fmt.Printf("Send channel for %s stalled, dropping chunk %d of stream %s\n", agentID, frame.Seq, frame.StreamID)
+	}
+	return false
+}
+
+// waitRelayed blocks until the chunks read before the message being processed have been
+// relayed. Chunks and messages go through separate pumps, so without it a final transfer
+// status could overtake its last chunks.
+func (h *WSHub) waitRelayed(c *Connection) {
+	read := c.streamIn.Load()
+	deadline := time.Now().Add(relayDrainTimeout)
+	for c.streamOut.Load() < read && time.Now().Before(deadline) {
+		select {
 		case <-c.Ctx.Done():
 			return
+		case <-time.After(10 * time.Millisecond):
 		}
 	}
 }
 
 func (h *WSHub) ReadPump(c *Connection) {
-	defer h.closeConnection(c)
+	reason := models.PresenceReasonReadError
 	c.ConnMutex.RLock()
+	session := c.Conn
+	defer func() {
+		h.closeConnection(c, session, reason)
+	}()
 	if c.Conn == nil {
 		c.ConnMutex.RUnlock()
 		return
@@ -69,27 +139,36 @@ func (h *WSHub) ReadPump(c *Connection) {
 				if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 					fmt.Printf("WebSocket read error for %s: %v\n", c.Id, err)
 				}
-				c.Cancel()
+				var closeErr *websocket.CloseError
+				if errors.As(err, &closeErr) && closeErr.Code != websocket.CloseAbnormalClosure {
+					reason = models.PresenceReasonCloseFrame
+				}
 				return
 			}
+			// Any frame shows the agent is alive: during a large relay its heartbeats wait
+			// behind the binary chunks in its send queue
+			c.ConnMutex.RLock()
+			if c.Conn != nil {
+				c.Conn.SetReadDeadline(time.Now().Add(pongWait))
+			}
+			c.ConnMutex.RUnlock()
+			h.Mutex.Lock()
+			c.LastSeen = h.now()
+			persist := time.Since(c.persistedAt) >= registryFlushInterval
+			h.Mutex.Unlock()
+			if persist {
+				h.persistConnection(c)
+			}
 			switch msgType {
 			case websocket.BinaryMessage:
+				// Relay sources only send what their destination granted credit for, so
+				// blocking here pushes back on the source instead of dropping its chunks
 				select {
 				case c.StreamCh <- msgBytes:
+					c.streamIn.Add(1)
 				case <-c.Ctx.Done():
-				case <-time.After(time.Second * 5): // Handling backpressure in lazy way
-					fmt.Println("Timed out trying to send message to StreamCh")
-					return
 				}
 			case websocket.TextMessage:
-				c.ConnMutex.RLock()
-				if c.Conn != nil {
-					c.Conn.SetReadDeadline(time.Now().Add(pongWait))
-				}
-				c.ConnMutex.RUnlock()
-				h.Mutex.Lock()
-				c.LastSeen = time.Now()
-				h.Mutex.Unlock()
 				var msg models.Message
 				if err := json.Unmarshal(msgBytes, &msg); err != nil {
 					fmt.Printf("Failed to unmarshal message from %s: %v\n", c.Id, err)
@@ -101,6 +180,7 @@ func (h *WSHub) ReadPump(c *Connection) {
 					return
 				default:
 					// TODO: Handling backpressure
+					h.Dropped.Incoming.Add(1)
 					fmt.Printf("Incoming channel full for %s, dropping message\n", c.Id)
 				}
 			default:
@@ -111,9 +191,12 @@ func (h *WSHub) ReadPump(c *Connection) {
 
 func (h *WSHub) WritePump(c *Connection) {
 	ticker := time.NewTicker(pingPeriod)
+	c.ConnMutex.RLock()
+	session := c.Conn
+	c.ConnMutex.RUnlock()
 	defer func() {
 		ticker.Stop()
-		h.closeConnection(c)
+		h.closeConnection(c, session, models.PresenceReasonWriteError)
 	}()
 	for {
 		select {
@@ -135,7 +218,11 @@ func (h *WSHub) WritePump(c *Connection) {
 			conn.SetWriteDeadline(time.Now().Add(writeWait))
 			c.ConnMutex.RUnlock()
 			if msg.Msg != nil {
-				bytes, err := json.Marshal(*msg.Msg)
+				out := *msg.Msg
+				if out.SentAt == 0 {
+					out.SentAt = time.Now().UnixMilli()
+				}
+				bytes, err := json.Marshal(out)
 				if err != nil {
 					fmt.Printf("Marshal error for %s: %v\n", c.Id, err)
 					continue
@@ -194,7 +281,7 @@ func (h *WSHub) ProcessorPump(c *Connection) {
 				} else {
 					fmt.Printf("No handler registered for message type: %s from %s\n", msgReceived.Type, c.Id)
 				}
-				if h.SSEHub != nil {
+				if h.SSEHub != nil && !unpublished[msgReceived.Type] {
 					h.SSEHub.Broadcast(msgReceived)
 				}
 			}
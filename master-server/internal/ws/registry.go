@@ -0,0 +1,76 @@
+package ws
+
+import (
+	"fmt"
+	"maps"
+	"time"
+
+	"github.com/The-Promised-Neverland/master-server/internal/registry"
+)
+
+// LastSeen changes on every message, so heartbeats only reach the store this often
+const registryFlushInterval = time.Minute
+
+// restoreRegistry loads known agents as offline connections so they are listed before they reconnect
+func (h *WSHub) restoreRegistry() {
+	if h.Registry == nil {
+		return
+	}
+	records := h.Registry.List()
+	h.Mutex.Lock()
+	defer h.Mutex.Unlock()
+	for _, r := range records {
+		if _, exists := h.Connections[r.ID]; exists || r.ID == "" {
+			continue
+		}
+		connection := NewConnection(r.Name, r.ID, r.OS, nil)
+		connection.LastSeen = r.LastSeen
+		connection.DisconnectedSince = r.LastSeen
+		connection.PublicEndpoint = r.PublicEndpoint
+		connection.CredentialID = r.CredentialID
+		connection.Labels = r.Labels
+		connection.persistedAt = time.Now()
+		h.Connections[r.ID] = connection
+	}
+	fmt.Printf("Restored %d agents from registry\n", len(records))
+}
+
+// persistConnection writes the connection's last-known state to the registry store
+func (h *WSHub) persistConnection(c *Connection) {
+	if h.Registry == nil || c.Id == "" || c.Name == "frontend" {
+		return
+	}
+	h.Mutex.Lock()
+	c.persistedAt = time.Now()
+	record := registry.AgentRecord{
+		ID:             c.Id,
+		Name:           c.Name,
+		OS:             c.OS,
+		LastSeen:       c.LastSeen,
+		PublicEndpoint: c.PublicEndpoint,
+		CredentialID:   c.CredentialID,
+		Labels:         maps.Clone(c.Labels),
+	}
+	h.Mutex.Unlock()
+	if err := h.Registry.Upsert(record); err != nil {
+		fmt.Printf("Failed to persist agent %s: %v\n", c.Id, err)
+	}
+}
+
+// forgetAgent removes an uninstalled agent's registry record, stored metrics and directory snapshot
+func (h *WSHub) forgetAgent(agentID string) {
+	if h.Registry != nil {
+		if err := h.Registry.Delete(agentID); err != nil {
+			fmt.Printf("Failed to remove agent %s from registry: %v\n", agentID, err)
+		}
+	}
+	if h.Metrics != nil {
+		if err := h.Metrics.Delete(agentID); err != nil {
+			fmt.Printf("Failed to remove metrics of agent %s: %v\n", agentID, err)
+		}
+	}
+	if err := h.Snapshots.Delete(agentID); err != nil {
+		fmt.Printf("Failed to remove directory snapshot of agent %s: %v\n", agentID, err)
+	}
+	fmt.Printf("Agent %s uninstalled, removed from registry\n", agentID)
+}
@@ -0,0 +1,136 @@
+package ws
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/The-Promised-Neverland/master-server/internal/metrics"
+	"github.com/The-Promised-Neverland/master-server/internal/models"
+	"github.com/The-Promised-Neverland/master-server/internal/registry"
+	"github.com/The-Promised-Neverland/master-server/internal/snapshot"
+)
+
+func TestRestoreRegistry(t *testing.T) {
+	lastSeen := time.Unix(1_700_000_000, 0)
+	store := registry.NewMemoryStore()
+	store.Upsert(registry.AgentRecord{
+		ID:             "a1",
+		Name:           "agent-a1",
+		OS:             "Linux",
+		LastSeen:       lastSeen,
+		PublicEndpoint: "203.0.113.7:4000",
+		Labels:         map[string]string{"env": "prod"},
+	})
+	snapshots, err := snapshot.NewStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewWSHub(nil, store, nil, snapshots, nil)
+
+	c := h.Connections["a1"]
+	if c == nil {
+		t.Fatal("agent a1 not restored")
+	}
+	if c.Conn != nil {
+		t.Error("restored agent is online")
+	}
+	if c.Name != "agent-a1" || c.OS != "Linux" || c.PublicEndpoint != "203.0.113.7:4000" || c.Labels["env"] != "prod" {
+		t.Errorf("restored agent = %+v", c)
+	}
+	if !c.LastSeen.Equal(lastSeen) || !c.DisconnectedSince.Equal(lastSeen) {
+		t.Errorf("LastSeen = %v, DisconnectedSince = %v, want %v", c.LastSeen, c.DisconnectedSince, lastSeen)
+	}
+}
+
+func TestPersistConnection(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1_700_000_000, 0)}
+	h := newTestHub(t, clock, DefaultHeartbeatInterval)
+	client := connectAgent(t, h, "a1", 0)
+
+	records := h.Registry.List()
+	if len(records) != 1 || records[0].ID != "a1" || records[0].Name != "agent-a1" {
+		t.Fatalf("records after connect = %+v", records)
+	}
+	clock.Advance(time.Second)
+	client.Close()
+	waitFor(t, func() bool { return !h.online("a1") })
+	records = h.Registry.List()
+	if len(records) != 1 || !records[0].LastSeen.Equal(clock.Now().Add(-time.Second)) {
+		t.Fatalf("records after disconnect = %+v", records)
+	}
+}
+
+func TestUninstallForgetsAgent(t *testing.T) {
+	tests := []struct {
+		name   string
+		status string // of the agent's answer to the uninstall
+		forget bool
+	}{
+		{"accepted", models.CommandStatusAccepted, true},
+		{"ok", models.CommandStatusOK, true},
+		{"failed", models.CommandStatusError, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHub(t, &fakeClock{now: time.Unix(1_700_000_000, 0)}, DefaultHeartbeatInterval)
+			h.RegisterDefaultHandlers()
+			dir := t.TempDir()
+			metricsStore, err := metrics.NewStore(dir, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			h.Metrics = metricsStore
+			metricsStore.Record("a1", metrics.Sample{CPUUsage: 10})
+			if err := metricsStore.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			_, err = h.Snapshots.AddSnapshot("a1", map[string]interface{}{
+				"version":   1,
+				"directory": map[string]interface{}{"files": []map[string]interface{}{{"name": "a.txt", "path": "a.txt", "type": "file"}}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			client := connectAgent(t, h, "a1", 0)
+
+			cmd, err := h.SendCommand("a1", models.Message{Type: models.MasterMsgAgentUninstall})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = client.WriteJSON(models.Message{
+				Type:    models.AgentMsgCommandResult,
+				ReplyTo: cmd.ID,
+				Payload: map[string]string{"command": models.MasterMsgAgentUninstall, "status": tt.status},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			waitFor(t, func() bool { return h.Commands.Get(cmd.ID).Status == tt.status })
+			client.Close()
+			waitFor(t, func() bool { return !h.online("a1") })
+			if tt.forget {
+				// the snapshot goes last
+				waitFor(t, func() bool { return h.Snapshots.Get("a1") == nil })
+			}
+
+			h.Mutex.RLock()
+			_, listed := h.Connections["a1"]
+			h.Mutex.RUnlock()
+			_, hasMetrics := metricsStore.Latest("a1")
+			hasSnapshot := h.Snapshots.Get("a1") != nil
+			_, statErr := os.Stat(filepath.Join(dir, "a1.json"))
+			if tt.forget {
+				if listed || len(h.Registry.List()) != 0 || hasMetrics || hasSnapshot || !errors.Is(statErr, os.ErrNotExist) {
+					t.Fatalf("uninstalled agent kept: listed=%v records=%v metrics=%v snapshot=%v file=%v",
+						listed, h.Registry.List(), hasMetrics, hasSnapshot, statErr)
+				}
+			} else if !listed || len(h.Registry.List()) != 1 || !hasMetrics || !hasSnapshot || statErr != nil {
+				t.Fatalf("agent whose uninstall failed was removed: listed=%v records=%v metrics=%v snapshot=%v file=%v",
+					listed, h.Registry.List(), hasMetrics, hasSnapshot, statErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package ws
+
+import (
+	"errors"
+	"time"
+
+	"github.com/The-Promised-Neverland/master-server/internal/models"
+	"github.com/The-Promised-Neverland/master-server/internal/transfer"
+	"github.com/google/uuid"
+)
+
+var (
+	ErrAgentOffline   = errors.New("agent is offline")
+	ErrRequestTimeout = errors.New("agent did not answer in time")
+)
+
+type pendingRequest struct {
+	agentID string
+	replyCh chan map[string]interface{}
+}
+
+// Request sends msgType to the agent with a fresh request_id in the payload and waits
+// up to timeout for the reply carrying the same request_id (see resolveRequest).
+func (h *WSHub) Request(agentID string, msgType string, payload map[string]interface{}, timeout time.Duration) (map[string]interface{}, error) {
+	h.Mutex.RLock()
+	c := h.Connections[agentID]
+	online := c != nil && c.Conn != nil
+	h.Mutex.RUnlock()
+	if !online {
+		return nil, ErrAgentOffline
+	}
+	if payload == nil {
+		payload = make(map[string]interface{})
+	}
+	requestID := uuid.New().String()
+	payload["request_id"] = requestID
+	pending := &pendingRequest{
+		agentID: agentID,
+		replyCh: make(chan map[string]interface{}, 1),
+	}
+	h.pendingMu.Lock()
+	h.pending[requestID] = pending
+	h.pendingMu.Unlock()
+	defer func() {
+		h.pendingMu.Lock()
+		delete(h.pending, requestID)
+		h.pendingMu.Unlock()
+	}()
+
+	h.Send(agentID, transfer.Outbound{Msg: &models.Message{Type: msgType, Payload: payload}})
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case reply := <-pending.replyCh:
+		return reply, nil
+	case <-timer.C:
+		return nil, ErrRequestTimeout
+	}
+}
+
+// resolveRequest hands a reply to the waiting Request. Replies from another agent
+// than the one asked, or for requests that already timed out, are ignored.
+func (h *WSHub) resolveRequest(agentID string, payload map[string]interface{}) bool {
+	requestID, _ := payload["request_id"].(string)
+	if requestID == "" {
+		return false
+	}
+	h.pendingMu.Lock()
+	pending := h.pending[requestID]
+	h.pendingMu.Unlock()
+	if pending == nil || pending.agentID != agentID {
+		return false
+	}
+	select {
+	case pending.replyCh <- payload:
+	default:
+	}
+	return true
+}
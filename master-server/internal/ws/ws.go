@@ -4,51 +4,185 @@ import (
 	"context"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/The-Promised-Neverland/master-server/internal/command"
+	"github.com/The-Promised-Neverland/master-server/internal/metrics"
 	"github.com/The-Promised-Neverland/master-server/internal/models"
+	"github.com/The-Promised-Neverland/master-server/internal/registry"
+	"github.com/The-Promised-Neverland/master-server/internal/snapshot"
 	"github.com/The-Promised-Neverland/master-server/internal/sse"
+	"github.com/The-Promised-Neverland/master-server/internal/syncpair"
+	"github.com/The-Promised-Neverland/master-server/internal/task"
 	"github.com/The-Promised-Neverland/master-server/internal/transfer"
 	"github.com/gorilla/websocket"
 )
 
+// DropCounters counts messages discarded because a connection channel was full
+type DropCounters struct {
+	Send     atomic.Uint64
+	Incoming atomic.Uint64
+	Stream   atomic.Uint64 // relayed chunks whose destination stalled
+}
+
 type WSHub struct {
 	Connections     map[string]*Connection
 	Mutex           sync.RWMutex
 	SSEHub          *sse.SSEHub
 	TransferManager *transfer.TransferManager
+	TaskManager     *task.TaskManager
+	Commands        *command.Tracker
+	Queue           *command.Queue
+	SyncPairs       *syncpair.Manager // set once the hub exists, see syncpair.NewManager
+	Snapshots       *snapshot.Store
+	Registry        registry.Store
+	Metrics         *metrics.Store
 	Handlers        map[string]func(msg *models.Message, connection *Connection) error
+	Dropped         DropCounters
+	// HeartbeatInterval is expected of agents that do not announce theirs when connecting
+	HeartbeatInterval time.Duration
+	now               func() time.Time           // the clock LastSeen is compared against
+	pending           map[string]*pendingRequest // request_id -> waiting Request call
+	pendingMu         sync.Mutex
+	connectMu         sync.Mutex // serializes Connect so a replaced session is torn down before the next one starts
 }
 
-func NewWSHub(sseHub *sse.SSEHub) *WSHub {
+func NewWSHub(sseHub *sse.SSEHub, store registry.Store, metricsStore *metrics.Store, snapshots *snapshot.Store, queue *command.Queue) *WSHub {
 	hub := &WSHub{
-		Connections: make(map[string]*Connection),
-		SSEHub:      sseHub,
-		Handlers:    make(map[string]func(msg *models.Message, connection *Connection) error),
+		Connections:       make(map[string]*Connection),
+		SSEHub:            sseHub,
+		Registry:          store,
+		Metrics:           metricsStore,
+		Snapshots:         snapshots,
+		Queue:             queue,
+		Handlers:          make(map[string]func(msg *models.Message, connection *Connection) error),
+		pending:           make(map[string]*pendingRequest),
+		now:               time.Now,
+		HeartbeatInterval: DefaultHeartbeatInterval,
 	}
-	hub.TransferManager = transfer.NewTransferManager(hub, hub)
+	hub.TransferManager = transfer.NewTransferManager(hub, hub, sseHub)
+	hub.TaskManager = task.NewTaskManager(hub, sseHub)
+	hub.Commands = command.NewTracker(sseHub)
+	hub.restoreRegistry()
+	go hub.sweepStale()
 	return hub
 }
 
+// trackedCommands are the message types sent as commands: they get an ID and the
+// master waits for the agent's agent_command_result
+var trackedCommands = map[string]bool{
+	models.MasterMsgRestartAgent:       true,
+	models.MasterMsgAgentUninstall:     true,
+	models.MasterMsgTaskAssignment:     true,
+	models.MasterMsgP2PTransferStart:   true,
+	models.MasterMsgRelayTransferStart: true,
+	models.MasterMsgRelayFallback:      true,
+}
+
+// queuedCommands are held for a known but offline agent and delivered when it reconnects.
+// Tasks and transfers are not: they are only dispatched to agents that are online.
+var queuedCommands = map[string]bool{
+	models.MasterMsgRestartAgent:   true,
+	models.MasterMsgAgentUninstall: true,
+}
+
+// unpublished are agent messages too frequent or internal to broadcast on SSE
+var unpublished = map[string]bool{
+	models.AgentMsgTransferCredit:    true,
+	models.AgentMsgSyncChanges:       true,
+	models.AgentMsgSyncAck:           true,
+	models.AgentMsgSyncPull:          true,
+	models.AgentMsgSyncReport:        true, // published as sync_update
+	models.AgentMsgDirectorySnapshot: true, // published once all its parts arrived
+	models.AgentMsgDirectoryDelta:    true, // published once applied
+}
+
 // Send implements transfer.MessageSender interface
 func (h *WSHub) Send(agentID string, msg transfer.Outbound) {
+	if msg.Msg != nil && msg.Msg.ID == "" && trackedCommands[msg.Msg.Type] {
+		h.SendCommand(agentID, *msg.Msg)
+		return
+	}
 	h.Mutex.RLock()
 	c := h.Connections[agentID]
 	h.Mutex.RUnlock()
 	if c == nil || c.Conn == nil {
 		return
 	}
+	h.enqueue(c, msg)
+}
+
+// SendCommand sends msg with a new command ID and returns the tracked command.
+// Queueable commands for an offline agent are queued instead and come back with status queued.
+func (h *WSHub) SendCommand(agentID string, msg models.Message) (*models.Command, error) {
+	h.Mutex.RLock()
+	c := h.Connections[agentID]
+	online := c != nil && c.Conn != nil
+	h.Mutex.RUnlock()
+	if c == nil || (!online && (h.Queue == nil || !queuedCommands[msg.Type])) {
+		return nil, ErrAgentOffline
+	}
+	if !online {
+		cmd, err := h.Queue.Enqueue(agentID, msg)
+		if err != nil {
+			return nil, err
+		}
+		h.Mutex.RLock()
+		reconnected := c.Conn != nil
+		h.Mutex.RUnlock()
+		if reconnected {
+			// the agent came back while the command was being queued
+			h.deliverQueued(c)
+			if delivered := h.Commands.Get(cmd.ID); delivered != nil {
+				return delivered, nil
+			}
+		}
+		return cmd, nil
+	}
+	return h.sendTracked(c, msg, h.Commands.Track(agentID, msg.Type, command.DefaultTimeout))
+}
+
+// deliverQueued sends the commands queued for c while it was offline, in order
+func (h *WSHub) deliverQueued(c *Connection) {
+	if h.Queue == nil {
+		return
+	}
+	for _, qc := range h.Queue.Drain(c.Id) {
+		fmt.Printf("[COMMAND] Delivering queued %s (%s) to agent %s\n", qc.ID, qc.Type, c.Id)
+		h.sendTracked(c, models.Message{Type: qc.Type, Payload: qc.Payload}, h.Commands.TrackDelivered(qc.Command, command.DefaultTimeout))
+	}
+}
+
+func (h *WSHub) sendTracked(c *Connection, msg models.Message, cmd *models.Command) (*models.Command, error) {
+	msg.ID = cmd.ID
+	if !h.enqueue(c, transfer.Outbound{Msg: &msg}) {
+		h.Commands.Fail(cmd.ID, "send channel full")
+		return h.Commands.Get(cmd.ID), nil
+	}
+	return cmd, nil
+}
+
+func (h *WSHub) enqueue(c *Connection, msg transfer.Outbound) bool {
 	select {
 	case c.SendCh <- msg:
+		return true
 	default:
-		fmt.Printf("Send channel full for %s\n", agentID)
+		h.Dropped.Send.Add(1)
+		fmt.Printf("Send channel full for %s\n", c.Id)
+		return false
 	}
 }
 
+// GetConnection returns the agent's connection while it is online, or nil
 func (h *WSHub) GetConnection(agentID string) transfer.ConnectionInfo {
 	h.Mutex.RLock()
 	defer h.Mutex.RUnlock()
-	return h.Connections[agentID]
+	c := h.Connections[agentID]
+	if c == nil || c.Conn == nil {
+		return nil
+	}
+	return c
 }
 
 func (h *WSHub) RegisterHandler(msgType string, handler func(msg *models.Message, connection *Connection) error) {
@@ -57,33 +191,65 @@ func (h *WSHub) RegisterHandler(msgType string, handler func(msg *models.Message
 	h.Handlers[msgType] = handler
 }
 
-// Registers or re-connects an agent
-func (h *WSHub) Connect(name string, id string, os string, conn *websocket.Conn) {
+// Registers or re-connects an agent. heartbeat is the interval the agent announced, 0 if none.
+func (h *WSHub) Connect(name string, id string, os string, credentialID string, signingKey string, codecs []string, encryption []string, heartbeat time.Duration, conn *websocket.Conn) {
+	if heartbeat <= 0 {
+		heartbeat = h.HeartbeatInterval
+	}
+	h.connectMu.Lock()
+	defer h.connectMu.Unlock()
 	h.Mutex.Lock()
+	existing, exists := h.Connections[id]
+	var previous *websocket.Conn
+	if exists {
+		previous = existing.Conn
+	}
+	h.Mutex.Unlock()
 	var connection *Connection
-	if existing, exists := h.Connections[id]; exists {
-		fmt.Printf("Reconnecting: %s\n", id)
-		existing.Cancel()
-		if existing.Conn != nil {
-			existing.Conn.Close()
+	if exists {
+		if previous != nil {
+			fmt.Printf("Replacing live connection: %s\n", id)
+			h.closeConnection(existing, previous, models.PresenceReasonReplaced)
+		} else {
+			fmt.Printf("Reconnecting: %s\n", id)
 		}
 		existing.wg.Wait()
+		ctx, cancel := context.WithCancel(context.Background())
+		h.Mutex.Lock()
+		existing.ConnMutex.Lock()
 		existing.Conn = conn
-		existing.LastSeen = time.Now()
+		existing.Codecs = codecs
+		existing.Encryption = encryption
+		existing.ConnMutex.Unlock()
+		existing.LastSeen = h.now()
+		existing.Heartbeat = heartbeat
+		existing.ConnectedSince = existing.LastSeen
+		existing.DisconnectedSince = time.Time{}
 		existing.Name = name
+		existing.CredentialID = credentialID
+		existing.SigningKey = signingKey
 		if os != "" {
 			existing.OS = os
 		}
-		ctx, cancel := context.WithCancel(context.Background())
 		existing.Ctx = ctx
 		existing.Cancel = cancel
+		h.Mutex.Unlock()
 		connection = existing
 	} else {
 		fmt.Printf("New connection: %s\n", id)
 		connection = NewConnection(name, id, os, conn)
+		connection.CredentialID = credentialID
+		connection.SigningKey = signingKey
+		connection.Codecs = codecs
+		connection.Encryption = encryption
+		connection.Heartbeat = heartbeat
+		connection.LastSeen = h.now()
+		h.Mutex.Lock()
 		h.Connections[id] = connection
+		h.Mutex.Unlock()
 	}
-	h.Mutex.Unlock()
+	h.persistConnection(connection)
+	h.publishPresence(connection, models.SSEMsgAgentOnline, models.PresenceReasonConnected)
 	connection.wg.Add(4)
 	go func() {
 		defer connection.wg.Done()
@@ -101,17 +267,43 @@ func (h *WSHub) Connect(name string, id string, os string, conn *websocket.Conn)
 		defer connection.wg.Done()
 		h.DataStreamPump(connection) // Start stream processing
 	}()
+	h.deliverQueued(connection)
+	if h.SyncPairs != nil {
+		h.SyncPairs.AgentConnected(id)
+	}
 }
 
-func (h *WSHub) closeConnection(c *Connection) {
-	c.Cancel()
-	if c.Conn != nil {
-		_ = c.Conn.Close()
+// closeConnection ends the session on conn. It is a no-op if c has already moved on
+// from conn, so every pump and the sweeper can call it and only the first reason counts.
+func (h *WSHub) closeConnection(c *Connection, conn *websocket.Conn, reason string) {
+	if conn == nil {
+		return
 	}
 	h.Mutex.Lock()
-	c.LastSeen = time.Now()
+	c.ConnMutex.Lock()
+	if c.Conn != conn {
+		c.ConnMutex.Unlock()
+		h.Mutex.Unlock()
+		return
+	}
 	c.Conn = nil
+	c.ConnMutex.Unlock()
+	c.ConnectedSince = time.Time{}
+	c.DisconnectedSince = time.Now()
+	lastSeen := c.LastSeen
+	cancel := c.Cancel
+	uninstalled := c.uninstalled
+	if uninstalled && h.Connections[c.Id] == c {
+		delete(h.Connections, c.Id)
+	}
 	h.Mutex.Unlock()
+	cancel()
+	_ = conn.Close()
+	if uninstalled {
+		h.forgetAgent(c.Id)
+	} else {
+		h.persistConnection(c)
+	}
 	msg := models.Message{
 		Type: "agent_disconnected",
 		Payload: map[string]string{
@@ -121,5 +313,12 @@ func (h *WSHub) closeConnection(c *Connection) {
 	if h.SSEHub != nil {
 		h.SSEHub.Broadcast(msg)
 	}
-	fmt.Printf("Disconnected: %s (Last seen %v)\n", c.Id, c.LastSeen)
+	h.publishPresence(c, models.SSEMsgAgentOffline, reason)
+	for _, transferID := range c.relayStreams() {
+		c.RemoveRelay(transferID)
+		h.TransferManager.GetRelayCoordinator().Finish(transferID)
+	}
+	h.TransferManager.AgentDisconnected(c.Id)
+	h.Snapshots.AgentDisconnected(c.Id)
+	fmt.Printf("Disconnected: %s, %s (Last seen %v)\n", c.Id, reason, lastSeen)
 }
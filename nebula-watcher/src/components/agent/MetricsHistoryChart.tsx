@@ -0,0 +1,86 @@
+import { useState } from "react";
+import { History, Loader2 } from "lucide-react";
+import {
+  CartesianGrid,
+  Legend,
+  Line,
+  LineChart,
+  ResponsiveContainer,
+  Tooltip,
+  XAxis,
+  YAxis,
+} from "recharts";
+import { Button } from "@/components/ui/button";
+import { useMetricsHistory } from "@/hooks/useAgents";
+
+const ranges = [
+  { label: "1h", seconds: 3600, step: "1m" },
+  { label: "24h", seconds: 86400, step: "15m" },
+  { label: "7d", seconds: 604800, step: "2h" },
+  { label: "30d", seconds: 2592000, step: "6h" },
+];
+
+interface MetricsHistoryChartProps {
+  agentId: string;
+}
+
+export function MetricsHistoryChart({ agentId }: MetricsHistoryChartProps) {
+  const [range, setRange] = useState(ranges[0]);
+  const { data: points = [], isLoading } = useMetricsHistory(agentId, range.seconds, range.step);
+
+  const formatTick = (timestamp: string) => {
+    const date = new Date(timestamp);
+    return range.seconds > 86400
+      ? date.toLocaleDateString([], { month: "short", day: "numeric" })
+      : date.toLocaleTimeString([], { hour: "2-digit", minute: "2-digit" });
+  };
+
+  return (
+    <div className="glass-card rounded-xl p-6">
+      <div className="flex items-center justify-between mb-6">
+        <div className="flex items-center gap-3">
+          <History className="h-5 w-5 text-primary" />
+          <h2 className="text-lg font-semibold">Metrics History</h2>
+        </div>
+        <div className="flex gap-1">
+          {ranges.map((r) => (
+            <Button
+              key={r.label}
+              variant={r.label === range.label ? "default" : "outline"}
+              size="sm"
+              onClick={() => setRange(r)}
+            >
+              {r.label}
+            </Button>
+          ))}
+        </div>
+      </div>
+
+      {isLoading ? (
+        <div className="flex items-center justify-center h-64">
+          <Loader2 className="h-8 w-8 text-primary animate-spin" />
+        </div>
+      ) : points.length === 0 ? (
+        <div className="flex items-center justify-center h-64 text-muted-foreground">
+          No history recorded for this range yet.
+        </div>
+      ) : (
+        <ResponsiveContainer width="100%" height={256}>
+          <LineChart data={points}>
+            <CartesianGrid strokeDasharray="3 3" className="stroke-border" />
+            <XAxis dataKey="timestamp" tickFormatter={formatTick} fontSize={12} />
+            <YAxis domain={[0, 100]} unit="%" fontSize={12} />
+            <Tooltip
+              labelFormatter={(label) => new Date(label).toLocaleString()}
+              formatter={(value: number) => `${value.toFixed(1)}%`}
+            />
+            <Legend />
+            <Line type="monotone" dataKey="cpu_usage" name="CPU" stroke="hsl(var(--primary))" dot={false} />
+            <Line type="monotone" dataKey="memory_usage" name="Memory" stroke="hsl(var(--warning))" dot={false} />
+            <Line type="monotone" dataKey="disk_usage" name="Disk" stroke="hsl(var(--success))" dot={false} />
+          </LineChart>
+        </ResponsiveContainer>
+      )}
+    </div>
+  );
+}
@@ -2,6 +2,7 @@ import type { EnvConfig } from "@/types";
 
 export const env: EnvConfig = {
   apiBaseUrl: import.meta.env.VITE_API_BASE_URL || "http://localhost:8430",
+  apiKey: import.meta.env.VITE_API_KEY || "",
   wsUrl: import.meta.env.VITE_WS_URL || "ws://localhost:8430/ws",
   wsRole: import.meta.env.VITE_WS_ROLE || "frontend",
   wsPingInterval: parseInt(import.meta.env.VITE_WS_PING_INTERVAL || "30000", 10),
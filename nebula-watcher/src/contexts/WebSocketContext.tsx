@@ -5,8 +5,10 @@ import type {
   WebSocketMessage,
   MetricsPayload,
   DirectorySnapshot,
+  DirectoryDelta,
   AgentWithStatus,
   AgentInfo,
+  PresenceEvent,
   TransferInfo,
   TransferStatusPayload,
 } from "@/types";
@@ -37,8 +39,8 @@ export function WebSocketProvider({ children }: { children: ReactNode }) {
 
       agentList.forEach((agent) => {
         const lastSeen = new Date(agent.agent_last_seen).getTime();
-        const isOnline = now - lastSeen < onlineThreshold;
-        
+        const isOnline = agent.online ?? now - lastSeen < onlineThreshold;
+
         const existing = newAgents.get(agent.agent_id);
         newAgents.set(agent.agent_id, {
           ...agent,
@@ -64,7 +66,8 @@ export function WebSocketProvider({ children }: { children: ReactNode }) {
       console.log("WebSocket message received:", message.type, message.payload);
       
       switch (message.type) {
-        case "agent_metrics": {
+        case "agent_metrics":
+        case "agent_metrics_response": {
           const payload = message.payload as MetricsPayload;
           console.log("Processing agent_metrics for:", payload.agent_id, payload);
           
@@ -100,12 +103,56 @@ export function WebSocketProvider({ children }: { children: ReactNode }) {
           });
           break;
         }
+        case "agent_online":
+        case "agent_offline": {
+          const payload = message.payload as PresenceEvent;
+          const isOnline = message.type === "agent_online";
+          setAgents((prev) => {
+            const existing = prev.get(payload.agent_id);
+            if (!existing) return prev;
+            return new Map(prev).set(payload.agent_id, {
+              ...existing,
+              agent_last_seen: payload.agent_last_seen,
+              online: isOnline,
+              connected_since: isOnline ? payload.timestamp : undefined,
+              disconnected_since: isOnline ? undefined : payload.timestamp,
+              isOnline,
+            });
+          });
+          break;
+        }
         case "agent_directory_snapshot": {
           const payload = message.payload as DirectorySnapshot;
           console.log("Processing directory snapshot for:", payload.agent_id, payload);
           setSnapshots((prev) => new Map(prev).set(payload.agent_id, payload));
           break;
         }
+        case "agent_directory_delta": {
+          const delta = message.payload as DirectoryDelta;
+          setSnapshots((prev) => {
+            const snapshot = prev.get(delta.agent_id);
+            // A delta applies to the version it was made from; the next full snapshot catches up
+            if (!snapshot || snapshot.version !== delta.base_version) return prev;
+            const removed = new Set(delta.removed ?? []);
+            const changed = new Map(
+              [...(delta.added ?? []), ...(delta.modified ?? [])].map((f) => [f.path, f])
+            );
+            const files = snapshot.directory.files
+              .filter((f) => !removed.has(f.path) && !changed.has(f.path))
+              .concat([...changed.values()]);
+            return new Map(prev).set(delta.agent_id, {
+              ...snapshot,
+              timestamp: delta.timestamp,
+              version: delta.version,
+              directory: {
+                files,
+                total_files: delta.total_files,
+                total_size: delta.total_size,
+              },
+            });
+          });
+          break;
+        }
         case "master_filetransfer_manager": {
           const payload = message.payload as TransferStatusPayload;
           console.log("Processing transfer status:", payload);
@@ -60,7 +60,7 @@ export function useAgent(id: string): {
   // Merge API data with context data, preferring context (which has isOnline status)
   const agent: AgentWithStatus | undefined = agentFromContext || (agentQuery.data ? {
     ...agentQuery.data,
-    isOnline: false,
+    isOnline: agentQuery.data.online ?? false,
     metrics: undefined,
     lastMetricsUpdate: undefined,
   } : undefined);
@@ -84,3 +84,16 @@ export function useHealthCheck() {
     refetchInterval: 10000, // Refetch every 10 seconds
   });
 }
+
+export function useMetricsHistory(id: string, rangeSeconds: number, step: string) {
+  return useQuery({
+    queryKey: ["metrics-history", id, rangeSeconds, step],
+    queryFn: async () => {
+      const from = Math.floor(Date.now() / 1000) - rangeSeconds;
+      const response = await api.getAgentMetricsHistory(id, { from, step });
+      return response.payload?.points || [];
+    },
+    enabled: !!id,
+    refetchInterval: 60000,
+  });
+}
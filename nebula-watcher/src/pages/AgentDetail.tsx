@@ -13,6 +13,7 @@ import {
 } from "lucide-react";
 import { Layout } from "@/components/layout/Layout";
 import { MetricsGauge } from "@/components/agent/MetricsGauge";
+import { MetricsHistoryChart } from "@/components/agent/MetricsHistoryChart";
 import { FileTree } from "@/components/agent/FileTree";
 import { AgentActions } from "@/components/agent/AgentActions";
 import { Button } from "@/components/ui/button";
@@ -34,10 +35,14 @@ export default function AgentDetail() {
     
     setIsRefreshingMetrics(true);
     try {
-      await api.getAgentMetrics(decodedId);
+      const response = await api.getAgentMetrics(decodedId);
+      const age = Math.round(response.payload?.age_seconds ?? 0);
       toast({
-        title: "Metrics Requested",
-        description: "Fresh metrics have been requested from the agent.",
+        title: "Metrics Refreshed",
+        description:
+          response.payload?.source === "cached"
+            ? `The agent did not answer in time, showing its last heartbeat (${age}s old).`
+            : "Fresh metrics received from the agent.",
       });
     } catch (error) {
       toast({
@@ -231,6 +236,9 @@ export default function AgentDetail() {
           )}
         </div>
 
+        {/* Metrics History Section */}
+        <MetricsHistoryChart agentId={decodedId} />
+
         {/* File Browser Section */}
         <FileTree 
           snapshot={snapshot} 
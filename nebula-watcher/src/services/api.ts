@@ -4,8 +4,23 @@ import type {
   AgentListResponse,
   AgentInfoResponse,
   MetricsPayload,
+  MetricsHistoryResponse,
   ActionResponse,
+  AgentInfo,
+  Distribution,
+  DistributionListResponse,
+  DistributionResponse,
+  DirectorySnapshot,
+  FileSearchQuery,
+  FileSearchResponse,
+  FileSystemResponse,
+  PushResponse,
   Message,
+  Transfer,
+  TransferListResponse,
+  SyncConflictWinner,
+  SyncPair,
+  SyncPairListResponse,
 } from "@/types";
 
 class ApiService {
@@ -15,6 +30,10 @@ class ApiService {
     this.baseUrl = env.apiBaseUrl;
   }
 
+  private authHeaders(): Record<string, string> {
+    return env.apiKey ? { Authorization: `Bearer ${env.apiKey}` } : {};
+  }
+
   private async request<T>(
     endpoint: string,
     options: RequestInit = {}
@@ -25,6 +44,7 @@ class ApiService {
       ...options,
       headers: {
         "Content-Type": "application/json",
+        ...this.authHeaders(),
         ...options.headers,
       },
     });
@@ -58,6 +78,36 @@ class ApiService {
     );
   }
 
+  // Get Agent Metrics History (from/to: unix seconds, step: e.g. "1m")
+  async getAgentMetricsHistory(
+    id: string,
+    range: { from: number; to?: number; step?: string }
+  ): Promise<MetricsHistoryResponse> {
+    const params = new URLSearchParams({ from: String(range.from) });
+    if (range.to) params.set("to", String(range.to));
+    if (range.step) params.set("step", range.step);
+    return this.request<MetricsHistoryResponse>(
+      `/api/v1/agents/${encodeURIComponent(id)}/metrics?${params.toString()}`
+    );
+  }
+
+  // Get the master's copy of an agent's shared folder, kept while the agent is offline
+  async getAgentSnapshot(id: string): Promise<{ success: boolean; snapshot: DirectorySnapshot }> {
+    return this.request<{ success: boolean; snapshot: DirectorySnapshot }>(
+      `/api/v1/agents/${encodeURIComponent(id)}/snapshot`
+    );
+  }
+
+  // Search Files across the agents' shared folders
+  async searchFiles(query: FileSearchQuery): Promise<FileSearchResponse> {
+    const params = new URLSearchParams();
+    for (const [key, value] of Object.entries(query)) {
+      if (value === undefined || value === "") continue;
+      params.set(key, Array.isArray(value) ? value.join(",") : String(value));
+    }
+    return this.request<FileSearchResponse>(`/api/v1/files/search?${params.toString()}`);
+  }
+
   // Restart Agent
   async restartAgent(id: string): Promise<ActionResponse> {
     return this.request<ActionResponse>(
@@ -78,15 +128,17 @@ class ApiService {
   async requestFileSystem(
     requestingAgentId: string,
     sourceAgentId: string,
-    path: string
-  ): Promise<ActionResponse> {
+    path: string,
+    delta = false // patch files the requesting agent already has instead of resending them
+  ): Promise<FileSystemResponse> {
     const url = `/api/v1/agents/${encodeURIComponent(requestingAgentId)}/filesystem/${encodeURIComponent(sourceAgentId)}`;
     const response = await fetch(`${this.baseUrl}${url}`, {
       method: "POST",
       headers: {
         "Content-Type": "application/json",
+        ...this.authHeaders(),
       },
-      body: JSON.stringify({ path }),
+      body: JSON.stringify({ path, delta }),
     });
 
     if (!response.ok) {
@@ -95,6 +147,117 @@ class ApiService {
 
     return response.json();
   }
+
+  // Push File/Folder from Agent to other agents (207 when only some transfers started)
+  async pushFileSystem(
+    sourceAgentId: string,
+    path: string,
+    destinations: string[],
+    delta = false
+  ): Promise<PushResponse> {
+    return this.request<PushResponse>(
+      `/api/v1/agents/${encodeURIComponent(sourceAgentId)}/push`,
+      {
+        method: "POST",
+        body: JSON.stringify({ path, destinations, delta }),
+      }
+    );
+  }
+
+  // List Transfers (newest first)
+  async getTransfers(): Promise<TransferListResponse> {
+    return this.request<TransferListResponse>("/api/v1/transfers");
+  }
+
+  // Get Transfer
+  async getTransfer(id: string): Promise<{ success: boolean; transfer: Transfer }> {
+    return this.request<{ success: boolean; transfer: Transfer }>(
+      `/api/v1/transfers/${encodeURIComponent(id)}`
+    );
+  }
+
+  // Cancel Transfer
+  async cancelTransfer(id: string): Promise<{ success: boolean; message: string; transfer?: Transfer }> {
+    return this.request<{ success: boolean; message: string; transfer?: Transfer }>(
+      `/api/v1/transfers/${encodeURIComponent(id)}`,
+      { method: "DELETE" }
+    );
+  }
+
+  // Replace Agent Labels
+  async setAgentLabels(
+    agentId: string,
+    labels: Record<string, string>
+  ): Promise<{ success: boolean; agent: AgentInfo }> {
+    return this.request<{ success: boolean; agent: AgentInfo }>(
+      `/api/v1/agents/${encodeURIComponent(agentId)}/labels`,
+      {
+        method: "PUT",
+        body: JSON.stringify({ labels }),
+      }
+    );
+  }
+
+  // Distribute a path of one agent to a list and/or label selector of agents
+  // (207 when some destinations cannot receive it)
+  async createDistribution(distribution: {
+    source_agent_id: string;
+    path: string;
+    destinations?: string[];
+    selector?: string;
+  }): Promise<DistributionResponse> {
+    return this.request<DistributionResponse>("/api/v1/distributions", {
+      method: "POST",
+      body: JSON.stringify(distribution),
+    });
+  }
+
+  // List Distributions (newest first)
+  async getDistributions(): Promise<DistributionListResponse> {
+    return this.request<DistributionListResponse>("/api/v1/distributions");
+  }
+
+  // Get Distribution
+  async getDistribution(id: string): Promise<{ success: boolean; distribution: Distribution }> {
+    return this.request<{ success: boolean; distribution: Distribution }>(
+      `/api/v1/distributions/${encodeURIComponent(id)}`
+    );
+  }
+
+  // Cancel Distribution
+  async cancelDistribution(id: string): Promise<DistributionResponse> {
+    return this.request<DistributionResponse>(
+      `/api/v1/distributions/${encodeURIComponent(id)}`,
+      { method: "DELETE" }
+    );
+  }
+
+  // List Sync Pairs (newest first)
+  async getSyncPairs(): Promise<SyncPairListResponse> {
+    return this.request<SyncPairListResponse>("/api/v1/sync");
+  }
+
+  // Create Sync Pair
+  async createSyncPair(pair: {
+    agent_a: string;
+    folder_a: string;
+    agent_b: string;
+    folder_b: string;
+    conflict_winner?: SyncConflictWinner;
+  }): Promise<{ success: boolean; pair: SyncPair }> {
+    return this.request<{ success: boolean; pair: SyncPair }>("/api/v1/sync", {
+      method: "POST",
+      body: JSON.stringify(pair),
+    });
+  }
+
+  // Delete Sync Pair
+  async deleteSyncPair(id: string): Promise<{ success: boolean; message: string; pair: SyncPair }> {
+    return this.request<{ success: boolean; message: string; pair: SyncPair }>(
+      `/api/v1/sync/${encodeURIComponent(id)}`,
+      { method: "DELETE" }
+    );
+  }
 }
 
 export const api = new ApiService();
@@ -30,6 +30,10 @@ class SSEService {
       // If no /ws suffix, just append /sse
       sseUrl = sseUrl.endsWith("/") ? sseUrl + "sse" : sseUrl + "/sse";
     }
+    // EventSource cannot send headers, so the API key goes in the query string
+    if (env.apiKey) {
+      sseUrl += `?access_token=${encodeURIComponent(env.apiKey)}`;
+    }
     
     try {
       this.eventSource = new EventSource(sseUrl);
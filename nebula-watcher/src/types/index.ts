@@ -4,6 +4,9 @@
 export interface Message<T = unknown> {
   type: string;
   payload?: T;
+  id?: string;                // set on master→agent commands
+  reply_to?: string;          // command ID an agent_command_result answers
+  sent_at?: number;           // Unix milliseconds
 }
 
 // Agent Information
@@ -12,6 +15,27 @@ export interface AgentInfo {
   agent_name?: string;        // Optional agent name
   agent_os: string;           // "Windows", "Linux", "darwin"
   agent_last_seen: string;    // ISO 8601 timestamp
+  online?: boolean;
+  connected_since?: string;   // ISO 8601, set while online
+  disconnected_since?: string; // ISO 8601, set while offline
+  labels?: Record<string, string>; // PUT /api/v1/agents/:id/labels, matched by distribution selectors
+}
+
+// Presence events (agent_online / agent_offline)
+export type PresenceReason =
+  | "connected"
+  | "timeout"
+  | "close_frame"
+  | "read_error"
+  | "write_error"
+  | "replaced";
+
+export interface PresenceEvent {
+  agent_id: string;
+  agent_name?: string;
+  reason: PresenceReason;
+  agent_last_seen: string;
+  timestamp: string;
 }
 
 export interface AgentListResponse extends Message<AgentInfo[]> {
@@ -37,12 +61,36 @@ export interface MetricsPayload {
   agent_name?: string;        // Agent name from metrics
   host_metrics: HostMetrics;
   timestamp?: number;         // Unix timestamp
+  age_seconds?: number;       // GET /metrics: age of a cached reading
+  source?: "live" | "cached"; // GET /metrics: fresh answer or last heartbeat
 }
 
 export interface MetricsMessage extends Message<MetricsPayload> {
   type: "agent_metrics";
 }
 
+// Metrics History (averaged per step)
+export interface MetricsPoint {
+  timestamp: string;          // ISO 8601 bucket start
+  cpu_usage: number;
+  memory_usage: number;
+  disk_usage: number;
+  uptime: number;
+  samples: number;
+}
+
+export interface MetricsHistory {
+  agent_id: string;
+  from: string;
+  to: string;
+  step_seconds: number;
+  points: MetricsPoint[];
+}
+
+export interface MetricsHistoryResponse extends Message<MetricsHistory> {
+  type: "agent_metrics_history";
+}
+
 // Directory Snapshot
 export interface FileInfo {
   name: string;
@@ -61,6 +109,9 @@ export interface DirectoryInfo {
 export interface DirectorySnapshot {
   agent_id: string;
   timestamp: string;          // ISO 8601 timestamp
+  version: number;
+  part: number;
+  parts: number;
   directory: DirectoryInfo;
 }
 
@@ -68,6 +119,52 @@ export interface DirectorySnapshotMessage extends Message<DirectorySnapshot> {
   type: "agent_directory_snapshot";
 }
 
+// Changes to a snapshot at base_version, published by the master once applied to its copy
+export interface DirectoryDelta {
+  agent_id: string;
+  timestamp: string;
+  version: number;
+  base_version: number;
+  added?: FileInfo[];
+  modified?: FileInfo[];
+  removed?: string[];         // paths
+  total_files: number;
+  total_size: number;
+}
+
+export interface DirectoryDeltaMessage extends Message<DirectoryDelta> {
+  type: "agent_directory_delta";
+}
+
+// File search (GET /api/v1/files/search). source_agent_id and path are what
+// requestFileSystem takes to pull a result, which needs the agent online.
+export interface FileSearchResult extends FileInfo {
+  source_agent_id: string;
+  agent_name?: string;
+  online: boolean;
+  snapshot_at: string;        // when the master last updated its copy of the agent's folder
+}
+
+export interface FileSearchResponse {
+  results: FileSearchResult[];
+  total: number;              // matches, including those past the limit
+  truncated: boolean;
+}
+
+export interface FileSearchQuery {
+  name?: string;              // glob on the entry name, case-insensitive
+  path?: string;              // folder to search under
+  type?: "file" | "directory";
+  min_size?: number;
+  max_size?: number;
+  modified_after?: string;    // RFC 3339 or unix seconds
+  modified_before?: string;
+  agent_id?: string[];
+  selector?: string;          // label selector, e.g. "env=prod"
+  online?: boolean;
+  limit?: number;
+}
+
 // Health Check
 export interface HealthCheck {
   sys_status: string;         // "Healthy"
@@ -91,6 +188,193 @@ export interface TransferStatusPayload {
   status: TransferStatus;
   agent_id: string;
   source_agent_id?: string;
+  connection_id?: string;     // transfer ID
+}
+
+// Transfer Registry (GET /api/v1/transfers, transfer_update)
+export type TransferMode = "p2p" | "relay";
+export type TransferCodec = "none" | "gzip" | "zstd";
+export type TransferEncryption = "none" | "x25519-aes-256-gcm";
+export type TransferState = "pending" | "running" | "completed" | "failed" | "cancelled";
+
+export interface TransferFallback {
+  from: TransferMode;
+  to: TransferMode;
+  reason: string;
+  at: string;                 // ISO 8601 timestamp
+}
+
+export interface TransferResume {
+  offset: number;             // tar bytes the destination already had
+  entries_completed: number;
+  entry?: string;             // tar entry cut off at offset
+  at: string;                 // ISO 8601 timestamp
+}
+
+export interface TransferProgress {
+  bytes_done: number;
+  total_bytes?: number;       // known to the source only
+  chunks: number;
+  rate_bytes_per_sec: number;
+  eta_seconds?: number;
+  updated_at: string;
+}
+
+export interface Transfer {
+  id: string;
+  source_agent_id: string;
+  destination_agent_id: string;
+  path: string;
+  mode: TransferMode;
+  codec: TransferCodec;       // negotiated with both agents when the transfer starts
+  encryption: TransferEncryption; // end-to-end, when both agents support it
+  delta?: boolean;            // only changed blocks of files the destination has are sent
+  push?: boolean;             // started for the source rather than the destination
+  status: TransferState;
+  fallbacks?: TransferFallback[];
+  resumes?: TransferResume[];
+  bytes_transferred: number;
+  chunks: number;             // relayed chunks, 0 for P2P
+  total_bytes?: number;       // estimated by the source before sending
+  rate_bytes_per_sec?: number;
+  eta_seconds?: number;
+  source_progress?: TransferProgress;
+  destination_progress?: TransferProgress;
+  started_at: string;
+  ended_at?: string;
+  failure_reason?: string;
+  corrupt_paths?: string[];   // files that failed verification against the source's manifest
+  sync_pair_id?: string;      // set for the pulls of a sync pair
+  files?: string[];           // the files a sync pull asked for
+  target?: string;            // folder a sync pull extracts into
+}
+
+export interface TransferListResponse {
+  transfers: Transfer[];
+  total: number;
+}
+
+// Push (POST /api/v1/agents/:id/push)
+export interface PushResult {
+  destination_agent_id: string;
+  transfer_id?: string;
+  transfer?: Transfer;
+  error?: string;             // why no transfer started for this destination
+}
+
+export interface PushResponse extends ActionResponse {
+  results?: PushResult[];
+}
+
+// Distributions (GET /api/v1/distributions, distribution_update)
+export type DistributionState = TransferState | "partial";
+
+export interface DistributionTarget {
+  agent_id: string;
+  status: TransferState;
+  progress?: TransferProgress;
+  error?: string;             // why this destination did not receive the path
+  corrupt_paths?: string[];
+  ended_at?: string;
+}
+
+export interface Distribution {
+  id: string;
+  source_agent_id: string;
+  path: string;
+  selector?: string;          // "key=value,...", agents with all of these labels
+  codec: TransferCodec;       // supported by the source and every destination
+  status: DistributionState;
+  destinations: DistributionTarget[];
+  succeeded: number;
+  failed: number;
+  bytes_transferred: number;  // sent once by the source, whatever the number of destinations
+  chunks: number;
+  total_bytes?: number;
+  started_at: string;
+  ended_at?: string;
+  failure_reason?: string;
+}
+
+export interface DistributionListResponse {
+  distributions: Distribution[];
+  total: number;
+}
+
+export interface DistributionResponse extends ActionResponse {
+  distribution?: Distribution;
+}
+
+// Sync Pairs (GET /api/v1/sync, sync_update)
+export type SyncSide = "a" | "b";
+export type SyncConflictWinner = "newest" | SyncSide;
+
+export interface SyncSideState {
+  files: number;
+  bytes: number;
+  pending: number;            // local changes the other agent has not applied yet
+  scanned_at: string;
+  error?: string;
+  reported_at: string;
+}
+
+export interface SyncEndpoint {
+  agent_id: string;
+  folder: string;             // relative to the agent's shared folder
+  online: boolean;
+  state?: SyncSideState;
+}
+
+export interface SyncConflict {
+  path: string;
+  detected_by: SyncSide;
+  local_sha256?: string;      // empty for a deleted file
+  remote_sha256?: string;
+  winner: SyncSide;
+  at: string;
+}
+
+export interface SyncPair {
+  id: string;
+  a: SyncEndpoint;
+  b: SyncEndpoint;
+  conflict_winner: SyncConflictWinner;
+  status: "active" | "waiting";
+  conflicts?: SyncConflict[]; // most recent last
+  created_at: string;
+}
+
+export interface SyncPairListResponse {
+  pairs: SyncPair[];
+  total: number;
+}
+
+export interface FileSystemResponse extends ActionResponse {
+  transfer_id?: string;
+  transfer?: Transfer;
+}
+
+// Command Acknowledgements
+export type CommandStatus =
+  | "queued"
+  | "pending"
+  | "accepted"
+  | "ok"
+  | "error"
+  | "timed_out"
+  | "expired"
+  | "cancelled";
+
+export interface Command {
+  id: string;
+  agent_id: string;
+  type: string;
+  status: CommandStatus;
+  error?: string;
+  queued_at?: string;         // set when the agent was offline
+  sent_at: string;            // ISO 8601 timestamp
+  deadline: string;
+  answered_at?: string;
 }
 
 // WebSocket Message Types
@@ -98,10 +382,17 @@ export type WebSocketMessageType =
   | "ping" 
   | "pong" 
   | "agent_metrics" 
+  | "agent_metrics_response"
   | "agent_directory_snapshot"
   | "agent_list"
   | "agent_disconnected"
+  | "agent_online"
+  | "agent_offline"
   | "health_check"
+  | "transfer_update"
+  | "transfer_progress"
+  | "sync_update"
+  | "distribution_update"
   | "master_filetransfer_manager";
 
 export interface WebSocketMessage {
@@ -133,6 +424,7 @@ export interface AgentWithStatus extends AgentInfo {
 // Environment config
 export interface EnvConfig {
   apiBaseUrl: string;
+  apiKey: string;
   wsUrl: string;
   wsRole: string;
   wsPingInterval: number;